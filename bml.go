@@ -3,12 +3,25 @@
 package bml
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 // Node represents a BML node with a name, value, and children.
@@ -16,708 +29,5232 @@ type Node struct {
 	Name     string
 	Value    string
 	Children []*Node
+
+	// LeadingComments holds the full-line comments directly preceding the
+	// node, without their "//" markers. Populated when parsing with
+	// ParseOptions.PreserveComments and written back by Serialize.
+	LeadingComments []string
+
+	// InlineComment holds the comment at the end of the node's line, without
+	// its "//" marker.
+	InlineComment string
+
+	// TrailingComments holds the full-line comments that follow the node's
+	// children and are indented deeper than the next line, such as a comment
+	// closing a section. Serialize writes them after the children at child
+	// indentation. Those of a document's Root are its footer, written at the
+	// top level after the last node.
+	TrailingComments []string
+
+	// Heredoc holds the delimiter of a value written in heredoc form, as
+	// parsed with ParseOptions.Heredoc. When set, Serialize writes the value
+	// as a heredoc block unless a line of the value equals the delimiter.
+	Heredoc string
+
+	// HasValue reports that the node was written with a value, even an empty
+	// one, as in "Name:" or "Name=". It is set by the parser and by Set, and
+	// makes Serialize write an empty value as "Name:" rather than "Name".
+	HasValue bool
+
+	// IsAttr reports that the node was written as an inline attribute on its
+	// parent's line, such as b in "a b=1". Serialize writes attribute
+	// children back inline when their values allow it.
+	IsAttr bool
+
+	// Meta holds arbitrary caller annotations, such as the source file or a
+	// validation status. It is never serialized or marshaled and is ignored
+	// by Equal (but not by reflect.DeepEqual).
+	Meta map[string]interface{}
+
+	// Raw holds the source line the node was parsed from, and RawLines the
+	// lines of a multiline value that follow it: continuation lines or a
+	// heredoc block with its closing delimiter. Both are populated when
+	// parsing with ParseOptions.KeepRaw, and SerializeOptions.PreferRaw
+	// writes them back verbatim while the node is unchanged.
+	Raw      string
+	RawLines []string
+
+	raw *rawSource // the node as parsed, for PreferRaw
+
+	numericBool bool // Bool accepts "1" and "0", from ParseOptions.NumericBools
+
+	spacing map[string]string // text after "//" of parsed comments not written as "// text", by comment
+
+	blankRow bool // an empty heredoc value was written as a single blank line
+}
+
+// rawSource records a node parsed with ParseOptions.KeepRaw, so
+// SerializeOptions.PreferRaw can tell whether it has changed since.
+type rawSource struct {
+	level int   // nesting level, 1 at the top
+	heads int   // number of children parsed from the node's own line
+	node  *Node // the node and its first heads children at the end of the parse
 }
 
 // Document represents a parsed BML document.
+//
+// A document may also hold a value of its own, with no node name, in
+// Root.Value. SerializeOptions.RootValue writes it first as ":" continuation
+// lines at the top level, which parse back with ParseOptions.RootValue:
+//
+//	: the whole file is one setting
 type Document struct {
 	Root *Node // Anonymous root containing top-level nodes
 }
 
-// Parse parses BML data and returns a Document.
-func Parse(data []byte) (*Document, error) {
-	lines := normalizeLines(string(data))
-	if len(lines) == 0 {
-		return &Document{Root: &Node{}}, nil
-	}
+// IndentStyle selects which characters may be used for indentation.
+type IndentStyle int
 
-	root := &Node{}
-	index := 0
+const (
+	// IndentAny allows any mix of spaces and tabs.
+	IndentAny IndentStyle = iota
+	// IndentSpaces requires indentation to consist only of spaces.
+	IndentSpaces
+	// IndentTabs requires indentation to consist only of tabs.
+	IndentTabs
+)
 
-	for index < len(lines) {
-		node, err := parseNode(lines, &index, -1)
-		if err != nil {
-			return nil, err
-		}
-		root.Children = append(root.Children, node)
-	}
+// ParseOptions configures ParseWithOptions. The zero value matches Parse.
+type ParseOptions struct {
+	// MaxNodes limits the number of nodes (including attributes) in the
+	// document. Zero means unlimited.
+	MaxNodes int
 
-	return &Document{Root: root}, nil
+	// MaxLineLength limits the length of a single line in bytes. Zero means
+	// unlimited.
+	MaxLineLength int
+
+	// IndentStyle restricts the characters allowed in a line's indentation.
+	// The default, IndentAny, accepts both spaces and tabs.
+	IndentStyle IndentStyle
+
+	// RawText lists node names whose deeper-indented lines are captured
+	// verbatim as the node's value when the node has no value of its own,
+	// including blank lines, lines that look like children, and comments.
+	// Only ":" continuation lines are still read as such, so serialized
+	// values read back unchanged. Indentation up to the first text line is
+	// removed, and blank lines at the end of the block are not part of it.
+	RawText []string
+
+	// QuotedAttributeNames allows attribute names to be written in double
+	// quotes, such as "some name"=value. The quotes are removed and the name
+	// is trimmed of surrounding whitespace.
+	QuotedAttributeNames bool
+
+	// PreserveComments records comments on the parsed nodes so Serialize can
+	// write them back: full-line comments become the LeadingComments of the
+	// node that follows them and end-of-line comments become InlineComment.
+	// A full-line comment indented deeper than the line after it instead
+	// closes the innermost node indented less than the comment and is added
+	// to its TrailingComments. Comments before the first node that are
+	// separated from it by a blank line, such as a header banner, and all
+	// comments of a file without nodes become the LeadingComments of the
+	// document's Root. Comments at the end of the file that do not close a
+	// node, from the first one at the top level on, become the Root's
+	// TrailingComments, a footer written after the last node. Comments that
+	// precede a multiline continuation line are discarded.
+	PreserveComments bool
+
+	// AppendOperator enables "name += text" lines, which append text on a new
+	// line to the value of the preceding sibling with the same name. It is an
+	// error if no such sibling exists. Under KeepRaw, a line directly after
+	// the sibling's own lines joins its Node.RawLines, while any other leaves
+	// the sibling to be reformatted by SerializeOptions.PreferRaw.
+	AppendOperator bool
+
+	// NumericBools makes Node.Bool and Node.BoolE accept "1" and "0" as true
+	// and false for the parsed nodes and their clones. Nodes added later,
+	// such as by Set, accept only "true" and "false".
+	NumericBools bool
+
+	// StrictIndent rejects lines whose indentation mixes tabs and spaces in a
+	// way that makes parentage ambiguous: the indentation of a line and of each
+	// enclosing or preceding line it is compared against must be a prefix of
+	// one another. A tab under two spaces, for example, is an error rather
+	// than a sibling of the spaced line. A line that dedents must also return
+	// to the depth of an enclosing line, as in Python.
+	StrictIndent bool
+
+	// Heredoc enables block values written as "Name: <<END" followed by
+	// verbatim lines up to a line containing only the delimiter, here END.
+	// The delimiter is chosen per node. The lines between the delimiters,
+	// including blank lines and indentation, become the node's value and the
+	// delimiter is recorded in Node.Heredoc.
+	Heredoc bool
+
+	// Warnings, if set, is called for each recoverable oddity found while
+	// parsing. Warnings do not stop the parse; those reported before a parse
+	// error are still delivered.
+	Warnings func(Warning)
+
+	// Includes makes ParseFileWithOptions replace each Include node, at any
+	// depth, with the top-level nodes of the file its value names. Relative
+	// paths are resolved against the directory of the including file and
+	// included files may include others; a cycle is an error. Parse and
+	// ParseWithOptions have no file path and leave Include nodes as they are.
+	Includes bool
+
+	// DetectUTF16 decodes UTF-16 input to UTF-8 before parsing. Input is
+	// treated as UTF-16 when it starts with a UTF-16 byte order mark or, for
+	// files saved without one, when NUL bytes fill at least half of the
+	// high-order byte positions as they do in mostly-ASCII text. Other input
+	// is parsed as UTF-8. Unpaired surrogates and a trailing odd byte
+	// decode to U+FFFD.
+	DetectUTF16 bool
+
+	// NextLineValues lists node names whose value may be written on the
+	// following line, indented and without a ":" prefix:
+	//
+	//	Name
+	//	  value
+	//
+	// A bare indented line is otherwise a valueless child, so the two forms
+	// are ambiguous. The line is taken as the value only when the node has
+	// no value of its own and it is the one line indented beneath the node,
+	// and only if it does not look like a "name:" or "name=" child or a ":"
+	// continuation. A listed node with more than one deeper line has
+	// children as usual. Serialize writes the value in the standard form.
+	NextLineValues []string
+
+	// RootValue accepts ":" lines at the top level as continuation lines of
+	// the document's own value, stored in Root.Value, for files that hold a
+	// single value with no node name. Without it they are an error. A bare
+	// top-level line such as "Metal" is a node name either way.
+	RootValue bool
+
+	// EscapedNames allows node and attribute names to contain ":" and "=",
+	// escaped with a backslash: "Port\:1: Gamepad" is the node "Port:1"
+	// with the value "Gamepad". Serialize always writes these characters
+	// escaped, as other names cannot contain them.
+	EscapedNames bool
+
+	// Flow allows the children of a node to be written on its line between
+	// braces: "Resolution { Width=640 Height=480 }" is the node Resolution
+	// with the children Width and Height. Each child is a name with an
+	// optional "=value", followed by braces holding its own children, and
+	// children and braces are separated by spaces. An unclosed brace is an
+	// error.
+	Flow bool
+
+	// SiblingContinuation reads a ":" line at the same indentation as the
+	// node before it as a continuation of that node's value, as some
+	// emitters write multiline values:
+	//
+	//	Desc: Line1
+	//	: Line2
+	//
+	// A ":" line with no node before it at its indentation continues the
+	// parent's value as usual, and at the top level is an error unless
+	// RootValue is set.
+	SiblingContinuation bool
+
+	// Anchors allows a node to be reused elsewhere, YAML-style. A name
+	// prefixed with "&" before a node, as in "&Base Path: /games", defines
+	// the anchor Base for that node and its children, and a line holding
+	// "*Base" is replaced with a copy of it. Lines indented beneath a
+	// reference add children to the copy. A reference must follow the end
+	// of its anchor's node: an undefined anchor is an error, as is a
+	// reference within the node it names. A later definition of an anchor
+	// replaces the earlier one. Copies count toward MaxNodes, and even when
+	// MaxNodes is zero references may copy at most 1,000,000 nodes in total,
+	// so that anchors referencing each other cannot expand without bound.
+	// Serialize writes the copies out in full, without anchors.
+	Anchors bool
+
+	// KeepRaw records the source text of each node in Node.Raw and
+	// Node.RawLines, for SerializeOptions.PreferRaw. Nodes copied by Anchors
+	// have no source text.
+	KeepRaw bool
+
+	// BlockComments allows C-style "/* ... */" comments, which may span
+	// lines, in addition to "//" comments. "/*" inside a double-quoted
+	// value or after "//" does not start one, and a "/*" inside a block
+	// comment is an error, as is a block comment left open. With
+	// PreserveComments, each line holding only a block comment becomes a
+	// full-line comment, while a block comment sharing a line with a node is
+	// discarded with a warning.
+	BlockComments bool
+
+	// NormalizeNames, if set, is applied to every node and attribute name
+	// as it is read, such as strings.ToLower for case-insensitive lookups.
+	// Options that list names, such as RawText, are matched against the
+	// normalized names, and Includes looks for nodes named by the
+	// normalized form of "Include", so any spelling it maps there works.
+	NormalizeNames func(string) string
 }
 
-// normalizeLines converts the input into a slice of non-empty, non-comment lines.
-func normalizeLines(input string) []string {
-	// Normalize line endings
-	input = strings.ReplaceAll(input, "\r\n", "\n")
-	input = strings.ReplaceAll(input, "\r", "\n")
+// WarningCategory classifies a Warning.
+type WarningCategory int
 
-	rawLines := strings.Split(input, "\n")
-	var lines []string
+const (
+	// WarnDuplicateName reports a node with the same name as an earlier
+	// sibling.
+	WarnDuplicateName WarningCategory = iota + 1
+	// WarnDroppedComment reports a comment that PreserveComments could not
+	// attach to a node and discarded.
+	WarnDroppedComment
+	// WarnMixedIndent reports indentation that mixes tabs and spaces.
+	WarnMixedIndent
+)
 
-	for _, line := range rawLines {
-		// Skip empty lines (but preserve lines that are only whitespace for indentation tracking)
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" {
-			continue
-		}
+// Warning describes a recoverable issue found while parsing.
+type Warning struct {
+	Line     int // 1-based line number
+	Category WarningCategory
+	Message  string
+}
 
-		// Skip comment lines
-		depth := readDepth(line)
-		rest := line[depth:]
-		if strings.HasPrefix(rest, "//") {
-			continue
-		}
+// line is a significant (non-empty, non-comment) line of input.
+type line struct {
+	text     string
+	num      int       // 1-based line number in the input
+	comments []comment // preceding comments, when preserving comments
+	delim    string    // heredoc delimiter, when the line opens a heredoc
+	block    string    // heredoc contents
+	blankRow bool      // the heredoc block is a single blank line
+	rawBlock []string  // heredoc or RawText lines, with KeepRaw
+	rawText  bool      // the line heads a RawText block held in block
+	blank    bool      // a blank line between continuation lines, read as ":"
+}
 
-		lines = append(lines, line)
-	}
+// comment is a preserved full-line comment waiting to be attached to a node.
+type comment struct {
+	text  string
+	raw   string // the text after "//" when it is not " "+text
+	depth int    // indentation of the comment line
+	num   int    // 1-based line number in the input
+}
 
-	return lines
+// parser holds the state of a single parse.
+type parser struct {
+	opts  ParseOptions
+	lines []line
+	index int
+	level int // nesting level of the node being parsed, 1 at the top
+	stats Stats
+	tail  []comment      // comments after the last line
+	head  []comment      // document comments, before a blank line ahead of the first line
+	spans map[*Node]span // input lines of each node, when recorded
+
+	// values holds the byte range on its line of the value text of each node
+	// and attribute, from its ":" or "=" separator, when spans are recorded
+	values map[*Node][2]int
+	parts  []string // lines of the multiline values being parsed
+
+	anchors map[string]*Node // anchored nodes, by anchor name
+	open    map[string]bool  // anchors whose nodes are being parsed
+	copies  int              // nodes copied by references
 }
 
-// readDepth counts the leading whitespace characters (tabs or spaces).
-func readDepth(line string) int {
-	depth := 0
-	for _, c := range line {
-		if c == '\t' || c == ' ' {
-			depth++
-		} else {
-			break
-		}
-	}
-	return depth
+// span is the range of input lines, 1-based and inclusive, that a node and
+// its descendants were parsed from.
+type span struct {
+	start, end int
 }
 
-// isValidNameChar returns true if c is a valid BML name character (A-Z, a-z, 0-9, -, .)
-func isValidNameChar(c byte) bool {
-	return (c >= 'A' && c <= 'Z') ||
-		(c >= 'a' && c <= 'z') ||
-		(c >= '0' && c <= '9') ||
-		c == '-' || c == '.'
+// Stats summarizes a parse.
+type Stats struct {
+	// Nodes is the number of nodes, including attributes.
+	Nodes int
+
+	// MaxDepth is the deepest nesting level reached: 1 for top-level nodes,
+	// 2 for their children and attributes, and so on. It is 0 for an empty
+	// document.
+	MaxDepth int
+
+	// Lines is the number of lines in the input.
+	Lines int
+
+	// BlankLines is the number of empty or whitespace-only lines, not
+	// counting lines inside heredoc blocks.
+	BlankLines int
+
+	// Comments is the number of full-line and end-of-line comments.
+	Comments int
+
+	// DroppedComments is the number of comments not kept on the document:
+	// all of them unless ParseOptions.PreserveComments is set, otherwise
+	// those PreserveComments discards.
+	DroppedComments int
 }
 
-// parseNode parses a single node and its children from the lines.
-func parseNode(lines []string, index *int, parentDepth int) (*Node, error) {
-	if *index >= len(lines) {
-		return nil, errors.New("unexpected end of input")
-	}
+// Parse parses BML data and returns a Document.
+// Parse never panics: malformed input always results in an error.
+func Parse(data []byte) (*Document, error) {
+	return ParseWithOptions(data, ParseOptions{})
+}
 
-	line := lines[*index]
-	*index++
+// ParseWithOptions parses BML data using the given options and returns a Document.
+func ParseWithOptions(data []byte, opts ParseOptions) (*Document, error) {
+	doc, _, err := parse(data, opts)
+	return doc, err
+}
 
-	depth := readDepth(line)
-	if depth <= parentDepth && parentDepth >= 0 {
-		return nil, fmt.Errorf("invalid indentation at line: %s", line)
-	}
+// ParseWithStats is like Parse but also returns statistics gathered while
+// parsing.
+func ParseWithStats(data []byte) (*Document, Stats, error) {
+	return parse(data, ParseOptions{})
+}
 
-	pos := depth
-	node := &Node{}
+// ParseWithOptionsStats is like ParseWithOptions but also returns statistics
+// gathered while parsing, such as the comments PreserveComments discarded.
+func ParseWithOptionsStats(data []byte, opts ParseOptions) (*Document, Stats, error) {
+	return parse(data, opts)
+}
 
-	// Parse name
-	nameStart := pos
-	for pos < len(line) && isValidNameChar(line[pos]) {
-		pos++
-	}
-	if pos == nameStart {
-		return nil, fmt.Errorf("invalid node name at line: %s", line)
+// parse parses data with the given options and returns the document with
+// the parse statistics.
+func parse(data []byte, opts ParseOptions) (*Document, Stats, error) {
+	p := &parser{opts: opts}
+	doc, err := p.parse(data)
+	if err != nil {
+		return nil, Stats{}, err
 	}
-	node.Name = line[nameStart:pos]
+	return doc, p.stats, nil
+}
 
-	// Parse value
-	if pos < len(line) {
-		value, newPos, err := parseValue(line, pos)
-		if err != nil {
-			return nil, err
-		}
-		node.Value = value
-		pos = newPos
-	}
+// Parser parses documents with a fixed set of options, reusing its buffers
+// from one parse to the next to reduce allocations when parsing many small
+// documents. A Parser may be reused for any number of sequential parses but
+// is not safe for concurrent use.
+type Parser struct {
+	p parser
+}
 
-	// Parse attributes (space-separated key-value pairs on the same line)
-	for pos < len(line) {
-		// Skip spaces
-		for pos < len(line) && line[pos] == ' ' {
-			pos++
-		}
-		if pos >= len(line) {
-			break
-		}
+// NewParser returns a Parser that parses with the given options.
+func NewParser(opts ParseOptions) *Parser {
+	return &Parser{p: parser{opts: opts}}
+}
 
-		// Check for inline comment
-		if pos+1 < len(line) && line[pos:pos+2] == "//" {
-			break
-		}
+// Parse parses BML data and returns a Document, as ParseWithOptions does.
+// The document does not share memory with the Parser, so it remains valid
+// after later calls.
+func (ps *Parser) Parse(data []byte) (*Document, error) {
+	p := &ps.p
+	doc, err := p.parse(data)
 
-		// Parse attribute name
-		attrStart := pos
-		for pos < len(line) && isValidNameChar(line[pos]) {
-			pos++
-		}
-		if pos == attrStart {
-			break
-		}
-		attrName := line[attrStart:pos]
+	// Reset the state, dropping references to this input so the buffers
+	// do not keep it alive
+	clear(p.lines)
+	clear(p.parts[:cap(p.parts)])
+	clear(p.anchors)
+	clear(p.open)
+	*p = parser{opts: p.opts, lines: p.lines[:0], parts: p.parts[:0], anchors: p.anchors, open: p.open}
 
-		// Parse attribute value
-		attrValue := ""
-		if pos < len(line) {
-			var err error
-			attrValue, pos, err = parseValue(line, pos)
-			if err != nil {
-				return nil, err
-			}
-		}
+	if err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
 
-		node.Children = append(node.Children, &Node{Name: attrName, Value: attrValue})
+// parse parses data into a document, recording its statistics in p.stats.
+// The lines and parts buffers and anchor maps of p are reused if present.
+func (p *parser) parse(data []byte) (*Document, error) {
+	if p.opts.DetectUTF16 {
+		data = decodeUTF16(data)
+	}
+	if p.opts.Anchors && p.anchors == nil {
+		p.anchors, p.open = make(map[string]*Node), make(map[string]bool)
 	}
 
-	// Parse child nodes based on indentation
-	for *index < len(lines) {
-		childDepth := readDepth(lines[*index])
-		if childDepth <= depth {
-			break
-		}
+	lines, err := p.normalizeLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	p.lines = lines
 
-		// Check for multiline value continuation (line starting with : at deeper depth)
-		rest := strings.TrimLeft(lines[*index], " \t")
-		if strings.HasPrefix(rest, ":") {
-			// Multiline value continuation
-			continuation := strings.TrimPrefix(rest, ":")
-			continuation = strings.TrimPrefix(continuation, " ") // Trim one leading space if present
-			if node.Value != "" {
-				node.Value += "\n"
+	// Top-level nodes are the children of the root, and top-level ":" lines
+	// continue its value if ParseOptions.RootValue is set
+	root := &Node{}
+	root.LeadingComments = root.keepComments(p.head)
+	if err := p.parseChildren(root, -1); err != nil {
+		return nil, err
+	}
+
+	doc := &Document{Root: root}
+	if p.opts.KeepRaw || p.opts.NumericBools {
+		doc.Walk(func(_ string, n *Node) bool {
+			if n.raw != nil {
+				n.raw.record(n)
 			}
-			node.Value += continuation
-			*index++
-			continue
-		}
+			n.numericBool = p.opts.NumericBools
+			return true
+		})
+	}
+	return doc, nil
+}
 
-		child, err := parseNode(lines, index, depth)
-		if err != nil {
-			return nil, err
+// decodeUTF16 converts UTF-16 data to UTF-8, as described by
+// ParseOptions.DetectUTF16. Data that is not UTF-16 is returned unchanged.
+func decodeUTF16(data []byte) []byte {
+	var order binary.ByteOrder
+	switch {
+	case len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe:
+		order, data = binary.LittleEndian, data[2:]
+	case len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff:
+		order, data = binary.BigEndian, data[2:]
+	default:
+		if order = guessUTF16(data); order == nil {
+			return data
 		}
-		node.Children = append(node.Children, child)
 	}
 
-	return node, nil
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	runes := utf16.Decode(units)
+	if len(data)%2 != 0 {
+		// A truncated final code unit decodes like an unpaired surrogate
+		runes = append(runes, utf8.RuneError)
+	}
+	return []byte(string(runes))
 }
 
-// parseValue parses a value starting at pos in line. Returns the value, new position, and any error.
-func parseValue(line string, pos int) (string, int, error) {
-	if pos >= len(line) {
-		return "", pos, nil
+// guessUTF16 returns the byte order of BOM-less UTF-16 data by looking for
+// NUL high-order bytes, or nil if the data does not look like UTF-16.
+func guessUTF16(data []byte) binary.ByteOrder {
+	if len(data) < 2 || len(data)%2 != 0 {
+		return nil
 	}
 
-	switch line[pos] {
-	case ':':
-		// Colon format: Name: value
-		pos++
-		// Skip one leading space if present
-		if pos < len(line) && line[pos] == ' ' {
-			pos++
+	var even, odd int
+	for i := 0; i < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
 		}
-		// Value extends to end of line (or until inline comment)
-		end := pos
-		for end < len(line) {
-			if end+1 < len(line) && line[end:end+2] == "//" {
-				break
-			}
-			end++
+		if data[i+1] == 0 {
+			odd++
 		}
-		value := strings.TrimRight(line[pos:end], " ")
-		return value, end, nil
+	}
 
-	case '=':
-		pos++
-		if pos >= len(line) {
-			return "", pos, nil
-		}
+	units := len(data) / 2
+	switch {
+	case odd*2 >= units && even*2 < units:
+		return binary.LittleEndian
+	case even*2 >= units && odd*2 < units:
+		return binary.BigEndian
+	}
+	return nil
+}
 
-		if line[pos] == '"' {
-			// Quoted format: Name="value"
-			pos++
-			end := pos
-			for end < len(line) && line[end] != '"' {
-				end++
-			}
-			if end >= len(line) {
-				return "", pos, fmt.Errorf("unclosed quote in line: %s", line)
-			}
-			value := line[pos:end]
-			return value, end + 1, nil
-		}
+// ParseFile reads and parses the BML file at path.
+func ParseFile(path string) (*Document, error) {
+	return ParseFileWithOptions(path, ParseOptions{})
+}
 
-		// Unquoted format: Name=value (no spaces allowed)
-		end := pos
-		for end < len(line) && line[end] != ' ' && line[end] != '"' {
-			end++
-		}
-		value := line[pos:end]
-		return value, end, nil
+// ParseFileWithOptions is like ParseFile but uses the given options. Errors
+// are prefixed with the path of the file they occurred in.
+func ParseFileWithOptions(path string, opts ParseOptions) (*Document, error) {
+	return parseFile(path, opts, nil)
+}
 
-	default:
-		return "", pos, nil
+// parseFile parses the file at path. stack holds the cleaned paths of the
+// files currently being included, outermost first.
+func parseFile(path string, opts ParseOptions, stack []string) (*Document, error) {
+	path = filepath.Clean(path)
+	for _, open := range stack {
+		if open == path {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(append(stack, path), " -> "))
+		}
 	}
-}
 
-// Get retrieves a child node by path (e.g., "Video/Driver").
-// Returns nil if the path doesn't exist.
-func (n *Node) Get(path string) *Node {
-	if n == nil {
-		return nil
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := ParseWithOptions(data, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
 	}
 
-	parts := strings.Split(path, "/")
-	current := n
+	if opts.Includes {
+		if err := resolveIncludes(doc.Root, filepath.Dir(path), opts, append(stack, path)); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
 
-	for _, part := range parts {
-		if part == "" {
+// resolveIncludes replaces the Include nodes beneath n with the contents of
+// the files they name, resolved relative to dir.
+func resolveIncludes(n *Node, dir string, opts ParseOptions, stack []string) error {
+	include := "Include"
+	if opts.NormalizeNames != nil {
+		include = opts.NormalizeNames(include)
+	}
+	children := make([]*Node, 0, len(n.Children))
+	for _, child := range n.Children {
+		if child.Name != include || child.IsAttr {
+			if err := resolveIncludes(child, dir, opts, stack); err != nil {
+				return err
+			}
+			children = append(children, child)
 			continue
 		}
 
-		found := false
-		for _, child := range current.Children {
-			if child.Name == part {
-				current = child
-				found = true
-				break
-			}
+		target := strings.TrimSpace(child.Value)
+		if target == "" {
+			return fmt.Errorf("%s: Include without a file path", stack[len(stack)-1])
 		}
-		if !found {
-			return nil
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		included, err := parseFile(target, opts, stack)
+		if err != nil {
+			return err
 		}
+		children = append(children, included.Root.Children...)
 	}
+	n.Children = children
+	return nil
+}
 
-	return current
+// ReadFile reads and parses the BML file at path. It is ParseFile, named to
+// pair with WriteFile.
+func ReadFile(path string) (*Document, error) {
+	return ParseFile(path)
 }
 
-// String returns the node's value as a string, or the fallback if the node is nil.
-func (n *Node) String(fallback string) string {
-	if n == nil {
-		return fallback
+// WriteFile serializes doc to the file at path, creating it with perm if
+// needed. The output is written to a temporary file in the same directory and
+// renamed over path, so a failed write leaves any existing file intact. The
+// directory is then synced so the rename survives a crash, where the platform
+// allows it.
+func WriteFile(path string, doc *Document, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
 	}
-	return strings.TrimSpace(n.Value)
-}
+	tmp := f.Name()
 
-// Bool returns the node's value as a boolean, or the fallback if the node is nil or not a valid bool.
-func (n *Node) Bool(fallback bool) bool {
-	if n == nil {
-		return fallback
+	_, err = f.Write(Serialize(doc))
+	if err == nil {
+		err = f.Sync()
 	}
-	v := strings.TrimSpace(n.Value)
-	if v == "true" {
-		return true
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	if v == "false" {
-		return false
+	if err == nil {
+		err = os.Chmod(tmp, perm)
 	}
-	return fallback
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Some platforms cannot sync a directory, so this is best effort
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
-// Int returns the node's value as an integer, or the fallback if the node is nil or not a valid int.
-func (n *Node) Int(fallback int) int {
-	if n == nil {
-		return fallback
+// ParseReader reads all of r and parses it as BML. Gzip-compressed input is
+// recognized by its magic header and decompressed transparently.
+func ParseReader(r io.Reader) (*Document, error) {
+	br := bufio.NewReader(r)
+
+	var src io.Reader = br
+	if header, err := br.Peek(2); err == nil && header[0] == 0x1f && header[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		src = gz
 	}
-	v := strings.TrimSpace(n.Value)
-	i, err := strconv.Atoi(v)
+
+	data, err := io.ReadAll(src)
 	if err != nil {
-		return fallback
+		return nil, err
 	}
-	return i
+	return Parse(data)
 }
 
-// Float returns the node's value as a float64, or the fallback if the node is nil or not a valid float.
-func (n *Node) Float(fallback float64) float64 {
-	if n == nil {
-		return fallback
+// Scanner reads top-level nodes from a stream one at a time. Each call to
+// Scan reads just enough input to build the next top-level node with all of
+// its descendants:
+//
+//	s := bml.NewScanner(r)
+//	for s.Scan() {
+//		node := s.Node()
+//	}
+//	if err := s.Err(); err != nil {
+//		// handle error
+//	}
+type Scanner struct {
+	lines   *bufio.Scanner
+	pending []string // lines read ahead that begin the next node
+	node    *Node
+	err     error
+}
+
+// NewScanner returns a Scanner that reads from r.
+func NewScanner(r io.Reader) *Scanner {
+	lines := bufio.NewScanner(r)
+	lines.Buffer(nil, math.MaxInt32)
+	lines.Split(scanLines)
+	return &Scanner{lines: lines}
+}
+
+// Scan advances to the next top-level node, which is then available through
+// Node. It returns false at the end of the input or on an error.
+func (s *Scanner) Scan() bool {
+	s.node = nil
+	if s.err != nil {
+		return false
 	}
-	v := strings.TrimSpace(n.Value)
-	f, err := strconv.ParseFloat(v, 64)
+
+	// A top-level node spans its first line and every following line that
+	// is indented deeper. Blank and comment lines are held until the next
+	// significant line shows which node they belong to.
+	chunk, depth := s.pending, -1
+	if len(chunk) > 0 {
+		depth = readDepth(chunk[len(chunk)-1])
+	}
+	s.pending = nil
+
+	var held []string
+	for s.lines.Scan() {
+		text := s.lines.Text()
+		d := readDepth(text)
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text[d:], "//") {
+			held = append(held, text)
+			continue
+		}
+		if depth >= 0 && d <= depth {
+			s.pending = append(held, text)
+			return s.emit(chunk)
+		}
+		if depth < 0 {
+			depth = d
+		}
+		chunk = append(chunk, held...)
+		chunk = append(chunk, text)
+		held = nil
+	}
+	if err := s.lines.Err(); err != nil {
+		s.err = err
+		return false
+	}
+
+	if depth < 0 {
+		return false
+	}
+	return s.emit(chunk)
+}
+
+// emit parses the lines of a single top-level node and makes it current.
+func (s *Scanner) emit(chunk []string) bool {
+	doc, err := Parse([]byte(strings.Join(chunk, "\n")))
 	if err != nil {
-		return fallback
+		s.err = err
+		return false
 	}
-	return f
+	s.node = doc.Root.Children[0]
+	return true
 }
 
-// Set sets or creates a node at the given path with the given value.
-// Creates intermediate nodes as needed. Returns the node that was set.
-func (n *Node) Set(path string, value string) *Node {
-	if n == nil {
-		return nil
+// Node returns the top-level node read by the most recent call to Scan.
+func (s *Scanner) Node() *Node {
+	return s.node
+}
+
+// Err returns the first error encountered by the Scanner.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// scanLines is a bufio.SplitFunc that recognizes "\n", "\r\n", and "\r" line endings.
+func scanLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		switch {
+		case data[i] == '\n':
+			return i + 1, data[:i], nil
+		case i+1 < len(data) && data[i+1] == '\n':
+			return i + 2, data[:i], nil
+		case i+1 < len(data) || atEOF:
+			return i + 1, data[:i], nil
+		}
+		// A trailing "\r" may be followed by "\n"; request more data
+		return 0, nil, nil
 	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
 
-	parts := strings.Split(path, "/")
-	current := n
+// normalizeLines converts the input into a slice of non-empty, non-comment lines.
+// Blank lines between two continuation lines at the same indentation are
+// kept as empty continuation lines, so a multiline value can contain them.
+func (p *parser) normalizeLines(input string) ([]line, error) {
+	// Size the result for the common case of one node per line, reusing
+	// the buffer of an earlier parse if it is large enough
+	lines := p.lines[:0]
+	if n := strings.Count(input, "\n") + 1; cap(lines) < n {
+		lines = make([]line, 0, n)
+	}
+	var comments []comment
+	var open []openLine
+	var block []string
+	heredocStart := 0
+	rawDepth := -1   // indentation of the node of an open RawText block
+	blockStart := 0  // line of an open block comment
+	var blanks []int // blank lines since the last line, by number
 
-	for i, part := range parts {
-		if part == "" {
+	// Scan the input by index, treating "\r\n", "\r", and "\n" as line
+	// endings, rather than splitting it into an intermediate slice of lines
+	for i, start := 0, 0; start < len(input); i++ {
+		p.stats.Lines++
+		text := input[start:]
+		if end := strings.IndexAny(text, "\r\n"); end >= 0 {
+			text = text[:end]
+			start += end + 1
+			if input[start-1] == '\r' && start < len(input) && input[start] == '\n' {
+				start++
+			}
+		} else {
+			start = len(input) + 1
+		}
+
+		if p.opts.MaxLineLength > 0 && len(text) > p.opts.MaxLineLength {
+			return nil, fmt.Errorf("line %d exceeds maximum length of %d bytes", i+1, p.opts.MaxLineLength)
+		}
+
+		// Collect heredoc lines verbatim until the closing delimiter
+		if heredocStart > 0 {
+			last := &lines[len(lines)-1]
+			if strings.TrimSpace(text) == last.delim {
+				last.block = strings.Join(block, "\n")
+				last.blankRow = len(block) == 1 && block[0] == ""
+				if p.opts.KeepRaw {
+					last.rawBlock = append(block, text)
+				}
+				block = nil
+				heredocStart = 0
+			} else {
+				block = append(block, text)
+			}
 			continue
 		}
 
-		var found *Node
-		for _, child := range current.Children {
-			if child.Name == part {
-				found = child
-				break
+		// Collect the lines of a RawText block verbatim, blank lines and
+		// comments included, until a line indented no deeper than its node
+		if rawDepth >= 0 {
+			if strings.TrimSpace(text) == "" {
+				p.stats.BlankLines++
+				block = append(block, text)
+				continue
+			}
+			if readDepth(text) > rawDepth {
+				block = append(block, text)
+				continue
+			}
+			p.closeRawText(&lines[len(lines)-1], block)
+			block, rawDepth = nil, -1
+		}
+
+		// Blank out block comments, keeping the columns of the rest
+		if p.opts.BlockComments {
+			depth := readDepth(text)
+			stripped, texts, open, err := stripBlockComments(text, blockStart > 0)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			if !open {
+				blockStart = 0
+			} else if blockStart == 0 {
+				blockStart = i + 1
+			}
+			text = stripped
+			if len(texts) > 0 && strings.TrimSpace(text) == "" {
+				p.countComment()
+				if p.opts.PreserveComments {
+					for _, t := range texts {
+						if t != "" {
+							comments = append(comments, comment{text: t, depth: depth, num: i + 1})
+						}
+					}
+				}
+				continue
+			}
+			if len(texts) > 0 {
+				p.countComment()
+				if p.opts.PreserveComments {
+					p.dropComments(1, i+1, "block comment on a node line discarded")
+				}
+			}
+		}
+
+		// Skip empty lines (but preserve lines that are only whitespace for indentation tracking)
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" {
+			p.stats.BlankLines++
+			blanks = append(blanks, i+1)
+			// Comments cut off from the first node belong to the document
+			if len(lines) == 0 {
+				for _, c := range comments {
+					p.head = append(p.head, c)
+				}
+				comments = nil
+			}
+			continue
+		}
+
+		depth := readDepth(text)
+		if err := p.checkIndent(text[:depth]); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if strings.Contains(text[:depth], " ") && strings.Contains(text[:depth], "\t") {
+			p.warn(i+1, WarnMixedIndent, "indentation mixes tabs and spaces")
+		}
+
+		// Skip comment lines
+		rest := text[depth:]
+		if strings.HasPrefix(rest, "//") {
+			p.countComment()
+			if p.opts.PreserveComments {
+				c := lineComment(rest[2:])
+				c.depth, c.num = depth, i+1
+				comments = append(comments, c)
+			}
+			continue
+		}
+
+		if p.opts.StrictIndent {
+			var err error
+			if open, err = checkNesting(open, openLine{indent: text[:depth], num: i + 1}); err != nil {
+				return nil, err
+			}
+		}
+
+		// Blank lines between continuation lines of the same value are
+		// empty lines of the value
+		if len(blanks) > 0 && strings.HasPrefix(rest, ":") && len(lines) > 0 {
+			prev := lines[len(lines)-1].text
+			if d := readDepth(prev); prev[:d] == text[:depth] && prev[d] == ':' {
+				for _, num := range blanks {
+					lines = append(lines, line{text: text[:depth] + ":", num: num, blank: true})
+				}
 			}
 		}
+		blanks = blanks[:0]
 
-		if found == nil {
-			found = &Node{Name: part}
-			current.Children = append(current.Children, found)
+		l := line{text: text, num: i + 1, comments: comments}
+		if p.opts.Heredoc {
+			if l.delim = heredocDelimiter(text, depth); l.delim != "" {
+				heredocStart = i + 1
+			}
 		}
+		if name := rawTextName(text, depth); name != "" && listed(p.opts.RawText, p.normalize(name)) {
+			rawDepth = depth
+		}
+		lines = append(lines, l)
+		comments = nil
+	}
+	if rawDepth >= 0 {
+		p.closeRawText(&lines[len(lines)-1], block)
+	}
+
+	if heredocStart > 0 {
+		return nil, fmt.Errorf("line %d: unterminated heredoc %q", heredocStart, lines[len(lines)-1].delim)
+	}
+	if blockStart > 0 {
+		return nil, fmt.Errorf("line %d: unterminated block comment", blockStart)
+	}
 
-		if i == len(parts)-1 {
-			found.Value = value
-			return found
+	// The comments of a file without nodes belong to the document, and
+	// indented comments at the end may still close the last nodes, with the
+	// rest left for the document's footer
+	if len(lines) == 0 {
+		for _, c := range comments {
+			p.head = append(p.head, c)
 		}
+		comments = nil
+	}
+	p.tail = comments
+
+	return lines, nil
+}
 
-		current = found
+// stripBlockComments replaces the block comments in text with spaces, as
+// described by ParseOptions.BlockComments. open reports whether a comment is
+// open at the start of text, and the returned open whether one is still open
+// at its end. Returns the text of each comment, or part of one, on the line.
+func stripBlockComments(text string, open bool) (string, []string, bool, error) {
+	b := []byte(text)
+	var texts []string
+	start := 0 // start of the text of the open comment
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch {
+		case open && strings.HasPrefix(text[i:], "*/"):
+			texts = append(texts, strings.TrimSpace(text[start:i]))
+			b[i], b[i+1] = ' ', ' '
+			i++
+			open = false
+		case open && strings.HasPrefix(text[i:], "/*"):
+			return "", nil, false, errors.New("nested block comment")
+		case open:
+			b[i] = ' '
+		case text[i] == '"':
+			quoted = !quoted
+		case quoted:
+		case strings.HasPrefix(text[i:], "//"):
+			i = len(text) // The rest is a line comment
+		case strings.HasPrefix(text[i:], "/*"):
+			b[i], b[i+1] = ' ', ' '
+			i++
+			start = i + 1
+			open = true
+		}
+	}
+	if open {
+		texts = append(texts, strings.TrimSpace(text[start:]))
 	}
+	return string(b), texts, open, nil
+}
 
-	return current
+// countComment records a comment in the statistics. Comments are dropped
+// unless comments are being preserved.
+func (p *parser) countComment() {
+	p.stats.Comments++
+	if !p.opts.PreserveComments {
+		p.stats.DroppedComments++
+	}
 }
 
-// SetBool sets a boolean value at the given path.
-func (n *Node) SetBool(path string, value bool) *Node {
-	if value {
-		return n.Set(path, "true")
+// dropComments records n preserved comments that could not be attached to a
+// node and warns about them at line num.
+func (p *parser) dropComments(n, num int, message string) {
+	p.stats.DroppedComments += n
+	p.warn(num, WarnDroppedComment, "%s", message)
+}
+
+// warn reports a warning to ParseOptions.Warnings, if set.
+func (p *parser) warn(num int, category WarningCategory, format string, args ...interface{}) {
+	if p.opts.Warnings != nil {
+		p.opts.Warnings(Warning{Line: num, Category: category, Message: fmt.Sprintf(format, args...)})
 	}
-	return n.Set(path, "false")
 }
 
-// SetInt sets an integer value at the given path.
-func (n *Node) SetInt(path string, value int) *Node {
-	return n.Set(path, strconv.Itoa(value))
+// checkDuplicate warns if parent already has a child named name.
+func (p *parser) checkDuplicate(parent *Node, name string, num int) {
+	if p.opts.Warnings == nil {
+		return
+	}
+	for _, child := range parent.Children {
+		if child.Name == name {
+			p.warn(num, WarnDuplicateName, "duplicate node %q", name)
+			return
+		}
+	}
 }
 
-// SetFloat sets a float value at the given path.
-func (n *Node) SetFloat(path string, value float64) *Node {
-	return n.Set(path, strconv.FormatFloat(value, 'f', -1, 64))
+// heredocDelimiter returns the delimiter of a "Name: <<END" line, or "" if
+// the line does not open a heredoc. depth is the line's indentation.
+func heredocDelimiter(text string, depth int) string {
+	pos := depth
+	for pos < len(text) && isValidNameChar(text[pos]) {
+		pos++
+	}
+	if pos == depth {
+		return ""
+	}
+	for pos < len(text) && text[pos] == ' ' {
+		pos++
+	}
+	if pos >= len(text) || text[pos] != ':' {
+		return ""
+	}
+	value, _ := colonText(text, pos+1)
+	return heredocMarker(value)
 }
 
-// Remove removes a child node at the given path. Returns true if the node was removed.
-func (n *Node) Remove(path string) bool {
-	if n == nil {
-		return false
+// heredocMarker returns the delimiter of a colon value that opens a heredoc,
+// such as END for "<<END", or "" if the value does not.
+func heredocMarker(value string) string {
+	delim, ok := strings.CutPrefix(value, "<<")
+	if !ok || delim == "" || strings.ContainsAny(delim, " \t") {
+		return ""
 	}
+	return delim
+}
 
-	parts := strings.Split(path, "/")
+// rawTextName returns the name of the node on text, a line indented by
+// depth, if the node has no value of its own, or "" otherwise.
+func rawTextName(text string, depth int) string {
+	pos := depth
+	for pos < len(text) && isValidNameChar(text[pos]) {
+		pos++
+	}
+	name := text[depth:pos]
+	if rest := strings.TrimLeft(text[pos:], " "); strings.HasPrefix(rest, ":") || strings.HasPrefix(rest, "=") {
+		return ""
+	}
+	if pos < len(text) && text[pos] != ' ' && text[pos] != '\t' {
+		return ""
+	}
+	return name
+}
 
-	// Navigate to the parent of the node to remove
-	current := n
-	for i := 0; i < len(parts)-1; i++ {
-		part := parts[i]
-		if part == "" {
-			continue
+// closeRawText stores block, the lines following l, as the value of the
+// RawText node on l. Indentation up to that of the first line is removed,
+// ":" continuation lines lose their marker, and trailing blank lines are
+// dropped.
+func (p *parser) closeRawText(l *line, block []string) {
+	for len(block) > 0 && strings.TrimSpace(block[len(block)-1]) == "" {
+		block = block[:len(block)-1]
+	}
+	if len(block) == 0 {
+		return
+	}
+
+	indent := readDepth(block[0])
+	texts := make([]string, len(block))
+	for i, text := range block {
+		depth := readDepth(text)
+		if rest := text[depth:]; strings.HasPrefix(rest, ":") {
+			texts[i] = strings.TrimPrefix(rest[1:], " ")
+		} else {
+			texts[i] = text[min(depth, indent):]
 		}
+	}
+	l.block = strings.Join(texts, "\n")
+	l.rawText = true
+	if p.opts.KeepRaw {
+		l.rawBlock = block
+	}
+}
 
-		found := false
-		for _, child := range current.Children {
-			if child.Name == part {
-				current = child
-				found = true
-				break
+// openLine records the indentation of a line that may still have children.
+type openLine struct {
+	indent string
+	num    int
+}
+
+// checkNesting verifies that l's indentation is consistent with the stack of
+// open lines above it and returns the stack with l pushed. Lines at the same
+// or a deeper level than l are popped; each must share l's indentation as a
+// prefix, and l must extend the indentation of the line it nests under. A
+// line that dedents must return to the depth of one of the popped lines.
+func checkNesting(open []openLine, l openLine) ([]openLine, error) {
+	all := open
+	var dedent *openLine
+	for len(open) > 0 {
+		top := open[len(open)-1]
+		if len(top.indent) < len(l.indent) {
+			if !strings.HasPrefix(l.indent, top.indent) {
+				return nil, fmt.Errorf("line %d: indentation %q is ambiguous under line %d indentation %q", l.num, l.indent, top.num, top.indent)
 			}
+			break
 		}
-		if !found {
+		if !strings.HasPrefix(top.indent, l.indent) {
+			return nil, fmt.Errorf("line %d: indentation %q is ambiguous after line %d indentation %q", l.num, l.indent, top.num, top.indent)
+		}
+		dedent = &top
+		open = open[:len(open)-1]
+	}
+
+	if dedent != nil && len(dedent.indent) != len(l.indent) {
+		depths := make([]string, len(all))
+		for i, o := range all {
+			depths[i] = strconv.Itoa(len(o.indent))
+		}
+		return nil, fmt.Errorf("line %d: indentation depth %d does not match any enclosing level (valid depths: %s)", l.num, len(l.indent), strings.Join(depths, ", "))
+	}
+	return append(open, l), nil
+}
+
+// checkIndent validates an indentation prefix against ParseOptions.IndentStyle.
+func (p *parser) checkIndent(indent string) error {
+	switch p.opts.IndentStyle {
+	case IndentSpaces:
+		if strings.Contains(indent, "\t") {
+			return errors.New("indentation contains tabs but spaces are required")
+		}
+	case IndentTabs:
+		if strings.Contains(indent, " ") {
+			return errors.New("indentation contains spaces but tabs are required")
+		}
+	}
+	return nil
+}
+
+// readDepth counts the leading whitespace characters (tabs or spaces).
+func readDepth(line string) int {
+	depth := 0
+	for _, c := range line {
+		if c == '\t' || c == ' ' {
+			depth++
+		} else {
+			break
+		}
+	}
+	return depth
+}
+
+// isValidNameChar returns true if c is a valid BML name character (A-Z, a-z, 0-9, -, .)
+// Any run of them is a name, including ones without letters such as "123",
+// ".5", ".", and "-". A name never starts with "//", which begins a comment.
+func isValidNameChar(c byte) bool {
+	return (c >= 'A' && c <= 'Z') ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '.'
+}
+
+// isValidName reports whether name is a non-empty node name.
+func isValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isValidNameChar(name[i]) {
 			return false
 		}
 	}
+	return true
+}
 
-	// Remove the last node in the path
-	targetName := parts[len(parts)-1]
-	for i, child := range current.Children {
-		if child.Name == targetName {
-			current.Children = append(current.Children[:i], current.Children[i+1:]...)
-			return true
+// countNode records a newly parsed node, enforcing ParseOptions.MaxNodes.
+func (p *parser) countNode() error {
+	p.stats.Nodes++
+	if p.opts.MaxNodes > 0 && p.stats.Nodes > p.opts.MaxNodes {
+		return fmt.Errorf("document exceeds maximum of %d nodes", p.opts.MaxNodes)
+	}
+	return nil
+}
+
+// parseNode parses a single node and its children from the lines and adds it to parent.
+func (p *parser) parseNode(parent *Node, parentDepth int) error {
+	if p.index >= len(p.lines) {
+		return errors.New("unexpected end of input")
+	}
+
+	current := p.lines[p.index]
+	line := current.text
+	p.index++
+
+	depth := readDepth(line)
+	if depth <= parentDepth && parentDepth >= 0 {
+		return fmt.Errorf("invalid indentation at line: %s", line)
+	}
+
+	pos := depth
+	node := &Node{}
+	node.LeadingComments = node.keepComments(current.comments)
+
+	// Parse an anchor definition or reference
+	var anchor string
+	if p.opts.Anchors && line[pos] == '*' {
+		return p.parseReference(parent, node, current, pos, depth)
+	}
+	if p.opts.Anchors && line[pos] == '&' {
+		anchor, pos = p.parseName(line, pos+1)
+		if anchor == "" {
+			return fmt.Errorf("invalid anchor name at line: %s", line)
+		}
+		pos += len(line[pos:]) - len(strings.TrimLeft(line[pos:], " "))
+		p.open[anchor] = true
+		defer func() {
+			delete(p.open, anchor)
+			p.anchors[anchor] = node
+		}()
+	}
+
+	// Parse name
+	nameStart := pos
+	node.Name, pos = p.parseName(line, pos)
+	if pos == nameStart {
+		return fmt.Errorf("invalid node name at line: %s", line)
+	}
+	node.Name = p.normalize(node.Name)
+	// Spaces may separate the name from a colon, as in aligned files
+	if rest := strings.TrimLeft(line[pos:], " "); strings.HasPrefix(rest, ":") {
+		pos = len(line) - len(rest)
+	}
+
+	// Append to a preceding sibling with the += operator
+	if p.opts.AppendOperator {
+		if rest := strings.TrimLeft(line[pos:], " "); strings.HasPrefix(rest, "+=") {
+			if len(current.comments) > 0 {
+				p.dropComments(len(current.comments), current.num, "comment before append line discarded")
+			}
+			return p.appendToSibling(parent, node.Name, current, len(line)-len(rest)+2, depth)
+		}
+	}
+
+	if err := p.countNode(); err != nil {
+		return err
+	}
+	p.level++
+	defer func() { p.level-- }()
+	p.stats.MaxDepth = max(p.stats.MaxDepth, p.level)
+
+	// Parse value
+	valueStart := pos
+	if pos < len(line) {
+		value, newPos, err := parseValue(line, pos)
+		if err != nil {
+			return err
+		}
+		node.Value = value
+		node.HasValue = hasValue(line, pos)
+		pos = newPos
+	}
+	if p.values != nil {
+		p.values[node] = [2]int{valueStart, pos}
+	}
+	if current.delim != "" {
+		node.Value = current.block
+		node.Heredoc = current.delim
+		node.blankRow = current.blankRow
+	}
+	if current.rawText {
+		node.Value = current.block
+		node.HasValue = true
+	}
+	if p.opts.KeepRaw {
+		node.Raw = current.text
+		node.RawLines = current.rawBlock
+	}
+
+	// Parse attributes (space-separated key-value pairs on the same line)
+	for pos < len(line) {
+		// Skip spaces
+		for pos < len(line) && line[pos] == ' ' {
+			pos++
+		}
+		if pos >= len(line) {
+			break
+		}
+
+		// Check for inline comment
+		if strings.HasPrefix(line[pos:], "//") {
+			p.countComment()
+			if p.opts.PreserveComments {
+				node.InlineComment = node.keepComment(lineComment(line[pos+2:]))
+			}
+			break
+		}
+
+		// Parse children written between braces
+		if p.opts.Flow && line[pos] == '{' {
+			var err error
+			if pos, err = p.parseFlow(node, current, pos, p.level); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Parse attribute name
+		var attrName string
+		if p.opts.QuotedAttributeNames && line[pos] == '"' {
+			var err error
+			attrName, pos, err = parseQuotedName(line, pos)
+			if err != nil {
+				return err
+			}
+		} else {
+			attrStart := pos
+			attrName, pos = p.parseName(line, pos)
+			if pos == attrStart {
+				break
+			}
+		}
+
+		// Parse attribute value
+		attr := &Node{Name: p.normalize(attrName), IsAttr: true}
+		valueStart := pos
+		if pos < len(line) {
+			var err error
+			attr.HasValue = hasValue(line, pos)
+			attr.Value, pos, err = parseValue(line, pos)
+			if err != nil {
+				return err
+			}
+		}
+		if p.values != nil {
+			p.values[attr] = [2]int{valueStart, pos}
+		}
+
+		if err := p.countNode(); err != nil {
+			return err
+		}
+		p.stats.MaxDepth = max(p.stats.MaxDepth, p.level+1)
+		p.checkDuplicate(node, attr.Name, current.num)
+		node.Children = append(node.Children, attr)
+	}
+
+	p.checkDuplicate(parent, node.Name, current.num)
+	parent.Children = append(parent.Children, node)
+	if p.opts.KeepRaw {
+		node.raw = &rawSource{level: p.level, heads: len(node.Children)}
+	}
+	if p.spans != nil {
+		p.spans[node] = span{start: current.num}
+	}
+	return p.parseChildren(node, depth)
+}
+
+// parseChildren parses the continuation lines and child nodes indented deeper than depth.
+func (p *parser) parseChildren(node *Node, depth int) error {
+	if !node.HasValue && listed(p.opts.NextLineValues, node.Name) {
+		p.parseNextLineValue(node, depth)
+	}
+
+	// Collect the lines of a multiline value and join them once, rather
+	// than concatenating each line onto the value, which is quadratic in the
+	// number of lines. Nested calls stack their lines above these in
+	// p.parts and remove them before returning.
+	base := len(p.parts)
+	size := 0 // bytes in the lines collected so far
+	addLine := func(text string) {
+		if size == 0 {
+			p.parts = p.parts[:base]
+			if node.Value != "" {
+				p.parts = append(p.parts, node.Value)
+				size = len(node.Value)
+			}
+		}
+		p.parts = append(p.parts, text)
+		size += len(text)
+		node.HasValue = true
+	}
+
+	// The last child parsed, and its indentation, for SiblingContinuation
+	var prev *Node
+	prevDepth := -1
+
+	// Parse child nodes based on indentation
+	for p.index < len(p.lines) {
+		childDepth := readDepth(p.lines[p.index].text)
+		if childDepth <= depth {
+			break
+		}
+
+		// Continue the value of the preceding sibling
+		rest := strings.TrimLeft(p.lines[p.index].text, " \t")
+		if p.opts.SiblingContinuation && strings.HasPrefix(rest, ":") && prev != nil && childDepth == prevDepth {
+			p.continueSibling(prev, childDepth)
+			continue
+		}
+
+		// Comments are only kept on nodes
+		if len(p.lines[p.index].comments) > 0 && strings.HasPrefix(rest, ":") {
+			p.dropComments(len(p.lines[p.index].comments), p.lines[p.index].num, "comment inside a multiline value discarded")
+		}
+
+		// Check for multiline value continuation (line starting with : at deeper depth)
+		if strings.HasPrefix(rest, ":") {
+			if depth < 0 && !p.opts.RootValue {
+				return fmt.Errorf("value without a node name at line: %s", p.lines[p.index].text)
+			}
+			// Multiline value continuation
+			continuation := strings.TrimPrefix(rest, ":")
+			continuation = strings.TrimPrefix(continuation, " ") // Trim one leading space if present
+			addLine(continuation)
+			p.keepRaw(node)
+			p.index++
+			continue
+		}
+
+		count := len(node.Children)
+		if err := p.parseNode(node, depth); err != nil {
+			return err
+		}
+		if len(node.Children) > count {
+			prev, prevDepth = node.Children[len(node.Children)-1], childDepth
+		}
+	}
+
+	if size > 0 {
+		node.Value = strings.Join(p.parts[base:], "\n")
+	}
+	p.parts = p.parts[:base]
+	if s, ok := p.spans[node]; ok {
+		s.end = p.lines[p.index-1].num
+		p.spans[node] = s
+	}
+	p.claimTrailing(node, depth)
+	return nil
+}
+
+// lineComment returns the comment whose text follows a "//" marker, keeping
+// the text as written when it is not the "// text" that Serialize writes.
+func lineComment(after string) comment {
+	c := comment{text: strings.TrimSpace(after)}
+	if after != " "+c.text && after != "" {
+		c.raw = after
+	}
+	return c
+}
+
+// keepComment returns the text of c, a comment of n, recording its spacing
+// for Serialize.
+func (n *Node) keepComment(c comment) string {
+	if c.raw != "" {
+		if n.spacing == nil {
+			n.spacing = make(map[string]string)
+		}
+		n.spacing[c.text] = c.raw
+	}
+	return c.text
+}
+
+// keepComments is keepComment for the comments of a line, returning nil for
+// none.
+func (n *Node) keepComments(cs []comment) []string {
+	var texts []string
+	for _, c := range cs {
+		texts = append(texts, n.keepComment(c))
+	}
+	return texts
+}
+
+// claimTrailing attaches the comments ahead of the next line that are indented
+// deeper than depth to node as trailing comments. Nested nodes finish first,
+// so each comment goes to the innermost node indented less than it, and the
+// root, at depth -1, takes the rest.
+func (p *parser) claimTrailing(node *Node, depth int) {
+	pending := &p.tail
+	if p.index < len(p.lines) {
+		pending = &p.lines[p.index].comments
+	}
+	n := 0
+	for n < len(*pending) && (*pending)[n].depth > depth {
+		node.TrailingComments = append(node.TrailingComments, node.keepComment((*pending)[n]))
+		n++
+	}
+	*pending = (*pending)[n:]
+}
+
+// appendToSibling handles a "name += text" line by appending text, on a new
+// line, to the value of the last child of parent with that name. Lines
+// indented beneath it continue that sibling.
+func (p *parser) appendToSibling(parent *Node, name string, l line, pos, depth int) error {
+	line := l.text
+	var target *Node
+	for i := len(parent.Children) - 1; i >= 0; i-- {
+		if parent.Children[i].Name == name {
+			target = parent.Children[i]
+			break
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("cannot append to %q without a preceding node at line: %s", name, line)
+	}
+
+	text, end := colonText(line, pos)
+	if end < len(line) {
+		// The inline comment of an append line has nowhere to go
+		p.countComment()
+		if p.opts.PreserveComments {
+			p.dropComments(1, l.num, "comment on append line discarded")
+		}
+	}
+	if target.Value != "" {
+		target.Value += "\n"
+	}
+	target.Value += text
+	target.HasValue = true
+	if p.opts.KeepRaw {
+		if target.raw != nil && parent.Children[len(parent.Children)-1] == target && len(target.Children) == target.raw.heads {
+			target.RawLines = append(target.RawLines, line)
+		} else {
+			// The line is apart from the source lines of the sibling, which
+			// PreferRaw could not write back in place
+			target.raw = nil
+		}
+	}
+	return p.parseChildren(target, depth)
+}
+
+// parseNextLineValue takes the line after node as its value, as described
+// by ParseOptions.NextLineValues, if it is the only line indented deeper
+// than depth and does not look like a child or continuation.
+func (p *parser) parseNextLineValue(node *Node, depth int) {
+	if p.index >= len(p.lines) {
+		return
+	}
+	l := p.lines[p.index]
+	childDepth := readDepth(l.text)
+	if childDepth <= depth {
+		return
+	}
+	if p.index+1 < len(p.lines) && readDepth(p.lines[p.index+1].text) > depth {
+		return
+	}
+	rest := l.text[childDepth:]
+	if strings.HasPrefix(rest, ":") || looksLikeChild(rest) {
+		return
+	}
+
+	if len(l.comments) > 0 {
+		p.dropComments(len(l.comments), l.num, "comment before next-line value discarded")
+	}
+	value, end := colonText(l.text, childDepth)
+	if end < len(l.text) {
+		p.countComment()
+		if p.opts.PreserveComments && node.InlineComment == "" {
+			node.InlineComment = node.keepComment(lineComment(l.text[end+2:]))
+		} else if p.opts.PreserveComments {
+			p.dropComments(1, l.num, "comment on next-line value discarded")
+		}
+	}
+	node.Value = value
+	node.HasValue = true
+	p.keepRaw(node)
+	p.index++
+}
+
+// keepRaw adds the current line to the raw lines of node under
+// ParseOptions.KeepRaw.
+func (p *parser) keepRaw(node *Node) {
+	if p.opts.KeepRaw {
+		text := p.lines[p.index].text
+		if p.lines[p.index].blank {
+			text = ""
+		}
+		node.RawLines = append(node.RawLines, text)
+	}
+}
+
+// record saves the state of n, which was parsed with ParseOptions.KeepRaw.
+func (r *rawSource) record(n *Node) {
+	r.node = &Node{Name: n.Name, Value: n.Value, HasValue: n.HasValue, Heredoc: n.Heredoc, InlineComment: n.InlineComment}
+	for _, child := range n.Children[:r.heads] {
+		r.node.Children = append(r.node.Children, child.Clone())
+	}
+}
+
+// unchanged reports whether n, written at depth, still matches the source
+// text recorded in r.
+func (r *rawSource) unchanged(n *Node, depth int) bool {
+	s := r.node
+	if r.level != depth+1 || n.Name != s.Name || n.Value != s.Value || n.HasValue != s.HasValue ||
+		n.Heredoc != s.Heredoc || n.InlineComment != s.InlineComment || len(n.Children) < r.heads {
+		return false
+	}
+	for i, child := range s.Children {
+		c := n.Children[i]
+		if c.IsAttr != child.IsAttr || c.HasValue != child.HasValue || !c.Equal(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// listed reports whether name is one of names.
+func listed(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeChild reports whether rest (a line without its indentation)
+// starts with a node name immediately followed by a ":" or "=" separator.
+func looksLikeChild(rest string) bool {
+	pos := 0
+	for pos < len(rest) && isValidNameChar(rest[pos]) {
+		pos++
+	}
+	return pos > 0 && pos < len(rest) && (rest[pos] == ':' || rest[pos] == '=')
+}
+
+// hasValue reports whether the text at pos in line introduces a value with
+// ":" or "=", even an empty one.
+func hasValue(line string, pos int) bool {
+	return line[pos] == ':' || line[pos] == '='
+}
+
+// colonText reads the text of a colon-format value starting at pos, after the
+// separator. One leading space is skipped, the text extends to the end of the
+// line or an inline comment, and trailing spaces are trimmed. Returns the text
+// and the position where it ended. Text starting with ":", as in
+// "Ratio: :special", is part of the value; only a line of its own starting
+// with ":" continues a multiline value.
+func colonText(line string, pos int) (string, int) {
+	// Skip one leading space if present
+	if pos < len(line) && line[pos] == ' ' {
+		pos++
+	}
+	// Value extends to end of line (or until inline comment)
+	end := pos
+	for end < len(line) {
+		if strings.HasPrefix(line[end:], "//") {
+			break
+		}
+		end++
+	}
+	return strings.TrimRight(line[pos:end], " "), end
+}
+
+// nameEscaper and nameUnescaper convert between names containing separators
+// and their escaped form, as described by ParseOptions.EscapedNames.
+var (
+	nameEscaper   = strings.NewReplacer(":", `\:`, "=", `\=`)
+	nameUnescaper = strings.NewReplacer(`\:`, ":", `\=`, "=")
+)
+
+// parseName parses a node or attribute name starting at pos in line. Returns
+// the name and the position after it, which is pos if there is no name.
+func (p *parser) parseName(line string, pos int) (string, int) {
+	start, escaped := pos, false
+	for pos < len(line) {
+		if isValidNameChar(line[pos]) {
+			pos++
+		} else if p.opts.EscapedNames && line[pos] == '\\' && pos+1 < len(line) && (line[pos+1] == ':' || line[pos+1] == '=') {
+			pos += 2
+			escaped = true
+		} else {
+			break
+		}
+	}
+	if escaped {
+		return nameUnescaper.Replace(line[start:pos]), pos
+	}
+	return line[start:pos], pos
+}
+
+// parseReference replaces the "*Name" reference at pos in current with a copy
+// of the anchored node, as described by ParseOptions.Anchors. node holds the
+// comments of the line.
+func (p *parser) parseReference(parent, node *Node, current line, pos, depth int) error {
+	line := current.text
+	name, end := p.parseName(line, pos+1)
+	if name == "" {
+		return fmt.Errorf("invalid anchor name at line: %s", line)
+	}
+	if p.open[name] {
+		return fmt.Errorf("line %d: anchor %q is referenced within its own node", current.num, name)
+	}
+	anchored, ok := p.anchors[name]
+	if !ok {
+		return fmt.Errorf("line %d: undefined anchor %q", current.num, name)
+	}
+
+	rest := strings.TrimLeft(line[end:], " ")
+	if rest != "" && !strings.HasPrefix(rest, "//") {
+		return fmt.Errorf("unexpected text after reference at line: %s", line)
+	}
+
+	if err := p.countCopy(anchored, p.level+1); err != nil {
+		return err
+	}
+	c := anchored.Clone()
+	c.LeadingComments, c.InlineComment, c.TrailingComments = node.LeadingComments, "", nil
+	c.spacing = node.spacing
+	if p.opts.KeepRaw {
+		clearRaw(c)
+	}
+	if rest != "" {
+		p.countComment()
+		if p.opts.PreserveComments {
+			c.InlineComment = c.keepComment(lineComment(rest[2:]))
+		}
+	}
+
+	p.checkDuplicate(parent, c.Name, current.num)
+	parent.Children = append(parent.Children, c)
+	p.level++
+	defer func() { p.level-- }()
+	return p.parseChildren(c, depth)
+}
+
+// clearRaw removes the source text of n and its descendants.
+func clearRaw(n *Node) {
+	n.Raw, n.RawLines, n.raw = "", nil, nil
+	for _, child := range n.Children {
+		clearRaw(child)
+	}
+}
+
+// maxAnchorCopies limits the nodes copied by anchor references in a
+// document, as described by ParseOptions.Anchors.
+const maxAnchorCopies = 1_000_000
+
+// countCopy records the nodes of a subtree about to be copied at the given
+// nesting level, enforcing ParseOptions.MaxNodes and maxAnchorCopies.
+func (p *parser) countCopy(n *Node, level int) error {
+	if err := p.countNode(); err != nil {
+		return err
+	}
+	p.copies++
+	if p.copies > maxAnchorCopies {
+		return fmt.Errorf("anchor references copy more than %d nodes", maxAnchorCopies)
+	}
+	p.stats.MaxDepth = max(p.stats.MaxDepth, level)
+	for _, child := range n.Children {
+		if err := p.countCopy(child, level+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// continueSibling appends the ":" lines at depth starting at the current line
+// to the value of node, as described by ParseOptions.SiblingContinuation.
+func (p *parser) continueSibling(node *Node, depth int) {
+	var value strings.Builder
+	value.WriteString(node.Value)
+	for p.index < len(p.lines) && readDepth(p.lines[p.index].text) == depth {
+		current := p.lines[p.index]
+		rest := current.text[depth:]
+		if !strings.HasPrefix(rest, ":") {
+			break
+		}
+		if len(current.comments) > 0 {
+			p.dropComments(len(current.comments), current.num, "comment inside a multiline value discarded")
+		}
+		if value.Len() > 0 {
+			value.WriteByte('\n')
+		}
+		value.WriteString(strings.TrimPrefix(rest[1:], " "))
+		p.keepRaw(node)
+		p.index++
+	}
+	node.Value = value.String()
+	node.HasValue = true
+}
+
+// parseFlow parses the braced children of node, as described by
+// ParseOptions.Flow, starting at the "{" at pos in current. level is the
+// nesting level of node. Returns the position after the closing brace.
+func (p *parser) parseFlow(node *Node, current line, pos, level int) (int, error) {
+	text := current.text
+	pos++ // Skip "{"
+	for {
+		for pos < len(text) && text[pos] == ' ' {
+			pos++
+		}
+		if pos >= len(text) || strings.HasPrefix(text[pos:], "//") {
+			return pos, fmt.Errorf("unclosed brace in line: %s", text)
+		}
+		if text[pos] == '}' {
+			return pos + 1, nil
+		}
+
+		start := pos
+		child := &Node{}
+		child.Name, pos = p.parseName(text, pos)
+		if pos == start {
+			return pos, fmt.Errorf("invalid node name in braces in line: %s", text)
+		}
+		child.Name = p.normalize(child.Name)
+		if err := p.countNode(); err != nil {
+			return pos, err
+		}
+		p.stats.MaxDepth = max(p.stats.MaxDepth, level+1)
+
+		// A colon value would run to the end of the line, so only "=" is read
+		if pos < len(text) && text[pos] == '=' {
+			var err error
+			child.HasValue = true
+			if child.Value, pos, err = parseValue(text, pos); err != nil {
+				return pos, err
+			}
+		}
+		for pos < len(text) && text[pos] == ' ' {
+			pos++
+		}
+		if pos < len(text) && text[pos] == '{' {
+			var err error
+			if pos, err = p.parseFlow(child, current, pos, level+1); err != nil {
+				return pos, err
+			}
+		}
+
+		p.checkDuplicate(node, child.Name, current.num)
+		node.Children = append(node.Children, child)
+	}
+}
+
+// normalize applies ParseOptions.NormalizeNames to name.
+func (p *parser) normalize(name string) string {
+	if p.opts.NormalizeNames == nil {
+		return name
+	}
+	return p.opts.NormalizeNames(name)
+}
+
+// parseQuotedName parses a double-quoted attribute name starting at pos in
+// line. Returns the trimmed name and the position after the closing quote.
+func parseQuotedName(line string, pos int) (string, int, error) {
+	end := strings.IndexByte(line[pos+1:], '"')
+	if end < 0 {
+		return "", pos, fmt.Errorf("unclosed quote in attribute name in line: %s", line)
+	}
+	end += pos + 1
+
+	name := strings.TrimSpace(line[pos+1 : end])
+	if name == "" {
+		return "", pos, fmt.Errorf("empty attribute name in line: %s", line)
+	}
+	return name, end + 1, nil
+}
+
+// parseValue parses a value starting at pos in line. Returns the value, new position, and any error.
+func parseValue(line string, pos int) (string, int, error) {
+	if pos >= len(line) {
+		return "", pos, nil
+	}
+
+	switch line[pos] {
+	case ':':
+		// Colon format: Name: value
+		value, end := colonText(line, pos+1)
+		return value, end, nil
+
+	case '=':
+		pos++
+		if pos >= len(line) {
+			return "", pos, nil
+		}
+
+		if line[pos] == '"' {
+			// Quoted format: Name="value"
+			pos++
+			end := pos
+			for end < len(line) && line[end] != '"' {
+				end++
+			}
+			if end >= len(line) {
+				return "", pos, fmt.Errorf("unclosed quote in line: %s", line)
+			}
+			value := line[pos:end]
+			return value, end + 1, nil
+		}
+
+		// Unquoted format: Name=value (no spaces allowed)
+		end := pos
+		for end < len(line) && line[end] != ' ' && line[end] != '"' {
+			end++
+		}
+		value := line[pos:end]
+		return value, end, nil
+
+	default:
+		return "", pos, nil
+	}
+}
+
+// Dump returns a readable rendering of the node and its descendants for
+// debugging, one node per line indented by depth, such as:
+//
+//	Video [2 children]
+//	  Driver = "Metal"
+//	  mode = "full" (attr)
+//
+// Values are quoted, so empty and multiline values are visible, and a node
+// with an empty name, such as a document root, is shown as "(root)". The
+// format is meant for people and may change.
+func (n *Node) Dump() string {
+	if n == nil {
+		return "<nil>"
+	}
+	var buf strings.Builder
+	dumpNode(&buf, n, 0)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// GoString returns Dump, so the %#v verb prints a readable tree.
+func (n *Node) GoString() string {
+	return n.Dump()
+}
+
+// dumpNode writes n and its descendants to buf for Dump.
+func dumpNode(buf *strings.Builder, n *Node, depth int) {
+	buf.WriteString(strings.Repeat("  ", depth))
+	if n.Name == "" {
+		buf.WriteString("(root)")
+	} else {
+		buf.WriteString(n.Name)
+	}
+	if n.Value != "" || n.HasValue {
+		fmt.Fprintf(buf, " = %q", n.Value)
+	}
+	switch len(n.Children) {
+	case 0:
+	case 1:
+		buf.WriteString(" [1 child]")
+	default:
+		fmt.Fprintf(buf, " [%d children]", len(n.Children))
+	}
+	if n.IsAttr {
+		buf.WriteString(" (attr)")
+	}
+	buf.WriteByte('\n')
+	for _, child := range n.Children {
+		dumpNode(buf, child, depth+1)
+	}
+}
+
+// Equal reports whether n and other have the same names, values, and
+// children, recursively. Comments, Meta, and the presentation fields Heredoc,
+// HasValue, and IsAttr are ignored.
+func (n *Node) Equal(other *Node) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	if n.Name != other.Name || n.Value != other.Value || len(n.Children) != len(other.Children) {
+		return false
+	}
+	for i, child := range n.Children {
+		if !child.Equal(other.Children[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// EqualUnordered is like Equal but ignores the order of children: each child
+// of n must match a distinct child of other.
+func (n *Node) EqualUnordered(other *Node) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	if n.Name != other.Name || n.Value != other.Value || len(n.Children) != len(other.Children) {
+		return false
+	}
+	matched := make([]bool, len(other.Children))
+	for _, child := range n.Children {
+		found := false
+		for i, candidate := range other.Children {
+			if !matched[i] && child.EqualUnordered(candidate) {
+				matched[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Clone returns a deep copy of n. Meta is copied shallowly: the map is new but
+// its values are shared.
+func (n *Node) Clone() *Node {
+	if n == nil {
+		return nil
+	}
+	c := *n
+	if n.LeadingComments != nil {
+		c.LeadingComments = append([]string(nil), n.LeadingComments...)
+	}
+	if n.TrailingComments != nil {
+		c.TrailingComments = append([]string(nil), n.TrailingComments...)
+	}
+	if n.RawLines != nil {
+		c.RawLines = append([]string(nil), n.RawLines...)
+	}
+	if n.spacing != nil {
+		c.spacing = make(map[string]string, len(n.spacing))
+		for k, v := range n.spacing {
+			c.spacing[k] = v
+		}
+	}
+	if n.Meta != nil {
+		c.Meta = make(map[string]interface{}, len(n.Meta))
+		for k, v := range n.Meta {
+			c.Meta[k] = v
+		}
+	}
+	if n.Children != nil {
+		c.Children = make([]*Node, len(n.Children))
+		for i, child := range n.Children {
+			c.Children[i] = child.Clone()
+		}
+	}
+	return &c
+}
+
+// Get retrieves a child node by path (e.g., "Video/Driver").
+// Returns nil if the path doesn't exist.
+func (n *Node) Get(path string) *Node {
+	if n == nil {
+		return nil
+	}
+
+	parts := strings.Split(path, "/")
+	current := n
+
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+
+		if current = current.child(part, false); current == nil {
+			return nil
+		}
+	}
+
+	return current
+}
+
+// child returns the first child of n named name, ignoring case if fold is
+// set, or nil if there is none.
+func (n *Node) child(name string, fold bool) *Node {
+	for _, child := range n.Children {
+		if child.Name == name || fold && strings.EqualFold(child.Name, name) {
+			return child
+		}
+	}
+	return nil
+}
+
+// ensureChild returns n.child(name, fold), first appending a child named name
+// if there is none.
+func (n *Node) ensureChild(name string, fold bool) *Node {
+	if found := n.child(name, fold); found != nil {
+		return found
+	}
+	found := &Node{Name: name}
+	n.Children = append(n.Children, found)
+	return found
+}
+
+// GetAll retrieves every node matching the last element of path under the
+// node that the rest of path leads to, in document order. Returns nil if
+// there are none.
+func (n *Node) GetAll(path string) []*Node {
+	dir, name := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, name = path[:i], path[i+1:]
+	}
+
+	parent := n.Get(dir)
+	if parent == nil || name == "" {
+		return nil
+	}
+
+	var nodes []*Node
+	for _, child := range parent.Children {
+		if child.Name == name {
+			nodes = append(nodes, child)
+		}
+	}
+	return nodes
+}
+
+// Attributes returns the attribute children of the node, those written on
+// its line, in document order. Returns nil for a nil node.
+func (n *Node) Attributes() []*Node {
+	return n.filterChildren(true)
+}
+
+// Attr returns the first attribute child with the given name, ignoring block
+// children of the same name. Returns nil if there is none.
+func (n *Node) Attr(name string) *Node {
+	if n == nil {
+		return nil
+	}
+	for _, child := range n.Children {
+		if child.IsAttr && child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// Blocks returns the children of the node that are not attributes, those
+// written on their own lines, in document order. Returns nil for a nil node.
+func (n *Node) Blocks() []*Node {
+	return n.filterChildren(false)
+}
+
+// filterChildren returns the children of n whose IsAttr matches attr.
+func (n *Node) filterChildren(attr bool) []*Node {
+	if n == nil {
+		return nil
+	}
+	var nodes []*Node
+	for _, child := range n.Children {
+		if child.IsAttr == attr {
+			nodes = append(nodes, child)
+		}
+	}
+	return nodes
+}
+
+// HasChildren reports whether the node has block children, ignoring
+// attributes. Returns false for a nil node.
+func (n *Node) HasChildren() bool {
+	if n == nil {
+		return false
+	}
+	for _, child := range n.Children {
+		if !child.IsAttr {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLeaf reports whether the node has no block children, although it may
+// have attributes. Returns false for a nil node.
+func (n *Node) IsLeaf() bool {
+	return n != nil && !n.HasChildren()
+}
+
+// ForEach calls fn for each direct child of the node in order, with the
+// child's index, until fn returns false. It does nothing for a nil node.
+func (n *Node) ForEach(fn func(i int, child *Node) bool) {
+	if n == nil {
+		return
+	}
+	for i, child := range n.Children {
+		if !fn(i, child) {
+			return
+		}
+	}
+}
+
+// FindByValue returns every descendant of the node, attributes included,
+// whose value trimmed of surrounding whitespace equals value, in document
+// order. Returns nil if there are none or the node is nil.
+func (n *Node) FindByValue(value string) []*Node {
+	var nodes []*Node
+	walkNode(n, "", func(_ string, child *Node) bool {
+		if strings.TrimSpace(child.Value) == value {
+			nodes = append(nodes, child)
+		}
+		return true
+	})
+	return nodes
+}
+
+// String returns the node's value as a string, or the fallback if the node is nil.
+// The value is trimmed of surrounding whitespace; the result shares memory with
+// Value, so String does not allocate.
+func (n *Node) String(fallback string) string {
+	if n == nil {
+		return fallback
+	}
+	return strings.TrimSpace(n.Value)
+}
+
+// RawString is like String but returns the value without trimming, so
+// significant surrounding whitespace is kept.
+func (n *Node) RawString(fallback string) string {
+	if n == nil {
+		return fallback
+	}
+	return n.Value
+}
+
+// RawValue returns the node's value exactly as stored, without trimming, or
+// "" if the node is nil. Values are not kept as byte slices: a []byte view of
+// a string could not be handed out without a copy, so callers that need bytes
+// should convert RawValue themselves.
+func (n *Node) RawValue() string {
+	if n == nil {
+		return ""
+	}
+	return n.Value
+}
+
+// Bool returns the node's value as a boolean, or the fallback if the node is nil or not a valid bool.
+// "1" and "0" are valid for nodes parsed with ParseOptions.NumericBools.
+func (n *Node) Bool(fallback bool) bool {
+	if n == nil {
+		return fallback
+	}
+	if b, ok := parseBool(strings.TrimSpace(n.Value), n.numericBool); ok {
+		return b
+	}
+	return fallback
+}
+
+// parseBool interprets s as a boolean, reporting whether s was recognized.
+// When numeric is true, "1" and "0" are accepted in addition to "true" and "false".
+func parseBool(s string, numeric bool) (bool, bool) {
+	switch {
+	case s == "true", numeric && s == "1":
+		return true, true
+	case s == "false", numeric && s == "0":
+		return false, true
+	}
+	return false, false
+}
+
+// Int returns the node's value as an integer, or the fallback if the node is nil or not a valid int.
+func (n *Node) Int(fallback int) int {
+	if n == nil {
+		return fallback
+	}
+	v := stripDigitSeparators(strings.TrimSpace(n.Value))
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback
+	}
+	return i
+}
+
+// Float returns the node's value as a float64, or the fallback if the node is nil or not a valid float.
+// NaN and infinities are not valid floats.
+func (n *Node) Float(fallback float64) float64 {
+	if n == nil {
+		return fallback
+	}
+	f, err := parseFloat(strings.TrimSpace(n.Value))
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
+// ErrNotFound is returned by IntE, BoolE, and FloatE for a nil node, such as
+// the result of Get for a missing path.
+var ErrNotFound = errors.New("bml: node not found")
+
+// IntE is like Int but returns an error instead of a fallback: ErrNotFound
+// for a nil node, or the conversion error for a value that is not an int.
+func (n *Node) IntE() (int, error) {
+	if n == nil {
+		return 0, ErrNotFound
+	}
+	v := strings.TrimSpace(n.Value)
+	i, err := strconv.Atoi(stripDigitSeparators(v))
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q as int: %w", v, err)
+	}
+	return i, nil
+}
+
+// BoolE is like Bool but returns an error instead of a fallback: ErrNotFound
+// for a nil node, or an error for a value other than "true" or "false", or
+// "1" or "0" under ParseOptions.NumericBools.
+func (n *Node) BoolE() (bool, error) {
+	if n == nil {
+		return false, ErrNotFound
+	}
+	v := strings.TrimSpace(n.Value)
+	b, ok := parseBool(v, n.numericBool)
+	if !ok {
+		return false, fmt.Errorf("cannot parse %q as bool", v)
+	}
+	return b, nil
+}
+
+// FloatE is like Float but returns an error instead of a fallback:
+// ErrNotFound for a nil node, or the conversion error for a value that is not
+// a finite float.
+func (n *Node) FloatE() (float64, error) {
+	if n == nil {
+		return 0, ErrNotFound
+	}
+	v := strings.TrimSpace(n.Value)
+	f, err := parseFloat(v)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q as float: %w", v, err)
+	}
+	return f, nil
+}
+
+// GetString returns the value of the node at path as by String, or the
+// fallback if the path does not exist.
+func (n *Node) GetString(path string, fallback string) string {
+	return n.Get(path).String(fallback)
+}
+
+// GetInt returns the value of the node at path as by Int, or the fallback if
+// the path does not exist or is not a valid int.
+func (n *Node) GetInt(path string, fallback int) int {
+	return n.Get(path).Int(fallback)
+}
+
+// GetBool returns the value of the node at path as by Bool, or the fallback
+// if the path does not exist or is not a valid bool.
+func (n *Node) GetBool(path string, fallback bool) bool {
+	return n.Get(path).Bool(fallback)
+}
+
+// GetFloat returns the value of the node at path as by Float, or the
+// fallback if the path does not exist or is not a valid float.
+func (n *Node) GetFloat(path string, fallback float64) float64 {
+	return n.Get(path).Float(fallback)
+}
+
+// List returns the node's value split at each sep, with every element trimmed
+// of surrounding whitespace, as for "Extensions: sfc, smc, fig". Whitespace
+// inside an element is kept, and so are empty elements: "a,,b" has three.
+// Returns nil if the node is nil or its value is empty or only whitespace.
+// An empty sep does not split, so the trimmed value is the only element.
+func (n *Node) List(sep string) []string {
+	if n == nil {
+		return nil
+	}
+	value := strings.TrimSpace(n.Value)
+	if value == "" {
+		return nil
+	}
+	if sep == "" {
+		return []string{value}
+	}
+	items := strings.Split(value, sep)
+	for i, item := range items {
+		items[i] = strings.TrimSpace(item)
+	}
+	return items
+}
+
+// Value returns the node's value converted to the type of fallback, or the
+// fallback if the node is nil or the value cannot be converted. Supported
+// types are string, bool, int, int64, float64, and time.Duration; any other
+// type always yields the fallback.
+func Value[T any](n *Node, fallback T) T {
+	if n == nil {
+		return fallback
+	}
+
+	var v interface{}
+	switch f := interface{}(fallback).(type) {
+	case string:
+		v = n.String(f)
+	case bool:
+		v = n.Bool(f)
+	case int:
+		v = n.Int(f)
+	case int64:
+		i, err := strconv.ParseInt(stripDigitSeparators(strings.TrimSpace(n.Value)), 10, 64)
+		if err != nil {
+			return fallback
+		}
+		v = i
+	case float64:
+		v = n.Float(f)
+	case time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(n.Value))
+		if err != nil {
+			return fallback
+		}
+		v = d
+	default:
+		return fallback
+	}
+	return v.(T)
+}
+
+// Number is a numeric value kept in its original text, like json.Number.
+// Unmarshal checks that the trimmed value parses as a finite float and stores
+// its text, and Marshal writes it back verbatim, so "1.50" is not reformatted
+// as "1.5". Empty values follow UnmarshalOptions.StrictNumbers.
+type Number string
+
+// String returns the text of the number.
+func (n Number) String() string {
+	return string(n)
+}
+
+// Int64 returns the number as an int64, accepting digit separators.
+func (n Number) Int64() (int64, error) {
+	return strconv.ParseInt(stripDigitSeparators(string(n)), 10, 64)
+}
+
+// Float64 returns the number as a finite float64, accepting digit separators.
+func (n Number) Float64() (float64, error) {
+	return parseFloat(string(n))
+}
+
+// MapEntry is a key and value of an OrderedMap.
+type MapEntry[V any] struct {
+	Key   string
+	Value V
+}
+
+// OrderedMap is a map field type that keeps its entries in order. Unmarshal
+// appends one entry per child node in document order and Marshal writes the
+// entries in slice order, rather than sorting keys as for a Go map. Like a Go
+// map, a repeated key updates the existing entry.
+type OrderedMap[V any] []MapEntry[V]
+
+// Get returns the value for key and whether it is present.
+func (m OrderedMap[V]) Get(key string) (V, bool) {
+	for _, e := range m {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Set updates the value for key, appending a new entry if key is absent.
+func (m *OrderedMap[V]) Set(key string, value V) {
+	for i := range *m {
+		if (*m)[i].Key == key {
+			(*m)[i].Value = value
+			return
+		}
+	}
+	*m = append(*m, MapEntry[V]{Key: key, Value: value})
+}
+
+// orderedMap marks OrderedMap types for the encoder and decoder.
+func (OrderedMap[V]) orderedMap() {}
+
+// parseFloat parses s as a float64, accepting digit separators. NaN and
+// infinities are rejected so configuration values are always finite.
+func parseFloat(s string) (float64, error) {
+	f, err := strconv.ParseFloat(stripDigitSeparators(s), 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, errors.New("value is not a finite number")
+	}
+	return f, err
+}
+
+// stripDigitSeparators removes underscores placed between two digits, as in
+// "1_000". A misplaced underscore leaves s unchanged so that the numeric
+// parser rejects it.
+func stripDigitSeparators(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '_' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1]) {
+			return s
+		}
+	}
+	return b.String()
+}
+
+// isDigit reports whether c is an ASCII decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Set sets or creates a node at the given path with the given value.
+// Creates intermediate nodes as needed. Returns the node that was set.
+// An empty value leaves the node without a value, written as "Name"; set
+// HasValue afterwards to write an explicitly empty "Name:".
+func (n *Node) Set(path string, value string) *Node {
+	if n == nil {
+		return nil
+	}
+
+	node := n.Ensure(path)
+	// An empty final segment names no node, so nothing is set
+	if path != "" && !strings.HasSuffix(path, "/") {
+		setValue(node, value)
+	}
+	return node
+}
+
+// setValue sets the value of node as Set does.
+func setValue(node *Node, value string) {
+	node.Value = value
+	node.HasValue = value != ""
+}
+
+// Ensure returns the node at the given path, creating it and any
+// intermediate nodes with empty values if they do not exist. Unlike Set, it
+// leaves the value of an existing node unchanged.
+func (n *Node) Ensure(path string) *Node {
+	if n == nil {
+		return nil
+	}
+
+	current := n
+	for _, part := range strings.Split(path, "/") {
+		if part == "" {
+			continue
+		}
+
+		current = current.ensureChild(part, false)
+	}
+
+	return current
+}
+
+// ClearComments removes the node's leading, inline, and trailing comments.
+func (n *Node) ClearComments() {
+	if n == nil {
+		return
+	}
+	n.LeadingComments = nil
+	n.InlineComment = ""
+	n.TrailingComments = nil
+	n.spacing = nil
+}
+
+// SetBool sets a boolean value at the given path.
+func (n *Node) SetBool(path string, value bool) *Node {
+	if value {
+		return n.Set(path, "true")
+	}
+	return n.Set(path, "false")
+}
+
+// SetInt sets an integer value at the given path.
+func (n *Node) SetInt(path string, value int) *Node {
+	return n.Set(path, strconv.Itoa(value))
+}
+
+// SetFloat sets a float value at the given path.
+func (n *Node) SetFloat(path string, value float64) *Node {
+	return n.Set(path, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// SetList sets the value at the given path to items joined with sep, the
+// inverse of List. List reads the items back unchanged unless one contains
+// sep or has surrounding whitespace, or items holds only an empty string,
+// which is written as an empty value and read back as nil. With an empty sep
+// the items are joined directly, and List reads them back as one element.
+func (n *Node) SetList(path string, sep string, items []string) *Node {
+	return n.Set(path, strings.Join(items, sep))
+}
+
+// Remove removes a child node at the given path. Returns true if the node was removed.
+func (n *Node) Remove(path string) bool {
+	parent, index := n.locate(path)
+	if parent == nil {
+		return false
+	}
+
+	parent.Children = append(parent.Children[:index], parent.Children[index+1:]...)
+	return true
+}
+
+// Replace substitutes the node at the given path with replacement, keeping
+// its position among its siblings. Returns false if the path doesn't exist.
+func (n *Node) Replace(path string, replacement *Node) bool {
+	if replacement == nil {
+		return false
+	}
+
+	parent, index := n.locate(path)
+	if parent == nil {
+		return false
+	}
+
+	parent.Children[index] = replacement
+	return true
+}
+
+// AppendChild adds child as the last child of n. It does nothing if n or
+// child is nil.
+func (n *Node) AppendChild(child *Node) {
+	if n == nil || child == nil {
+		return
+	}
+	n.Children = append(n.Children, child)
+}
+
+// PrependChild adds child as the first child of n. It does nothing if n or
+// child is nil.
+func (n *Node) PrependChild(child *Node) {
+	if n == nil || child == nil {
+		return
+	}
+	n.Children = append([]*Node{child}, n.Children...)
+}
+
+// SetAll replaces the direct children named name with one new child per
+// value, in order. The new children take the position of the first existing
+// child with that name, or are appended if there was none; the other
+// children keep their relative order. An empty values removes every such
+// child. Returns the new children.
+func (n *Node) SetAll(name string, values []string) []*Node {
+	if n == nil {
+		return nil
+	}
+
+	nodes := make([]*Node, len(values))
+	for i, value := range values {
+		nodes[i] = &Node{Name: name, Value: value}
+	}
+
+	children := make([]*Node, 0, len(n.Children)+len(nodes))
+	inserted := false
+	for _, child := range n.Children {
+		if child.Name != name {
+			children = append(children, child)
+		} else if !inserted {
+			children = append(children, nodes...)
+			inserted = true
+		}
+	}
+	if !inserted {
+		children = append(children, nodes...)
+	}
+	n.Children = children
+	return nodes
+}
+
+// Prune recursively removes descendants that have an empty value, no
+// children, and no comments. Pruning is bottom-up, so a node left empty by
+// pruning its children is removed as well. n itself is never removed.
+// Attributes are ordinary children and follow the same rule, so a valueless
+// flag attribute such as "Node enabled" is pruned.
+func (n *Node) Prune() {
+	if n == nil {
+		return
+	}
+
+	kept := n.Children[:0]
+	for _, child := range n.Children {
+		child.Prune()
+		if child.Value != "" || len(child.Children) > 0 ||
+			len(child.LeadingComments) > 0 || child.InlineComment != "" ||
+			len(child.TrailingComments) > 0 {
+			kept = append(kept, child)
+		}
+	}
+	for i := len(kept); i < len(n.Children); i++ {
+		n.Children[i] = nil
+	}
+	n.Children = kept
+}
+
+// locate finds the node at the given path and returns its parent and its
+// index in the parent's children. Returns a nil parent if the path doesn't exist.
+func (n *Node) locate(path string) (*Node, int) {
+	if n == nil {
+		return nil, 0
+	}
+
+	parts := strings.Split(path, "/")
+
+	// Navigate to the parent of the target node
+	current := n
+	for i := 0; i < len(parts)-1; i++ {
+		part := parts[i]
+		if part == "" {
+			continue
+		}
+
+		found := false
+		for _, child := range current.Children {
+			if child.Name == part {
+				current = child
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, 0
+		}
+	}
+
+	// Find the last node in the path
+	targetName := parts[len(parts)-1]
+	for i, child := range current.Children {
+		if child.Name == targetName {
+			return current, i
+		}
+	}
+
+	return nil, 0
+}
+
+// Clone returns a deep copy of the document.
+func (d *Document) Clone() *Document {
+	if d == nil {
+		return nil
+	}
+	return &Document{Root: d.Root.Clone()}
+}
+
+// Equal reports whether d and other have equal root nodes. A nil document is
+// only equal to another nil document.
+func (d *Document) Equal(other *Document) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	return d.Root.Equal(other.Root)
+}
+
+// EqualUnordered is like Equal but ignores the order of children.
+func (d *Document) EqualUnordered(other *Document) bool {
+	if d == nil || other == nil {
+		return d == other
+	}
+	return d.Root.EqualUnordered(other.Root)
+}
+
+// Flatten returns a map from slash-delimited paths to values, such as
+// "Video/Driver" -> "Metal". Every node with a value is included, as is every
+// leaf node (with an empty value); nodes that only have children are omitted.
+// When several siblings share a name, each occurrence gets a zero-based index
+// suffix, e.g. "Input/Port[0]" and "Input/Port[1]".
+func (d *Document) Flatten() map[string]string {
+	m := make(map[string]string)
+	d.Walk(func(path string, n *Node) bool {
+		if n.Value != "" || len(n.Children) == 0 {
+			m[path] = n.Value
+		}
+		return true
+	})
+	return m
+}
+
+// ChangeKind classifies a Change.
+type ChangeKind int
+
+const (
+	// ChangeAdded is a path present only in the second document.
+	ChangeAdded ChangeKind = iota + 1
+	// ChangeRemoved is a path present only in the first document.
+	ChangeRemoved
+	// ChangeModified is a path whose value differs between the documents.
+	ChangeModified
+)
+
+// Change is a difference between two documents at a path of Flatten.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Old  string // value in the first document, empty when added
+	New  string // value in the second document, empty when removed
+}
+
+// Diff returns the changes that turn a into b, comparing the paths and values
+// given by Flatten, in path order. Comments and formatting are ignored. A nil
+// document has no paths.
+func Diff(a, b *Document) []Change {
+	before, after := a.Flatten(), b.Flatten()
+	var changes []Change
+	for path, value := range before {
+		if other, ok := after[path]; !ok {
+			changes = append(changes, Change{Path: path, Kind: ChangeRemoved, Old: value})
+		} else if other != value {
+			changes = append(changes, Change{Path: path, Kind: ChangeModified, Old: value, New: other})
+		}
+	}
+	for path, value := range after {
+		if _, ok := before[path]; !ok {
+			changes = append(changes, Change{Path: path, Kind: ChangeAdded, New: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return comparePaths(changes[i].Path, changes[j].Path) < 0 })
+	return changes
+}
+
+// Walk calls fn for every node below the root in document order, passing its
+// slash-delimited path in the form used by Flatten. If fn returns false, the
+// children of that node are skipped.
+func (d *Document) Walk(fn func(path string, n *Node) bool) {
+	if d != nil {
+		walkNode(d.Root, "", fn)
+	}
+}
+
+// walkNode calls fn for the descendants of n, prefixing their paths with prefix.
+func walkNode(n *Node, prefix string, fn func(path string, n *Node) bool) {
+	if n == nil {
+		return
+	}
+	for i, segment := range childSegments(n) {
+		path := prefix + segment
+		if fn(path, n.Children[i]) {
+			walkNode(n.Children[i], path+"/", fn)
+		}
+	}
+}
+
+// Paths returns the path of every node in the document, branches and leaves
+// alike, in document order. Paths use the form of Flatten, with index
+// suffixes for repeated siblings.
+func (d *Document) Paths() []string {
+	var paths []string
+	d.Walk(func(path string, n *Node) bool {
+		paths = append(paths, path)
+		return true
+	})
+	return paths
+}
+
+// FromFlat builds a Document from a map of slash-delimited paths to values,
+// the inverse of Flatten. Intermediate nodes are created as needed, as by
+// Set, and "[i]" index suffixes recreate repeated siblings. Keys are
+// processed in sorted order (comparing indexes numerically) so sibling order
+// is stable. Indexes of a name must run from 0 without gaps, which bounds
+// them by the number of keys, and a name may not appear both with and
+// without an index under the same parent.
+func FromFlat(m map[string]string) (*Document, error) {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return comparePaths(keys[i], keys[j]) < 0
+	})
+
+	root := &Node{}
+	indexed := make(map[*Node]map[string]bool) // names used with an index, by parent
+	for _, key := range keys {
+		current := root
+		for _, segment := range strings.Split(key, "/") {
+			if segment == "" {
+				continue
+			}
+			next, err := flatChild(current, segment, indexed)
+			if err != nil {
+				return nil, fmt.Errorf("bml: FromFlat: path %q: %w", key, err)
+			}
+			current = next
+		}
+		if current != root {
+			setValue(current, m[key])
+		}
+	}
+
+	return &Document{Root: root}, nil
+}
+
+// flatChild returns the child of n for the path segment of FromFlat,
+// creating it if needed. indexed records, for each parent, whether each name
+// was used with an index.
+func flatChild(n *Node, segment string, indexed map[*Node]map[string]bool) (*Node, error) {
+	name, index := splitSegment(segment)
+	if !isValidName(name) {
+		return nil, fmt.Errorf("invalid node name %q", name)
+	}
+	if indexed[n] == nil {
+		indexed[n] = make(map[string]bool)
+	}
+	if was, ok := indexed[n][name]; ok && was != (index >= 0) {
+		return nil, fmt.Errorf("%s is used both with and without an index", name)
+	}
+	indexed[n][name] = index >= 0
+	if index < 0 {
+		return n.Ensure(name), nil
+	}
+
+	count := 0
+	for _, child := range n.Children {
+		if child.Name == name {
+			if count == index {
+				return child, nil
+			}
+			count++
+		}
+	}
+	if index > count {
+		return nil, fmt.Errorf("%s[%d] is set without %s[%d]", name, index, name, count)
+	}
+	child := &Node{Name: name}
+	n.Children = append(n.Children, child)
+	return child, nil
+}
+
+// splitSegment splits a path segment such as "Port[1]" into its name and
+// index. The index is -1 when the segment has no valid index suffix.
+func splitSegment(segment string) (string, int) {
+	open := strings.LastIndexByte(segment, '[')
+	if open < 0 || !strings.HasSuffix(segment, "]") {
+		return segment, -1
+	}
+	index, err := strconv.Atoi(segment[open+1 : len(segment)-1])
+	if err != nil || index < 0 {
+		return segment, -1
+	}
+	return segment[:open], index
+}
+
+// comparePaths orders slash-delimited paths segment by segment, comparing
+// index suffixes numerically.
+func comparePaths(a, b string) int {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		aName, aIndex := splitSegment(as[i])
+		bName, bIndex := splitSegment(bs[i])
+		if c := strings.Compare(aName, bName); c != 0 {
+			return c
+		}
+		if aIndex != bIndex {
+			if aIndex < bIndex {
+				return -1
+			}
+			return 1
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// childSegments returns the path segment addressing each child of n. Names
+// shared by several siblings are suffixed with the occurrence index.
+func childSegments(n *Node) []string {
+	counts := make(map[string]int, len(n.Children))
+	for _, child := range n.Children {
+		counts[child.Name]++
+	}
+
+	seen := make(map[string]int, len(counts))
+	segments := make([]string, len(n.Children))
+	for i, child := range n.Children {
+		if counts[child.Name] > 1 {
+			segments[i] = fmt.Sprintf("%s[%d]", child.Name, seen[child.Name])
+			seen[child.Name]++
+		} else {
+			segments[i] = child.Name
+		}
+	}
+	return segments
+}
+
+// OverlayEnv sets document values from environment variables whose names
+// start with prefix, for overriding settings at load time. The rest of the
+// name is split at "_" into a path: with the prefix "BML_", the variable
+// BML_VIDEO_DRIVER=Metal sets Video/Driver. Node names cannot contain "_",
+// so each "_" separates two levels. Segments match existing nodes ignoring
+// case, as environment variables are conventionally upper case; missing
+// nodes are created with the segment as written. A variable with a segment
+// that is not a valid node name, such as "B!" in BML_A_B!, is an error, and
+// so are two variables naming the same path, such as BML_VIDEO_DRIVER and
+// BML_Video_Driver, whose order in the environment is unspecified. On error
+// no values are set.
+func (d *Document) OverlayEnv(prefix string) error {
+	return d.overlayEnv(prefix, os.Environ())
+}
+
+// overlayEnv applies the "key=value" entries of environ as described by
+// OverlayEnv.
+func (d *Document) overlayEnv(prefix string, environ []string) error {
+	if d == nil || d.Root == nil {
+		return nil
+	}
+
+	type setting struct {
+		path  []string
+		value string
+	}
+	var settings []setting
+	keys := make(map[string]string) // variable names by lower-case path
+	for _, entry := range environ {
+		key, value, _ := strings.Cut(entry, "=")
+		rest, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		var path []string
+		for _, segment := range strings.Split(rest, "_") {
+			if segment == "" {
+				continue
+			}
+			if !isValidName(segment) {
+				return fmt.Errorf("bml: OverlayEnv: variable %s: invalid node name %q", key, segment)
+			}
+			path = append(path, segment)
+		}
+		if len(path) > 0 {
+			folded := strings.ToLower(strings.Join(path, "/"))
+			if other, ok := keys[folded]; ok {
+				first, second := min(key, other), max(key, other)
+				return fmt.Errorf("bml: OverlayEnv: variables %s and %s name the same node", first, second)
+			}
+			keys[folded] = key
+			settings = append(settings, setting{path, value})
+		}
+	}
+
+	for _, s := range settings {
+		node := d.Root
+		for _, segment := range s.path {
+			node = node.ensureChild(segment, true)
+		}
+		node.Value = s.value
+		node.HasValue = true
+	}
+	return nil
+}
+
+// Migration is a single step of a configuration migration, such as renaming
+// a node, setting a default, or removing a deprecated setting.
+type Migration func(*Document) error
+
+// ApplyMigrations runs ms over d in order, stopping at the first one that
+// returns an error.
+func ApplyMigrations(d *Document, ms ...Migration) error {
+	for i, m := range ms {
+		if err := m(d); err != nil {
+			return fmt.Errorf("migration %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// ApplyPatch sets the values of base, a BML file, to those of the leaf nodes
+// of patch, editing the text of base rather than reserializing it. The value
+// of a node present in base is replaced in place, leaving the rest of its
+// line as written, unless the new value cannot be written in the same form,
+// in which case the line is rewritten, keeping its indentation, attributes,
+// and inline comment. A node missing from base is inserted, with any missing
+// descendants, after the last line of its parent. Every other line,
+// including comments and blank lines, is left untouched. Nodes are matched
+// by path, as given by Document.Walk, so the second "Port" in patch updates
+// the second "Port" in base. Patching a multiline value in base, or a path
+// below an attribute, is an error.
+func ApplyPatch(base []byte, patch *Document) ([]byte, error) {
+	p := &parser{
+		opts:   ParseOptions{PreserveComments: true},
+		spans:  make(map[*Node]span),
+		values: make(map[*Node][2]int),
+	}
+	doc, err := p.parse(base)
+	if err != nil {
+		return nil, err
+	}
+	if patch == nil || patch.Root == nil {
+		return base, nil
+	}
+
+	pt := &patcher{
+		lines:   splitLines(string(base)),
+		spans:   p.spans,
+		values:  p.values,
+		heads:   make(map[*Node]*Node),
+		rewrite: make(map[*Node]bool),
+		splices: make(map[int][]splice),
+		inserts: make(map[int][]string),
+	}
+	if err := pt.patch(doc.Root, patch.Root); err != nil {
+		return nil, err
+	}
+	return pt.output(), nil
+}
+
+// patcher collects the line edits made by ApplyPatch.
+type patcher struct {
+	lines   []string         // lines of the base, each with its line ending
+	spans   map[*Node]span   // input lines of each base node
+	values  map[*Node][2]int // value text of each base node on its line
+	heads   map[*Node]*Node  // new head line of each edited base node
+	rewrite map[*Node]bool   // edited nodes whose head line is reserialized
+	splices map[int][]splice // in-place value edits, by line number
+	inserts map[int][]string // lines to insert after each line number
+}
+
+// splice replaces the bytes from start to end of a line with text.
+type splice struct {
+	start, end int
+	text       string
+}
+
+// patch applies the children of from to those of node, recursively.
+func (pt *patcher) patch(node, from *Node) error {
+	segments := childSegments(node)
+	for i, segment := range childSegments(from) {
+		child := from.Children[i]
+		j := slices.Index(segments, segment)
+		if j < 0 {
+			pt.insert(node, child)
+			continue
+		}
+
+		target := node.Children[j]
+		if target.IsAttr && len(child.Children) > 0 {
+			return fmt.Errorf("line %d: cannot patch below the attribute %s", pt.spans[node].start, target.Name)
+		}
+		if len(child.Children) == 0 || child.HasValue || child.Value != "" {
+			if err := pt.setValue(node, target, child); err != nil {
+				return err
+			}
+		}
+		if err := pt.patch(target, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setValue gives target, a child of parent, the value of from, replacing its
+// value text in place when it can and otherwise marking the head line to be
+// rewritten. An attribute is edited on the line of its parent.
+func (pt *patcher) setValue(parent, target, from *Node) error {
+	owner, edit := target, func(head *Node) { head.Value, head.HasValue = from.Value, true }
+	if target.IsAttr {
+		i := slices.Index(parent.Children, target)
+		owner, edit = parent, func(head *Node) { head.Children[i].Value, head.Children[i].HasValue = from.Value, true }
+	}
+
+	head, ok := pt.heads[owner]
+	if !ok {
+		if strings.Contains(owner.Value, "\n") {
+			return fmt.Errorf("line %d: cannot patch a multiline value", pt.spans[owner].start)
+		}
+		// The head line holds the name, value, attributes, and inline
+		// comment; attributes keep their positions among the children
+		head = &Node{Name: owner.Name, Value: owner.Value, HasValue: owner.HasValue, InlineComment: owner.InlineComment, spacing: owner.spacing}
+		for _, child := range owner.Children {
+			head.Children = append(head.Children, &Node{Name: child.Name, Value: child.Value, HasValue: child.HasValue, IsAttr: child.IsAttr})
+		}
+		pt.heads[owner] = head
+	}
+	edit(head)
+
+	num := pt.spans[owner].start
+	line := strings.TrimRight(pt.lines[num-1], "\r\n")
+	r := pt.values[target]
+	rest := strings.TrimLeft(line[r[1]:], " ")
+	inline := target.IsAttr || rest != "" && !strings.HasPrefix(rest, "//")
+	if s, ok := valueSplice(line, r[0], r[1], from.Value, inline); ok {
+		pt.splices[num] = append(pt.splices[num], s)
+	} else {
+		pt.rewrite[owner] = true
+	}
+	return nil
+}
+
+// valueSplice returns the splice that gives value to the node or attribute
+// whose value text, from its ":" or "=" separator, is at start to end of
+// line. inline requires the "=" form, for an attribute or a node followed by
+// attributes. It reports false if value cannot be written in place.
+func valueSplice(line string, start, end int, value string, inline bool) (splice, bool) {
+	quotable := !strings.ContainsAny(value, "\"\n")
+	colon := value == strings.TrimSpace(value) && !strings.Contains(value, "\n") && !strings.Contains(value, "//")
+	switch {
+	case start < end && line[start] == ':':
+		// Keep the spaces around the value, and any inline comment
+		vs := start + 1
+		for vs < end && (line[vs] == ' ' || line[vs] == '\t') {
+			vs++
+		}
+		ve := start + 1 + len(strings.TrimRight(line[start+1:end], " "))
+		ve = max(ve, vs)
+		switch {
+		case value == "":
+			return splice{start + 1, ve, ""}, true
+		case colon && vs == ve && vs == start+1:
+			return splice{vs, ve, " " + value}, true
+		case colon:
+			return splice{vs, ve, value}, true
+		case quotable:
+			return splice{start, ve, `="` + value + `"`}, true
+		}
+	case start < end && end-start > 1 && line[start+1] == '"' && quotable:
+		// Keep the quotes of a quoted value
+		return splice{start + 2, end - 1, value}, true
+	case start < end || inline:
+		if text, ok := inlineValue(value, true); ok {
+			return splice{start, end, text}, true
+		}
+	case value == "":
+		return splice{start, end, ":"}, true
+	case colon:
+		return splice{start, end, ": " + value}, true
+	case quotable:
+		return splice{start, end, `="` + value + `"`}, true
+	}
+	return splice{}, false
+}
+
+// insert adds child and its descendants after the last line of parent,
+// indented like the other children of parent.
+func (pt *patcher) insert(parent, child *Node) {
+	after, indent := len(pt.lines), ""
+	if s, ok := pt.spans[parent]; ok {
+		after = s.end
+		indent = leadingSpace(pt.lines[s.start-1]) + "  "
+		for _, c := range parent.Children {
+			if cs, ok := pt.spans[c]; ok {
+				indent = leadingSpace(pt.lines[cs.start-1])
+				break
+			}
+		}
+	}
+	pt.inserts[after] = append(pt.inserts[after], indentLines(SerializeNode(child), indent)...)
+}
+
+// output returns the edited text.
+func (pt *patcher) output() []byte {
+	eol := "\n"
+	for _, l := range pt.lines {
+		if e := lineEnding(l); e != "" {
+			eol = e
+			break
+		}
+	}
+
+	heads := make(map[int]*Node, len(pt.rewrite))
+	for owner := range pt.rewrite {
+		heads[pt.spans[owner].start] = pt.heads[owner]
+	}
+
+	var buf strings.Builder
+	write := func(lines []string) {
+		for _, l := range lines {
+			buf.WriteString(l)
+			buf.WriteString(eol)
+		}
+	}
+	write(pt.inserts[0])
+	for i, l := range pt.lines {
+		if head, ok := heads[i+1]; ok {
+			var out bytes.Buffer
+			serializeNode(head, 0, 0, &out, DefaultSerializeOptions())
+			l = strings.Join(indentLines(out.Bytes(), leadingSpace(l)), eol) + lineEnding(l)
+		} else if splices := pt.splices[i+1]; len(splices) > 0 {
+			// Apply the edits from the end of the line so earlier offsets
+			// stay valid
+			sort.Slice(splices, func(a, b int) bool { return splices[a].start > splices[b].start })
+			for _, s := range splices {
+				l = l[:s.start] + s.text + l[s.end:]
+			}
+		}
+		buf.WriteString(l)
+		if lines := pt.inserts[i+1]; len(lines) > 0 {
+			if lineEnding(l) == "" {
+				buf.WriteString(eol)
+			}
+			write(lines)
+		}
+	}
+	return []byte(buf.String())
+}
+
+// splitLines splits s into lines, each keeping its "\r\n", "\r", or "\n"
+// ending, as the parser numbers them.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		end := strings.IndexAny(s, "\r\n")
+		if end < 0 {
+			end = len(s)
+		} else if s[end] == '\r' && end+1 < len(s) && s[end+1] == '\n' {
+			end += 2
+		} else {
+			end++
+		}
+		lines = append(lines, s[:end])
+		s = s[end:]
+	}
+	return lines
+}
+
+// lineEnding returns the line ending of l, or "" for a final line without one.
+func lineEnding(l string) string {
+	return l[len(strings.TrimRight(l, "\r\n")):]
+}
+
+// leadingSpace returns the indentation of l.
+func leadingSpace(l string) string {
+	return l[:readDepth(l)]
+}
+
+// indentLines splits serialized BML into lines, prefixing each with indent.
+func indentLines(data []byte, indent string) []string {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	for i := range lines {
+		lines[i] = indent + lines[i]
+	}
+	return lines
+}
+
+// SerializeOptions configures SerializeWithOptions. Use
+// DefaultSerializeOptions for the behavior of Serialize.
+type SerializeOptions struct {
+	// FinalNewline ends the output with a newline after the last node.
+	FinalNewline bool
+
+	// FlattenSingleChild writes a node that has no value and a single child
+	// without children of its own as one line, the child becoming an
+	// attribute: "Video Driver=Metal" rather than "Video" with
+	// "Driver: Metal" beneath it. Parsing the output gives an equal tree.
+	FlattenSingleChild bool
+
+	// AlignValues pads the names of sibling nodes written in the "Name: value"
+	// form so their colons line up, as in "Driver    : Metal" above
+	// "Multiplier: 2". The parser accepts spaces before a colon.
+	AlignValues bool
+
+	// Flow writes the children of a node without a value on its line
+	// between braces, as read by ParseOptions.Flow, when no descendant has
+	// comments or a value that cannot be written inline.
+	Flow bool
+
+	// PreferRaw writes a node parsed with ParseOptions.KeepRaw from its
+	// source text, Node.Raw and Node.RawLines, when its name, value, inline
+	// comment, attributes, and depth are unchanged, so a formatter can
+	// reprint untouched nodes exactly. Comments and children are written
+	// as usual.
+	PreferRaw bool
+
+	// RootValue writes the document's own value, Root.Value, first as ":"
+	// lines at the top level, as read by ParseOptions.RootValue. Without it
+	// the root's value is not written.
+	RootValue bool
+}
+
+// DefaultSerializeOptions returns the options used by Serialize.
+func DefaultSerializeOptions() SerializeOptions {
+	return SerializeOptions{FinalNewline: true}
+}
+
+// Serialize converts a Document back to BML format.
+func Serialize(doc *Document) []byte {
+	return SerializeWithOptions(doc, DefaultSerializeOptions())
+}
+
+// SerializeWithOptions is like Serialize but uses the given options.
+func SerializeWithOptions(doc *Document, opts SerializeOptions) []byte {
+	if doc == nil || doc.Root == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, comment := range doc.Root.LeadingComments {
+		writeComment(&buf, doc.Root, comment)
+		buf.WriteByte('\n')
+	}
+	hasValue := opts.RootValue && (doc.Root.Value != "" || doc.Root.HasValue)
+	if len(doc.Root.LeadingComments) > 0 && (hasValue || len(doc.Root.Children) > 0) {
+		// Keep the document comments apart from the first node's
+		buf.WriteByte('\n')
+	}
+	if hasValue {
+		for _, line := range strings.Split(doc.Root.Value, "\n") {
+			buf.WriteString(": ")
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	align := 0
+	if opts.AlignValues {
+		align = alignWidth(doc.Root.Children)
+	}
+	for _, child := range doc.Root.Children {
+		serializeNode(child, 0, align, &buf, opts)
+	}
+	for _, comment := range doc.Root.TrailingComments {
+		writeComment(&buf, doc.Root, comment)
+		buf.WriteByte('\n')
+	}
+
+	out := buf.Bytes()
+	if !opts.FinalNewline {
+		out = bytes.TrimSuffix(out, []byte("\n"))
+	}
+	return out
+}
+
+// SerializeNode converts a single node and its descendants to BML format, as
+// a top-level node, independent of the document containing it. Returns nil
+// for a nil node.
+func SerializeNode(n *Node) []byte {
+	if n == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	serializeNode(n, 0, 0, &buf, DefaultSerializeOptions())
+	return buf.Bytes()
+}
+
+// serializeNode writes a node and its children to the buffer. A name followed
+// by a colon is padded to align bytes.
+func serializeNode(node *Node, depth, align int, buf *bytes.Buffer, opts SerializeOptions) {
+	if node == nil {
+		return
+	}
+
+	// Write leading comments
+	for _, comment := range node.LeadingComments {
+		writeIndent(buf, depth)
+		writeComment(buf, node, comment)
+		buf.WriteByte('\n')
+	}
+
+	// Write an unchanged node from its source text
+	if opts.PreferRaw && node.raw != nil && node.raw.unchanged(node, depth) {
+		for _, line := range append([]string{node.Raw}, node.RawLines...) {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+		serializeChildren(node, node.Children[node.raw.heads:], depth, buf, opts)
+		return
+	}
+
+	// Write indentation
+	writeIndent(buf, depth)
+
+	// Write name
+	writeName(buf, node.Name)
+	if align > 0 && writesColon(node) {
+		buf.WriteString(strings.Repeat(" ", align-len(escapeName(node.Name))))
+	}
+
+	// Write value (multiline values follow the name line as continuations
+	// or a heredoc block)
+	heredoc := node.Heredoc != "" && canHeredoc(node.Value, node.Heredoc)
+	multiline := !heredoc && continues(node.Value)
+	attrs, children := splitAttributes(node, heredoc)
+	if opts.FlattenSingleChild && !heredoc && node.Value == "" && !node.HasValue &&
+		len(node.Children) == 1 && canInline(node.Children[0]) {
+		attrs, children = node.Children, nil
+	}
+	flow := opts.Flow && !heredoc && node.Value == "" && !node.HasValue &&
+		len(children) > 0 && canFlow(children)
+	if heredoc {
+		buf.WriteString(": <<")
+		buf.WriteString(node.Heredoc)
+	} else if (node.Value != "" || node.HasValue) && !multiline {
+		if len(attrs) > 0 {
+			// A colon value would swallow the attributes that follow it
+			text, _ := inlineValue(node.Value, node.HasValue)
+			buf.WriteString(text)
+		} else if needsQuotes(node.Value) {
+			buf.WriteString(`="`)
+			buf.WriteString(node.Value)
+			buf.WriteByte('"')
+		} else if node.Value == "" {
+			buf.WriteByte(':')
+		} else {
+			buf.WriteString(": ")
+			buf.WriteString(node.Value)
+		}
+	}
+
+	// Write inline attributes
+	for _, attr := range attrs {
+		buf.WriteByte(' ')
+		writeName(buf, attr.Name)
+		text, _ := inlineValue(attr.Value, attr.HasValue)
+		buf.WriteString(text)
+	}
+
+	if flow {
+		writeFlow(buf, children)
+		children = nil
+	}
+
+	if node.InlineComment != "" {
+		buf.WriteByte(' ')
+		writeComment(buf, node, node.InlineComment)
+	}
+	buf.WriteByte('\n')
+
+	if heredoc {
+		if node.Value != "" || node.blankRow {
+			buf.WriteString(node.Value)
+			buf.WriteByte('\n')
+		}
+		writeIndent(buf, depth)
+		buf.WriteString(node.Heredoc)
+		buf.WriteByte('\n')
+	}
+
+	if multiline {
+		for _, line := range strings.Split(node.Value, "\n") {
+			writeIndent(buf, depth+1)
+			buf.WriteString(": ")
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+
+	serializeChildren(node, children, depth, buf, opts)
+}
+
+// serializeChildren writes children, the block children of node, and the
+// trailing comments of node, which is at depth.
+func serializeChildren(node *Node, children []*Node, depth int, buf *bytes.Buffer, opts SerializeOptions) {
+	align := 0
+	if opts.AlignValues {
+		align = alignWidth(children)
+	}
+	for _, child := range children {
+		serializeNode(child, depth+1, align, buf, opts)
+	}
+
+	// Write trailing comments
+	for _, comment := range node.TrailingComments {
+		writeIndent(buf, depth+1)
+		writeComment(buf, node, comment)
+		buf.WriteByte('\n')
+	}
+}
+
+// splitAttributes separates the attribute children of node that can be
+// written inline on its line from the children written as blocks. Nothing is
+// inlined for a heredoc or a single-line value that cannot precede
+// attributes, and attributes with children, comments, or values that cannot
+// be written inline are kept as blocks.
+func splitAttributes(node *Node, heredoc bool) ([]*Node, []*Node) {
+	if heredoc {
+		return nil, node.Children
+	}
+	if _, ok := inlineValue(node.Value, false); !ok && !strings.Contains(node.Value, "\n") {
+		return nil, node.Children
+	}
+
+	var attrs, children []*Node
+	for _, child := range node.Children {
+		if child.IsAttr && canInline(child) {
+			attrs = append(attrs, child)
+		} else {
+			children = append(children, child)
+		}
+	}
+	return attrs, children
+}
+
+// canInline reports whether node can be written as an attribute on its
+// parent's line: it has no children or comments and its value can be written
+// inline.
+func canInline(node *Node) bool {
+	_, ok := inlineValue(node.Value, false)
+	return ok && len(node.Children) == 0 && len(node.LeadingComments) == 0 &&
+		node.InlineComment == "" && len(node.TrailingComments) == 0
+}
+
+// canFlow reports whether nodes and their descendants can be written between
+// braces: none has comments or a value that cannot be written inline.
+func canFlow(nodes []*Node) bool {
+	for _, node := range nodes {
+		if _, ok := inlineValue(node.Value, false); !ok || len(node.LeadingComments) > 0 ||
+			node.InlineComment != "" || len(node.TrailingComments) > 0 || !canFlow(node.Children) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFlow writes nodes and their descendants between braces, preceded by
+// a space.
+func writeFlow(buf *bytes.Buffer, nodes []*Node) {
+	buf.WriteString(" {")
+	for _, node := range nodes {
+		buf.WriteByte(' ')
+		writeName(buf, node.Name)
+		text, _ := inlineValue(node.Value, node.HasValue)
+		buf.WriteString(text)
+		if len(node.Children) > 0 {
+			writeFlow(buf, node.Children)
+		}
+	}
+	buf.WriteString(" }")
+}
+
+// inlineValue returns the "=value" or "=\"value\"" text for writing value on
+// a node's line, or "" for an empty value unless explicit is set. It reports
+// false if the value contains a quote or newline and cannot be written inline.
+func inlineValue(value string, explicit bool) (string, bool) {
+	switch {
+	case value == "" && explicit:
+		return `=""`, true
+	case value == "":
+		return "", true
+	case strings.ContainsAny(value, "\"\n"):
+		return "", false
+	case strings.ContainsAny(value, " \t"):
+		return `="` + value + `"`, true
+	default:
+		return "=" + value, true
+	}
+}
+
+// canHeredoc reports whether value can be written as a heredoc block closed
+// by delim, which requires that no line of the value equals the delimiter.
+func canHeredoc(value, delim string) bool {
+	for _, l := range strings.Split(value, "\n") {
+		if strings.TrimSpace(l) == delim {
+			return false
+		}
+	}
+	return true
+}
+
+// needsQuotes reports whether a single-line value must be written in the
+// quoted form to survive a round trip. Colon values are trimmed on parse, so
+// values with leading or trailing whitespace are quoted when they contain no
+// quote character of their own. Those that do are written as continuation
+// lines instead.
+func needsQuotes(value string) bool {
+	return value != strings.TrimSpace(value) && !strings.Contains(value, `"`)
+}
+
+// continues reports whether a value is written as continuation lines: it
+// spans lines, it has leading or trailing whitespace and a quote character,
+// which rules out the quoted form, or it would read back as a heredoc marker.
+func continues(value string) bool {
+	return strings.Contains(value, "\n") ||
+		value != strings.TrimSpace(value) && strings.Contains(value, `"`) ||
+		heredocMarker(value) != ""
+}
+
+// writeIndent writes the indentation for the given depth.
+func writeIndent(buf *bytes.Buffer, depth int) {
+	for i := 0; i < depth*2; i++ {
+		buf.WriteByte(' ')
+	}
+}
+
+// writeName writes a node or attribute name, escaping any ":" and "="
+// separators as read back by ParseOptions.EscapedNames.
+func writeName(buf *bytes.Buffer, name string) {
+	buf.WriteString(escapeName(name))
+}
+
+// escapeName returns name with any ":" and "=" separators escaped.
+func escapeName(name string) string {
+	if strings.ContainsAny(name, ":=") {
+		return nameEscaper.Replace(name)
+	}
+	return name
+}
+
+// writesColon reports whether serializeNode writes a ":" directly after the
+// name of node, for a colon or heredoc value.
+func writesColon(node *Node) bool {
+	if node.Heredoc != "" && canHeredoc(node.Value, node.Heredoc) {
+		return true
+	}
+	if continues(node.Value) || node.Value == "" && !node.HasValue {
+		return false
+	}
+	attrs, _ := splitAttributes(node, false)
+	return len(attrs) == 0 && !needsQuotes(node.Value)
+}
+
+// alignWidth returns the column to which AlignValues pads the names of
+// siblings written with a colon: the width of the longest such name.
+func alignWidth(siblings []*Node) int {
+	width := 0
+	for _, node := range siblings {
+		if node != nil && writesColon(node) {
+			width = max(width, len(escapeName(node.Name)))
+		}
+	}
+	return width
+}
+
+// writeComment writes a comment of node with its "//" marker, spaced as
+// parsed.
+func writeComment(buf *bytes.Buffer, node *Node, comment string) {
+	buf.WriteString("//")
+	if raw, ok := node.spacing[comment]; ok {
+		buf.WriteString(raw)
+	} else if comment != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(comment)
+	}
+}
+
+// UnmarshalOptions configures UnmarshalWith. The zero value matches Unmarshal.
+type UnmarshalOptions struct {
+	// NumericBools accepts "1" and "0" as true and false for bool fields.
+	NumericBools bool
+
+	// Lenient keeps going after a field fails to convert, populating every
+	// valid field and returning all failures joined with errors.Join.
+	Lenient bool
+
+	// StrictNumbers makes an empty value for a numeric field an error
+	// instead of leaving the field zero. A pointer to a number is left nil
+	// instead, so optional numbers remain possible.
+	StrictNumbers bool
+
+	// UnknownHandler, if set, is called for each node that no struct field
+	// reads, such as a misspelled or obsolete setting, with its path as
+	// given by Document.Walk. The children of an unknown node are not
+	// reported separately. Attributes are unknown unless a field has the
+	// attrs tag option. A struct with a field tagged rest has no unknown
+	// nodes.
+	UnknownHandler func(path string, node *Node)
+}
+
+// decoder holds the state of a single unmarshal.
+type decoder struct {
+	opts  UnmarshalOptions
+	paths map[*Node]string // document paths, when reporting unknown nodes
+}
+
+// Marshaler is implemented by types that encode themselves as a single BML
+// value. It takes precedence over the stringer tag option and the value's
+// kind.
+type Marshaler interface {
+	MarshalBML() (string, error)
+}
+
+// Unmarshaler is implemented by types that decode themselves from a single
+// BML value. The value is trimmed of surrounding whitespace unless the field
+// has the raw tag option.
+type Unmarshaler interface {
+	UnmarshalBML(value string) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// enum holds the names of a type registered with RegisterEnum.
+type enum struct {
+	values map[string]int64
+	names  map[int64]string
+}
+
+var (
+	enumsMu sync.RWMutex
+	enums   = make(map[reflect.Type]*enum)
+)
+
+// RegisterEnum registers the names of the values of an integer type, given
+// by an example value, so Unmarshal reads fields of that type by name and
+// Marshal writes them by name:
+//
+//	bml.RegisterEnum(Driver(0), map[string]int64{"Metal": 1, "OpenGL": 2})
+//
+// Unmarshal fails on a name not in mapping, and Marshal on a value without
+// a name, including an unsigned value above math.MaxInt64, which mapping
+// cannot hold. When several names share a value, Marshal writes the first in
+// sorted order. Registering a type again replaces its names. A Marshaler or
+// Unmarshaler takes precedence. RegisterEnum panics if example is not an
+// integer.
+func RegisterEnum(example interface{}, mapping map[string]int64) {
+	t := reflect.TypeOf(example)
+	if t == nil || !isInteger(t.Kind()) {
+		panic(fmt.Sprintf("bml: RegisterEnum requires an integer type, not %v", t))
+	}
+
+	e := &enum{values: make(map[string]int64, len(mapping)), names: make(map[int64]string, len(mapping))}
+	for name, value := range mapping {
+		e.values[name] = value
+		if prev, ok := e.names[value]; !ok || name < prev {
+			e.names[value] = name
+		}
+	}
+
+	enumsMu.Lock()
+	defer enumsMu.Unlock()
+	enums[t] = e
+}
+
+// enumOf returns the names registered for t, or nil.
+func enumOf(t reflect.Type) *enum {
+	enumsMu.RLock()
+	defer enumsMu.RUnlock()
+	return enums[t]
+}
+
+// isInteger reports whether k is a signed or unsigned integer kind.
+func isInteger(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+var numberType = reflect.TypeOf(Number(""))
+
+// orderedMapType is implemented by every OrderedMap type.
+var orderedMapType = reflect.TypeOf((*interface{ orderedMap() })(nil)).Elem()
+
+// Unmarshal parses BML data and populates the struct pointed to by v.
+// Pointer fields are only allocated when their node exists, so a *bool field
+// distinguishes an absent setting (nil) from one set to false.
+//
+// Numeric fields accept values wrapped in extra characters when tagged with
+// the strip option, which lists characters to remove from both ends before
+// parsing: `bml:"Multiplier,strip=()"` reads "(2)" and `bml:"Latency,strip=ms"`
+// reads "20ms".
+//
+// A slice field tagged with the split option, as in
+// `bml:"Extensions,split=,"`, reads a single node holding a delimited list
+// instead of repeated nodes, as Node.List splits it. Marshal joins the
+// elements back with the same separator, and returns an error for elements
+// that would not read back: those containing the separator or surrounding
+// whitespace, or a lone empty element.
+//
+// A field tagged required, as in `bml:"Driver,required"`, is an error when
+// none of its names is present.
+//
+// A field tagged with a path, as in `bml:"Video/Driver"`, reads the node at
+// that path, and Marshal writes it there, sharing parent nodes with the
+// fields before it.
+//
+// A []*Node or map[string]*Node field tagged `bml:",rest"` receives copies of
+// the children that no other field reads, and Marshal writes them after the
+// other fields, so unknown settings pass through a round trip. A repeated
+// name is an error for a map, which holds one node per name.
+//
+// A time.Duration, alone or as a slice element or map value, is read in the
+// form written by Marshal, time.Duration.String, such as "1m30s". A plain
+// integer is read as nanoseconds.
+//
+// v may also point to a slice, for a document of repeated top-level nodes.
+// Each top-level node named after the element type, ignoring pointers,
+// becomes an element, so a []Game or []*Game reads the Game nodes. If the
+// element type has no name of its own, as for []string or a slice of an
+// anonymous struct, every top-level node becomes an element.
+func Unmarshal(data []byte, v interface{}) error {
+	return UnmarshalWith(data, v, UnmarshalOptions{})
+}
+
+// UnmarshalWith is like Unmarshal but uses the given options.
+func UnmarshalWith(data []byte, v interface{}, opts UnmarshalOptions) error {
+	doc, err := Parse(data)
+	if err != nil {
+		return err
+	}
+
+	d := &decoder{opts: opts}
+	if opts.UnknownHandler != nil {
+		d.paths = make(map[*Node]string)
+		doc.Walk(func(path string, n *Node) bool {
+			d.paths[n] = path
+			return true
+		})
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && !rv.IsNil() && isSliceField(rv.Elem()) {
+		return d.unmarshalRootSlice(doc.Root, rv.Elem())
+	}
+
+	rv, err := structTarget("Unmarshal", v)
+	if err != nil {
+		return err
+	}
+	return d.unmarshalNode(doc.Root, rv)
+}
+
+// unmarshalRootSlice fills the slice v with the top-level nodes named after
+// its element type, or with every top-level node if the element type is
+// unnamed or predeclared. Other top-level nodes are unknown.
+func (d *decoder) unmarshalRootSlice(root *Node, v reflect.Value) error {
+	elem := v.Type().Elem()
+	for elem.Kind() == reflect.Ptr {
+		elem = elem.Elem()
+	}
+
+	nodes := root.Children
+	if elem.PkgPath() != "" {
+		nodes = root.GetAll(elem.Name())
+		if d.opts.UnknownHandler != nil {
+			for _, child := range root.Children {
+				if child.Name != elem.Name() {
+					d.opts.UnknownHandler(d.paths[child], child)
+				}
+			}
+		}
+	}
+	return d.unmarshalSlice(nodes, v, fieldTag{name: elem.Name()})
+}
+
+// UnmarshalLenient is like Unmarshal but populates every field that converts
+// successfully and returns all field failures joined with errors.Join.
+func UnmarshalLenient(data []byte, v interface{}) error {
+	return UnmarshalWith(data, v, UnmarshalOptions{Lenient: true})
+}
+
+// ValidateAgainst reports every problem Unmarshal would find decoding data
+// into the struct pointed to by v, such as values that do not convert and
+// missing required nodes, without modifying v. Returns nil if data would
+// unmarshal cleanly.
+func ValidateAgainst(data []byte, v interface{}) []error {
+	doc, err := Parse(data)
+	if err != nil {
+		return []error{err}
+	}
+
+	rv, err := structTarget("ValidateAgainst", v)
+	if err != nil {
+		return []error{err}
+	}
+
+	// Decode into a scratch value of the same type, collecting every failure
+	d := &decoder{opts: UnmarshalOptions{Lenient: true}}
+	if err := d.unmarshalNode(doc.Root, reflect.New(rv.Type()).Elem()); err != nil {
+		return err.(interface{ Unwrap() []error }).Unwrap()
+	}
+	return nil
+}
+
+// UnmarshalNode populates the struct pointed to by v from an arbitrary node,
+// such as a section returned by Get. A nil node leaves v unchanged.
+func UnmarshalNode(n *Node, v interface{}) error {
+	rv, err := structTarget("UnmarshalNode", v)
+	if err != nil {
+		return err
+	}
+
+	d := &decoder{}
+	return d.unmarshalNode(n, rv)
+}
+
+// structTarget validates that v is a non-nil pointer to a struct and returns
+// the struct value. fn names the calling function in error messages.
+func structTarget(fn string, v interface{}) (reflect.Value, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return reflect.Value{}, fmt.Errorf("bml: %s requires a pointer", fn)
+	}
+	if rv.IsNil() {
+		return reflect.Value{}, fmt.Errorf("bml: %s requires a non-nil pointer", fn)
+	}
+
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return reflect.Value{}, fmt.Errorf("bml: %s requires a pointer to a struct", fn)
+	}
+	return rv, nil
+}
+
+// unmarshalNode populates a struct value from a BML node.
+func (d *decoder) unmarshalNode(node *Node, v reflect.Value) error {
+	if node == nil {
+		return nil
+	}
+
+	var errs []error
+	known := make(map[string]bool) // names read by fields
+	attrs := false
+	var rest reflect.Value // the field tagged rest, if any
+	var restName string
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := t.Field(i)
+
+		// Skip unexported fields
+		if !field.CanSet() {
+			continue
+		}
+
+		// Get the bml tag
+		tag := parseTag(fieldType.Tag.Get("bml"))
+		if tag.rest {
+			rest, restName = field, fieldType.Name
+			continue
+		}
+		if tag.name == "" && !tag.attrs {
+			continue
+		}
+		// A path such as "Video/Driver" reads through the child Video
+		known[firstSegment(tag.name)] = true
+		for _, alias := range tag.aliases {
+			known[firstSegment(alias)] = true
+		}
+		attrs = attrs || tag.attrs
+
+		var err error
+		if tag.attrs {
+			err = unmarshalAttrs(node, field)
+		} else if tag.required && tag.find(node) == nil {
+			err = fmt.Errorf("required node %s is missing", tag.name)
+		} else if (isSliceField(field) || isSlicePtr(field)) && tag.hasSplit {
+			var nodes []*Node
+			if nodes, err = tag.splitNodes(tag.find(node)); err == nil {
+				err = d.unmarshalSlice(nodes, field, tag)
+			}
+		} else if isSliceField(field) || isSlicePtr(field) {
+			err = d.unmarshalSlice(tag.findAll(node), field, tag)
+		} else {
+			// Find the corresponding BML node
+			err = d.unmarshalValue(tag.find(node), field, tag)
+		}
+		if err != nil {
+			if !d.opts.Lenient {
+				return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			}
+			errs = append(errs, fieldErrors(fieldType.Name, err)...)
+		}
+	}
+
+	// Children no field reads go to the rest field or the unknown handler
+	var unknown []*Node
+	for _, child := range node.Children {
+		if !known[child.Name] && !(child.IsAttr && attrs) {
+			unknown = append(unknown, child)
+		}
+	}
+	if rest.IsValid() {
+		if err := unmarshalRest(unknown, rest); err != nil {
+			if !d.opts.Lenient {
+				return fmt.Errorf("field %s: %w", restName, err)
+			}
+			errs = append(errs, fmt.Errorf("field %s: %w", restName, err))
+		}
+	} else if d.opts.UnknownHandler != nil {
+		for _, child := range unknown {
+			d.opts.UnknownHandler(d.paths[child], child)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// firstSegment returns the first non-empty segment of a slash-delimited
+// path, the name of the child that Node.Get looks up first.
+func firstSegment(path string) string {
+	name, _, _ := strings.Cut(strings.TrimLeft(path, "/"), "/")
+	return name
+}
+
+// unmarshalRest stores copies of nodes in v, a field with the rest tag option,
+// which must be a []*Node or a map[string]*Node keyed by node name. A map
+// cannot hold two nodes of the same name, so a repeated name is an error.
+// Without nodes, v is left unchanged.
+func unmarshalRest(nodes []*Node, v reflect.Value) error {
+	if v.Type() != nodesType && v.Type() != nodeMapType {
+		return fmt.Errorf("rest requires []*Node or map[string]*Node, not %s", v.Type())
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	if v.Type() == nodesType {
+		copies := make([]*Node, len(nodes))
+		for i, n := range nodes {
+			copies[i] = n.Clone()
+		}
+		v.Set(reflect.ValueOf(copies))
+		return nil
+	}
+	m := make(map[string]*Node, len(nodes))
+	for _, n := range nodes {
+		if _, ok := m[n.Name]; ok {
+			return fmt.Errorf("rest map cannot hold more than one node named %q", n.Name)
+		}
+		m[n.Name] = n.Clone()
+	}
+	v.Set(reflect.ValueOf(m))
+	return nil
+}
+
+// unmarshalAttrs copies the attribute children of node into v, which must be
+// a map[string]string. Attributes also bound to named fields are included.
+func unmarshalAttrs(node *Node, v reflect.Value) error {
+	if v.Type() != attrsType {
+		return fmt.Errorf("attrs requires map[string]string, not %s", v.Type())
+	}
+	for _, child := range node.Children {
+		if !child.IsAttr {
+			continue
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(attrsType))
+		}
+		v.SetMapIndex(reflect.ValueOf(child.Name), reflect.ValueOf(child.Value))
+	}
+	return nil
+}
+
+// isSliceField reports whether v is a slice whose elements are encoded as
+// repeated nodes, rather than a slice type implementing Marshaler or
+// Unmarshaler itself.
+func isSliceField(v reflect.Value) bool {
+	if v.Kind() != reflect.Slice || v.Type().Implements(orderedMapType) {
+		return false
+	}
+	if _, ok := marshalerOf(v); ok {
+		return false
+	}
+	if v.CanAddr() {
+		if _, ok := v.Addr().Interface().(Unmarshaler); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isSlicePtr reports whether v is a pointer to a slice whose elements are
+// encoded as repeated nodes, as for isSliceField.
+func isSlicePtr(v reflect.Value) bool {
+	return v.Kind() == reflect.Ptr && v.Type().Elem().Kind() == reflect.Slice &&
+		isSliceField(reflect.New(v.Type().Elem()).Elem())
+}
+
+// unmarshalSlice sets v, a slice or pointer to a slice, to a slice with one
+// element per node. v is left unchanged if there are no nodes.
+func (d *decoder) unmarshalSlice(nodes []*Node, v reflect.Value, tag fieldTag) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		ptr := reflect.New(v.Type().Elem())
+		if err := d.unmarshalSlice(nodes, ptr.Elem(), tag); err != nil {
+			return err
+		}
+		v.Set(ptr)
+		return nil
+	}
+
+	slice := reflect.MakeSlice(v.Type(), len(nodes), len(nodes))
+	for i, node := range nodes {
+		if err := d.unmarshalValue(node, slice.Index(i), tag); err != nil {
+			return fmt.Errorf("element %d: %w", i, err)
+		}
+	}
+	v.Set(slice)
+	return nil
+}
+
+// unmarshalMap adds an entry to v for each child of node, keyed by the child's
+// name converted to the key type, which must be a string or integer. Children
+// sharing a name fill a slice value, as written by MarshalValue; otherwise
+// the last one wins.
+func (d *decoder) unmarshalMap(node *Node, v reflect.Value) error {
+	keyType, elemType := v.Type().Key(), v.Type().Elem()
+	switch keyType.Kind() {
+	case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		return fmt.Errorf("map keys must be strings or integers, not %s", keyType)
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), len(node.Children)))
+	}
+
+	done := make(map[string]bool)
+	for _, child := range node.Children {
+		key := reflect.New(keyType).Elem()
+		if err := setKey(key, child.Name); err != nil {
+			return fmt.Errorf("key %s: %w", child.Name, err)
+		}
+
+		elem := reflect.New(elemType).Elem()
+		var err error
+		if isSliceField(elem) {
+			if done[child.Name] {
+				continue
+			}
+			done[child.Name] = true
+			err = d.unmarshalSlice(node.GetAll(child.Name), elem, fieldTag{name: child.Name})
+		} else {
+			err = d.unmarshalValue(child, elem, fieldTag{name: child.Name})
+		}
+		if err != nil {
+			return fmt.Errorf("key %s: %w", child.Name, err)
+		}
+		v.SetMapIndex(key, elem)
+	}
+	return nil
+}
+
+// unmarshalOrderedMap appends an entry to the OrderedMap v for each child of
+// node, in document order. A repeated name updates the entry of the first.
+func (d *decoder) unmarshalOrderedMap(node *Node, v reflect.Value) error {
+	index := make(map[string]int, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		index[v.Index(i).Field(0).String()] = i
+	}
+
+	done := make(map[string]bool)
+	for _, child := range node.Children {
+		i, ok := index[child.Name]
+		if !ok {
+			i = v.Len()
+			index[child.Name] = i
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			v.Index(i).Field(0).SetString(child.Name)
+		}
+
+		elem := v.Index(i).Field(1)
+		var err error
+		if isSliceField(elem) {
+			if done[child.Name] {
+				continue
+			}
+			done[child.Name] = true
+			elem.Set(reflect.Zero(elem.Type()))
+			err = d.unmarshalSlice(node.GetAll(child.Name), elem, fieldTag{name: child.Name})
+		} else {
+			err = d.unmarshalValue(child, elem, fieldTag{name: child.Name})
+		}
+		if err != nil {
+			return fmt.Errorf("key %s: %w", child.Name, err)
+		}
+	}
+	return nil
+}
+
+// setKey sets the string or integer map key v from a node name.
+func setKey(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(name, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("cannot parse %q as %s: %w", name, v.Type(), err)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(name, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("cannot parse %q as %s: %w", name, v.Type(), err)
+		}
+		v.SetUint(u)
+	default:
+		v.SetString(name)
+	}
+	return nil
+}
+
+// fieldErrors prefixes err with the field name. Joined errors from nested
+// structs are prefixed individually so every message carries its full path.
+func fieldErrors(name string, err error) []error {
+	var errs []error
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	} else {
+		errs = []error{err}
+	}
+
+	wrapped := make([]error, len(errs))
+	for i, e := range errs {
+		wrapped[i] = fmt.Errorf("field %s: %w", name, e)
+	}
+	return wrapped
+}
+
+// unmarshalValue sets a reflect.Value from a BML node. Values are trimmed of
+// surrounding whitespace unless the tag has the raw option.
+func (d *decoder) unmarshalValue(node *Node, v reflect.Value, tag fieldTag) error {
+	// Handle pointer types
+	if v.Kind() == reflect.Ptr {
+		if node == nil {
+			return nil // Leave as nil
+		}
+		if v.IsNil() {
+			if d.opts.StrictNumbers && isNumber(v.Type().Elem()) && tag.number(node.Value) == "" {
+				return nil // Leave an empty optional number as nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.unmarshalValue(node, v.Elem(), tag)
+	}
+
+	if node == nil {
+		return nil // Leave as zero value
+	}
+
+	text := strings.TrimSpace(node.Value)
+	if tag.raw {
+		text = node.Value
+	}
+
+	if v.CanAddr() {
+		if u, ok := v.Addr().Interface().(Unmarshaler); ok {
+			return u.UnmarshalBML(text)
+		}
+	}
+
+	if e := enumOf(v.Type()); e != nil {
+		return d.unmarshalEnum(e, text, v)
+	}
+	if v.Type() == durationType {
+		return d.unmarshalDuration(node, v, tag)
+	}
+	if v.Type() == numberType {
+		val := tag.number(node.Value)
+		if val == "" {
+			return d.emptyNumber()
+		}
+		if _, err := parseFloat(val); err != nil {
+			return fmt.Errorf("cannot parse %q as number: %w", val, err)
+		}
+		v.SetString(val)
+		return nil
+	}
+	if v.Type().Implements(orderedMapType) {
+		return d.unmarshalOrderedMap(node, v)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+
+	case reflect.Bool:
+		b, _ := parseBool(strings.TrimSpace(node.Value), d.opts.NumericBools)
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		val := tag.number(node.Value)
+		if val == "" {
+			return d.emptyNumber()
+		}
+		i, err := strconv.ParseInt(stripDigitSeparators(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse %q as int: %w", val, err)
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		val := tag.number(node.Value)
+		if val == "" {
+			return d.emptyNumber()
+		}
+		u, err := strconv.ParseUint(stripDigitSeparators(val), 10, 64)
+		if err != nil {
+			return fmt.Errorf("cannot parse %q as uint: %w", val, err)
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		val := tag.number(node.Value)
+		if val == "" {
+			return d.emptyNumber()
+		}
+		f, err := parseFloat(val)
+		if err != nil {
+			return fmt.Errorf("cannot parse %q as float: %w", val, err)
+		}
+		v.SetFloat(f)
+
+	case reflect.Struct:
+		return d.unmarshalNode(node, v)
+
+	case reflect.Map:
+		return d.unmarshalMap(node, v)
+
+	default:
+		return fmt.Errorf("unsupported type: %s", v.Kind())
+	}
+
+	return nil
+}
+
+// unmarshalDuration sets a time.Duration from a value such as "1m30s". A plain
+// integer is read as nanoseconds, the encoding of a bare int64.
+func (d *decoder) unmarshalDuration(node *Node, v reflect.Value, tag fieldTag) error {
+	val := tag.number(node.Value)
+	if val == "" {
+		return d.emptyNumber()
+	}
+	if i, err := strconv.ParseInt(stripDigitSeparators(val), 10, 64); err == nil {
+		v.SetInt(i)
+		return nil
+	}
+	dur, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("cannot parse %q as duration: %w", val, err)
+	}
+	v.SetInt(int64(dur))
+	return nil
+}
+
+// unmarshalEnum sets v, a type registered with RegisterEnum, from the value
+// of the name text.
+func (d *decoder) unmarshalEnum(e *enum, text string, v reflect.Value) error {
+	if text == "" {
+		return d.emptyNumber()
+	}
+	value, ok := e.values[text]
+	if !ok {
+		return fmt.Errorf("unknown %s name %q", v.Type(), text)
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(value) {
+			return fmt.Errorf("value %d of %q overflows %s", value, text, v.Type())
+		}
+		v.SetInt(value)
+	default:
+		if value < 0 || v.OverflowUint(uint64(value)) {
+			return fmt.Errorf("value %d of %q overflows %s", value, text, v.Type())
+		}
+		v.SetUint(uint64(value))
+	}
+	return nil
+}
+
+// emptyNumber returns the result of decoding an empty numeric value, an
+// error under UnmarshalOptions.StrictNumbers.
+func (d *decoder) emptyNumber() error {
+	if d.opts.StrictNumbers {
+		return errors.New("empty value for a number")
+	}
+	return nil
+}
+
+// isNumber reports whether t is an integer, floating-point or Number type
+// decoded as a number rather than by an Unmarshaler.
+func isNumber(t reflect.Type) bool {
+	if t == numberType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return !reflect.PointerTo(t).Implements(unmarshalerType)
+	}
+	return false
+}
+
+// Marshal converts a struct to BML format.
+//
+// Fields are written in declaration order unless they have an order tag
+// option, as in `bml:"Driver,order=1"`. Fields with an order come first,
+// sorted by it, followed by the others in declaration order. A bool field
+// tagged omitfalse, as in `bml:"Fast,omitfalse"`, is written only when true.
+//
+// A field tagged omitempty is skipped when it holds its zero value, such as
+// "" or 0, or when it is a struct or map, directly or through a non-nil
+// pointer, that writes nothing. Without omitempty, a non-nil pointer to an
+// empty struct is written as a section with no children.
+//
+// A field tagged attr, as in `bml:"width,attr"`, is written as an attribute
+// on its parent's line, in field order, ahead of the block children written
+// beneath it, and Unmarshal reads such a field only from attributes. It is an
+// error if an attr field is written with children, as a struct is, or with
+// a value holding a quote or a newline, or if it is a field of v itself,
+// since the top level of a document has no line to hold attributes.
+func Marshal(v interface{}) ([]byte, error) {
+	doc, err := marshalDocument("Marshal", v)
+	if err != nil {
+		return nil, err
+	}
+
+	return Serialize(doc), nil
+}
+
+// MarshalSafe is like Marshal but checks that its output parses back to the
+// same names and values, returning an error naming the first path that does
+// not, such as a value whose surrounding whitespace cannot be preserved. The
+// check parses and compares the whole output, which makes MarshalSafe several
+// times slower than Marshal.
+func MarshalSafe(v interface{}) ([]byte, error) {
+	doc, err := marshalDocument("MarshalSafe", v)
+	if err != nil {
+		return nil, err
+	}
+
+	data := Serialize(doc)
+	parsed, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("bml: MarshalSafe output does not parse: %w", err)
+	}
+
+	if changes := Diff(doc, parsed); len(changes) > 0 {
+		return nil, fmt.Errorf("bml: MarshalSafe: %s does not survive serialization", changes[0].Path)
+	}
+	return data, nil
+}
+
+// Drift reports how data, a BML file, deviates from the file Marshal would
+// produce for v: the changes that would turn data into the marshaled form of
+// v, as returned by Diff. It returns no changes for a file in the desired
+// state, whatever its comments or formatting.
+func Drift(data []byte, v interface{}) ([]Change, error) {
+	doc, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	marshaled, err := marshalDocument("Drift", v)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(doc, marshaled), nil
+}
+
+// MarshalNode converts a struct to an unnamed node whose children are the
+// struct's fields, ready to be spliced into an existing document.
+func MarshalNode(v interface{}) (*Node, error) {
+	return marshalRoot("MarshalNode", v)
+}
+
+// SetStruct marshals v, a struct or pointer to struct, and installs its
+// fields as the children of the node at path, creating the node if needed.
+// Existing children of the node are replaced; its value is kept.
+func (d *Document) SetStruct(path string, v interface{}) error {
+	if d == nil {
+		return errors.New("bml: SetStruct requires a non-nil document")
+	}
+	root, err := marshalRoot("SetStruct", v)
+	if err != nil {
+		return err
+	}
+	if d.Root == nil {
+		d.Root = &Node{}
+	}
+	d.Root.Ensure(path).Children = root.Children
+	return nil
+}
+
+// marshalRoot converts a struct or pointer to struct into an unnamed node.
+// fn names the calling function in error messages.
+func marshalRoot(fn string, v interface{}) (*Node, error) {
+	rv := reflect.ValueOf(v)
+
+	// Dereference pointer if needed
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("bml: %s requires a non-nil value", fn)
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("bml: %s requires a struct or pointer to struct", fn)
+	}
+
+	root := &Node{}
+	if err := marshalStruct(rv, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// marshalDocument converts a struct or pointer to struct into a document.
+// Its fields become top-level nodes, so none may have the attr tag option.
+// fn names the calling function in error messages.
+func marshalDocument(fn string, v interface{}) (*Document, error) {
+	root, err := marshalRoot(fn, v)
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.Indirect(reflect.ValueOf(v)).Type()
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.IsExported() && parseTag(field.Tag.Get("bml")).attr {
+			return nil, fmt.Errorf("bml: %s: field %s: attr requires a parent node, not the top level", fn, field.Name)
+		}
+	}
+	return &Document{Root: root}, nil
+}
+
+// marshalStruct converts a struct to BML nodes and adds them as children of parent.
+func marshalStruct(v reflect.Value, parent *Node) error {
+	t := v.Type()
+
+	// Collect the nodes of each field so they can be sorted by order
+	type group struct {
+		tag   fieldTag
+		nodes []*Node
+	}
+	var groups []group
+	var rest []*Node // nodes of the field tagged rest, written last
+
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		fieldType := t.Field(i)
+
+		// Skip unexported fields
+		if !fieldType.IsExported() {
+			continue
+		}
+
+		// Get the bml tag
+		tag := parseTag(fieldType.Tag.Get("bml"))
+		if tag.rest {
+			nodes, err := marshalRest(field)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			}
+			rest = append(rest, nodes...)
+			continue
+		}
+		if tag.name == "" && !tag.attrs {
+			continue
+		}
+
+		if tag.attrs {
+			attrs, err := marshalAttrs(field)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			}
+			groups = append(groups, group{tag, attrs})
+			continue
+		}
+
+		// A pointer to a slice is skipped when nil, like other pointers
+		if isSlicePtr(field) {
+			if field.IsNil() {
+				continue
+			}
+			field = field.Elem()
+		}
+
+		g := group{tag: tag}
+		if isSliceField(field) && tag.hasSplit {
+			node, err := marshalSplit(field, tag)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			}
+			if node != nil {
+				g.nodes = append(g.nodes, node)
+			}
+		} else if isSliceField(field) {
+			for j := 0; j < field.Len(); j++ {
+				node, err := marshalValue(field.Index(j), tag)
+				if err != nil {
+					return fmt.Errorf("field %s: element %d: %w", fieldType.Name, j, err)
+				}
+				if node != nil {
+					g.nodes = append(g.nodes, node)
+				}
+			}
+		} else {
+			node, err := marshalValue(field, tag)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			}
+			if node != nil && !(tag.omitEmpty && isEmptyField(field, node)) {
+				g.nodes = append(g.nodes, node)
+			}
+		}
+
+		// Attribute fields are written on the parent's line
+		if tag.attr {
+			for _, node := range g.nodes {
+				if !canInline(node) {
+					return fmt.Errorf("field %s: attr requires a value that fits on one line", fieldType.Name)
+				}
+				node.IsAttr = true
+			}
+		}
+		groups = append(groups, g)
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		a, b := groups[i].tag, groups[j].tag
+		return a.ordered && (!b.ordered || a.order < b.order)
+	})
+	for _, g := range groups {
+		for _, node := range g.nodes {
+			addPath(parent, node)
 		}
 	}
+	parent.Children = append(parent.Children, rest...)
 
-	return false
+	return nil
 }
 
-// Serialize converts a Document back to BML format.
-func Serialize(doc *Document) []byte {
-	if doc == nil || doc.Root == nil {
-		return nil
-	}
-
-	var buf bytes.Buffer
-	for _, child := range doc.Root.Children {
-		serializeNode(child, 0, &buf)
+// addPath adds node as a child of parent. A node named by a path, from a tag
+// such as `bml:"Video/Driver"`, is renamed to the last segment and added
+// beneath the nodes named by the others, which are created as needed and
+// shared with earlier fields.
+func addPath(parent *Node, node *Node) {
+	if strings.Contains(node.Name, "/") {
+		segments := strings.FieldsFunc(node.Name, func(r rune) bool { return r == '/' })
+		if n := len(segments); n > 0 {
+			for _, segment := range segments[:n-1] {
+				parent = parent.ensureChild(segment, false)
+			}
+			node.Name = segments[n-1]
+		}
 	}
-	return buf.Bytes()
+	parent.Children = append(parent.Children, node)
 }
 
-// serializeNode writes a node and its children to the buffer.
-func serializeNode(node *Node, depth int, buf *bytes.Buffer) {
-	if node == nil {
-		return
+// isEmptyField reports whether the field v, marshaled as node, is skipped by
+// the omitempty tag option: a struct, map, or OrderedMap, directly or through
+// a pointer, that writes no value or children, or any other zero value.
+func isEmptyField(v reflect.Value, node *Node) bool {
+	e := v
+	for e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface {
+		e = e.Elem()
 	}
-
-	// Write indentation
-	for i := 0; i < depth*2; i++ {
-		buf.WriteByte(' ')
+	if e.Kind() == reflect.Struct || e.Kind() == reflect.Map || e.Type().Implements(orderedMapType) {
+		return node.Value == "" && len(node.Children) == 0
 	}
+	return v.IsZero()
+}
 
-	// Write name
-	buf.WriteString(node.Name)
-
-	// Write value
-	if node.Value != "" {
-		// Check for multiline values
-		if strings.Contains(node.Value, "\n") {
-			buf.WriteByte('\n')
-			lines := strings.Split(node.Value, "\n")
-			for _, line := range lines {
-				for i := 0; i < (depth+1)*2; i++ {
-					buf.WriteByte(' ')
-				}
-				buf.WriteString(": ")
-				buf.WriteString(line)
-				buf.WriteByte('\n')
+// marshalRest returns copies of the nodes of v, a field with the rest tag
+// option. Nodes of a map are named by their keys and written in key order.
+func marshalRest(v reflect.Value) ([]*Node, error) {
+	var nodes []*Node
+	switch rest := v.Interface().(type) {
+	case []*Node:
+		for _, n := range rest {
+			if n != nil {
+				nodes = append(nodes, n.Clone())
 			}
-		} else {
-			buf.WriteString(": ")
-			buf.WriteString(node.Value)
-			buf.WriteByte('\n')
 		}
-	} else {
-		buf.WriteByte('\n')
-	}
-
-	// Write children (skip if we just wrote multiline value)
-	if !strings.Contains(node.Value, "\n") || node.Value == "" {
-		for _, child := range node.Children {
-			serializeNode(child, depth+1, buf)
+	case map[string]*Node:
+		keys := make([]string, 0, len(rest))
+		for key := range rest {
+			keys = append(keys, key)
 		}
-	} else {
-		// For multiline values, children come after the value lines
-		for _, child := range node.Children {
-			serializeNode(child, depth+1, buf)
+		sort.Strings(keys)
+		for _, key := range keys {
+			if n := rest[key]; n != nil {
+				c := n.Clone()
+				c.Name = key
+				nodes = append(nodes, c)
+			}
 		}
+	default:
+		return nil, fmt.Errorf("rest requires []*Node or map[string]*Node, not %s", v.Type())
 	}
+	return nodes, nil
 }
 
-// Unmarshal parses BML data and populates the struct pointed to by v.
-func Unmarshal(data []byte, v interface{}) error {
-	doc, err := Parse(data)
-	if err != nil {
-		return err
-	}
-
-	rv := reflect.ValueOf(v)
-	if rv.Kind() != reflect.Ptr {
-		return errors.New("bml: Unmarshal requires a pointer")
+// marshalSplit converts a slice to a single node whose value joins the
+// elements with the separator of the split tag option. It returns nil for
+// an empty slice.
+func marshalSplit(v reflect.Value, tag fieldTag) (*Node, error) {
+	if tag.split == "" {
+		return nil, errors.New("split requires a separator")
 	}
-	if rv.IsNil() {
-		return errors.New("bml: Unmarshal requires a non-nil pointer")
+	var items []string
+	for i := 0; i < v.Len(); i++ {
+		node, err := marshalValue(v.Index(i), tag)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		if node == nil {
+			continue
+		}
+		if len(node.Children) > 0 || strings.Contains(node.Value, tag.split) {
+			return nil, fmt.Errorf("element %d: split requires values without %q", i, tag.split)
+		}
+		// Elements are trimmed when read back
+		if node.Value != strings.TrimSpace(node.Value) {
+			return nil, fmt.Errorf("element %d: split requires values without surrounding whitespace", i)
+		}
+		items = append(items, node.Value)
 	}
-
-	rv = rv.Elem()
-	if rv.Kind() != reflect.Struct {
-		return errors.New("bml: Unmarshal requires a pointer to a struct")
+	switch {
+	case len(items) == 0:
+		return nil, nil
+	case len(items) == 1 && items[0] == "":
+		// An empty value reads back as an empty slice
+		return nil, errors.New("split cannot write a single empty element")
 	}
-
-	return unmarshalNode(doc.Root, rv)
+	return &Node{Name: tag.name, Value: strings.Join(items, tag.split)}, nil
 }
 
-// unmarshalNode populates a struct value from a BML node.
-func unmarshalNode(node *Node, v reflect.Value) error {
-	if node == nil {
-		return nil
+// marshalValue converts a reflect.Value to a BML node. A Marshaler takes
+// precedence over the stringer tag option, which takes precedence over the
+// value's kind.
+func marshalValue(v reflect.Value, tag fieldTag) (*Node, error) {
+	// Handle pointer and interface types
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil // Skip nil pointers
+		}
+		return marshalValue(v.Elem(), tag)
 	}
 
-	t := v.Type()
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		fieldType := t.Field(i)
+	node := &Node{Name: tag.name}
 
-		// Skip unexported fields
-		if !field.CanSet() {
-			continue
+	if m, ok := marshalerOf(v); ok {
+		s, err := m.MarshalBML()
+		if err != nil {
+			return nil, err
 		}
+		node.Value = s
+		return node, nil
+	}
 
-		// Get the bml tag
-		tag := fieldType.Tag.Get("bml")
-		if tag == "" {
-			continue
+	if e := enumOf(v.Type()); e != nil {
+		// Unsigned values above math.MaxInt64 cannot have been registered
+		var name, value string
+		var ok bool
+		if v.CanInt() {
+			name, ok = e.names[v.Int()]
+			value = strconv.FormatInt(v.Int(), 10)
+		} else {
+			if u := v.Uint(); u <= math.MaxInt64 {
+				name, ok = e.names[int64(u)]
+			}
+			value = strconv.FormatUint(v.Uint(), 10)
 		}
-
-		// Find the corresponding BML node
-		childNode := node.Get(tag)
-
-		if err := unmarshalValue(childNode, field); err != nil {
-			return fmt.Errorf("field %s: %w", fieldType.Name, err)
+		if !ok {
+			return nil, fmt.Errorf("no %s name for value %s", v.Type(), value)
 		}
+		node.Value = name
+		return node, nil
 	}
 
-	return nil
-}
-
-// unmarshalValue sets a reflect.Value from a BML node.
-func unmarshalValue(node *Node, v reflect.Value) error {
-	// Handle pointer types
-	if v.Kind() == reflect.Ptr {
-		if node == nil {
-			return nil // Leave as nil
-		}
-		if v.IsNil() {
-			v.Set(reflect.New(v.Type().Elem()))
+	if tag.stringer {
+		if s, ok := v.Interface().(fmt.Stringer); ok {
+			node.Value = s.String()
+			return node, nil
 		}
-		return unmarshalValue(node, v.Elem())
 	}
 
-	if node == nil {
-		return nil // Leave as zero value
+	if v.Type() == durationType {
+		node.Value = time.Duration(v.Int()).String()
+		return node, nil
+	}
+	if v.Type().Implements(orderedMapType) {
+		if err := marshalOrderedMap(v, node); err != nil {
+			return nil, err
+		}
+		return node, nil
 	}
 
 	switch v.Kind() {
 	case reflect.String:
-		v.SetString(strings.TrimSpace(node.Value))
+		node.Value = v.String()
 
 	case reflect.Bool:
-		val := strings.TrimSpace(node.Value)
-		v.SetBool(val == "true")
+		if v.Bool() {
+			node.Value = "true"
+		} else if tag.omitFalse {
+			return nil, nil // Absent reads back as false
+		} else {
+			node.Value = "false"
+		}
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		val := strings.TrimSpace(node.Value)
-		if val == "" {
-			return nil
-		}
-		i, err := strconv.ParseInt(val, 10, 64)
-		if err != nil {
-			return fmt.Errorf("cannot parse %q as int: %w", val, err)
-		}
-		v.SetInt(i)
+		node.Value = strconv.FormatInt(v.Int(), 10)
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		val := strings.TrimSpace(node.Value)
-		if val == "" {
-			return nil
-		}
-		u, err := strconv.ParseUint(val, 10, 64)
-		if err != nil {
-			return fmt.Errorf("cannot parse %q as uint: %w", val, err)
-		}
-		v.SetUint(u)
+		node.Value = strconv.FormatUint(v.Uint(), 10)
 
 	case reflect.Float32, reflect.Float64:
-		val := strings.TrimSpace(node.Value)
-		if val == "" {
-			return nil
-		}
-		f, err := strconv.ParseFloat(val, 64)
-		if err != nil {
-			return fmt.Errorf("cannot parse %q as float: %w", val, err)
+		// NaN and infinities would not read back
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%v is not a finite number", f)
 		}
-		v.SetFloat(f)
+		node.Value = strconv.FormatFloat(f, 'f', -1, 64)
 
 	case reflect.Struct:
-		return unmarshalNode(node, v)
+		if err := marshalStruct(v, node); err != nil {
+			return nil, err
+		}
+
+	case reflect.Map:
+		if err := marshalMap(v, node); err != nil {
+			return nil, err
+		}
 
 	default:
-		return fmt.Errorf("unsupported type: %s", v.Kind())
+		return nil, fmt.Errorf("unsupported type: %s", v.Kind())
 	}
 
-	return nil
+	return node, nil
 }
 
-// Marshal converts a struct to BML format.
-func Marshal(v interface{}) ([]byte, error) {
+// MarshalValue converts a struct, map, or slice to BML format. Structs are
+// marshaled as by Marshal. Map keys, which must be strings or integers,
+// become node names in sorted order. A slice value in a map or struct becomes one node per
+// element sharing the key, while a slice without a name of its own, at the
+// top level or directly inside another slice, becomes nodes named by index
+// ("0", "1", ...). Nil values are skipped.
+func MarshalValue(v interface{}) ([]byte, error) {
 	rv := reflect.ValueOf(v)
-
-	// Dereference pointer if needed
-	if rv.Kind() == reflect.Ptr {
-		if rv.IsNil() {
-			return nil, errors.New("bml: Marshal requires a non-nil value")
-		}
+	for (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) && !rv.IsNil() {
 		rv = rv.Elem()
 	}
 
-	if rv.Kind() != reflect.Struct {
-		return nil, errors.New("bml: Marshal requires a struct or pointer to struct")
-	}
-
 	root := &Node{}
-	if err := marshalStruct(rv, root); err != nil {
+	var err error
+	switch rv.Kind() {
+	case reflect.Struct:
+		err = marshalStruct(rv, root)
+	case reflect.Map:
+		err = marshalMap(rv, root)
+	case reflect.Slice:
+		root.Children, err = marshalIndexed(rv)
+	case reflect.Invalid, reflect.Ptr, reflect.Interface:
+		return nil, errors.New("bml: MarshalValue requires a non-nil value")
+	default:
+		return nil, fmt.Errorf("bml: MarshalValue requires a struct, map, or slice, not %s", rv.Kind())
+	}
+	if err != nil {
 		return nil, err
 	}
 
 	return Serialize(&Document{Root: root}), nil
 }
 
-// marshalStruct converts a struct to BML nodes and adds them as children of parent.
-func marshalStruct(v reflect.Value, parent *Node) error {
-	t := v.Type()
-
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-		fieldType := t.Field(i)
+// marshalMap converts a map with string or integer keys into children of
+// parent, in key order.
+func marshalMap(v reflect.Value, parent *Node) error {
+	keys := v.MapKeys()
+	switch v.Type().Key().Kind() {
+	case reflect.String:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		sort.Slice(keys, func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() })
+	default:
+		return fmt.Errorf("map keys must be strings or integers, not %s", v.Type().Key())
+	}
 
-		// Skip unexported fields
-		if !fieldType.IsExported() {
-			continue
+	for _, key := range keys {
+		name := keyName(key)
+		if !isValidName(name) {
+			return fmt.Errorf("invalid node name %q", name)
 		}
-
-		// Get the bml tag
-		tag := fieldType.Tag.Get("bml")
-		if tag == "" {
-			continue
+		nodes, err := marshalNamed(v.MapIndex(key), name)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", name, err)
 		}
+		parent.Children = append(parent.Children, nodes...)
+	}
+	return nil
+}
 
-		node, err := marshalValue(field, tag)
+// marshalOrderedMap converts the entries of the OrderedMap v into children of
+// parent, in slice order.
+func marshalOrderedMap(v reflect.Value, parent *Node) error {
+	for i := 0; i < v.Len(); i++ {
+		name := v.Index(i).Field(0).String()
+		if !isValidName(name) {
+			return fmt.Errorf("invalid node name %q", name)
+		}
+		nodes, err := marshalNamed(v.Index(i).Field(1), name)
 		if err != nil {
-			return fmt.Errorf("field %s: %w", fieldType.Name, err)
+			return fmt.Errorf("key %s: %w", name, err)
 		}
-		if node != nil {
-			parent.Children = append(parent.Children, node)
+		parent.Children = append(parent.Children, nodes...)
+	}
+	return nil
+}
+
+// keyName returns the node name for a string or integer map key.
+func keyName(key reflect.Value) string {
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(key.Uint(), 10)
+	}
+	return key.String()
+}
+
+// marshalNamed converts a value with the given name into nodes: one per
+// element for a slice, otherwise at most one.
+func marshalNamed(v reflect.Value, name string) ([]*Node, error) {
+	for (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	if !isSliceField(v) {
+		node, err := marshalValue(v, fieldTag{name: name})
+		if node == nil || err != nil {
+			return nil, err
 		}
+		return []*Node{node}, nil
 	}
 
-	return nil
+	var nodes []*Node
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		for (elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface) && !elem.IsNil() {
+			elem = elem.Elem()
+		}
+
+		var elemNodes []*Node
+		var err error
+		if isSliceField(elem) {
+			// A nested slice has no name of its own, so its elements are indexed
+			var children []*Node
+			children, err = marshalIndexed(elem)
+			elemNodes = []*Node{{Name: name, Children: children}}
+		} else {
+			elemNodes, err = marshalNamed(elem, name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		nodes = append(nodes, elemNodes...)
+	}
+	return nodes, nil
 }
 
-// marshalValue converts a reflect.Value to a BML node.
-func marshalValue(v reflect.Value, name string) (*Node, error) {
-	// Handle pointer types
-	if v.Kind() == reflect.Ptr {
-		if v.IsNil() {
-			return nil, nil // Skip nil pointers
+// marshalIndexed converts the elements of a slice into nodes named by their
+// index.
+func marshalIndexed(v reflect.Value) ([]*Node, error) {
+	var nodes []*Node
+	for i := 0; i < v.Len(); i++ {
+		elemNodes, err := marshalNamed(v.Index(i), strconv.Itoa(i))
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
 		}
-		return marshalValue(v.Elem(), name)
+		nodes = append(nodes, elemNodes...)
 	}
+	return nodes, nil
+}
 
-	node := &Node{Name: name}
+// attrsType is the type of fields tagged with the attrs option.
+var attrsType = reflect.TypeOf(map[string]string(nil))
 
-	switch v.Kind() {
-	case reflect.String:
-		node.Value = v.String()
+var (
+	nodesType   = reflect.TypeOf([]*Node(nil))
+	nodeMapType = reflect.TypeOf(map[string]*Node(nil))
+)
 
-	case reflect.Bool:
-		if v.Bool() {
-			node.Value = "true"
-		} else {
-			node.Value = "false"
+// marshalAttrs converts a map[string]string into attribute nodes sorted by
+// name.
+func marshalAttrs(v reflect.Value) ([]*Node, error) {
+	if v.Type() != attrsType {
+		return nil, fmt.Errorf("attrs requires map[string]string, not %s", v.Type())
+	}
+
+	attrs := v.Interface().(map[string]string)
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		if !isValidName(name) {
+			return nil, fmt.Errorf("invalid attribute name %q", name)
 		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		node.Value = strconv.FormatInt(v.Int(), 10)
+	nodes := make([]*Node, len(names))
+	for i, name := range names {
+		nodes[i] = &Node{Name: name, Value: attrs[name], IsAttr: true}
+	}
+	return nodes, nil
+}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		node.Value = strconv.FormatUint(v.Uint(), 10)
+// marshalerOf returns v as a Marshaler, checking the pointer receiver when v
+// is addressable.
+func marshalerOf(v reflect.Value) (Marshaler, bool) {
+	if m, ok := v.Interface().(Marshaler); ok {
+		return m, true
+	}
+	if v.CanAddr() {
+		m, ok := v.Addr().Interface().(Marshaler)
+		return m, ok
+	}
+	return nil, false
+}
 
-	case reflect.Float32, reflect.Float64:
-		node.Value = strconv.FormatFloat(v.Float(), 'f', -1, 64)
+// fieldTag holds the parsed contents of a bml struct tag.
+type fieldTag struct {
+	name      string   // canonical name, used when marshaling
+	aliases   []string // further names accepted when unmarshaling
+	stringer  bool
+	attrs     bool
+	attr      bool // written as an attribute on the parent's line
+	raw       bool
+	order     int // position from the order option, when ordered is set
+	ordered   bool
+	strip     string // characters trimmed from numeric values
+	split     string // separator of a slice encoded as a single value
+	hasSplit  bool   // the split option is present, even without a separator
+	omitFalse bool
+	omitEmpty bool
+	required  bool
+	rest      bool
+}
 
-	case reflect.Struct:
-		if err := marshalStruct(v, node); err != nil {
-			return nil, err
+// parseTag parses a struct tag of the form "Name|Alias...,option,...".
+// Unknown options are ignored.
+func parseTag(tag string) fieldTag {
+	parts := strings.Split(tag, ",")
+	names := strings.Split(parts[0], "|")
+	ft := fieldTag{name: names[0], aliases: names[1:]}
+	for i, opt := range parts[1:] {
+		switch opt {
+		case "stringer":
+			ft.stringer = true
+		case "attrs":
+			ft.attrs = true
+		case "attr":
+			ft.attr = true
+		case "raw":
+			ft.raw = true
+		case "omitfalse":
+			ft.omitFalse = true
+		case "omitempty":
+			ft.omitEmpty = true
+		case "required":
+			ft.required = true
+		case "rest":
+			ft.rest = true
+		default:
+			if value, ok := strings.CutPrefix(opt, "strip="); ok {
+				ft.strip = value
+			}
+			// "split=," is cut by the comma that separates options
+			if value, ok := strings.CutPrefix(opt, "split="); ok {
+				ft.split, ft.hasSplit = value, true
+				if value == "" && i+2 < len(parts) && parts[i+2] == "" {
+					ft.split = ","
+				}
+			}
+			if value, ok := strings.CutPrefix(opt, "order="); ok {
+				if order, err := strconv.Atoi(value); err == nil {
+					ft.order, ft.ordered = order, true
+				}
+			}
 		}
+	}
+	return ft
+}
 
-	default:
-		return nil, fmt.Errorf("unsupported type: %s", v.Kind())
+// number returns value prepared for numeric parsing: trimmed of whitespace
+// and of the characters of the strip option.
+func (t fieldTag) number(value string) string {
+	value = strings.TrimSpace(value)
+	if t.strip != "" {
+		value = strings.TrimSpace(strings.Trim(value, t.strip))
 	}
+	return value
+}
 
-	return node, nil
+// splitNodes returns one node per element of the delimited value of node,
+// as described by the split option. Returns nil if node is nil or empty.
+func (t fieldTag) splitNodes(node *Node) ([]*Node, error) {
+	if t.split == "" {
+		return nil, errors.New("split requires a separator")
+	}
+	var nodes []*Node
+	for _, item := range node.List(t.split) {
+		nodes = append(nodes, &Node{Name: node.Name, Value: item, HasValue: true})
+	}
+	return nodes, nil
+}
+
+// find returns the node for the first of the tag's names present under node.
+// With the attr option only attributes are considered.
+func (t fieldTag) find(node *Node) *Node {
+	if t.attr {
+		if nodes := t.findAll(node); nodes != nil {
+			return nodes[0]
+		}
+		return nil
+	}
+	if n := node.Get(t.name); n != nil {
+		return n
+	}
+	for _, alias := range t.aliases {
+		if n := node.Get(alias); n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// findAll returns the nodes for the first of the tag's names present under
+// node. With the attr option only attributes are considered.
+func (t fieldTag) findAll(node *Node) []*Node {
+	if nodes := t.getAll(node, t.name); nodes != nil {
+		return nodes
+	}
+	for _, alias := range t.aliases {
+		if nodes := t.getAll(node, alias); nodes != nil {
+			return nodes
+		}
+	}
+	return nil
+}
+
+// getAll returns the nodes at path under node, keeping only attributes for
+// the attr option.
+func (t fieldTag) getAll(node *Node, path string) []*Node {
+	nodes := node.GetAll(path)
+	if !t.attr {
+		return nodes
+	}
+	var attrs []*Node
+	for _, n := range nodes {
+		if n.IsAttr {
+			attrs = append(attrs, n)
+		}
+	}
+	return attrs
 }
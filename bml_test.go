@@ -1,10 +1,22 @@
 package bml
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf16"
 )
 
 // === Parser Tests ===
@@ -233,6 +245,105 @@ func TestParseInvalidNodeName(t *testing.T) {
 	}
 }
 
+func TestParseBoundaryNames(t *testing.T) {
+	input := "123: a\n.: b\n-: c\n.5: d\n-1 0=x .=y\n...\n  --: e\n"
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		path, value string
+	}{
+		{"123", "a"},
+		{".", "b"},
+		{"-", "c"},
+		{".5", "d"},
+		{"-1/0", "x"},
+		{"-1/.", "y"},
+		{".../--", "e"},
+	}
+	for _, tt := range tests {
+		if got := doc.Root.Get(tt.path); got == nil || got.Value != tt.value {
+			t.Errorf("Get(%q): expected value %q, got %v", tt.path, tt.value, got)
+		}
+	}
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("round trip: expected %q, got %q", input, got)
+	}
+
+	// "//" starts a comment rather than a name
+	doc, err = Parse([]byte("//: a\n/: b"))
+	if err == nil {
+		t.Errorf("expected an error for a name starting with /, got %d nodes", len(doc.Root.Children))
+	}
+}
+
+func TestParseColonLeadingValues(t *testing.T) {
+	input := "Ratio: :special\nNested: : : x\nTight:: y\nNotes: : first\n  : : second\n  ::\nQuoted=\":q\" attr=:e\n"
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		path, value string
+	}{
+		{"Ratio", ":special"},
+		{"Nested", ": : x"},
+		{"Tight", ": y"},
+		{"Notes", ": first\n: second\n:"},
+		{"Quoted", ":q"},
+		{"Quoted/attr", ":e"},
+	}
+	for _, tt := range tests {
+		if got := doc.Root.Get(tt.path); got == nil || got.Value != tt.value {
+			t.Errorf("Get(%q): expected value %q, got %v", tt.path, tt.value, got)
+		}
+	}
+
+	// Colon-leading values survive a round trip, including continuation lines
+	reparsed, err := Parse(Serialize(doc))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reparsed.Root.Equal(doc.Root) {
+		t.Errorf("round trip changed the document:\n%s", Serialize(reparsed))
+	}
+}
+
+func TestParseColonValueWithEquals(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Equation: a=b+c", "a=b+c"},
+		{"Equation: x=1 y=2", "x=1 y=2"},
+		{"Equation: =", "="},
+		{"Equation: a==b // note", "a==b"},
+	}
+
+	for _, tt := range tests {
+		doc, err := Parse([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.input, err)
+		}
+		node := doc.Root.Get("Equation")
+		if node.Value != tt.expected {
+			t.Errorf("%q: expected value %q, got %q", tt.input, tt.expected, node.Value)
+		}
+		// The rest of the line is the value, not attributes
+		if len(node.Children) != 0 {
+			t.Errorf("%q: expected no attributes, got %d", tt.input, len(node.Children))
+		}
+
+		doc2, err := Parse(Serialize(doc))
+		if err != nil || doc2.Root.Get("Equation").Value != tt.expected {
+			t.Errorf("%q: round-trip failed: %q, %v", tt.input, Serialize(doc), err)
+		}
+	}
+}
+
 func TestParseMultilineValue(t *testing.T) {
 	input := `Description
   : Line 1
@@ -251,6 +362,42 @@ func TestParseMultilineValue(t *testing.T) {
 	}
 }
 
+func TestParseMultilineValueBlankLines(t *testing.T) {
+	input := "Description\n  : Line 1\n\n  :\n\n  : Line 5\n\n  Child\nOther: a\n\n  : b\n"
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Blank lines between continuation lines are empty lines of the value,
+	// while those before a child or after the node line are not
+	tests := []struct{ path, expected string }{
+		{"Description", "Line 1\n\n\n\nLine 5"},
+		{"Other", "a\nb"},
+	}
+	for _, tt := range tests {
+		if got := doc.Root.Get(tt.path).Value; got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.path, tt.expected, got)
+		}
+	}
+
+	reparsed, err := Parse(Serialize(doc))
+	if err != nil || reparsed.Root.Get("Description").Value != "Line 1\n\n\n\nLine 5" {
+		t.Errorf("expected the blank lines to survive a round trip, got %v", err)
+	}
+
+	// With KeepRaw the blank lines are reprinted as they were
+	doc, err = ParseWithOptions([]byte(input), ParseOptions{KeepRaw: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Description\n  : Line 1\n\n  :\n\n  : Line 5\n  Child\nOther: a\n  : b"
+	if got := string(SerializeWithOptions(doc, SerializeOptions{PreferRaw: true})); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
 func TestParseAttributes(t *testing.T) {
 	input := `Node attr1=value1 attr2: value2`
 
@@ -311,6 +458,50 @@ func TestParseColonNoSpace(t *testing.T) {
 	}
 }
 
+func TestParseColonInValue(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"Ratio: 4:3", "4:3"},
+		{"Time: 12:30:00", "12:30:00"},
+		{"Time:12:30:00", "12:30:00"},
+		{"Time: :30", ":30"},
+		{"Time: 12:30:00 // noon", "12:30:00"},
+		{"Time=12:30:00", "12:30:00"},
+		{`Time="12:30 PM"`, "12:30 PM"},
+		{"Time\n  : 12:30\n  : 13:45", "12:30\n13:45"},
+	}
+
+	for _, tt := range tests {
+		doc, err := Parse([]byte(tt.input))
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", tt.input, err)
+		}
+		if got := doc.Root.Children[0].Value; got != tt.want {
+			t.Errorf("Parse(%q) value: expected %q, got %q", tt.input, tt.want, got)
+		}
+
+		// Colon values survive a round trip
+		doc2, err := Parse(Serialize(doc))
+		if err != nil {
+			t.Fatalf("re-parse of %q error: %v", tt.input, err)
+		}
+		if got := doc2.Root.Children[0].Value; got != tt.want {
+			t.Errorf("round trip of %q value: expected %q, got %q", tt.input, tt.want, got)
+		}
+	}
+
+	// Colons in attribute values are kept as well
+	doc, _ := Parse([]byte("Clock start=12:30 end=\"13:45:00\""))
+	if got := doc.Root.Get("Clock/start").Value; got != "12:30" {
+		t.Errorf("start: expected %q, got %q", "12:30", got)
+	}
+	if got := doc.Root.Get("Clock/end").Value; got != "13:45:00" {
+		t.Errorf("end: expected %q, got %q", "13:45:00", got)
+	}
+}
+
 func TestParseValidNameChars(t *testing.T) {
 	input := "Node-Name.123: value"
 
@@ -364,6 +555,181 @@ func TestNodeGetNil(t *testing.T) {
 	}
 }
 
+func TestNodeGetAll(t *testing.T) {
+	doc, _ := Parse([]byte("Library\n  Game: a\n  Other\n  Game: b\nGame: c\n"))
+
+	var values []string
+	for _, n := range doc.Root.GetAll("Library/Game") {
+		values = append(values, n.Value)
+	}
+	if !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("unexpected GetAll(Library/Game): %v", values)
+	}
+	if got := doc.Root.GetAll("Game"); len(got) != 1 || got[0].Value != "c" {
+		t.Errorf("unexpected GetAll(Game): %v", got)
+	}
+
+	for _, path := range []string{"Missing/Game", "Library/Missing", "", "Library/"} {
+		if got := doc.Root.GetAll(path); got != nil {
+			t.Errorf("GetAll(%q): expected nil, got %v", path, got)
+		}
+	}
+
+	var node *Node
+	if node.GetAll("Game") != nil {
+		t.Error("GetAll on nil node should return nil")
+	}
+}
+
+func TestNodeAttributesAndBlocks(t *testing.T) {
+	doc, _ := Parse([]byte("Game id=1 region=NTSC\n  Title: One\n  Board\n    Memory type=ROM\n"))
+	game := doc.Root.Get("Game")
+
+	names := func(nodes []*Node) []string {
+		var out []string
+		for _, n := range nodes {
+			out = append(out, n.Name)
+		}
+		return out
+	}
+	if got := names(game.Attributes()); !reflect.DeepEqual(got, []string{"id", "region"}) {
+		t.Errorf("unexpected Attributes result: %v", got)
+	}
+	if got := names(game.Blocks()); !reflect.DeepEqual(got, []string{"Title", "Board"}) {
+		t.Errorf("unexpected Blocks result: %v", got)
+	}
+	if got := game.Get("Title").Attributes(); got != nil {
+		t.Errorf("Attributes of a leaf: expected nil, got %v", got)
+	}
+
+	var node *Node
+	if node.Attributes() != nil || node.Blocks() != nil {
+		t.Error("Attributes and Blocks on nil node should return nil")
+	}
+}
+
+func TestNodeDump(t *testing.T) {
+	doc, _ := Parse([]byte("Video mode=full\n  Driver: Metal\n  Notes: a\n    : b\n  Shader\n    Path:\nAudio"))
+
+	expected := `(root) [2 children]
+  Video [4 children]
+    mode = "full" (attr)
+    Driver = "Metal"
+    Notes = "a\nb"
+    Shader [1 child]
+      Path = ""
+  Audio`
+	if got := doc.Root.Dump(); got != expected {
+		t.Errorf("expected Dump output:\n%s\ngot:\n%s", expected, got)
+	}
+	if got := fmt.Sprintf("%#v", doc.Root.Get("Audio")); got != "Audio" {
+		t.Errorf("%%#v: expected %q, got %q", "Audio", got)
+	}
+
+	var node *Node
+	if got := node.Dump(); got != "<nil>" {
+		t.Errorf("unexpected Dump of a nil node: %q", got)
+	}
+}
+
+func TestNodeHasChildrenAndIsLeaf(t *testing.T) {
+	doc, _ := Parse([]byte("Game id=1\n  Title: One\nMemory type=ROM size=4096\nEmpty"))
+
+	tests := []struct {
+		path        string
+		hasChildren bool
+		isLeaf      bool
+	}{
+		{"Game", true, false},
+		{"Game/Title", false, true},
+		{"Memory", false, true},
+		{"Empty", false, true},
+		{"Missing", false, false},
+	}
+	for _, tt := range tests {
+		node := doc.Root.Get(tt.path)
+		if got := node.HasChildren(); got != tt.hasChildren {
+			t.Errorf("%s: HasChildren: expected %v, got %v", tt.path, tt.hasChildren, got)
+		}
+		if got := node.IsLeaf(); got != tt.isLeaf {
+			t.Errorf("%s: IsLeaf: expected %v, got %v", tt.path, tt.isLeaf, got)
+		}
+	}
+}
+
+func TestNodeAttr(t *testing.T) {
+	doc, _ := Parse([]byte("Window width=640 fullscreen=true\n  width: 800\n  height: 480"))
+	window := doc.Root.Get("Window")
+
+	if got := window.Attr("width").Int(0); got != 640 {
+		t.Errorf("Attr(width): expected 640, got %d", got)
+	}
+	if got := window.Get("width"); !got.IsAttr {
+		t.Error("expected Get to find the attribute first")
+	}
+	if got := window.Attr("fullscreen").Bool(false); !got {
+		t.Error("Attr(fullscreen) = false")
+	}
+	if window.Attr("height") != nil {
+		t.Error("expected no attribute for a block child")
+	}
+
+	// A block child listed first does not shadow the attribute
+	window.Children = append([]*Node{{Name: "width", Value: "1024"}}, window.Children...)
+	if got := window.Attr("width").Int(0); got != 640 {
+		t.Errorf("Attr(width) with a leading block child: expected 640, got %d", got)
+	}
+
+	var node *Node
+	if node.Attr("width") != nil {
+		t.Error("Attr on nil node should return nil")
+	}
+}
+
+func TestNodeFindByValue(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal\n  Shader driver=Metal\n    Path: crt.slang\nAudio\n  Driver:   Metal  \n  Backup: OpenGL\nInput\n  Driver: SDL"))
+
+	var paths []string
+	for _, node := range doc.Root.FindByValue("Metal") {
+		paths = append(paths, node.Name)
+	}
+	if !reflect.DeepEqual(paths, []string{"Driver", "driver", "Driver"}) {
+		t.Errorf("FindByValue(Metal) found %v", paths)
+	}
+	if got := doc.Root.Get("Audio").FindByValue("Metal"); len(got) != 1 || got[0] != doc.Root.Get("Audio/Driver") {
+		t.Errorf("expected the search to be limited to the node's descendants, got %v", got)
+	}
+	if got := doc.Root.FindByValue("Vulkan"); got != nil {
+		t.Errorf("expected nil for an unused value, got %v", got)
+	}
+
+	var node *Node
+	if node.FindByValue("Metal") != nil {
+		t.Error("FindByValue on nil node should return nil")
+	}
+}
+
+func TestNodeForEach(t *testing.T) {
+	doc, _ := Parse([]byte("List\n  A: 1\n  B: 2\n    Nested: x\n  C: 3\n  D: 4"))
+
+	var visited []string
+	last := -1
+	doc.Root.Get("List").ForEach(func(i int, child *Node) bool {
+		visited = append(visited, child.Name)
+		last = i
+		return child.Name != "C"
+	})
+	if !reflect.DeepEqual(visited, []string{"A", "B", "C"}) || last != 2 {
+		t.Errorf("ForEach visited %v, stopping at %d", visited, last)
+	}
+
+	var node *Node
+	node.ForEach(func(int, *Node) bool {
+		t.Error("ForEach on nil node should not call fn")
+		return true
+	})
+}
+
 func TestNodeString(t *testing.T) {
 	doc, _ := Parse([]byte("Driver: Metal"))
 
@@ -390,6 +756,45 @@ func TestNodeStringNil(t *testing.T) {
 	}
 }
 
+func TestNodeRawValue(t *testing.T) {
+	doc, _ := Parse([]byte(`Pad="  x  "`))
+	if got := doc.Root.Get("Pad").RawValue(); got != "  x  " {
+		t.Errorf("RawValue: expected %q, got %q", "  x  ", got)
+	}
+	if got := doc.Root.Get("Pad").String(""); got != "x" {
+		t.Errorf("String: expected %q, got %q", "x", got)
+	}
+
+	var node *Node
+	if got := node.RawValue(); got != "" {
+		t.Errorf("RawValue on nil: expected empty, got %q", got)
+	}
+}
+
+func TestNodeStringAllocations(t *testing.T) {
+	node := &Node{Value: "  Metal  "}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = node.String("")
+		_ = node.RawValue()
+	})
+	if allocs != 0 {
+		t.Errorf("String/RawValue allocations: expected 0, got %v", allocs)
+	}
+}
+
+func TestNodeRawString(t *testing.T) {
+	doc, _ := Parse([]byte("Sep=\" | \"\nPlain:   x"))
+	if got := doc.Root.Get("Sep").RawString(""); got != " | " {
+		t.Errorf("RawString: expected %q, got %q", " | ", got)
+	}
+	if got := doc.Root.Get("Sep").String(""); got != "|" {
+		t.Errorf("String: expected %q, got %q", "|", got)
+	}
+	if got := doc.Root.Get("Missing").RawString("def"); got != "def" {
+		t.Errorf("RawString on nil: expected fallback, got %q", got)
+	}
+}
+
 func TestNodeBoolTrue(t *testing.T) {
 	doc, _ := Parse([]byte("Enabled: true"))
 
@@ -425,6 +830,39 @@ func TestNodeBoolNil(t *testing.T) {
 	}
 }
 
+func TestNodeNumericBool(t *testing.T) {
+	input := []byte("Fast: 1\nMute: 0\nVsync: true\nBlur: maybe")
+	doc, _ := ParseWithOptions(input, ParseOptions{NumericBools: true})
+
+	if !doc.Root.Get("Fast").Bool(false) {
+		t.Error("expected 1 to be true")
+	}
+	if doc.Root.Get("Mute").Bool(true) {
+		t.Error("expected 0 to be false")
+	}
+	if !doc.Root.Get("Vsync").Bool(false) {
+		t.Error("expected true to be true")
+	}
+	if !doc.Root.Get("Blur").Bool(true) {
+		t.Error("expected fallback value true")
+	}
+	if !doc.Root.Get("Missing").Bool(true) {
+		t.Error("expected fallback value true for nil node")
+	}
+	if b, err := doc.Clone().Root.Get("Mute").BoolE(); err != nil || b {
+		t.Errorf("expected a clone to keep accepting 0, got %v, %v", b, err)
+	}
+
+	// Without the option numeric values are not booleans
+	doc, _ = Parse(input)
+	if !doc.Root.Get("Mute").Bool(true) {
+		t.Error("expected fallback value true for 0 without NumericBools")
+	}
+	if _, err := doc.Root.Get("Fast").BoolE(); err == nil {
+		t.Error("expected error for 1 without NumericBools")
+	}
+}
+
 func TestNodeInt(t *testing.T) {
 	doc, _ := Parse([]byte("Count: 42"))
 
@@ -477,87 +915,413 @@ func TestNodeFloatNil(t *testing.T) {
 	}
 }
 
-// === Node Mutation Tests ===
-
-func TestNodeSet(t *testing.T) {
-	doc, _ := Parse([]byte("Video"))
+func TestNodeTypedErrors(t *testing.T) {
+	doc, _ := Parse([]byte("Multiplier: 1_000\nFullscreen: true\nLuminance: 0.5\nBroken: abc\nHuge: 1e999"))
+	root := doc.Root
 
-	doc.Root.Get("Video").Set("Driver", "Metal")
-	node := doc.Root.Get("Video/Driver")
-	if node == nil {
-		t.Fatal("expected node to be created")
+	if i, err := root.Get("Multiplier").IntE(); err != nil || i != 1000 {
+		t.Errorf("unexpected IntE result: %d, %v", i, err)
 	}
-	if node.Value != "Metal" {
-		t.Errorf("expected 'Metal', got %q", node.Value)
+	if b, err := root.Get("Fullscreen").BoolE(); err != nil || !b {
+		t.Errorf("unexpected BoolE result: %v, %v", b, err)
+	}
+	if f, err := root.Get("Luminance").FloatE(); err != nil || f != 0.5 {
+		t.Errorf("unexpected FloatE result: %v, %v", f, err)
 	}
-}
 
-func TestNodeSetUpdate(t *testing.T) {
-	doc, _ := Parse([]byte("Video\n  Driver: OpenGL"))
+	// Missing nodes
+	missing := root.Get("Missing")
+	if _, err := missing.IntE(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("IntE of a missing node: expected ErrNotFound, got %v", err)
+	}
+	if _, err := missing.BoolE(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("BoolE of a missing node: expected ErrNotFound, got %v", err)
+	}
+	if _, err := missing.FloatE(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FloatE of a missing node: expected ErrNotFound, got %v", err)
+	}
 
-	doc.Root.Get("Video").Set("Driver", "Metal")
-	node := doc.Root.Get("Video/Driver")
-	if node.Value != "Metal" {
-		t.Errorf("expected 'Metal', got %q", node.Value)
+	// Unparseable values
+	broken := root.Get("Broken")
+	var numErr *strconv.NumError
+	if _, err := broken.IntE(); !errors.As(err, &numErr) || !strings.HasPrefix(err.Error(), `cannot parse "abc" as int`) {
+		t.Errorf("unexpected IntE of an invalid value: %v", err)
+	}
+	if _, err := broken.BoolE(); err == nil || err.Error() != `cannot parse "abc" as bool` {
+		t.Errorf("unexpected BoolE of an invalid value: %v", err)
+	}
+	if _, err := broken.FloatE(); err == nil || !strings.HasPrefix(err.Error(), `cannot parse "abc" as float`) {
+		t.Errorf("unexpected FloatE of an invalid value: %v", err)
+	}
+	if _, err := root.Get("Huge").FloatE(); err == nil {
+		t.Error("FloatE() of an infinite value should fail")
 	}
 }
 
-func TestNodeSetNestedCreate(t *testing.T) {
-	doc, _ := Parse([]byte(""))
-	doc.Root.Set("Video/Driver", "Metal")
+func TestNodeGetTyped(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal\n  Multiplier: 2\n  Fullscreen: true\n  Luminance: 0.5\n  Broken: abc"))
+	root := doc.Root
 
-	node := doc.Root.Get("Video/Driver")
-	if node == nil {
-		t.Fatal("expected nested node to be created")
+	if got := root.GetString("Video/Driver", "none"); got != "Metal" {
+		t.Errorf("unexpected GetString result: %q", got)
 	}
-	if node.Value != "Metal" {
-		t.Errorf("expected 'Metal', got %q", node.Value)
+	if got := root.GetInt("Video/Multiplier", 1); got != 2 {
+		t.Errorf("unexpected GetInt result: %d", got)
+	}
+	if got := root.GetBool("Video/Fullscreen", false); !got {
+		t.Error("expected GetBool to return true")
+	}
+	if got := root.GetFloat("Video/Luminance", 1); got != 0.5 {
+		t.Errorf("unexpected GetFloat result: %v", got)
+	}
+
+	// Missing paths and unconvertible values give the fallback
+	if got := root.GetString("Video/Missing", "none"); got != "none" {
+		t.Errorf("unexpected GetString of missing path: %q", got)
+	}
+	if got := root.GetInt("Video/Broken", 7); got != 7 {
+		t.Errorf("unexpected GetInt of invalid value: %d", got)
+	}
+	if got := root.GetBool("Audio/Mute", true); !got {
+		t.Error("GetBool() of missing path = false")
+	}
+	if got := root.GetFloat("Video/Broken", 1.5); got != 1.5 {
+		t.Errorf("unexpected GetFloat of invalid value: %v", got)
 	}
-}
 
-func TestNodeSetNil(t *testing.T) {
 	var node *Node
-	result := node.Set("path", "value")
-	if result != nil {
-		t.Error("expected nil for nil node")
+	if node.GetString("a", "x") != "x" || node.GetInt("a", 3) != 3 || !node.GetBool("a", true) || node.GetFloat("a", 2) != 2 {
+		t.Error("expected fallbacks for nil node")
 	}
 }
 
-func TestNodeSetBool(t *testing.T) {
-	doc, _ := Parse([]byte(""))
-	doc.Root.SetBool("Enabled", true)
+func TestNodeList(t *testing.T) {
+	doc, _ := Parse([]byte("Extensions: sfc, smc ,fig\nSingle: sfc\nEmpty:\nBlank=\"  \"\nGaps: a,,b\nTitles: Super Mario ,  Zelda\nComma: ,"))
 
-	if doc.Root.Get("Enabled").Value != "true" {
-		t.Error("expected 'true'")
+	tests := []struct {
+		path     string
+		expected []string
+	}{
+		{"Extensions", []string{"sfc", "smc", "fig"}},
+		{"Single", []string{"sfc"}},
+		{"Empty", nil},
+		{"Blank", nil},
+		{"Gaps", []string{"a", "", "b"}},
+		{"Titles", []string{"Super Mario", "Zelda"}},
+		{"Comma", []string{"", ""}},
+		{"Missing", nil},
+	}
+	for _, tt := range tests {
+		if got := doc.Root.Get(tt.path).List(","); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: List() = %q, expected %q", tt.path, got, tt.expected)
+		}
 	}
 
-	doc.Root.SetBool("Disabled", false)
-	if doc.Root.Get("Disabled").Value != "false" {
-		t.Error("expected 'false'")
+	// An empty separator does not split
+	if got := doc.Root.Get("Titles").List(""); !reflect.DeepEqual(got, []string{"Super Mario ,  Zelda"}) {
+		t.Errorf("expected the whole value, got %q", got)
+	}
+	if got := doc.Root.Get("Blank").List(""); got != nil {
+		t.Errorf("expected nil for a blank value, got %q", got)
+	}
+	var nilNode *Node
+	if got := nilNode.List(""); got != nil {
+		t.Errorf("expected nil for a nil node, got %q", got)
 	}
 }
 
-func TestNodeSetInt(t *testing.T) {
+func TestNodeSetList(t *testing.T) {
 	doc, _ := Parse([]byte(""))
-	doc.Root.SetInt("Count", 42)
 
-	if doc.Root.Get("Count").Value != "42" {
-		t.Error("expected '42'")
+	doc.Root.SetList("Game/Extensions", ",", []string{"sfc", "smc"})
+	if got := doc.Root.Get("Game/Extensions").Value; got != "sfc,smc" {
+		t.Errorf("expected %q, got %q", "sfc,smc", got)
+	}
+	if got := doc.Root.Get("Game/Extensions").List(","); !reflect.DeepEqual(got, []string{"sfc", "smc"}) {
+		t.Errorf("unexpected List after SetList: %q", got)
 	}
-}
-
-func TestNodeSetFloat(t *testing.T) {
-	doc, _ := Parse([]byte(""))
-	doc.Root.SetFloat("Value", 3.14)
 
-	val := doc.Root.Get("Value").Float(0)
-	if val != 3.14 {
-		t.Errorf("expected 3.14, got %f", val)
+	doc.Root.SetList("Game/Extensions", ",", nil)
+	if got := doc.Root.Get("Game/Extensions").List(","); got != nil {
+		t.Errorf("expected empty list, got %q", got)
 	}
-}
 
-func TestNodeRemove(t *testing.T) {
-	doc, _ := Parse([]byte("Video\n  Driver: Metal\n  Count: 2"))
+	// Empty elements survive among others, but a lone one reads back as an
+	// empty list, and whitespace survives only inside elements
+	tests := []struct {
+		items    []string
+		expected []string
+	}{
+		{[]string{"a", "", "b"}, []string{"a", "", "b"}},
+		{[]string{"", ""}, []string{"", ""}},
+		{[]string{""}, nil},
+		{[]string{"Super Mario", " Zelda "}, []string{"Super Mario", "Zelda"}},
+	}
+	for _, tt := range tests {
+		doc.Root.SetList("List", ",", tt.items)
+		reparsed, err := Parse(Serialize(doc))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := reparsed.Root.Get("List").List(","); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %q, got %q", tt.items, tt.expected, got)
+		}
+	}
+
+	// An empty separator joins the items directly, read back as one element
+	doc.Root.SetList("List", "", []string{"a", "b"})
+	if got := doc.Root.Get("List").List(""); !reflect.DeepEqual(got, []string{"ab"}) {
+		t.Errorf("expected a single element, got %q", got)
+	}
+}
+
+func TestNodeNumericDigitSeparators(t *testing.T) {
+	tests := []struct {
+		value     string
+		wantInt   int
+		wantFloat float64
+	}{
+		{"1_000", 1000, 1000},
+		{"-2_500_000", -2500000, -2500000},
+		{"1_000.5", -1, 1000.5},
+		{"_1000", -1, -1},
+		{"1000_", -1, -1},
+		{"1__000", -1, -1},
+		{"1_.5", -1, -1},
+	}
+
+	for _, tt := range tests {
+		n := &Node{Value: tt.value}
+		if got := n.Int(-1); got != tt.wantInt {
+			t.Errorf("Int(%q): expected %d, got %d", tt.value, tt.wantInt, got)
+		}
+		if got := n.Float(-1); got != tt.wantFloat {
+			t.Errorf("Float(%q): expected %v, got %v", tt.value, tt.wantFloat, got)
+		}
+	}
+}
+
+func TestValue(t *testing.T) {
+	doc, err := Parse([]byte("Name: Metal\nOn: true\nCount: 3\nBig: 9_000_000_000\nRatio: 0.5\nDelay: 1m30s\nBad: x\n"))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	root := doc.Root
+
+	if got := Value(root.Get("Name"), ""); got != "Metal" {
+		t.Errorf("unexpected Value[string]: %q", got)
+	}
+	if got := Value(root.Get("On"), false); !got {
+		t.Errorf("unexpected Value[bool]: %v", got)
+	}
+	if got := Value(root.Get("Count"), 0); got != 3 {
+		t.Errorf("unexpected Value[int]: %d", got)
+	}
+	if got := Value(root.Get("Big"), int64(0)); got != 9000000000 {
+		t.Errorf("unexpected Value[int64]: %d", got)
+	}
+	if got := Value(root.Get("Ratio"), 0.0); got != 0.5 {
+		t.Errorf("unexpected Value[float64]: %v", got)
+	}
+	if got := Value(root.Get("Delay"), time.Second); got != 90*time.Second {
+		t.Errorf("unexpected Value[time.Duration]: %v", got)
+	}
+
+	// Conversion failures, nil nodes, and unsupported types yield the fallback
+	if got := Value(root.Get("Bad"), int64(7)); got != 7 {
+		t.Errorf("unexpected Value[int64] invalid: %d", got)
+	}
+	if got := Value(root.Get("Bad"), time.Second); got != time.Second {
+		t.Errorf("unexpected Value[time.Duration] invalid: %v", got)
+	}
+	if got := Value(root.Get("Missing"), 4); got != 4 {
+		t.Errorf("unexpected Value[int] nil: %d", got)
+	}
+	if got := Value(root.Get("Count"), uint8(2)); got != 2 {
+		t.Errorf("unexpected Value[uint8]: %d", got)
+	}
+}
+
+func TestNodeFloatNotation(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+	}{
+		{"1.5e3", 1500},
+		{"1.0e-1", 0.1},
+		{"-2E2", -200},
+		{"NaN", -1},
+		{"nan", -1},
+		{"Inf", -1},
+		{"+Inf", -1},
+		{"-infinity", -1},
+		{"1e400", -1},
+	}
+
+	for _, tt := range tests {
+		n := &Node{Value: tt.value}
+		if got := n.Float(-1); got != tt.want {
+			t.Errorf("Float(%q): expected %v, got %v", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestNodeEqual(t *testing.T) {
+	doc1, _ := Parse([]byte("Video\n  Driver: Metal\n  Multiplier: 2"))
+	doc2, _ := Parse([]byte("Video\n  Driver: Metal\n  Multiplier: 2"))
+
+	if !doc1.Root.Equal(doc2.Root) {
+		t.Error("expected equal trees")
+	}
+
+	doc2.Root.Get("Video/Driver").Value = "OpenGL"
+	if doc1.Root.Equal(doc2.Root) {
+		t.Error("expected different values to be unequal")
+	}
+
+	doc3, _ := Parse([]byte("Video\n  Driver: Metal"))
+	if doc1.Root.Equal(doc3.Root) {
+		t.Error("expected different child counts to be unequal")
+	}
+
+	doc4, _ := Parse([]byte("Audio\n  Driver: Metal\n  Multiplier: 2"))
+	if doc1.Root.Equal(doc4.Root) {
+		t.Error("expected different names to be unequal")
+	}
+
+	var nilNode *Node
+	if !nilNode.Equal(nil) {
+		t.Error("expected nil nodes to be equal")
+	}
+	if nilNode.Equal(doc1.Root) || doc1.Root.Equal(nil) {
+		t.Error("expected nil and non-nil nodes to be unequal")
+	}
+}
+
+func TestNodeMeta(t *testing.T) {
+	doc1, _ := ParseWithOptions([]byte("// note\nDriver: Metal"), ParseOptions{PreserveComments: true})
+	doc2, _ := Parse([]byte("Driver: Metal"))
+
+	driver := doc1.Root.Get("Driver")
+	driver.Meta = map[string]interface{}{"source": "settings.bml", "valid": true}
+
+	if !doc1.Root.Equal(doc2.Root) {
+		t.Error("expected Meta and comments to be ignored by Equal")
+	}
+	if got := string(Serialize(&Document{Root: &Node{Children: []*Node{driver}}})); got != "// note\nDriver: Metal\n" {
+		t.Errorf("expected Meta to be omitted from output, got %q", got)
+	}
+	if driver.Meta["source"] != "settings.bml" {
+		t.Error("expected Meta to be retained on the node")
+	}
+}
+
+// === Node Mutation Tests ===
+
+func TestNodeSet(t *testing.T) {
+	doc, _ := Parse([]byte("Video"))
+
+	doc.Root.Get("Video").Set("Driver", "Metal")
+	node := doc.Root.Get("Video/Driver")
+	if node == nil {
+		t.Fatal("expected node to be created")
+	}
+	if node.Value != "Metal" {
+		t.Errorf("expected 'Metal', got %q", node.Value)
+	}
+}
+
+func TestNodeSetUpdate(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: OpenGL"))
+
+	doc.Root.Get("Video").Set("Driver", "Metal")
+	node := doc.Root.Get("Video/Driver")
+	if node.Value != "Metal" {
+		t.Errorf("expected 'Metal', got %q", node.Value)
+	}
+}
+
+func TestNodeSetNestedCreate(t *testing.T) {
+	doc, _ := Parse([]byte(""))
+	doc.Root.Set("Video/Driver", "Metal")
+
+	node := doc.Root.Get("Video/Driver")
+	if node == nil {
+		t.Fatal("expected nested node to be created")
+	}
+	if node.Value != "Metal" {
+		t.Errorf("expected 'Metal', got %q", node.Value)
+	}
+}
+
+func TestNodeSetNil(t *testing.T) {
+	var node *Node
+	result := node.Set("path", "value")
+	if result != nil {
+		t.Error("expected nil for nil node")
+	}
+}
+
+func TestNodeEnsure(t *testing.T) {
+	doc, _ := Parse([]byte("Video: Metal\n  Driver: OpenGL"))
+
+	video := doc.Root.Ensure("Video")
+	if video != doc.Root.Get("Video") || video.Value != "Metal" {
+		t.Errorf("expected existing node with value preserved, got %+v", video)
+	}
+
+	shader := doc.Root.Ensure("Video/Shader/Path")
+	if shader == nil || shader != doc.Root.Get("Video/Shader/Path") {
+		t.Fatal("expected nested node to be created")
+	}
+	if shader.Value != "" || shader.HasValue {
+		t.Errorf("expected empty value, got %q", shader.Value)
+	}
+	if got := len(doc.Root.Get("Video").Children); got != 2 {
+		t.Errorf("expected 2 children of Video, got %d", got)
+	}
+
+	var nilNode *Node
+	if nilNode.Ensure("path") != nil {
+		t.Error("expected nil for nil node")
+	}
+}
+
+func TestNodeSetBool(t *testing.T) {
+	doc, _ := Parse([]byte(""))
+	doc.Root.SetBool("Enabled", true)
+
+	if doc.Root.Get("Enabled").Value != "true" {
+		t.Error("expected 'true'")
+	}
+
+	doc.Root.SetBool("Disabled", false)
+	if doc.Root.Get("Disabled").Value != "false" {
+		t.Error("expected 'false'")
+	}
+}
+
+func TestNodeSetInt(t *testing.T) {
+	doc, _ := Parse([]byte(""))
+	doc.Root.SetInt("Count", 42)
+
+	if doc.Root.Get("Count").Value != "42" {
+		t.Error("expected '42'")
+	}
+}
+
+func TestNodeSetFloat(t *testing.T) {
+	doc, _ := Parse([]byte(""))
+	doc.Root.SetFloat("Value", 3.14)
+
+	val := doc.Root.Get("Value").Float(0)
+	if val != 3.14 {
+		t.Errorf("expected 3.14, got %f", val)
+	}
+}
+
+func TestNodeRemove(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal\n  Count: 2"))
 
 	removed := doc.Root.Get("Video").Remove("Driver")
 	if !removed {
@@ -620,1399 +1384,6197 @@ func TestNodeRemoveInvalidPath(t *testing.T) {
 	}
 }
 
-// === Serialization Tests ===
+func TestNodeReplace(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal\n  Shader: None\n  Multiplier: 2"))
 
-func TestSerializeEmpty(t *testing.T) {
-	doc := &Document{Root: &Node{}}
-	data := Serialize(doc)
-	if len(data) != 0 {
-		t.Errorf("expected empty output, got %q", string(data))
+	replacement := &Node{Name: "Shader", Value: "CRT", Children: []*Node{{Name: "Pass", Value: "1"}}}
+	if !doc.Root.Replace("Video/Shader", replacement) {
+		t.Fatal("expected Replace to succeed")
+	}
+
+	expected := "Video\n  Driver: Metal\n  Shader: CRT\n    Pass: 1\n  Multiplier: 2\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
 
-func TestSerializeNil(t *testing.T) {
-	data := Serialize(nil)
-	if data != nil {
-		t.Error("expected nil for nil document")
+func TestNodeReplaceMissing(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
+
+	if doc.Root.Replace("Video/Missing", &Node{Name: "X"}) {
+		t.Error("expected false for missing node")
+	}
+	if doc.Root.Replace("Audio/Driver", &Node{Name: "X"}) {
+		t.Error("expected false for missing parent")
+	}
+	if doc.Root.Replace("Video/Driver", nil) {
+		t.Error("expected false for nil replacement")
 	}
 
-	data = Serialize(&Document{})
-	if data != nil {
-		t.Error("expected nil for nil root")
+	var node *Node
+	if node.Replace("Video", &Node{Name: "X"}) {
+		t.Error("expected false for nil receiver")
 	}
 }
 
-func TestSerializeSingleNode(t *testing.T) {
-	doc := &Document{Root: &Node{
-		Children: []*Node{{Name: "Video"}},
-	}}
-	data := Serialize(doc)
-	expected := "Video\n"
-	if string(data) != expected {
-		t.Errorf("expected %q, got %q", expected, string(data))
+func TestNodePrune(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Shader
+  Filter
+    Mode
+    Level
+Empty
+  Nested
+    Deeper
+Audio enabled
+  // keep me
+  Device
+  Volume: 1.0
+`
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
 	}
-}
 
-func TestSerializeNodeWithValue(t *testing.T) {
-	doc := &Document{Root: &Node{
-		Children: []*Node{{Name: "Driver", Value: "Metal"}},
-	}}
-	data := Serialize(doc)
-	expected := "Driver: Metal\n"
-	if string(data) != expected {
-		t.Errorf("expected %q, got %q", expected, string(data))
+	doc.Root.Prune()
+
+	want := "Video\n  Driver: Metal\nAudio\n  // keep me\n  Device\n  Volume: 1.0\n"
+	if got := string(Serialize(doc)); got != want {
+		t.Errorf("Prune result: expected %q, got %q", want, got)
 	}
+
+	var nilNode *Node
+	nilNode.Prune()
 }
 
-func TestSerializeNested(t *testing.T) {
-	doc := &Document{Root: &Node{
-		Children: []*Node{
-			{
-				Name: "Video",
-				Children: []*Node{
-					{Name: "Driver", Value: "Metal"},
-				},
-			},
-		},
-	}}
-	data := Serialize(doc)
-	expected := "Video\n  Driver: Metal\n"
-	if string(data) != expected {
-		t.Errorf("expected %q, got %q", expected, string(data))
+func TestNodeAppendPrependChild(t *testing.T) {
+	root := &Node{}
+	root.AppendChild(&Node{Name: "B"})
+	root.AppendChild(&Node{Name: "C"})
+	root.PrependChild(&Node{Name: "A"})
+	root.PrependChild(&Node{Name: "Z", Value: "first"})
+	root.AppendChild(nil)
+	root.PrependChild(nil)
+
+	var names []string
+	for _, child := range root.Children {
+		names = append(names, child.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"Z", "A", "B", "C"}) {
+		t.Errorf("children: expected [Z A B C], got %v", names)
 	}
+
+	var node *Node
+	node.AppendChild(&Node{Name: "A"})
+	node.PrependChild(&Node{Name: "A"})
 }
 
-func TestSerializeMultilineValue(t *testing.T) {
-	doc := &Document{Root: &Node{
-		Children: []*Node{{Name: "Desc", Value: "Line1\nLine2"}},
-	}}
-	data := Serialize(doc)
-	expected := "Desc\n  : Line1\n  : Line2\n"
-	if string(data) != expected {
-		t.Errorf("expected %q, got %q", expected, string(data))
+func TestNodeSetAll(t *testing.T) {
+	doc, _ := Parse([]byte("Server\n  Host: a\n  Port: 80\n  Name: n\n  Port: 81\n"))
+	server := doc.Root.Get("Server")
+
+	nodes := server.SetAll("Port", []string{"8080", "8081", "8082"})
+	if len(nodes) != 3 || nodes[0].Value != "8080" {
+		t.Errorf("SetAll() returned %v", nodes)
+	}
+
+	want := "Server\n  Host: a\n  Port: 8080\n  Port: 8081\n  Port: 8082\n  Name: n\n"
+	if got := string(Serialize(doc)); got != want {
+		t.Errorf("SetAll result: expected %q, got %q", want, got)
+	}
+
+	// Names with no existing children are appended
+	server.SetAll("Alias", []string{"x"})
+	if last := server.Children[len(server.Children)-1]; last.Name != "Alias" || last.Value != "x" {
+		t.Errorf("unexpected appended child: %+v", last)
+	}
+
+	// An empty set removes every child with the name
+	server.SetAll("Port", nil)
+	if len(server.GetAll("Port")) != 0 || len(server.Children) != 3 {
+		t.Errorf("unexpected children after clearing: %d", len(server.Children))
+	}
+
+	var node *Node
+	if node.SetAll("Port", []string{"1"}) != nil {
+		t.Error("SetAll on nil node should return nil")
 	}
 }
 
-func TestSerializeRoundTrip(t *testing.T) {
+// === Document Tests ===
+
+func TestDocumentFlatten(t *testing.T) {
 	input := `Video
   Driver: Metal
   Multiplier: 2
-Audio
-  Driver: SDL
-  Volume: 1.0
-`
+Input
+  Port: 1
+  Port: 2
+  Name: pad
+Paths
+  Home
+Description: top
+  Child: value`
+
 	doc, err := Parse([]byte(input))
 	if err != nil {
 		t.Fatalf("parse error: %v", err)
 	}
 
-	output := Serialize(doc)
-	doc2, err := Parse(output)
-	if err != nil {
-		t.Fatalf("re-parse error: %v", err)
+	expected := map[string]string{
+		"Video/Driver":      "Metal",
+		"Video/Multiplier":  "2",
+		"Input/Port[0]":     "1",
+		"Input/Port[1]":     "2",
+		"Input/Name":        "pad",
+		"Paths/Home":        "",
+		"Description":       "top",
+		"Description/Child": "value",
+	}
+	if got := doc.Flatten(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
 	}
+}
 
-	// Verify key values
-	if doc2.Root.Get("Video/Driver").String("") != "Metal" {
-		t.Error("Video/Driver mismatch after round-trip")
+func TestDocumentFlattenNil(t *testing.T) {
+	var doc *Document
+	if got := doc.Flatten(); len(got) != 0 {
+		t.Errorf("expected empty map, got %v", got)
 	}
-	if doc2.Root.Get("Audio/Volume").Float(0) != 1.0 {
-		t.Error("Audio/Volume mismatch after round-trip")
+	if got := (&Document{}).Flatten(); len(got) != 0 {
+		t.Errorf("expected empty map for nil root, got %v", got)
 	}
 }
 
-// === Marshal/Unmarshal Tests ===
-
-type TestVideoSettings struct {
-	Driver     string  `bml:"Driver"`
-	Multiplier int     `bml:"Multiplier"`
-	Luminance  float64 `bml:"Luminance"`
-	ColorBleed bool    `bml:"ColorBleed"`
+func TestDocumentPaths(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Shader
+    Path: crt
+Input
+  Port: 1
+  Port: 2
+    Device: Gamepad
+Node a=1`
+
+	doc, _ := Parse([]byte(input))
+	expected := []string{
+		"Video",
+		"Video/Driver",
+		"Video/Shader",
+		"Video/Shader/Path",
+		"Input",
+		"Input/Port[0]",
+		"Input/Port[1]",
+		"Input/Port[1]/Device",
+		"Node",
+		"Node/a",
+	}
+	if got := doc.Paths(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	var nilDoc *Document
+	if got := nilDoc.Paths(); got != nil {
+		t.Errorf("expected nil for nil document, got %q", got)
+	}
 }
 
-type TestAudioSettings struct {
-	Driver  string  `bml:"Driver"`
-	Volume  float64 `bml:"Volume"`
-	Mute    bool    `bml:"Mute"`
-	Latency int64   `bml:"Latency"`
+func TestDocumentWalkSkip(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal\nAudio\n  Driver: SDL"))
+
+	var visited []string
+	doc.Walk(func(path string, n *Node) bool {
+		visited = append(visited, path)
+		return n.Name != "Video"
+	})
+	expected := []string{"Video", "Audio", "Audio/Driver"}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("expected %q, got %q", expected, visited)
+	}
 }
 
-type TestSettings struct {
-	Video TestVideoSettings `bml:"Video"`
-	Audio TestAudioSettings `bml:"Audio"`
+func TestFromFlat(t *testing.T) {
+	m := map[string]string{
+		"Video/Multiplier": "2",
+		"Video/Driver":     "Metal",
+		"Input/Port[1]":    "2",
+		"Input/Port[0]":    "1",
+		"Input/Port[0]/On": "yes",
+		"Paths/Home":       "",
+	}
+
+	doc, err := FromFlat(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "Input\n  Port: 1\n    On: yes\n  Port: 2\nPaths\n  Home\nVideo\n  Driver: Metal\n  Multiplier: 2\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
 }
 
-func TestUnmarshalBasic(t *testing.T) {
+func TestFromFlatRoundTrip(t *testing.T) {
 	input := `Video
   Driver: Metal
-  Multiplier: 2
-  Luminance: 1.5
-  ColorBleed: true
-Audio
-  Driver: SDL
-  Volume: 0.8
-  Mute: false
-  Latency: 20`
+Input
+  Port: 1
+  Port: 2
+  Port: 3
+Description: top
+  Child: value`
 
-	var settings TestSettings
-	err := Unmarshal([]byte(input), &settings)
+	doc, err := Parse([]byte(input))
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("parse error: %v", err)
 	}
 
-	if settings.Video.Driver != "Metal" {
-		t.Errorf("expected 'Metal', got %q", settings.Video.Driver)
-	}
-	if settings.Video.Multiplier != 2 {
-		t.Errorf("expected 2, got %d", settings.Video.Multiplier)
-	}
-	if settings.Video.Luminance != 1.5 {
-		t.Errorf("expected 1.5, got %f", settings.Video.Luminance)
+	flat := doc.Flatten()
+	rebuilt, err := FromFlat(flat)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if settings.Video.ColorBleed != true {
-		t.Error("expected true")
+	if got := rebuilt.Flatten(); !reflect.DeepEqual(got, flat) {
+		t.Errorf("expected %v, got %v", flat, got)
 	}
-	if settings.Audio.Driver != "SDL" {
-		t.Errorf("expected 'SDL', got %q", settings.Audio.Driver)
+}
+
+func TestFromFlatNumericIndexOrder(t *testing.T) {
+	m := map[string]string{}
+	for i := 0; i < 12; i++ {
+		m[fmt.Sprintf("List/Item[%d]", i)] = strconv.Itoa(i)
 	}
-	if settings.Audio.Volume != 0.8 {
-		t.Errorf("expected 0.8, got %f", settings.Audio.Volume)
+
+	doc, err := FromFlat(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if settings.Audio.Mute != false {
-		t.Error("expected false")
+	items := doc.Root.Get("List").Children
+	if len(items) != 12 {
+		t.Fatalf("expected 12 items, got %d", len(items))
 	}
-	if settings.Audio.Latency != 20 {
-		t.Errorf("expected 20, got %d", settings.Audio.Latency)
+	for i, item := range items {
+		if item.Value != strconv.Itoa(i) {
+			t.Errorf("item %d: expected %d, got %q", i, i, item.Value)
+		}
 	}
 }
 
-func TestUnmarshalMissingNodes(t *testing.T) {
-	input := `Video
-  Driver: Metal`
-
-	var settings TestSettings
-	err := Unmarshal([]byte(input), &settings)
+func TestFromFlatEmptySegments(t *testing.T) {
+	doc, err := FromFlat(map[string]string{
+		"A//Item[0]": "a",
+		"A/Item[1]":  "b",
+		"":           "ignored",
+	})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if settings.Video.Driver != "Metal" {
-		t.Errorf("expected 'Metal', got %q", settings.Video.Driver)
-	}
-	// Missing fields should have zero values
-	if settings.Video.Multiplier != 0 {
-		t.Errorf("expected 0, got %d", settings.Video.Multiplier)
+	items := doc.Root.Get("A").Children
+	if len(items) != 2 || items[0].Value != "a" || items[1].Value != "b" {
+		t.Errorf("unexpected items: %v", items)
 	}
-	if settings.Audio.Driver != "" {
-		t.Errorf("expected empty, got %q", settings.Audio.Driver)
+	if doc.Root.Value != "" {
+		t.Errorf("expected root value to be untouched, got %q", doc.Root.Value)
 	}
 }
 
-func TestUnmarshalNonPointer(t *testing.T) {
-	var settings TestSettings
-	err := Unmarshal([]byte("Video"), settings)
-	if err == nil {
-		t.Fatal("expected error for non-pointer")
+func TestFromFlatErrors(t *testing.T) {
+	tests := []struct {
+		m        map[string]string
+		expected string
+	}{
+		{map[string]string{"A/Item[1000000000]": "x"}, `bml: FromFlat: path "A/Item[1000000000]": Item[1000000000] is set without Item[0]`},
+		{map[string]string{"A/Item[0]": "x", "A/Item[2]": "y"}, `bml: FromFlat: path "A/Item[2]": Item[2] is set without Item[1]`},
+		{map[string]string{"Port": "1", "Port[0]": "2"}, `bml: FromFlat: path "Port[0]": Port is used both with and without an index`},
+		{map[string]string{"A/bad name": "x"}, `bml: FromFlat: path "A/bad name": invalid node name "bad name"`},
+		{map[string]string{"Port[x]": "1"}, `bml: FromFlat: path "Port[x]": invalid node name "Port[x]"`},
 	}
-	if !strings.Contains(err.Error(), "pointer") {
-		t.Errorf("expected 'pointer' in error, got: %v", err)
+	for _, tt := range tests {
+		if _, err := FromFlat(tt.m); err == nil || err.Error() != tt.expected {
+			t.Errorf("%v: expected error %q, got %v", tt.m, tt.expected, err)
+		}
 	}
 }
 
-func TestUnmarshalNilPointer(t *testing.T) {
-	err := Unmarshal([]byte("Video"), nil)
-	if err == nil {
-		t.Fatal("expected error for nil pointer")
+func TestSplitSegment(t *testing.T) {
+	tests := []struct {
+		segment string
+		name    string
+		index   int
+	}{
+		{"Port", "Port", -1},
+		{"Port[0]", "Port", 0},
+		{"Port[12]", "Port", 12},
+		{"Port[x]", "Port[x]", -1},
+		{"Port[-1]", "Port[-1]", -1},
+		{"Port]", "Port]", -1},
 	}
-}
 
-func TestUnmarshalNonStruct(t *testing.T) {
-	var s string
-	err := Unmarshal([]byte("Video"), &s)
-	if err == nil {
-		t.Fatal("expected error for non-struct")
-	}
-	if !strings.Contains(err.Error(), "struct") {
-		t.Errorf("expected 'struct' in error, got: %v", err)
+	for _, tt := range tests {
+		name, index := splitSegment(tt.segment)
+		if name != tt.name || index != tt.index {
+			t.Errorf("splitSegment(%q) = (%q, %d), expected (%q, %d)", tt.segment, name, index, tt.name, tt.index)
+		}
 	}
 }
 
-type TestPointerSettings struct {
-	Driver *string `bml:"Driver"`
-	Count  *int    `bml:"Count"`
-}
+func TestComparePaths(t *testing.T) {
+	tests := []struct {
+		a, b string
+		sign int
+	}{
+		{"A", "B", -1},
+		{"B", "A", 1},
+		{"A", "A/B", -1},
+		{"A/Port[2]", "A/Port[10]", -1},
+		{"A/Port[10]", "A/Port[2]", 1},
+		{"A/Port", "A/Port[0]", -1},
+		{"A/B", "A/B", 0},
+	}
 
-func TestUnmarshalPointerFields(t *testing.T) {
-	input := `Driver: Metal
-Count: 5`
+	for _, tt := range tests {
+		got := comparePaths(tt.a, tt.b)
+		if (got < 0 && tt.sign >= 0) || (got > 0 && tt.sign <= 0) || (got == 0 && tt.sign != 0) {
+			t.Errorf("comparePaths(%q, %q) = %d, expected sign %d", tt.a, tt.b, got, tt.sign)
+		}
+	}
+}
 
-	var settings TestPointerSettings
-	err := Unmarshal([]byte(input), &settings)
+func TestDocumentClone(t *testing.T) {
+	doc, err := ParseWithOptions([]byte("// header\nVideo // inline\n  Driver: Metal\n"), ParseOptions{PreserveComments: true})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("parse error: %v", err)
 	}
+	doc.Root.Get("Video").Meta = map[string]interface{}{"line": 2}
 
-	if settings.Driver == nil || *settings.Driver != "Metal" {
-		t.Error("expected Driver to be 'Metal'")
+	clone := doc.Clone()
+	if !clone.Equal(doc) {
+		t.Fatal("clone is not equal to original")
 	}
-	if settings.Count == nil || *settings.Count != 5 {
-		t.Error("expected Count to be 5")
+	if string(Serialize(clone)) != string(Serialize(doc)) {
+		t.Errorf("clone serializes differently: %q", Serialize(clone))
 	}
-}
 
-func TestUnmarshalPointerFieldsMissing(t *testing.T) {
-	input := `Other: value`
+	// Mutating the clone must not affect the original
+	clone.Root.Set("Video/Driver", "OpenGL")
+	clone.Root.Get("Video").LeadingComments[0] = "changed"
+	clone.Root.Get("Video").Meta["line"] = 9
+	video := doc.Root.Get("Video")
+	if video.Get("Driver").Value != "Metal" || video.LeadingComments[0] != "header" || video.Meta["line"] != 2 {
+		t.Errorf("original modified through clone: %+v", video)
+	}
+	if clone.Equal(doc) {
+		t.Error("modified clone still equal to original")
+	}
 
-	var settings TestPointerSettings
-	err := Unmarshal([]byte(input), &settings)
-	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+	// Raw lines are copied too
+	doc, _ = ParseWithOptions([]byte("Notes: a\n  : b\n"), ParseOptions{KeepRaw: true})
+	doc.Clone().Root.Get("Notes").RawLines[0] = "changed"
+	if got := doc.Root.Get("Notes").RawLines[0]; got != "  : b" {
+		t.Errorf("original raw lines modified through clone: %q", got)
 	}
 
-	if settings.Driver != nil {
-		t.Error("expected Driver to be nil")
+	var nilDoc *Document
+	if nilDoc.Clone() != nil {
+		t.Error("Clone() of nil document should be nil")
 	}
-	if settings.Count != nil {
-		t.Error("expected Count to be nil")
+	if (&Document{}).Clone().Root != nil {
+		t.Error("Clone() of empty document should have nil root")
 	}
 }
 
-type TestUnexportedFields struct {
-	Public  string `bml:"Public"`
-	private string `bml:"private"`
-}
+func TestDocumentEqual(t *testing.T) {
+	a, _ := Parse([]byte("A: 1\nB\n  C: 2\n  D: 3\n"))
+	b, _ := Parse([]byte("B\n  D: 3\n  C: 2\nA: 1\n"))
+	c, _ := Parse([]byte("B\n  D: 3\n  C: 4\nA: 1\n"))
+	dup1, _ := Parse([]byte("A: 1\nA: 1\nA: 2\n"))
+	dup2, _ := Parse([]byte("A: 1\nA: 2\nA: 2\n"))
 
-func TestUnmarshalUnexportedFields(t *testing.T) {
-	input := `Public: value
-private: secret`
+	var nilDoc *Document
+	tests := []struct {
+		name          string
+		x, y          *Document
+		want, unorder bool
+	}{
+		{"same", a, a.Clone(), true, true},
+		{"reordered", a, b, false, true},
+		{"different value", b, c, false, false},
+		{"duplicates", dup1, dup2, false, false},
+		{"nil both", nilDoc, nil, true, true},
+		{"nil one", a, nil, false, false},
+		{"nil other", nil, a, false, false},
+	}
 
-	var settings TestUnexportedFields
-	err := Unmarshal([]byte(input), &settings)
-	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+	for _, tt := range tests {
+		if got := tt.x.Equal(tt.y); got != tt.want {
+			t.Errorf("%s: Equal: expected %v, got %v", tt.name, tt.want, got)
+		}
+		if got := tt.x.EqualUnordered(tt.y); got != tt.unorder {
+			t.Errorf("%s: EqualUnordered: expected %v, got %v", tt.name, tt.unorder, got)
+		}
 	}
 
-	if settings.Public != "value" {
-		t.Errorf("expected 'value', got %q", settings.Public)
+	if (&Node{Name: "A"}).EqualUnordered(&Node{Name: "B"}) {
+		t.Error("EqualUnordered() with different names should be false")
 	}
-	// private field should be zero value (unexported)
-	if settings.private != "" {
-		t.Errorf("expected empty, got %q", settings.private)
+	if (&Node{}).EqualUnordered(nil) {
+		t.Error("EqualUnordered() with nil node should be false")
 	}
 }
 
-type TestNoTagFields struct {
-	Tagged   string `bml:"Tagged"`
-	Untagged string
-}
-
-func TestUnmarshalNoTagFields(t *testing.T) {
-	input := `Tagged: value
-Untagged: ignored`
-
-	var settings TestNoTagFields
-	err := Unmarshal([]byte(input), &settings)
+func TestOverlayEnv(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: OpenGL\n  Multiplier: 2\nAudio\n  Driver: SDL"))
+
+	err := doc.overlayEnv("BML_", []string{
+		"BML_VIDEO_DRIVER=Metal",
+		"BML_AUDIO_LATENCY=20",
+		"BML_INPUT__PORT=1=2",
+		"BML_=ignored",
+		"HOME=/root",
+		"BMLVIDEO_MULTIPLIER=3",
+	})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if settings.Tagged != "value" {
-		t.Errorf("expected 'value', got %q", settings.Tagged)
-	}
-	if settings.Untagged != "" {
-		t.Errorf("expected empty (no tag), got %q", settings.Untagged)
+	expected := "Video\n  Driver: Metal\n  Multiplier: 2\nAudio\n  Driver: SDL\n  LATENCY: 20\nINPUT\n  PORT: 1=2\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
-}
-
-type TestUintFields struct {
-	Count  uint   `bml:"Count"`
-	Count8 uint8  `bml:"Count8"`
-	Count64 uint64 `bml:"Count64"`
-}
 
-func TestUnmarshalUintFields(t *testing.T) {
-	input := `Count: 42
-Count8: 255
-Count64: 9999999999`
+	t.Setenv("BMLTEST_VIDEO_DRIVER", "Vulkan")
+	if err := doc.OverlayEnv("BMLTEST_"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := doc.Root.Get("Video/Driver").Value; got != "Vulkan" {
+		t.Errorf("expected Vulkan from the environment, got %q", got)
+	}
 
-	var settings TestUintFields
-	err := Unmarshal([]byte(input), &settings)
-	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+	// A segment that is not a node name is an error, and nothing is set
+	err = doc.overlayEnv("BML_", []string{"BML_VIDEO_DRIVER=SDL", "BML_A_B!=1"})
+	if err == nil || err.Error() != `bml: OverlayEnv: variable BML_A_B!: invalid node name "B!"` {
+		t.Errorf("expected invalid node name error, got %v", err)
+	}
+	if got := doc.Root.Get("Video/Driver").Value; got != "Vulkan" || doc.Root.Get("A") != nil {
+		t.Errorf("expected the document to be unchanged, got %q", Serialize(doc))
 	}
 
-	if settings.Count != 42 {
-		t.Errorf("expected 42, got %d", settings.Count)
+	// Variables naming the same node in different case are an error in
+	// either order, and nothing is set
+	want := "bml: OverlayEnv: variables BML_VIDEO_DRIVER and BML_Video__Driver name the same node"
+	for _, environ := range [][]string{
+		{"BML_VIDEO_DRIVER=SDL", "BML_Video__Driver=Metal"},
+		{"BML_Video__Driver=Metal", "BML_VIDEO_DRIVER=SDL"},
+	} {
+		err = doc.overlayEnv("BML_", environ)
+		if err == nil || err.Error() != want {
+			t.Errorf("%q: expected error %q, got %v", environ, want, err)
+		}
 	}
-	if settings.Count8 != 255 {
-		t.Errorf("expected 255, got %d", settings.Count8)
+	if got := doc.Root.Get("Video/Driver").Value; got != "Vulkan" {
+		t.Errorf("expected the document to be unchanged, got %q", Serialize(doc))
 	}
-	if settings.Count64 != 9999999999 {
-		t.Errorf("expected 9999999999, got %d", settings.Count64)
+
+	var nilDoc *Document
+	if err := nilDoc.OverlayEnv("BML_"); err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
 }
 
-func TestUnmarshalInvalidInt(t *testing.T) {
-	input := `Count: abc`
+func TestApplyMigrations(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Shader: crt\n  Legacy: 1\nAudio\n  Driver: SDL"))
 
-	type S struct {
-		Count int `bml:"Count"`
+	rename := func(d *Document) error {
+		node := d.Root.Get("Video/Shader")
+		if node == nil {
+			return errors.New("missing Video/Shader")
+		}
+		node.Name = "PostShader"
+		return nil
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error for invalid int")
+	setDefault := func(d *Document) error {
+		if d.Root.Get("Audio/Latency") == nil {
+			d.Root.Set("Audio/Latency", "20")
+		}
+		return nil
+	}
+	remove := func(d *Document) error {
+		d.Root.Remove("Video/Legacy")
+		return nil
 	}
-}
 
-func TestUnmarshalInvalidUint(t *testing.T) {
-	input := `Count: -5`
+	if err := ApplyMigrations(doc, rename, setDefault, remove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Video\n  PostShader: crt\nAudio\n  Driver: SDL\n  Latency: 20\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
 
-	type S struct {
-		Count uint `bml:"Count"`
+	// Migrations stop at the first error
+	ran := false
+	err := ApplyMigrations(doc, setDefault, rename, func(*Document) error {
+		ran = true
+		return nil
+	})
+	if err == nil || err.Error() != "migration 1: missing Video/Shader" {
+		t.Errorf("expected error from the second migration, got %v", err)
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error for invalid uint")
+	if ran {
+		t.Error("expected migrations after the error to be skipped")
 	}
 }
 
-func TestUnmarshalInvalidFloat(t *testing.T) {
-	input := `Value: abc`
+func TestApplyPatch(t *testing.T) {
+	base := "// Settings\r\n" +
+		"Video\r\n" +
+		"\tDriver:   Metal // preferred\r\n" +
+		"\tShader crt=1 scale=2\r\n" +
+		"\r\n" +
+		"Audio\r\n" +
+		"\tDriver: SDL\r\n" +
+		"Port: 1\r\n" +
+		"Port: 2"
+	patch, _ := Parse([]byte("Video\n  Driver: OpenGL\n  Shader scale=3\n  Sync: true\nAudio\n  Latency: 20\nPort: 1\nPort: 4\nInput\n  Device: keyboard"))
+
+	out, err := ApplyPatch([]byte(base), patch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "// Settings\r\n" +
+		"Video\r\n" +
+		"\tDriver:   OpenGL // preferred\r\n" +
+		"\tShader crt=1 scale=3\r\n" +
+		"\tSync: true\r\n" +
+		"\r\n" +
+		"Audio\r\n" +
+		"\tDriver: SDL\r\n" +
+		"\tLatency: 20\r\n" +
+		"Port: 1\r\n" +
+		"Port: 4\r\n" +
+		"Input\r\n" +
+		"  Device: keyboard\r\n"
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, string(out))
+	}
+
+	// Children of a node without any get two more spaces of indentation
+	patch, _ = Parse([]byte("Video\n  Shader\n    Path: crt.slang"))
+	out, err = ApplyPatch([]byte("Video\n  Shader\n"), patch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "Video\n  Shader\n    Path: crt.slang\n"; string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, string(out))
+	}
 
-	type S struct {
-		Value float64 `bml:"Value"`
+	// An empty base receives the whole patch, and a nil patch changes nothing
+	if out, _ := ApplyPatch(nil, patch); string(out) != "Video\n  Shader\n    Path: crt.slang\n" {
+		t.Errorf("unexpected output for an empty base: %q", string(out))
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error for invalid float")
+	if out, _ := ApplyPatch([]byte(base), nil); string(out) != base {
+		t.Errorf("expected a nil patch to leave the base unchanged, got %q", string(out))
 	}
-}
+
+	// Multiline values cannot be edited in place, and the base must parse
+	patch, _ = Parse([]byte("Game\n  Notes: new"))
+	if _, err := ApplyPatch([]byte("Game\n  Notes: a\n    : b"), patch); err == nil || err.Error() != "line 2: cannot patch a multiline value" {
+		t.Errorf("expected a multiline value error, got %v", err)
+	}
+	if _, err := ApplyPatch([]byte("  : orphan"), patch); err == nil {
+		t.Error("expected an error for an invalid base")
+	}
+
+	// A path below an attribute has nowhere to go
+	patch, _ = Parse([]byte("Video\n  Shader\n    crt\n      Level: 2"))
+	if _, err := ApplyPatch([]byte("Video\n  Shader crt=1"), patch); err == nil || err.Error() != "line 2: cannot patch below the attribute crt" {
+		t.Errorf("expected an attribute error, got %v", err)
+	}
+}
+
+func TestApplyPatchInPlace(t *testing.T) {
+	tests := []struct {
+		base, patch, expected string
+	}{
+		{"Driver=Metal //note", "Driver: OpenGL", "Driver=OpenGL //note"},
+		{"Driver:Metal", "Driver: OpenGL", "Driver:OpenGL"},
+		{"Driver:  Metal   //  note", "Driver: OpenGL", "Driver:  OpenGL   //  note"},
+		{"Driver: Metal", "Driver:", "Driver:"},
+		{"Driver:", "Driver: OpenGL", "Driver: OpenGL"},
+		{"Driver: Metal", `Driver=" padded "`, `Driver=" padded "`},
+		{`Title="Old Name"  //x`, "Title: New", `Title="New"  //x`},
+		{`Title=Old`, "Title: New Name", `Title="New Name"`},
+		{"Shader  crt=1   scale=2 //keep", "Shader\n  scale: 3\n  crt: 0", "Shader  crt=0   scale=3 //keep"},
+		{"Shader crt //keep", "Shader\n  crt: 1", "Shader crt=1 //keep"},
+		{"Shader crt=1", "Shader: on", "Shader=on crt=1"},
+		{"Shader //keep", "Shader: on", "Shader: on //keep"},
+		{"Shader", "Shader:", "Shader:"},
+		{"Shader", `Shader=" on "`, `Shader=" on "`},
+		{"Shader crt=1", "Shader\n  crt:", `Shader crt=""`},
+	}
+	for _, tt := range tests {
+		patch, err := Parse([]byte(tt.patch))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		out, err := ApplyPatch([]byte(tt.base), patch)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(out) != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.base, tt.expected, out)
+		}
+	}
+
+	// A value that cannot be written in the same form rewrites the line
+	patch := &Document{Root: &Node{Children: []*Node{
+		{Name: "Driver", Value: ` "quoted" `},
+		{Name: "Shader", Children: []*Node{{Name: "crt", Value: `say "hi"`}}},
+	}}}
+	out, err := ApplyPatch([]byte("Driver: Metal //note\nShader crt=1 scale=2"), patch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "Driver //note\n  :  \"quoted\" \nShader scale=2\n  crt: say \"hi\""
+	if string(out) != expected {
+		t.Errorf("expected %q, got %q", expected, out)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, _ := Parse([]byte("Video\n  Driver: Metal\n  Shader: crt\nPort: 1\nPort: 2\nAudio"))
+	b, _ := Parse([]byte("// Updated\nVideo\n  Driver: OpenGL\nPort: 1\nPort: 2\nPort: 3\nAudio\nInput\n  Device: keyboard"))
+
+	want := []Change{
+		{Path: "Input/Device", Kind: ChangeAdded, New: "keyboard"},
+		{Path: "Port[2]", Kind: ChangeAdded, New: "3"},
+		{Path: "Video/Driver", Kind: ChangeModified, Old: "Metal", New: "OpenGL"},
+		{Path: "Video/Shader", Kind: ChangeRemoved, Old: "crt"},
+	}
+	if got := Diff(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff: expected %+v, got %+v", want, got)
+	}
+
+	if got := Diff(a, a.Clone()); got != nil {
+		t.Errorf("expected no changes between equal documents, got %+v", got)
+	}
+	if got := Diff(nil, b); len(got) != 6 || got[0].Kind != ChangeAdded {
+		t.Errorf("expected every path of b to be added, got %+v", got)
+	}
+}
+
+// === Serialization Tests ===
+
+func TestSerializeEmpty(t *testing.T) {
+	doc := &Document{Root: &Node{}}
+	data := Serialize(doc)
+	if len(data) != 0 {
+		t.Errorf("expected empty output, got %q", string(data))
+	}
+}
+
+func TestSerializeNil(t *testing.T) {
+	data := Serialize(nil)
+	if data != nil {
+		t.Error("expected nil for nil document")
+	}
+
+	data = Serialize(&Document{})
+	if data != nil {
+		t.Error("expected nil for nil root")
+	}
+}
+
+func TestSerializeSingleNode(t *testing.T) {
+	doc := &Document{Root: &Node{
+		Children: []*Node{{Name: "Video"}},
+	}}
+	data := Serialize(doc)
+	expected := "Video\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
+
+func TestSerializeNodeWithValue(t *testing.T) {
+	doc := &Document{Root: &Node{
+		Children: []*Node{{Name: "Driver", Value: "Metal"}},
+	}}
+	data := Serialize(doc)
+	expected := "Driver: Metal\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
+
+func TestSerializeNested(t *testing.T) {
+	doc := &Document{Root: &Node{
+		Children: []*Node{
+			{
+				Name: "Video",
+				Children: []*Node{
+					{Name: "Driver", Value: "Metal"},
+				},
+			},
+		},
+	}}
+	data := Serialize(doc)
+	expected := "Video\n  Driver: Metal\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
+
+func TestSerializeMultilineValue(t *testing.T) {
+	doc := &Document{Root: &Node{
+		Children: []*Node{{Name: "Desc", Value: "Line1\nLine2"}},
+	}}
+	data := Serialize(doc)
+	expected := "Desc\n  : Line1\n  : Line2\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Multiplier: 2
+Audio
+  Driver: SDL
+  Volume: 1.0
+`
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	output := Serialize(doc)
+	doc2, err := Parse(output)
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+
+	// Verify key values
+	if doc2.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("Video/Driver mismatch after round-trip")
+	}
+	if doc2.Root.Get("Audio/Volume").Float(0) != 1.0 {
+		t.Error("Audio/Volume mismatch after round-trip")
+	}
+}
+
+func TestSerializeWhitespaceValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"   ", "Node=\"   \"\n"},
+		{" padded ", "Node=\" padded \"\n"},
+		{"\tTab", "Node=\"\tTab\"\n"},
+		{"plain", "Node: plain\n"},
+		{` say "hi"`, "Node\n  :  say \"hi\"\n"},
+		{`"hi" `, "Node\n  : \"hi\" \n"},
+	}
+
+	for _, tt := range tests {
+		doc := &Document{Root: &Node{Children: []*Node{{Name: "Node", Value: tt.value}}}}
+		output := Serialize(doc)
+		if string(output) != tt.want {
+			t.Errorf("Serialize(%q): expected %q, got %q", tt.value, tt.want, output)
+		}
+	}
+
+	for _, value := range []string{"   ", ` say "hi"`, `"hi" `} {
+		doc := &Document{Root: &Node{Children: []*Node{{Name: "Node", Value: value}}}}
+		doc2, err := Parse(Serialize(doc))
+		if err != nil {
+			t.Fatalf("re-parse error: %v", err)
+		}
+		if got := doc2.Root.Get("Node").Value; got != value {
+			t.Errorf("Value after round-trip: expected %q, got %q", value, got)
+		}
+	}
+}
+
+func TestSerializeAttributes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"flags and values", "Node a=1 b=\"x y\" c\n", "Node a=1 b=\"x y\" c\n"},
+		{"value and attributes", "Node=v a=1\n", "Node=v a=1\n"},
+		{"spaced value", "Node=\"v w\" a=1 // note\n", "Node=\"v w\" a=1 // note\n"},
+		{"attributes and children", "Node a=1\n  Child: 2\n", "Node a=1\n  Child: 2\n"},
+		{"multiline value", "Node a=1\n  : one\n  : two\n", "Node a=1\n  : one\n  : two\n"},
+		{"heredoc", "Node: <<END\ntext\nEND\n", "Node: <<END\ntext\nEND\n"},
+	}
+
+	for _, tt := range tests {
+		doc, err := ParseWithOptions([]byte(tt.input), ParseOptions{PreserveComments: true, Heredoc: true})
+		if err != nil {
+			t.Fatalf("%s: Parse error: %v", tt.name, err)
+		}
+		if got := string(Serialize(doc)); got != tt.want {
+			t.Errorf("%s: Serialize: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	attr := func(name, value string) *Node { return &Node{Name: name, Value: value, IsAttr: true} }
+	nodes := []struct {
+		name string
+		node *Node
+		want string
+	}{
+		{"quoted attribute value", &Node{Name: "N", Children: []*Node{attr("a", "1"), attr("q", `say "hi"`)}}, "N a=1\n  q: say \"hi\"\n"},
+		{"quoted node value", &Node{Name: "N", Value: `"x"`, Children: []*Node{attr("a", "1")}}, "N: \"x\"\n  a: 1\n"},
+		{"attribute with children", &Node{Name: "N", Children: []*Node{{Name: "a", IsAttr: true, Children: []*Node{{Name: "b"}}}}}, "N\n  a\n    b\n"},
+		{"attribute with comment", &Node{Name: "N", Children: []*Node{{Name: "a", IsAttr: true, InlineComment: "c"}}}, "N\n  a // c\n"},
+		{"heredoc", &Node{Name: "N", Value: "x", Heredoc: "END", Children: []*Node{attr("a", "1")}}, "N: <<END\nx\nEND\n  a: 1\n"},
+	}
+	for _, tt := range nodes {
+		doc := &Document{Root: &Node{Children: []*Node{tt.node}}}
+		if got := string(Serialize(doc)); got != tt.want {
+			t.Errorf("%s: Serialize: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSerializeEmptyValue(t *testing.T) {
+	input := "None\nEmpty:\nEquals:\nNode a= b c=\"\"\nAttrs=\"\" x=1\nMulti\n  :\n"
+	want := "None\nEmpty:\nEquals:\nNode a=\"\" b c=\"\"\nAttrs=\"\" x=1\nMulti:\n"
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if doc.Root.Get("None").HasValue || !doc.Root.Get("Empty").HasValue || !doc.Root.Get("Node/a").HasValue || doc.Root.Get("Node/b").HasValue {
+		t.Error("HasValue not set from input")
+	}
+
+	output := Serialize(doc)
+	if string(output) != want {
+		t.Errorf("Serialize: expected %q, got %q", want, output)
+	}
+
+	// The distinction survives a second round trip
+	doc2, err := Parse(output)
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+	if got := string(Serialize(doc2)); got != want {
+		t.Errorf("second Serialize: expected %q, got %q", want, got)
+	}
+
+	// Setting an empty value leaves the node without one, as before
+	// HasValue existed, unless HasValue is set explicitly
+	root := &Node{}
+	root.Set("Video/Driver", "")
+	root.Set("Video/Shader", "crt").HasValue = true
+	root.Set("Video/Shader", "")
+	root.Set("Audio", "").HasValue = true
+	if got := string(Serialize(&Document{Root: root})); got != "Video\n  Driver\n  Shader\nAudio:\n" {
+		t.Errorf("unexpected Serialize after Set: %q", got)
+	}
+}
+
+func TestSerializeFinalNewline(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
+
+	if got := string(SerializeWithOptions(doc, DefaultSerializeOptions())); got != "Video\n  Driver: Metal\n" {
+		t.Errorf("unexpected FinalNewline true: %q", got)
+	}
+	if got := string(SerializeWithOptions(doc, SerializeOptions{})); got != "Video\n  Driver: Metal" {
+		t.Errorf("unexpected FinalNewline false: %q", got)
+	}
+	if got := SerializeWithOptions(&Document{Root: &Node{}}, SerializeOptions{}); len(got) != 0 {
+		t.Errorf("unexpected empty document: %q", got)
+	}
+	if got := SerializeWithOptions(nil, SerializeOptions{}); got != nil {
+		t.Errorf("unexpected nil document: %q", got)
+	}
+}
+
+func TestSerializeNode(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Shader: crt\n    Path: /shaders\n  Driver: Metal\nAudio\n  Driver: SDL"))
+
+	expected := "Shader: crt\n  Path: /shaders\n"
+	if got := string(SerializeNode(doc.Root.Get("Video/Shader"))); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := SerializeNode(nil); got != nil {
+		t.Errorf("expected nil for nil node, got %q", got)
+	}
+}
+
+func TestSerializeFlattenSingleChild(t *testing.T) {
+	input := `Video
+  Driver: Metal
+Audio
+  Driver: SDL
+  Latency: 20
+Input
+  Port
+    Device: Gamepad
+Shader: crt
+  Path: a
+Paths
+  Path: /my roms
+Notes
+  Text
+    : one
+    : two
+Flags
+  Fullscreen
+`
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := DefaultSerializeOptions()
+	opts.FlattenSingleChild = true
+	got := string(SerializeWithOptions(doc, opts))
+	expected := `Video Driver=Metal
+Audio
+  Driver: SDL
+  Latency: 20
+Input
+  Port Device=Gamepad
+Shader: crt
+  Path: a
+Paths Path="/my roms"
+Notes
+  Text
+    : one
+    : two
+Flags Fullscreen
+`
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	doc2, err := Parse([]byte(got))
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+	if !doc.Equal(doc2) {
+		t.Errorf("round-trip changed the tree:\n%s", Serialize(doc2))
+	}
+}
+
+func TestSerializeAlignValues(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Multiplier: 2
+  Shader=" crt "
+  Output a=1
+  Notes: <<END
+free text
+  END
+  Empty:
+Audio
+  Latency: 20
+  Description
+    : one
+    : two
+`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{Heredoc: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	opts := DefaultSerializeOptions()
+	opts.AlignValues = true
+	got := string(SerializeWithOptions(doc, opts))
+	expected := `Video
+  Driver    : Metal
+  Multiplier: 2
+  Shader=" crt "
+  Output a=1
+  Notes     : <<END
+free text
+  END
+  Empty     :
+Audio
+  Latency: 20
+  Description
+    : one
+    : two
+`
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	doc2, err := ParseWithOptions([]byte(got), ParseOptions{Heredoc: true})
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+	if !doc.Equal(doc2) {
+		t.Errorf("round-trip changed the tree:\n%s", Serialize(doc2))
+	}
+	if got := doc2.Root.Get("Video/Empty"); !got.HasValue {
+		t.Error("expected aligned empty value to be kept")
+	}
+}
+
+// === Marshal/Unmarshal Tests ===
+
+type TestVideoSettings struct {
+	Driver     string  `bml:"Driver"`
+	Multiplier int     `bml:"Multiplier"`
+	Luminance  float64 `bml:"Luminance"`
+	ColorBleed bool    `bml:"ColorBleed"`
+}
+
+type TestAudioSettings struct {
+	Driver  string  `bml:"Driver"`
+	Volume  float64 `bml:"Volume"`
+	Mute    bool    `bml:"Mute"`
+	Latency int64   `bml:"Latency"`
+}
+
+type TestSettings struct {
+	Video TestVideoSettings `bml:"Video"`
+	Audio TestAudioSettings `bml:"Audio"`
+}
+
+func TestUnmarshalBasic(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Multiplier: 2
+  Luminance: 1.5
+  ColorBleed: true
+Audio
+  Driver: SDL
+  Volume: 0.8
+  Mute: false
+  Latency: 20`
+
+	var settings TestSettings
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Video.Driver != "Metal" {
+		t.Errorf("expected 'Metal', got %q", settings.Video.Driver)
+	}
+	if settings.Video.Multiplier != 2 {
+		t.Errorf("expected 2, got %d", settings.Video.Multiplier)
+	}
+	if settings.Video.Luminance != 1.5 {
+		t.Errorf("expected 1.5, got %f", settings.Video.Luminance)
+	}
+	if settings.Video.ColorBleed != true {
+		t.Error("expected true")
+	}
+	if settings.Audio.Driver != "SDL" {
+		t.Errorf("expected 'SDL', got %q", settings.Audio.Driver)
+	}
+	if settings.Audio.Volume != 0.8 {
+		t.Errorf("expected 0.8, got %f", settings.Audio.Volume)
+	}
+	if settings.Audio.Mute != false {
+		t.Error("expected false")
+	}
+	if settings.Audio.Latency != 20 {
+		t.Errorf("expected 20, got %d", settings.Audio.Latency)
+	}
+}
+
+func TestUnmarshalNumericBools(t *testing.T) {
+	type Boot struct {
+		Fast bool `bml:"Fast"`
+		Mute bool `bml:"Mute"`
+		Skip bool `bml:"Skip"`
+	}
+	input := []byte("Fast: 1\nMute: 0\nSkip: true")
+
+	var strict Boot
+	if err := Unmarshal(input, &strict); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if strict.Fast || strict.Mute || !strict.Skip {
+		t.Errorf("expected numeric values to be false without NumericBools, got %+v", strict)
+	}
+
+	var numeric Boot
+	if err := UnmarshalWith(input, &numeric, UnmarshalOptions{NumericBools: true}); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !numeric.Fast || numeric.Mute || !numeric.Skip {
+		t.Errorf("unexpected values with NumericBools: %+v", numeric)
+	}
+}
+
+func TestUnmarshalMissingNodes(t *testing.T) {
+	input := `Video
+  Driver: Metal`
+
+	var settings TestSettings
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Video.Driver != "Metal" {
+		t.Errorf("expected 'Metal', got %q", settings.Video.Driver)
+	}
+	// Missing fields should have zero values
+	if settings.Video.Multiplier != 0 {
+		t.Errorf("expected 0, got %d", settings.Video.Multiplier)
+	}
+	if settings.Audio.Driver != "" {
+		t.Errorf("expected empty, got %q", settings.Audio.Driver)
+	}
+}
+
+func TestUnmarshalNonPointer(t *testing.T) {
+	var settings TestSettings
+	err := Unmarshal([]byte("Video"), settings)
+	if err == nil {
+		t.Fatal("expected error for non-pointer")
+	}
+	if !strings.Contains(err.Error(), "pointer") {
+		t.Errorf("expected 'pointer' in error, got: %v", err)
+	}
+}
+
+func TestUnmarshalNilPointer(t *testing.T) {
+	err := Unmarshal([]byte("Video"), nil)
+	if err == nil {
+		t.Fatal("expected error for nil pointer")
+	}
+}
+
+func TestUnmarshalNonStruct(t *testing.T) {
+	var s string
+	err := Unmarshal([]byte("Video"), &s)
+	if err == nil {
+		t.Fatal("expected error for non-struct")
+	}
+	if !strings.Contains(err.Error(), "struct") {
+		t.Errorf("expected 'struct' in error, got: %v", err)
+	}
+}
+
+type Game struct {
+	Title string `bml:"Title"`
+	Year  int    `bml:"Year"`
+}
+
+func TestUnmarshalRootSlice(t *testing.T) {
+	input := []byte("Game\n  Title: Chrono Trigger\n  Year: 1995\nPublisher: Square\nGame\n  Title: Earthbound\n  Year: 1994\n")
+
+	var games []Game
+	var unknown []string
+	opts := UnmarshalOptions{UnknownHandler: func(path string, _ *Node) { unknown = append(unknown, path) }}
+	if err := UnmarshalWith(input, &games, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Game{{"Chrono Trigger", 1995}, {"Earthbound", 1994}}
+	if !reflect.DeepEqual(games, expected) {
+		t.Errorf("expected %+v, got %+v", expected, games)
+	}
+	if !reflect.DeepEqual(unknown, []string{"Publisher"}) {
+		t.Errorf("expected Publisher to be unknown, got %v", unknown)
+	}
+
+	var ptrs []*Game
+	if err := Unmarshal(input, &ptrs); err != nil || len(ptrs) != 2 || ptrs[1].Title != "Earthbound" {
+		t.Errorf("unexpected result %v, %v", ptrs, err)
+	}
+
+	// Elements of an unnamed type are read from every top-level node
+	var values []string
+	if err := Unmarshal([]byte("A: 1\nB: 2\nA: 3\n"), &values); err != nil || !reflect.DeepEqual(values, []string{"1", "2", "3"}) {
+		t.Errorf("unexpected result %v, %v", values, err)
+	}
+
+	if err := Unmarshal([]byte("Game\n  Year: soon\n"), &games); err == nil || !strings.Contains(err.Error(), "element 0: field Year:") {
+		t.Errorf("expected an element error, got %v", err)
+	}
+}
+
+type TestPointerSettings struct {
+	Driver *string `bml:"Driver"`
+	Count  *int    `bml:"Count"`
+}
+
+func TestUnmarshalPointerFields(t *testing.T) {
+	input := `Driver: Metal
+Count: 5`
+
+	var settings TestPointerSettings
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Driver == nil || *settings.Driver != "Metal" {
+		t.Error("expected Driver to be 'Metal'")
+	}
+	if settings.Count == nil || *settings.Count != 5 {
+		t.Error("expected Count to be 5")
+	}
+}
+
+func TestUnmarshalPointerFieldsMissing(t *testing.T) {
+	input := `Other: value`
+
+	var settings TestPointerSettings
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Driver != nil {
+		t.Error("expected Driver to be nil")
+	}
+	if settings.Count != nil {
+		t.Error("expected Count to be nil")
+	}
+}
+
+type TestUnexportedFields struct {
+	Public  string `bml:"Public"`
+	private string `bml:"private"`
+}
+
+func TestUnmarshalUnexportedFields(t *testing.T) {
+	input := `Public: value
+private: secret`
+
+	var settings TestUnexportedFields
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Public != "value" {
+		t.Errorf("expected 'value', got %q", settings.Public)
+	}
+	// private field should be zero value (unexported)
+	if settings.private != "" {
+		t.Errorf("expected empty, got %q", settings.private)
+	}
+}
+
+type TestNoTagFields struct {
+	Tagged   string `bml:"Tagged"`
+	Untagged string
+}
+
+func TestUnmarshalNoTagFields(t *testing.T) {
+	input := `Tagged: value
+Untagged: ignored`
+
+	var settings TestNoTagFields
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Tagged != "value" {
+		t.Errorf("expected 'value', got %q", settings.Tagged)
+	}
+	if settings.Untagged != "" {
+		t.Errorf("expected empty (no tag), got %q", settings.Untagged)
+	}
+}
+
+type TestUintFields struct {
+	Count  uint   `bml:"Count"`
+	Count8 uint8  `bml:"Count8"`
+	Count64 uint64 `bml:"Count64"`
+}
+
+func TestUnmarshalUintFields(t *testing.T) {
+	input := `Count: 42
+Count8: 255
+Count64: 9999999999`
+
+	var settings TestUintFields
+	err := Unmarshal([]byte(input), &settings)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if settings.Count != 42 {
+		t.Errorf("expected 42, got %d", settings.Count)
+	}
+	if settings.Count8 != 255 {
+		t.Errorf("expected 255, got %d", settings.Count8)
+	}
+	if settings.Count64 != 9999999999 {
+		t.Errorf("expected 9999999999, got %d", settings.Count64)
+	}
+}
+
+func TestUnmarshalInvalidInt(t *testing.T) {
+	input := `Count: abc`
+
+	type S struct {
+		Count int `bml:"Count"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error for invalid int")
+	}
+}
+
+func TestUnmarshalInvalidUint(t *testing.T) {
+	input := `Count: -5`
+
+	type S struct {
+		Count uint `bml:"Count"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error for invalid uint")
+	}
+}
+
+func TestUnmarshalInvalidFloat(t *testing.T) {
+	input := `Value: abc`
+
+	type S struct {
+		Value float64 `bml:"Value"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error for invalid float")
+	}
+}
+
+func TestUnmarshalDigitSeparators(t *testing.T) {
+	type S struct {
+		Int   int     `bml:"Int"`
+		Uint  uint    `bml:"Uint"`
+		Float float64 `bml:"Float"`
+	}
+
+	var s S
+	if err := Unmarshal([]byte("Int: -1_000\nUint: 65_536\nFloat: 1_000.25\n"), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if s.Int != -1000 || s.Uint != 65536 || s.Float != 1000.25 {
+		t.Errorf("unexpected Unmarshal result: %+v", s)
+	}
+
+	if err := Unmarshal([]byte("Int: 1__000\n"), &s); err == nil {
+		t.Error("expected error for misplaced separator")
+	}
+}
+
+func TestUnmarshalStrip(t *testing.T) {
+	type S struct {
+		Multiplier int     `bml:"Multiplier,strip=()"`
+		Latency    uint    `bml:"Latency,strip=ms"`
+		Volume     float64 `bml:"Volume,strip=%"`
+		Plain      int     `bml:"Plain"`
+	}
+
+	var s S
+	if err := Unmarshal([]byte("Multiplier: (-2)\nLatency: 20 ms\nVolume: 50.5%\n"), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if s.Multiplier != -2 || s.Latency != 20 || s.Volume != 50.5 {
+		t.Errorf("unexpected Unmarshal result: %+v", s)
+	}
+
+	// Fields without the option stay strict
+	if err := Unmarshal([]byte("Plain: (2)\n"), &s); err == nil {
+		t.Error("expected error for wrapped value without strip")
+	}
+	if err := Unmarshal([]byte("Multiplier: (2x)\n"), &s); err == nil {
+		t.Error("expected error for characters left after stripping")
+	}
+}
+
+func TestUnmarshalFloatNotation(t *testing.T) {
+	type S struct {
+		Value float64 `bml:"Value"`
+	}
+
+	var s S
+	if err := Unmarshal([]byte("Value: 1.0e-1\n"), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if s.Value != 0.1 {
+		t.Errorf("Value: expected 0.1, got %v", s.Value)
+	}
+
+	for _, input := range []string{"Value: NaN\n", "Value: -Inf\n"} {
+		err := Unmarshal([]byte(input), &s)
+		if err == nil || !strings.Contains(err.Error(), "not a finite number") {
+			t.Errorf("Unmarshal(%q) error: expected finite number error, got %v", input, err)
+		}
+	}
+}
+
+func TestMarshalNonFiniteFloat(t *testing.T) {
+	type S struct {
+		Value float64 `bml:"Value"`
+	}
+
+	for _, f := range []float64{math.NaN(), math.Inf(1), math.Inf(-1)} {
+		_, err := Marshal(S{Value: f})
+		if err == nil || !strings.Contains(err.Error(), "not a finite number") {
+			t.Errorf("expected finite number error for %v, got %v", f, err)
+		}
+	}
+	if _, err := MarshalValue(map[string]float32{"Value": float32(math.Inf(1))}); err == nil {
+		t.Error("expected error for infinite map value")
+	}
+
+	// Finite values still round-trip
+	data, err := Marshal(S{Value: -1.5e-7})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var s S
+	if err := Unmarshal(data, &s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Value != -1.5e-7 {
+		t.Errorf("expected %v, got %v", -1.5e-7, s.Value)
+	}
+}
 
 func TestUnmarshalEmptyNumericValues(t *testing.T) {
 	input := `Int:
 Float:
 Uint:`
 
-	type S struct {
-		Int   int     `bml:"Int"`
-		Float float64 `bml:"Float"`
-		Uint  uint    `bml:"Uint"`
+	type S struct {
+		Int   int     `bml:"Int"`
+		Float float64 `bml:"Float"`
+		Uint  uint    `bml:"Uint"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	// Empty values should leave zero values
+	if s.Int != 0 || s.Float != 0 || s.Uint != 0 {
+		t.Error("expected zero values for empty strings")
+	}
+}
+
+func TestUnmarshalStrictNumbers(t *testing.T) {
+	opts := UnmarshalOptions{StrictNumbers: true}
+	for _, field := range []string{"Int", "Uint", "Float"} {
+		type S struct {
+			Int   int     `bml:"Int"`
+			Uint  uint8   `bml:"Uint"`
+			Float float32 `bml:"Float"`
+		}
+		var s S
+		err := UnmarshalWith([]byte(field+":\n"), &s, opts)
+		if err == nil || !strings.Contains(err.Error(), "field "+field+": empty value") {
+			t.Errorf("%s: expected empty value error naming the field, got %v", field, err)
+		}
+	}
+
+	// Optional numbers stay nil and absent nodes are not an error
+	type P struct {
+		Int     *int       `bml:"Int"`
+		Float   *float64   `bml:"Float"`
+		Missing int        `bml:"Missing"`
+		Level   *testLevel `bml:"Level"`
+		Name    *string    `bml:"Name"`
+		Set     *int       `bml:"Set"`
+	}
+	var p P
+	if err := UnmarshalWith([]byte("Int:\nFloat: \nName:\nSet: 3\n"), &p, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Int != nil || p.Float != nil || p.Name == nil || p.Set == nil || *p.Set != 3 {
+		t.Errorf("unexpected result: %+v", p)
+	}
+
+	// An Unmarshaler decodes even an empty value itself
+	if err := UnmarshalWith([]byte("Level:\n"), &p, opts); err == nil || !strings.Contains(err.Error(), "bad level") {
+		t.Errorf("expected Unmarshaler error, got %v", err)
+	}
+}
+
+type TestUnsupportedType struct {
+	Data complex128 `bml:"Data"`
+}
+
+func TestUnmarshalUnsupportedType(t *testing.T) {
+	input := `Data: value`
+
+	var settings TestUnsupportedType
+	err := Unmarshal([]byte(input), &settings)
+	if err == nil {
+		t.Fatal("expected error for unsupported type")
+	}
+	if !strings.Contains(err.Error(), "unsupported") {
+		t.Errorf("expected 'unsupported' in error, got: %v", err)
+	}
+}
+
+func TestUnmarshalNode(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Multiplier: 2
+  Luminance: 1.5
+  ColorBleed: true`
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var video TestVideoSettings
+	if err := UnmarshalNode(doc.Root.Get("Video"), &video); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if video.Driver != "Metal" || video.Multiplier != 2 || video.Luminance != 1.5 || !video.ColorBleed {
+		t.Errorf("unexpected values: %+v", video)
+	}
+}
+
+func TestUnmarshalNodeNilNode(t *testing.T) {
+	video := TestVideoSettings{Driver: "OpenGL"}
+	if err := UnmarshalNode(nil, &video); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if video.Driver != "OpenGL" {
+		t.Errorf("expected struct to be unchanged, got %+v", video)
+	}
+}
+
+func TestUnmarshalNodeInvalidTarget(t *testing.T) {
+	node := &Node{}
+
+	var video TestVideoSettings
+	if err := UnmarshalNode(node, video); err == nil || !strings.Contains(err.Error(), "UnmarshalNode requires a pointer") {
+		t.Errorf("expected pointer error, got: %v", err)
+	}
+
+	var nilPtr *TestVideoSettings
+	if err := UnmarshalNode(node, nilPtr); err == nil || !strings.Contains(err.Error(), "non-nil pointer") {
+		t.Errorf("expected non-nil pointer error, got: %v", err)
+	}
+
+	var str string
+	if err := UnmarshalNode(node, &str); err == nil || !strings.Contains(err.Error(), "pointer to a struct") {
+		t.Errorf("expected pointer to struct error, got: %v", err)
+	}
+}
+
+func TestUnmarshalLenient(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Multiplier: two
+  Luminance: bright
+  ColorBleed: true
+Audio
+  Driver: SDL
+  Volume: loud
+  Latency: 20`
+
+	var settings TestSettings
+	err := UnmarshalLenient([]byte(input), &settings)
+	if err == nil {
+		t.Fatal("expected error for invalid fields")
+	}
+
+	// Valid fields are still populated
+	if settings.Video.Driver != "Metal" || !settings.Video.ColorBleed {
+		t.Errorf("unexpected video settings: %+v", settings.Video)
+	}
+	if settings.Audio.Driver != "SDL" || settings.Audio.Latency != 20 {
+		t.Errorf("unexpected audio settings: %+v", settings.Audio)
+	}
+
+	// Every failure is reported with its full field path
+	msg := err.Error()
+	for _, want := range []string{
+		"field Video: field Multiplier:",
+		"field Video: field Luminance:",
+		"field Audio: field Volume:",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("expected error to contain %q, got: %v", want, msg)
+		}
+	}
+	if lines := strings.Split(msg, "\n"); len(lines) != 3 {
+		t.Errorf("expected 3 errors, got %d: %v", len(lines), msg)
+	}
+
+	var numErr *strconv.NumError
+	if !errors.As(err, &numErr) {
+		t.Error("expected joined error to wrap the conversion errors")
+	}
+}
+
+func TestUnmarshalLenientValid(t *testing.T) {
+	var settings TestSettings
+	if err := UnmarshalLenient([]byte("Video\n  Driver: Metal"), &settings); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if settings.Video.Driver != "Metal" {
+		t.Errorf("expected 'Metal', got %q", settings.Video.Driver)
+	}
+}
+
+func TestNumber(t *testing.T) {
+	type Settings struct {
+		Luminance Number  `bml:"Luminance"`
+		Count     Number  `bml:"Count"`
+		Scale     *Number `bml:"Scale"`
+	}
+
+	input := "Luminance: 1.50\nCount: 1_000\nScale: 2.0e3\n"
+	var s Settings
+	if err := Unmarshal([]byte(input), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if s.Luminance.String() != "1.50" {
+		t.Errorf("expected the raw text 1.50, got %q", s.Luminance)
+	}
+	if f, err := s.Luminance.Float64(); err != nil || f != 1.5 {
+		t.Errorf("unexpected Float64 result: %v, %v", f, err)
+	}
+	if i, err := s.Count.Int64(); err != nil || i != 1000 {
+		t.Errorf("unexpected Int64 result: %v, %v", i, err)
+	}
+	if _, err := s.Luminance.Int64(); err == nil {
+		t.Error("expected Int64 of 1.50 to fail")
+	}
+	if _, err := Number("inf").Float64(); err == nil {
+		t.Error("expected Float64 of inf to fail")
+	}
+
+	data, err := Marshal(s)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if string(data) != input {
+		t.Errorf("round trip: expected %q, got %q", input, data)
+	}
+}
+
+func TestUnmarshalNumberValidation(t *testing.T) {
+	type Settings struct {
+		Scale  Number  `bml:"Scale"`
+		Offset *Number `bml:"Offset"`
+	}
+
+	var s Settings
+	err := Unmarshal([]byte("Scale: abc"), &s)
+	if err == nil || err.Error() != `field Scale: cannot parse "abc" as number: strconv.ParseFloat: parsing "abc": invalid syntax` {
+		t.Errorf("expected an invalid number error, got %v", err)
+	}
+	if err := Unmarshal([]byte("Scale: nan"), &s); err == nil {
+		t.Error("expected nan to be rejected")
+	}
+
+	s = Settings{}
+	if err := Unmarshal([]byte("Scale:\nOffset:"), &s); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Scale != "" || s.Offset == nil || *s.Offset != "" {
+		t.Errorf("expected empty numbers, got %q, %v", s.Scale, s.Offset)
+	}
+
+	s = Settings{}
+	opts := UnmarshalOptions{StrictNumbers: true}
+	if err := UnmarshalWith([]byte("Offset:"), &s, opts); err != nil || s.Offset != nil {
+		t.Errorf("expected an empty optional number to stay nil, got %v, %v", err, s.Offset)
+	}
+	err = UnmarshalWith([]byte("Scale:"), &s, opts)
+	if err == nil || err.Error() != "field Scale: empty value for a number" {
+		t.Errorf("expected an empty number error, got %v", err)
+	}
+}
+
+func TestUnmarshalRequired(t *testing.T) {
+	type Settings struct {
+		Driver string `bml:"Driver|Backend,required"`
+		Volume int    `bml:"Volume"`
+	}
+
+	var s Settings
+	err := Unmarshal([]byte("Volume: 3"), &s)
+	if err == nil || err.Error() != "field Driver: required node Driver is missing" {
+		t.Errorf("expected a missing required node error, got %v", err)
+	}
+	if err := Unmarshal([]byte("Backend: SDL"), &s); err != nil || s.Driver != "SDL" {
+		t.Errorf("expected an alias to satisfy required, got %v, %q", err, s.Driver)
+	}
+}
+
+func TestValidateAgainst(t *testing.T) {
+	type Settings struct {
+		Driver     string  `bml:"Driver,required"`
+		Multiplier int     `bml:"Multiplier"`
+		Luminance  float64 `bml:"Luminance"`
+		Video      struct {
+			Sync int `bml:"Sync"`
+		} `bml:"Video"`
+	}
+
+	s := Settings{Driver: "Metal", Multiplier: 2}
+	errs := ValidateAgainst([]byte("Multiplier: two\nLuminance: bright\nVideo\n  Sync: often"), &s)
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	want := []string{
+		"field Driver: required node Driver is missing",
+		"field Multiplier: ",
+		"field Luminance: ",
+		"field Video: field Sync: ",
+	}
+	if len(msgs) != len(want) {
+		t.Fatalf("ValidateAgainst: expected %d errors, got %q", len(want), msgs)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(msgs[i], prefix) {
+			t.Errorf("error %d: expected prefix %q, got %q", i, prefix, msgs[i])
+		}
+	}
+
+	// The target is never written
+	if s.Driver != "Metal" || s.Multiplier != 2 || s.Luminance != 0 {
+		t.Errorf("expected v to be unchanged, got %+v", s)
+	}
+
+	if errs := ValidateAgainst([]byte("Driver: SDL\nMultiplier: 3"), &s); errs != nil {
+		t.Errorf("expected no errors for a valid document, got %v", errs)
+	}
+	if errs := ValidateAgainst([]byte("  : orphan"), &s); len(errs) != 1 {
+		t.Errorf("expected a parse error, got %v", errs)
+	}
+	if errs := ValidateAgainst([]byte("Driver: SDL"), s); len(errs) != 1 || errs[0].Error() != "bml: ValidateAgainst requires a pointer" {
+		t.Errorf("expected a pointer error, got %v", errs)
+	}
+}
+
+func TestUnmarshalUnknownHandler(t *testing.T) {
+	type Game struct {
+		Title string            `bml:"Title"`
+		Attrs map[string]string `bml:",attrs"`
+	}
+	type Settings struct {
+		Video struct {
+			Driver string `bml:"Driver|Backend"`
+		} `bml:"Video"`
+		Games []Game `bml:"Game"`
+	}
+	input := `Video mode=full
+  Backend: Metal
+  Shadr: crt
+Game region=NTSC
+  Title: One
+Game
+  Title: Two
+  Rating: E
+Legacy
+  Option: 1`
+
+	var paths []string
+	var s Settings
+	err := UnmarshalWith([]byte(input), &s, UnmarshalOptions{
+		UnknownHandler: func(path string, node *Node) {
+			paths = append(paths, path)
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"Video/mode", "Video/Shadr", "Game[1]/Rating", "Legacy"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("unknown paths: expected %q, got %q", want, paths)
+	}
+	if s.Video.Driver != "Metal" || len(s.Games) != 2 {
+		t.Errorf("expected known fields to be populated, got %+v", s)
+	}
+
+	// A path tag reads through its first segment, which is not unknown
+	type Flat struct {
+		Driver string `bml:"Video/Driver"`
+		Volume int    `bml:"Level|/Audio/Volume"`
+	}
+	var flat Flat
+	err = UnmarshalWith([]byte("Video\n  Driver: Metal\nAudio\n  Volume: 3\n"), &flat, UnmarshalOptions{
+		UnknownHandler: func(path string, node *Node) {
+			t.Errorf("unexpected unknown node %s", path)
+		},
+	})
+	if err != nil || flat.Driver != "Metal" || flat.Volume != 3 {
+		t.Errorf("expected path fields to be populated, got %+v, %v", flat, err)
+	}
+}
+
+func TestUnmarshalRest(t *testing.T) {
+	type Video struct {
+		Driver string           `bml:"Driver"`
+		Extra  map[string]*Node `bml:",rest"`
+	}
+	type Settings struct {
+		Video Video   `bml:"Video"`
+		Mode  string  `bml:"Mode"`
+		Rest  []*Node `bml:",rest"`
+	}
+	input := "Video\n  Driver: Metal\n  Shader: crt\nMode: full\nLegacy\n  Option: 1\nPort: 1\nPort: 2\n"
+
+	var s Settings
+	called := false
+	err := UnmarshalWith([]byte(input), &s, UnmarshalOptions{
+		UnknownHandler: func(string, *Node) { called = true },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if called {
+		t.Error("expected no unknown nodes with a rest field")
+	}
+	var names []string
+	for _, n := range s.Rest {
+		names = append(names, n.Name)
+	}
+	if want := []string{"Legacy", "Port", "Port"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("rest: expected %q, got %q", want, names)
+	}
+	if got := s.Video.Extra["Shader"].String(""); got != "crt" || len(s.Video.Extra) != 1 {
+		t.Errorf("expected Shader in the rest map, got %v", s.Video.Extra)
+	}
+
+	data, err := Marshal(s)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if string(data) != input {
+		t.Errorf("round trip: expected %q, got %q", input, data)
+	}
+
+	// Without unmatched children the rest field is left alone
+	var empty Settings
+	if err := Unmarshal([]byte("Mode: full"), &empty); err != nil || empty.Rest != nil {
+		t.Errorf("expected a nil rest field, got %v, %v", empty.Rest, err)
+	}
+
+	// A path field reads its node, which the rest field leaves alone, and
+	// writes it back in place
+	type Paths struct {
+		Driver string  `bml:"Video/Driver"`
+		Width  int     `bml:"/Video/Size/Width"`
+		Rest   []*Node `bml:",rest"`
+	}
+	input = "Video\n  Driver: Metal\n  Size\n    Width: 640\nMode: full\n"
+	var paths Paths
+	if err := Unmarshal([]byte(input), &paths); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if len(paths.Rest) != 1 || paths.Rest[0].Name != "Mode" {
+		t.Errorf("expected only Mode in the rest field, got %v", paths.Rest)
+	}
+	data, err = Marshal(paths)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if string(data) != input {
+		t.Errorf("round trip: expected %q, got %q", input, data)
+	}
+	var back Paths
+	if err := Unmarshal(data, &back); err != nil || !reflect.DeepEqual(back, paths) {
+		t.Errorf("round trip: expected %+v, got %+v, %v", paths, back, err)
+	}
+
+	// A map holds one node per name, so a repeated name is an error
+	err = Unmarshal([]byte("Video\n  Port: 1\n  Port: 2\n"), &s)
+	if want := `field Video: field Extra: rest map cannot hold more than one node named "Port"`; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+
+	type Bad struct {
+		Rest []string `bml:",rest"`
+	}
+	want := "field Rest: rest requires []*Node or map[string]*Node, not []string"
+	if err := Unmarshal([]byte("A: 1"), &Bad{}); err == nil || err.Error() != want {
+		t.Errorf("expected a type error, got %v", err)
+	}
+	if err := UnmarshalLenient([]byte("A: 1"), &Bad{}); err == nil || err.Error() != want {
+		t.Errorf("expected a lenient type error, got %v", err)
+	}
+	if _, err := Marshal(Bad{}); err == nil || err.Error() != want {
+		t.Errorf("expected a marshal type error, got %v", err)
+	}
+	data, _ = Marshal(Settings{Rest: []*Node{nil, {Name: "A", Value: "1"}}, Video: Video{Extra: map[string]*Node{"B": nil}}})
+	if expected := "Video\n  Driver\nMode\nA: 1\n"; string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+}
+
+func TestUnmarshalStrictFailsFast(t *testing.T) {
+	input := "Video\n  Multiplier: two\n  Luminance: bright"
+
+	var settings TestSettings
+	err := Unmarshal([]byte(input), &settings)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if strings.Contains(err.Error(), "Luminance") {
+		t.Errorf("expected strict Unmarshal to stop at the first error, got: %v", err)
+	}
+}
+
+func TestMarshalBasic(t *testing.T) {
+	settings := TestSettings{
+		Video: TestVideoSettings{
+			Driver:     "Metal",
+			Multiplier: 2,
+			Luminance:  1.5,
+			ColorBleed: true,
+		},
+		Audio: TestAudioSettings{
+			Driver: "SDL",
+			Volume: 0.8,
+			Mute:   false,
+		},
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	// Parse it back
+	var result TestSettings
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if result.Video.Driver != "Metal" {
+		t.Errorf("expected 'Metal', got %q", result.Video.Driver)
+	}
+	if result.Video.Multiplier != 2 {
+		t.Errorf("expected 2, got %d", result.Video.Multiplier)
+	}
+}
+
+func TestMarshalNonPointer(t *testing.T) {
+	settings := TestSettings{}
+	data, err := Marshal(settings) // non-pointer should work
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if len(data) == 0 {
+		t.Error("expected non-empty output")
+	}
+}
+
+func TestMarshalNilPointer(t *testing.T) {
+	var settings *TestSettings
+	_, err := Marshal(settings)
+	if err == nil {
+		t.Fatal("expected error for nil pointer")
+	}
+}
+
+func TestMarshalNonStruct(t *testing.T) {
+	s := "string"
+	_, err := Marshal(&s)
+	if err == nil {
+		t.Fatal("expected error for non-struct")
+	}
+}
+
+func TestMarshalPointerFields(t *testing.T) {
+	driver := "Metal"
+	count := 5
+	settings := TestPointerSettings{
+		Driver: &driver,
+		Count:  &count,
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	var result TestPointerSettings
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if result.Driver == nil || *result.Driver != "Metal" {
+		t.Error("expected Driver to be 'Metal'")
+	}
+}
+
+func TestMarshalNilPointerFields(t *testing.T) {
+	settings := TestPointerSettings{
+		Driver: nil,
+		Count:  nil,
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	// Nil pointer fields should be skipped
+	if strings.Contains(string(data), "Driver") {
+		t.Error("expected nil Driver to be skipped")
+	}
+}
+
+func TestMarshalUnexportedFields(t *testing.T) {
+	settings := TestUnexportedFields{
+		Public:  "value",
+		private: "secret",
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	// private field should not be in output
+	if strings.Contains(string(data), "private") {
+		t.Error("expected private field to be skipped")
+	}
+}
+
+func TestMarshalNoTagFields(t *testing.T) {
+	settings := TestNoTagFields{
+		Tagged:   "value",
+		Untagged: "ignored",
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	if !strings.Contains(string(data), "Tagged") {
+		t.Error("expected Tagged field in output")
+	}
+	if strings.Contains(string(data), "Untagged") {
+		t.Error("expected Untagged field to be skipped (no tag)")
+	}
+}
+
+func TestMarshalUnsupportedType(t *testing.T) {
+	settings := TestUnsupportedType{
+		Data: 1 + 2i,
+	}
+
+	_, err := Marshal(&settings)
+	if err == nil {
+		t.Fatal("expected error for unsupported type")
+	}
+}
+
+func TestDrift(t *testing.T) {
+	type Settings struct {
+		Driver     string `bml:"Driver"`
+		Multiplier int    `bml:"Multiplier"`
+	}
+
+	data := []byte("// Managed file\nDriver: Metal\nMultiplier: 2\n")
+	changes, err := Drift(data, Settings{Driver: "Metal", Multiplier: 3})
+	if err != nil {
+		t.Fatalf("Drift error: %v", err)
+	}
+	want := []Change{{Path: "Multiplier", Kind: ChangeModified, Old: "2", New: "3"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Drift: expected %+v, got %+v", want, changes)
+	}
+
+	if changes, err := Drift(data, &Settings{Driver: "Metal", Multiplier: 2}); err != nil || changes != nil {
+		t.Errorf("expected no drift, got %+v, %v", changes, err)
+	}
+	if _, err := Drift([]byte("  : orphan"), Settings{}); err == nil {
+		t.Error("expected an error for an invalid file")
+	}
+	if _, err := Drift(data, 1); err == nil || err.Error() != "bml: Drift requires a struct or pointer to struct" {
+		t.Errorf("expected a struct error, got %v", err)
+	}
+}
+
+func TestMarshalSafe(t *testing.T) {
+	type S struct {
+		Name  string `bml:"Name"`
+		Notes string `bml:"Notes"`
+	}
+
+	// Surrounding whitespace survives by quoting
+	data, err := MarshalSafe(S{Name: "padded ", Notes: "a\nb"})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if want := "Name=\"padded \"\nNotes\n  : a\n  : b\n"; string(data) != want {
+		t.Errorf("MarshalSafe: expected %q, got %q", want, data)
+	}
+
+	// A value read back differently is reported by path
+	_, err = MarshalSafe(S{Name: "ok", Notes: "text // not a comment"})
+	if err == nil || err.Error() != "bml: MarshalSafe: Notes does not survive serialization" {
+		t.Errorf("expected error for Notes, got %v", err)
+	}
+
+	var bad struct {
+		Name string `bml:"a b"`
+	}
+	if _, err := MarshalSafe(bad); err == nil || !strings.Contains(err.Error(), "does not survive serialization") {
+		t.Errorf("expected error for unwritable name, got %v", err)
+	}
+	var invalid struct {
+		Name string `bml:"+x"`
+	}
+	if _, err := MarshalSafe(invalid); err == nil || !strings.Contains(err.Error(), "output does not parse") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+	if _, err := MarshalSafe(nil); err == nil || !strings.Contains(err.Error(), "bml: MarshalSafe") {
+		t.Errorf("expected error for nil, got %v", err)
+	}
+}
+
+func TestMarshalNode(t *testing.T) {
+	video := TestVideoSettings{Driver: "Metal", Multiplier: 2, Luminance: 1.5, ColorBleed: true}
+
+	node, err := MarshalNode(&video)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if node.Name != "" {
+		t.Errorf("expected unnamed node, got %q", node.Name)
+	}
+	if node.Get("Driver").String("") != "Metal" || node.Get("Multiplier").Int(0) != 2 {
+		t.Errorf("unexpected children: %+v", node.Children)
+	}
+
+	// Splice into an existing document
+	doc, _ := Parse([]byte("Audio\n  Driver: SDL"))
+	node.Name = "Video"
+	doc.Root.Children = append(doc.Root.Children, node)
+
+	expected := "Audio\n  Driver: SDL\nVideo\n  Driver: Metal\n  Multiplier: 2\n  Luminance: 1.5\n  ColorBleed: true\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestMarshalNodeErrors(t *testing.T) {
+	var nilPtr *TestVideoSettings
+	if _, err := MarshalNode(nilPtr); err == nil || !strings.Contains(err.Error(), "MarshalNode requires a non-nil value") {
+		t.Errorf("expected non-nil error, got: %v", err)
+	}
+
+	if _, err := MarshalNode("string"); err == nil || !strings.Contains(err.Error(), "MarshalNode requires a struct") {
+		t.Errorf("expected struct error, got: %v", err)
+	}
+
+	type Bad struct {
+		Ch chan int `bml:"Ch"`
+	}
+	if _, err := MarshalNode(Bad{Ch: make(chan int)}); err == nil {
+		t.Error("expected error for unsupported type")
+	}
+}
+
+func TestDocumentSetStruct(t *testing.T) {
+	doc, _ := Parse([]byte("Video: main\n  Driver: OpenGL\n  Legacy: 1\nAudio\n  Driver: SDL"))
+
+	video := TestVideoSettings{Driver: "Metal", Multiplier: 3, Luminance: 0.5}
+	if err := doc.SetStruct("Video", &video); err != nil {
+		t.Fatalf("SetStruct error: %v", err)
+	}
+	if doc.Root.Get("Video/Legacy") != nil || doc.Root.Get("Video").Value != "main" {
+		t.Errorf("expected children replaced and value kept:\n%s", Serialize(doc))
+	}
+
+	var back TestVideoSettings
+	if err := UnmarshalNode(doc.Root.Get("Video"), &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if back != video {
+		t.Errorf("expected %+v, got %+v", video, back)
+	}
+	if doc.Root.Get("Audio/Driver").String("") != "SDL" {
+		t.Error("expected other sections to be unchanged")
+	}
+
+	// Missing paths are created, including on an empty document
+	empty := &Document{}
+	if err := empty.SetStruct("Settings/Video", video); err != nil || empty.Root.Get("Settings/Video/Driver").String("") != "Metal" {
+		t.Errorf("unexpected result: %v\n%s", err, Serialize(empty))
+	}
+
+	if err := doc.SetStruct("Video", "string"); err == nil || !strings.Contains(err.Error(), "SetStruct requires a struct") {
+		t.Errorf("expected struct error, got %v", err)
+	}
+	var nilDoc *Document
+	if err := nilDoc.SetStruct("Video", video); err == nil {
+		t.Error("expected error for nil document")
+	}
+}
+
+func TestMarshalUintFields(t *testing.T) {
+	settings := TestUintFields{
+		Count:   42,
+		Count8:  255,
+		Count64: 9999999999,
+	}
+
+	data, err := Marshal(&settings)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	var result TestUintFields
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if result.Count != 42 || result.Count8 != 255 || result.Count64 != 9999999999 {
+		t.Error("uint fields mismatch after round-trip")
+	}
+}
+
+type testDriver int
+
+func (d testDriver) String() string {
+	switch d {
+	case 1:
+		return "Metal"
+	case 2:
+		return "Vulkan"
+	}
+	return "None"
+}
+
+type testLevel int
+
+func (l testLevel) MarshalBML() (string, error) {
+	if l < 0 {
+		return "", errors.New("negative level")
+	}
+	return "L" + strconv.Itoa(int(l)), nil
+}
+
+func (l *testLevel) UnmarshalBML(value string) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(value, "L"))
+	if err != nil {
+		return fmt.Errorf("bad level %q", value)
+	}
+	*l = testLevel(n)
+	return nil
+}
+
+type testPtrLevel int
+
+func (l *testPtrLevel) MarshalBML() (string, error) {
+	return "P" + strconv.Itoa(int(*l)), nil
+}
+
+func TestMarshalStringer(t *testing.T) {
+	type Config struct {
+		Driver  testDriver  `bml:"Driver,stringer"`
+		Ordinal testDriver  `bml:"Ordinal"`
+		Ptr     *testDriver `bml:"Ptr,stringer"`
+		Plain   int         `bml:"Plain,stringer"`
+	}
+
+	d := testDriver(2)
+	data, err := Marshal(Config{Driver: 1, Ordinal: 1, Ptr: &d, Plain: 7})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	want := "Driver: Metal\nOrdinal: 1\nPtr: Vulkan\nPlain: 7\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+}
+
+type testEnum int
+
+type testUintEnum uint8
+
+type int8Enum int8
+
+type uint64Enum uint64
+
+func TestRegisterEnum(t *testing.T) {
+	RegisterEnum(testEnum(0), map[string]int64{"None": 0, "Metal": 1, "OpenGL": 2, "GL": 2})
+	RegisterEnum(testUintEnum(0), map[string]int64{"Low": 1, "High": 255, "Negative": -1, "Huge": 256})
+	RegisterEnum(int8Enum(0), map[string]int64{"Big": 1 << 40})
+	RegisterEnum(uint64Enum(0), map[string]int64{"One": 1, "Min": math.MinInt64})
+
+	type Config struct {
+		Driver  testEnum     `bml:"Driver"`
+		Drivers []testEnum   `bml:"Fallback"`
+		Ptr     *testEnum    `bml:"Ptr"`
+		Level   testUintEnum `bml:"Level"`
+	}
+
+	input := "Driver: GL\nFallback: Metal\nFallback: None\nPtr: Metal\nLevel: High\n"
+	var out Config
+	if err := Unmarshal([]byte(input), &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if out.Driver != 2 || !reflect.DeepEqual(out.Drivers, []testEnum{1, 0}) || *out.Ptr != 1 || out.Level != 255 {
+		t.Errorf("unexpected Unmarshal result: %+v", out)
+	}
+
+	// The first of several names for a value in sorted order is written
+	data, err := Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := "Driver: GL\nFallback: Metal\nFallback: None\nPtr: Metal\nLevel: High\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	errTests := []struct {
+		input, want string
+	}{
+		{"Driver: Vulkan", `unknown bml.testEnum name "Vulkan"`},
+		{"Level: Negative", `value -1 of "Negative" overflows bml.testUintEnum`},
+		{"Level: Huge", `value 256 of "Huge" overflows bml.testUintEnum`},
+	}
+	for _, tt := range errTests {
+		if err := Unmarshal([]byte(tt.input), &out); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: expected error containing %q, got %v", tt.input, tt.want, err)
+		}
+	}
+	var small struct {
+		Driver int8Enum `bml:"Driver"`
+	}
+	if err := Unmarshal([]byte("Driver: Big"), &small); err == nil || !strings.Contains(err.Error(), "overflows") {
+		t.Errorf("expected overflow error, got %v", err)
+	}
+
+	// Empty values are left alone unless numbers are strict
+	out = Config{Driver: 1}
+	if err := Unmarshal([]byte("Driver:"), &out); err != nil || out.Driver != 1 {
+		t.Errorf("unexpected Unmarshal result: %v, %v", out.Driver, err)
+	}
+	if err := UnmarshalWith([]byte("Driver:"), &out, UnmarshalOptions{StrictNumbers: true}); err == nil {
+		t.Error("expected error for an empty enum with StrictNumbers")
+	}
+
+	if _, err := Marshal(Config{Driver: 7}); err == nil || !strings.Contains(err.Error(), "no bml.testEnum name for value 7") {
+		t.Errorf("expected error for a value without a name, got %v", err)
+	}
+
+	// An unsigned value above math.MaxInt64 has no name, even one registered
+	// for the same bits as an int64
+	var huge struct {
+		Mode uint64Enum `bml:"Mode"`
+	}
+	huge.Mode = 1 << 63
+	_, err = Marshal(huge)
+	if want := "field Mode: no bml.uint64Enum name for value 9223372036854775808"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+	huge.Mode = 1
+	if data, err := Marshal(huge); err != nil || string(data) != "Mode: One\n" {
+		t.Errorf("unexpected Marshal result: %q, %v", data, err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "requires an integer type, not string") {
+			t.Errorf("expected panic for a non-integer type, got %v", r)
+		}
+	}()
+	RegisterEnum("Metal", map[string]int64{"Metal": 1})
+}
+
+func TestMarshaler(t *testing.T) {
+	type Config struct {
+		Level testLevel    `bml:"Level,stringer"`
+		Ptr   *testLevel   `bml:"Ptr"`
+		Addr  testPtrLevel `bml:"Addr"`
+	}
+
+	lvl := testLevel(5)
+	data, err := Marshal(&Config{Level: 3, Ptr: &lvl, Addr: 4})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	want := "Level: L3\nPtr: L5\nAddr: P4\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	// Pointer receivers are only reachable when the value is addressable
+	data, err = Marshal(Config{Addr: 4})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if !strings.Contains(string(data), "Addr: 4\n") {
+		t.Errorf("Marshal: expected numeric Addr, got %q", data)
+	}
+
+	_, err = Marshal(Config{Level: -1})
+	if err == nil || !strings.Contains(err.Error(), "field Level: negative level") {
+		t.Errorf("expected negative level error, got %v", err)
+	}
+}
+
+func TestUnmarshaler(t *testing.T) {
+	type Config struct {
+		Level testLevel  `bml:"Level"`
+		Ptr   *testLevel `bml:"Ptr"`
+	}
+
+	var cfg Config
+	if err := Unmarshal([]byte("Level: L3\nPtr:  L5 \n"), &cfg); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if cfg.Level != 3 || cfg.Ptr == nil || *cfg.Ptr != 5 {
+		t.Errorf("unexpected Unmarshal result: %+v", cfg)
+	}
+
+	err := Unmarshal([]byte("Level: high\n"), &cfg)
+	if err == nil || !strings.Contains(err.Error(), `field Level: bad level "high"`) {
+		t.Errorf("expected bad level error, got %v", err)
+	}
+}
+
+func TestUnmarshalAttrs(t *testing.T) {
+	type Config struct {
+		Name  string            `bml:"Name"`
+		Attrs map[string]string `bml:",attrs"`
+	}
+	type Doc struct {
+		Node Config `bml:"Node"`
+	}
+
+	var d Doc
+	if err := Unmarshal([]byte("Node a=1 b=\"x y\" Name=n\n  Child: c\n"), &d); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "x y", "Name": "n"}
+	if !reflect.DeepEqual(d.Node.Attrs, want) || d.Node.Name != "n" {
+		t.Errorf("Unmarshal: expected attrs %v, got %+v", want, d.Node)
+	}
+
+	var empty Doc
+	if err := Unmarshal([]byte("Node\n  Name: n\n"), &empty); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if empty.Node.Attrs != nil {
+		t.Errorf("Attrs: expected nil, got %v", empty.Node.Attrs)
+	}
+
+	type Bad struct {
+		Attrs map[string]int `bml:",attrs"`
+	}
+	err := Unmarshal([]byte("a=1\n"), &Bad{})
+	if err == nil || err.Error() != "field Attrs: attrs requires map[string]string, not map[string]int" {
+		t.Errorf("unexpected Unmarshal error: %v", err)
+	}
+}
+
+func TestMarshalAttrs(t *testing.T) {
+	type Config struct {
+		Attrs map[string]string `bml:",attrs"`
+		Name  string            `bml:"Name"`
+	}
+	type Doc struct {
+		Node Config `bml:"Node"`
+	}
+
+	data, err := Marshal(Doc{Node: Config{Attrs: map[string]string{"b": "x y", "a": "1"}, Name: "n"}})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := "Node a=1 b=\"x y\"\n  Name: n\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var back Doc
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if back.Node.Attrs["b"] != "x y" || back.Node.Name != "n" {
+		t.Errorf("unexpected round trip: %+v", back)
+	}
+
+	_, err = Marshal(Doc{Node: Config{Attrs: map[string]string{"bad name": "1"}}})
+	if err == nil || err.Error() != `field Node: field Attrs: invalid attribute name "bad name"` {
+		t.Errorf("unexpected Marshal error: %v", err)
+	}
+	_, err = Marshal(Doc{Node: Config{Attrs: map[string]string{"": "1"}}})
+	if err == nil {
+		t.Error("expected error for empty attribute name")
+	}
+
+	type Bad struct {
+		Attrs []string `bml:",attrs"`
+	}
+	if _, err := Marshal(Bad{}); err == nil {
+		t.Error("expected error for non-map attrs field")
+	}
+}
+
+type testGameEntry struct {
+	Title  string   `bml:"Title"`
+	Year   int      `bml:"Year"`
+	Boards []string `bml:"Board"`
+}
+
+type testTags []string
+
+func (t testTags) MarshalBML() (string, error) {
+	return strings.Join(t, ","), nil
+}
+
+func (t *testTags) UnmarshalBML(value string) error {
+	*t = strings.Split(value, ",")
+	return nil
+}
+
+type testCSV []string
+
+func (c *testCSV) UnmarshalBML(value string) error {
+	*c = strings.Split(value, ",")
+	return nil
+}
+
+func TestMarshalAttrFields(t *testing.T) {
+	type Layout struct {
+		Columns int `bml:"Columns"`
+	}
+	type Window struct {
+		Title  string   `bml:"Title"`
+		Width  int      `bml:"width,attr"`
+		Layout Layout   `bml:"Layout"`
+		Height int      `bml:"height,attr"`
+		Tags   []string `bml:"tag,attr"`
+		Note   string   `bml:"note,attr,omitempty"`
+	}
+	type Doc struct {
+		Window Window `bml:"Window"`
+	}
+
+	in := Doc{Window: Window{Title: "Main", Width: 640, Layout: Layout{Columns: 2}, Height: 480, Tags: []string{"a", "b c"}}}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := "Window width=640 height=480 tag=a tag=\"b c\"\n  Title: Main\n  Layout\n    Columns: 2\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var back Doc
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(back, in) {
+		t.Errorf("round trip: expected %+v, got %+v", in, back)
+	}
+
+	// Attribute fields do not read block children of the same name
+	back = Doc{}
+	if err := Unmarshal([]byte("Window\n  width: 800\n  tag: x\n"), &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if back.Window.Width != 0 || back.Window.Tags != nil {
+		t.Errorf("expected block children to be ignored, got %+v", back.Window)
+	}
+
+	_, err = Marshal(Doc{Window: Window{Title: "Main", Note: "two\nlines"}})
+	if err == nil || err.Error() != "field Window: field Note: attr requires a value that fits on one line" {
+		t.Errorf("unexpected Marshal error: %v", err)
+	}
+
+	// The top level has no line for attributes, though a node does
+	top := Window{Title: "Main", Width: 5}
+	_, err = Marshal(top)
+	if want := "bml: Marshal: field Width: attr requires a parent node, not the top level"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
+	}
+	if _, err := MarshalSafe(&top); err == nil {
+		t.Error("expected MarshalSafe to reject a top-level attr field")
+	}
+	if _, err := Drift([]byte("Title: Main"), top); err == nil {
+		t.Error("expected Drift to reject a top-level attr field")
+	}
+	node, err := MarshalNode(top)
+	if err != nil || !node.Get("width").IsAttr {
+		t.Errorf("expected MarshalNode to keep the attribute, got %v", err)
+	}
+}
+
+func TestMarshalStructSlice(t *testing.T) {
+	type Library struct {
+		Games []testGameEntry  `bml:"Game"`
+		Ptrs  []*testGameEntry `bml:"Ptr"`
+		None  []testGameEntry  `bml:"None"`
+		Tags  testTags         `bml:"Tags"`
+	}
+
+	lib := Library{
+		Games: []testGameEntry{
+			{Title: "One", Year: 1991, Boards: []string{"A", "B"}},
+			{Title: "Two", Year: 1992},
+			{Title: "Three", Year: 1993, Boards: []string{"C"}},
+		},
+		Ptrs: []*testGameEntry{nil, {Title: "Four"}},
+		None: []testGameEntry{},
+		Tags: testTags{"rpg", "jp"},
+	}
+
+	data, err := Marshal(lib)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	want := `Game
+  Title: One
+  Year: 1991
+  Board: A
+  Board: B
+Game
+  Title: Two
+  Year: 1992
+Game
+  Title: Three
+  Year: 1993
+  Board: C
+Ptr
+  Title: Four
+  Year: 0
+Tags: rpg,jp
+`
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var back Library
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(back.Games, lib.Games) {
+		t.Errorf("Games round trip: expected %+v, got %+v", lib.Games, back.Games)
+	}
+	if len(back.Ptrs) != 1 || back.Ptrs[0].Title != "Four" {
+		t.Errorf("unexpected Ptrs round trip: %+v", back.Ptrs)
+	}
+	if back.None != nil {
+		t.Errorf("None: expected nil, got %v", back.None)
+	}
+	if !reflect.DeepEqual(back.Tags, lib.Tags) {
+		t.Errorf("Tags round trip: expected %v, got %v", lib.Tags, back.Tags)
+	}
+}
+
+func TestSliceFieldErrors(t *testing.T) {
+	type S struct {
+		Values []int `bml:"Value"`
+	}
+	err := Unmarshal([]byte("Value: 1\nValue: x\n"), &S{})
+	if err == nil || !strings.Contains(err.Error(), "field Values: element 1: cannot parse") {
+		t.Errorf("unexpected Unmarshal error: %v", err)
+	}
+
+	var csv struct {
+		Values testCSV `bml:"Value"`
+	}
+	if err := Unmarshal([]byte("Value: a,b\nValue: c\n"), &csv); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(csv.Values, testCSV{"a", "b"}) {
+		t.Errorf("Unmarshaler slice: expected first node only, got %v", csv.Values)
+	}
+
+	type M struct {
+		Values []complex128 `bml:"Value"`
+	}
+	_, err = Marshal(M{Values: []complex128{1}})
+	if err == nil || err.Error() != "field Values: element 0: unsupported type: complex128" {
+		t.Errorf("unexpected Marshal error: %v", err)
+	}
+}
+
+func TestUnmarshalTriStateBool(t *testing.T) {
+	type S struct {
+		Absent  *bool `bml:"Absent"`
+		False   *bool `bml:"False"`
+		True    *bool `bml:"True"`
+		Empty   *bool `bml:"Empty"`
+		Nested  *bool `bml:"Group/Flag"`
+		Missing *bool `bml:"Group/Missing"`
+	}
+
+	var s S
+	if err := Unmarshal([]byte("False: false\nTrue: true\nEmpty\nGroup\n  Flag: true\n"), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if s.Absent != nil || s.Missing != nil {
+		t.Errorf("absent nodes should leave nil pointers: %v %v", s.Absent, s.Missing)
+	}
+	if s.False == nil || *s.False {
+		t.Errorf("False: expected pointer to false, got %v", s.False)
+	}
+	if s.True == nil || !*s.True || s.Nested == nil || !*s.Nested {
+		t.Errorf("expected pointers to true, got %v %v", s.True, s.Nested)
+	}
+	if s.Empty == nil || *s.Empty {
+		t.Errorf("Empty: expected pointer to false, got %v", s.Empty)
+	}
+}
+
+func TestSplitSlice(t *testing.T) {
+	type Game struct {
+		Ports      []int     `bml:"Ports,split=,"`
+		Extensions []string  `bml:"Extensions,split=;"`
+		Levels     []*int    `bml:"Levels,split=,"`
+		Scales     []float64 `bml:"Scale,split=x,strip=()"`
+		Tags       []string  `bml:"Tag"`
+	}
+
+	one, two := 1, 2
+	in := Game{
+		Ports:      []int{1, 22, 333},
+		Extensions: []string{"sfc"},
+		Levels:     []*int{&one, nil, &two},
+		Tags:       []string{"a", "b"},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := "Ports: 1,22,333\nExtensions: sfc\nLevels: 1,2\nTag: a\nTag: b\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var out Game
+	if err := Unmarshal(append(data, "Scale: (1.5)x2\n"...), &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(out.Ports, in.Ports) || !reflect.DeepEqual(out.Extensions, in.Extensions) ||
+		!reflect.DeepEqual(out.Tags, in.Tags) || !reflect.DeepEqual(out.Scales, []float64{1.5, 2}) {
+		t.Errorf("unexpected Unmarshal result: %+v", out)
+	}
+	if len(out.Levels) != 2 || *out.Levels[0] != 1 || *out.Levels[1] != 2 {
+		t.Errorf("unexpected Unmarshal Levels: %v", out.Levels)
+	}
+
+	// An empty value or missing node leaves the slice empty
+	var empty Game
+	if err := Unmarshal([]byte("Ports:\n"), &empty); err != nil || empty.Ports != nil {
+		t.Errorf("unexpected Unmarshal of empty value: %v, %v", empty.Ports, err)
+	}
+	if data, err := Marshal(Game{Ports: []int{}}); err != nil || len(data) != 0 {
+		t.Errorf("unexpected Marshal of empty slice: %q, %v", data, err)
+	}
+
+	// Elements must be single values without the separator
+	if err := Unmarshal([]byte("Ports: 1,x\n"), &empty); err == nil || !strings.Contains(err.Error(), "field Ports: element 1:") {
+		t.Errorf("expected element error, got %v", err)
+	}
+	if _, err := Marshal(Game{Extensions: []string{"a;b"}}); err == nil {
+		t.Error("expected error for element containing the separator")
+	}
+	type Nested struct {
+		Games []testGameEntry `bml:"Game,split=,"`
+		Bad   []testLevel     `bml:"Level,split=,"`
+	}
+	if _, err := Marshal(Nested{Games: []testGameEntry{{Title: "One"}}}); err == nil {
+		t.Error("expected error for struct elements")
+	}
+	if _, err := Marshal(Nested{Bad: []testLevel{-1}}); err == nil || !strings.Contains(err.Error(), "field Bad: element 0:") {
+		t.Errorf("expected element marshal error, got %v", err)
+	}
+
+	// "split=" followed by another option is not a comma separator
+	if tag := parseTag("Name,split=,stringer"); tag.split != "" || !tag.stringer {
+		t.Errorf("unexpected tag: %+v", tag)
+	}
+
+	// Whitespace inside elements and empty elements among others survive,
+	// but values that would not read back are errors
+	type Titles struct {
+		Names []string `bml:"Names,split=,"`
+	}
+	for _, names := range [][]string{{"Super Mario", "Zelda"}, {"a", "", "b"}, {"", ""}} {
+		data, err := Marshal(Titles{Names: names})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var got Titles
+		if err := Unmarshal(data, &got); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(got.Names, names) {
+			t.Errorf("expected %q, got %q", names, got.Names)
+		}
+	}
+	errs := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"a", " b"}, "field Names: element 1: split requires values without surrounding whitespace"},
+		{[]string{""}, "field Names: split cannot write a single empty element"},
+	}
+	for _, tt := range errs {
+		if _, err := Marshal(Titles{Names: tt.names}); err == nil || err.Error() != tt.want {
+			t.Errorf("%q: expected %q, got %v", tt.names, tt.want, err)
+		}
+	}
+
+	// A split option without a separator is rejected both ways
+	type NoSeparator struct {
+		Names []string `bml:"Names,split="`
+	}
+	if _, err := Marshal(NoSeparator{Names: []string{"a"}}); err == nil || err.Error() != "field Names: split requires a separator" {
+		t.Errorf("expected separator error, got %v", err)
+	}
+	if err := Unmarshal([]byte("Names: a"), &NoSeparator{}); err == nil || !strings.Contains(err.Error(), "split requires a separator") {
+		t.Errorf("expected separator error, got %v", err)
+	}
+}
+
+func TestPointerCollections(t *testing.T) {
+	type Config struct {
+		Ports  *[]int             `bml:"Port"`
+		Split  *[]int             `bml:"Split,split=,"`
+		Labels *map[string]string `bml:"Labels"`
+		Games  *[]testGameEntry   `bml:"Game"`
+	}
+
+	ports, split := []int{1, 2}, []int{3, 4}
+	labels := map[string]string{"b": "two", "a": "one"}
+	in := Config{Ports: &ports, Split: &split, Labels: &labels}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := "Port: 1\nPort: 2\nSplit: 3,4\nLabels\n  a: one\n  b: two\n"
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var out Config
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if out.Ports == nil || !reflect.DeepEqual(*out.Ports, ports) || out.Split == nil || !reflect.DeepEqual(*out.Split, split) {
+		t.Errorf("unexpected Unmarshal slices: %v, %v", out.Ports, out.Split)
+	}
+	if out.Labels == nil || !reflect.DeepEqual(*out.Labels, labels) {
+		t.Errorf("unexpected Unmarshal Labels: %v", out.Labels)
+	}
+	if out.Games != nil {
+		t.Errorf("expected nil pointer for absent nodes, got %v", *out.Games)
+	}
+
+	// Nil pointers are skipped
+	if data, err := Marshal(Config{}); err != nil || len(data) != 0 {
+		t.Errorf("unexpected Marshal of nil pointers: %q, %v", data, err)
+	}
+
+	if err := Unmarshal([]byte("Port: x"), &out); err == nil || !strings.Contains(err.Error(), "field Ports: element 0:") {
+		t.Errorf("expected element error, got %v", err)
+	}
+}
+
+func TestMarshalOmitFalse(t *testing.T) {
+	type Settings struct {
+		Fast  bool `bml:"Fast,omitfalse"`
+		Vsync bool `bml:"Vsync"`
+	}
+
+	data, err := Marshal(Settings{})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if expected := "Vsync: false\n"; string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+
+	data, err = Marshal(Settings{Fast: true})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if expected := "Fast: true\nVsync: false\n"; string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+
+	// An absent node reads back as false
+	var s Settings
+	if err := Unmarshal([]byte("Vsync: true"), &s); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if s.Fast {
+		t.Error("expected an absent Fast to read as false")
+	}
+}
+
+func TestMarshalDurations(t *testing.T) {
+	type Settings struct {
+		Latency  time.Duration            `bml:"Latency"`
+		Timeouts []time.Duration          `bml:"Timeout"`
+		Delays   map[string]time.Duration `bml:"Delays"`
+		Backoff  *time.Duration           `bml:"Backoff"`
+	}
+
+	backoff := 90 * time.Second
+	in := Settings{
+		Latency:  20 * time.Millisecond,
+		Timeouts: []time.Duration{10 * time.Millisecond, time.Second},
+		Delays:   map[string]time.Duration{"Audio": 5 * time.Millisecond},
+		Backoff:  &backoff,
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	expected := "Latency: 20ms\nTimeout: 10ms\nTimeout: 1s\nDelays\n  Audio: 5ms\nBackoff: 1m30s\n"
+	if string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+
+	var out Settings
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip: expected %+v, got %+v", in, out)
+	}
+
+	// Plain integers are nanoseconds
+	out = Settings{}
+	if err := Unmarshal([]byte("Latency: 20000000\nTimeout: 5\nDelays\n  Audio: 1_000\nBackoff: 0"), &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if out.Latency != 20*time.Millisecond || out.Timeouts[0] != 5 || out.Delays["Audio"] != time.Microsecond || *out.Backoff != 0 {
+		t.Errorf("expected nanoseconds, got %v, %v, %v, and %v", out.Latency, out.Timeouts, out.Delays, *out.Backoff)
+	}
+
+	tests := []struct {
+		input, want string
+	}{
+		{"Timeout: 1s\nTimeout: soon", `field Timeouts: element 1: cannot parse "soon" as duration`},
+		{"Delays\n  Video: later", `field Delays: key Video: cannot parse "later" as duration`},
+	}
+	for _, tt := range tests {
+		err := Unmarshal([]byte(tt.input), &out)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%q: expected error starting with %q, got %v", tt.input, tt.want, err)
+		}
+	}
+	err = UnmarshalWith([]byte("Latency:"), &out, UnmarshalOptions{StrictNumbers: true})
+	if err == nil {
+		t.Error("expected an empty duration to fail with StrictNumbers")
+	}
+}
+
+func TestMarshalOmitEmpty(t *testing.T) {
+	type Shader struct {
+		Path  string `bml:"Path,omitempty"`
+		Scale int    `bml:"Scale,omitempty"`
+	}
+	type Settings struct {
+		Shader   *Shader           `bml:"Shader,omitempty"`
+		Fallback *Shader           `bml:"Fallback"`
+		Inline   Shader            `bml:"Inline,omitempty"`
+		Tags     map[string]string `bml:"Tags,omitempty"`
+		Count    *int              `bml:"Count,omitempty"`
+	}
+
+	zero := 0
+	data, err := Marshal(Settings{Shader: &Shader{}, Fallback: &Shader{}, Tags: map[string]string{}, Count: &zero})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if expected := "Fallback\nCount: 0\n"; string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+
+	data, err = Marshal(Settings{Shader: &Shader{Path: "crt"}, Inline: Shader{Scale: 2}})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if expected := "Shader\n  Path: crt\nInline\n  Scale: 2\n"; string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+}
+
+func TestMarshalOrder(t *testing.T) {
+	type Settings struct {
+		Extra   string            `bml:"Extra"`
+		Shader  string            `bml:"Shader,order=3"`
+		Paths   []string          `bml:"Path,order=2"`
+		Driver  string            `bml:"Driver,order=1"`
+		Note    string            `bml:"Note,order=x"`
+		Attrs   map[string]string `bml:",attrs,order=0"`
+		Visible bool              `bml:"Visible"`
+	}
+
+	data, err := Marshal(Settings{
+		Extra:   "e",
+		Shader:  "crt",
+		Paths:   []string{"/a", "/b"},
+		Driver:  "Metal",
+		Note:    "n",
+		Attrs:   map[string]string{"id": "1"},
+		Visible: true,
+	})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	var names []string
+	doc, _ := Parse(data)
+	for _, child := range doc.Root.Children {
+		names = append(names, child.Name)
+	}
+	want := []string{"id", "Driver", "Path", "Path", "Shader", "Extra", "Note", "Visible"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("expected order %q, got %q\n%s", want, names, data)
+	}
+}
+
+func TestMarshalValue(t *testing.T) {
+	type Entry struct {
+		Title string `bml:"Title"`
+	}
+
+	data := map[string]interface{}{
+		"Video": map[string]interface{}{
+			"Driver":     "Metal",
+			"Multiplier": 2,
+		},
+		"Paths":  []string{"/a", "/b"},
+		"Grid":   [][]int{{1, 2}, {3}},
+		"Game":   []interface{}{Entry{Title: "One"}, &Entry{Title: "Two"}},
+		"Volume": 0.5,
+		"Nil":    nil,
+		"Tags":   map[string]bool{"rpg": true},
+	}
+
+	out, err := MarshalValue(data)
+	if err != nil {
+		t.Fatalf("MarshalValue error: %v", err)
+	}
+
+	want := `Game
+  Title: One
+Game
+  Title: Two
+Grid
+  0: 1
+  1: 2
+Grid
+  0: 3
+Paths: /a
+Paths: /b
+Tags
+  rpg: true
+Video
+  Driver: Metal
+  Multiplier: 2
+Volume: 0.5
+`
+	if string(out) != want {
+		t.Errorf("MarshalValue: expected %q, got %q", want, out)
+	}
+
+	// Top-level slices are indexed
+	out, err = MarshalValue(&[]interface{}{"a", map[string]int{"B": 1}})
+	if err != nil {
+		t.Fatalf("MarshalValue error: %v", err)
+	}
+	if string(out) != "0: a\n1\n  B: 1\n" {
+		t.Errorf("unexpected MarshalValue(slice): %q", out)
+	}
+
+	// Structs are marshaled as by Marshal, including map fields
+	type Config struct {
+		Name  string         `bml:"Name"`
+		Extra map[string]int `bml:"Extra"`
+	}
+	out, err = MarshalValue(Config{Name: "n", Extra: map[string]int{"b": 2, "a": 1}})
+	if err != nil {
+		t.Fatalf("MarshalValue error: %v", err)
+	}
+	if string(out) != "Name: n\nExtra\n  a: 1\n  b: 2\n" {
+		t.Errorf("unexpected MarshalValue(struct): %q", out)
+	}
+}
+
+func TestMapKeys(t *testing.T) {
+	type Port struct {
+		Device string `bml:"Device"`
+	}
+	type Config struct {
+		Names  map[int]string      `bml:"Names"`
+		Ports  map[uint8]Port      `bml:"Ports"`
+		Paths  map[string][]string `bml:"Paths"`
+		Levels map[int64]*int      `bml:"Levels"`
+	}
+
+	level := 3
+	in := Config{
+		Names:  map[int]string{10: "ten", -1: "minus", 2: "two"},
+		Ports:  map[uint8]Port{2: {Device: "Mouse"}, 1: {Device: "Gamepad"}},
+		Paths:  map[string][]string{"roms": {"/a", "/b"}, "saves": {"/c"}},
+		Levels: map[int64]*int{7: &level},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	want := `Names
+  -1: minus
+  2: two
+  10: ten
+Ports
+  1
+    Device: Gamepad
+  2
+    Device: Mouse
+Paths
+  roms: /a
+  roms: /b
+  saves: /c
+Levels
+  7: 3
+`
+	if string(data) != want {
+		t.Errorf("Marshal: expected %q, got %q", want, data)
+	}
+
+	var out Config
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if !reflect.DeepEqual(out.Names, in.Names) || !reflect.DeepEqual(out.Ports, in.Ports) ||
+		!reflect.DeepEqual(out.Paths, in.Paths) || *out.Levels[7] != 3 {
+		t.Errorf("unexpected Unmarshal result: %+v", out)
+	}
+
+	// Keys that do not parse as the key type are an error
+	for _, input := range []string{"Names\n  abc: x", "Ports\n  256\n    Device: x"} {
+		err := Unmarshal([]byte(input), &out)
+		if err == nil || !strings.Contains(err.Error(), "cannot parse") {
+			t.Errorf("%q: expected key parse error, got %v", input, err)
+		}
+	}
+	if err := Unmarshal([]byte("Levels\n  1: x"), &out); err == nil || !strings.Contains(err.Error(), "field Levels: key 1:") {
+		t.Errorf("expected value error naming the key, got %v", err)
+	}
+	var bad struct {
+		M map[float64]string `bml:"M"`
+	}
+	if err := Unmarshal([]byte("M\n  1: x"), &bad); err == nil || !strings.Contains(err.Error(), "map keys must be strings or integers") {
+		t.Errorf("expected key type error, got %v", err)
+	}
+}
+
+func TestOrderedMap(t *testing.T) {
+	type Core struct {
+		Path string `bml:"Path"`
+	}
+	type Config struct {
+		Cores  OrderedMap[Core]     `bml:"Cores"`
+		Paths  OrderedMap[[]string] `bml:"Paths"`
+		Empty  OrderedMap[int]      `bml:"Empty,omitempty"`
+		Levels OrderedMap[int]      `bml:"Levels"`
+	}
+
+	input := `Cores
+  snes
+    Path: bsnes.so
+  nes
+    Path: mesen.so
+  gba
+    Path: mgba.so
+Paths
+  saves: /c
+  roms: /a
+  roms: /b
+Levels
+  zeta: 1
+  alpha: 2
+  zeta: 3
+`
+	var out Config
+	if err := Unmarshal([]byte(input), &out); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	var keys []string
+	for _, e := range out.Cores {
+		keys = append(keys, e.Key)
+	}
+	if strings.Join(keys, ",") != "snes,nes,gba" {
+		t.Errorf("Cores keys: expected document order, got %v", keys)
+	}
+	if core, ok := out.Cores.Get("nes"); !ok || core.Path != "mesen.so" {
+		t.Errorf("unexpected Get(nes): %+v, %v", core, ok)
+	}
+	if _, ok := out.Cores.Get("n64"); ok {
+		t.Error("Get(n64) should report a missing key")
+	}
+	if roms, _ := out.Paths.Get("roms"); !reflect.DeepEqual(roms, []string{"/a", "/b"}) {
+		t.Errorf("unexpected Get(roms): %v", roms)
+	}
+	want := OrderedMap[int]{{Key: "zeta", Value: 3}, {Key: "alpha", Value: 2}}
+	if !reflect.DeepEqual(out.Levels, want) {
+		t.Errorf("Levels: expected %v, got %v", want, out.Levels)
+	}
+
+	data, err := Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	expected := strings.Replace(input, "  zeta: 1\n  alpha: 2\n  zeta: 3\n", "  zeta: 3\n  alpha: 2\n", 1)
+	if string(data) != expected {
+		t.Errorf("Marshal: expected %q, got %q", expected, data)
+	}
+
+	out.Levels.Set("alpha", 4)
+	out.Levels.Set("beta", 5)
+	out.Empty = OrderedMap[int]{}
+	data, err = Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if !strings.HasSuffix(string(data), "Levels\n  zeta: 3\n  alpha: 4\n  beta: 5\n") {
+		t.Errorf("unexpected Marshal after Set: %q", data)
+	}
+
+	// Errors name the key
+	if err := Unmarshal([]byte("Levels\n  a: x"), &out); err == nil || !strings.Contains(err.Error(), "field Levels: key a:") {
+		t.Errorf("expected value error naming the key, got %v", err)
+	}
+	bad := Config{Levels: OrderedMap[int]{{Key: "bad name", Value: 1}}}
+	if _, err := Marshal(bad); err == nil || !strings.Contains(err.Error(), `invalid node name "bad name"`) {
+		t.Errorf("expected invalid name error, got %v", err)
+	}
+	type Failing struct {
+		M OrderedMap[testLevel] `bml:"M"`
+	}
+	if _, err := Marshal(Failing{M: OrderedMap[testLevel]{{Key: "a", Value: -1}}}); err == nil || !strings.Contains(err.Error(), "field M: key a:") {
+		t.Errorf("expected marshal error naming the key, got %v", err)
+	}
+}
+
+func TestMarshalValueErrors(t *testing.T) {
+	var nilMap map[string]int
+	var nilPtr *TestVideoSettings
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{"nil", nil, "bml: MarshalValue requires a non-nil value"},
+		{"nil pointer", nilPtr, "bml: MarshalValue requires a non-nil value"},
+		{"scalar", 5, "bml: MarshalValue requires a struct, map, or slice, not int"},
+		{"func value", map[string]interface{}{"F": func() {}}, "key F: unsupported type: func"},
+		{"chan element", []interface{}{make(chan int)}, "element 0: unsupported type: chan"},
+		{"nested chan", map[string]interface{}{"L": [][]interface{}{{make(chan int)}}}, "key L: element 0: element 0: unsupported type: chan"},
+		{"chan in list", map[string]interface{}{"L": []interface{}{make(chan int)}}, "key L: element 0: unsupported type: chan"},
+		{"float keys", map[float64]string{1.5: "a"}, "map keys must be strings or integers, not float64"},
+		{"invalid name", map[string]int{"a b": 1}, `invalid node name "a b"`},
+		{"nested invalid name", map[string]interface{}{"M": map[string]int{"a b": 1}}, `key M: invalid node name "a b"`},
+		{"nil map", nilMap, ""},
+	}
+
+	for _, tt := range tests {
+		_, err := MarshalValue(tt.value)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%s: MarshalValue error: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: MarshalValue error: expected %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestTagAliases(t *testing.T) {
+	type Video struct {
+		Shader string   `bml:"Shader|PostShader|Filter"`
+		Paths  []string `bml:"Path|Dir"`
+		Scale  int      `bml:"Scale|Multiplier"`
+	}
+
+	var v Video
+	if err := Unmarshal([]byte("PostShader: crt\nFilter: none\nDir: /a\nDir: /b\n"), &v); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if v.Shader != "crt" {
+		t.Errorf("Shader: expected first present alias %q, got %q", "crt", v.Shader)
+	}
+	if !reflect.DeepEqual(v.Paths, []string{"/a", "/b"}) {
+		t.Errorf("unexpected Paths: %v", v.Paths)
+	}
+	if v.Scale != 0 {
+		t.Errorf("Scale: expected 0 when no name is present, got %d", v.Scale)
+	}
+
+	// The canonical name is preferred when several are present
+	if err := Unmarshal([]byte("Filter: a\nShader: b\nPath: /c\nDir: /d\n"), &v); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if v.Shader != "b" || !reflect.DeepEqual(v.Paths, []string{"/c"}) {
+		t.Errorf("unexpected Unmarshal result: %+v", v)
+	}
+
+	// Marshal writes the canonical name only
+	data, err := Marshal(Video{Shader: "crt", Paths: []string{"/a"}, Scale: 2})
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if string(data) != "Shader: crt\nPath: /a\nScale: 2\n" {
+		t.Errorf("unexpected Marshal result: %q", data)
+	}
+}
+
+type testRawVal string
+
+func (r *testRawVal) UnmarshalBML(value string) error {
+	*r = testRawVal(value)
+	return nil
+}
+
+func TestUnmarshalRaw(t *testing.T) {
+	type Format struct {
+		Sep     string     `bml:"Sep,raw"`
+		Trimmed string     `bml:"Trimmed"`
+		Prefix  *string    `bml:"Prefix,raw"`
+		Parts   []string   `bml:"Part,raw"`
+		Level   testLevel  `bml:"Level,raw"`
+		Raw     testRawVal `bml:"Raw,raw"`
+	}
+
+	input := "Sep=\" | \"\nTrimmed=\"  x  \"\nPrefix=\"> \"\nPart=\" a\"\nPart=\"b \"\nLevel: L2\nRaw=\" v \"\n"
+	var f Format
+	if err := Unmarshal([]byte(input), &f); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if f.Sep != " | " || f.Trimmed != "x" || f.Prefix == nil || *f.Prefix != "> " {
+		t.Errorf("unexpected Unmarshal result: %+v", f)
+	}
+	if !reflect.DeepEqual(f.Parts, []string{" a", "b "}) {
+		t.Errorf("unexpected Parts: %q", f.Parts)
+	}
+	if f.Level != 2 || f.Raw != " v " {
+		t.Errorf("unexpected Level %d and Raw %q", f.Level, f.Raw)
+	}
+
+	// Whitespace-significant values round-trip through Marshal
+	data, err := Marshal(f)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	var back Format
+	if err := Unmarshal(data, &back); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if back.Sep != " | " || !reflect.DeepEqual(back.Parts, f.Parts) {
+		t.Errorf("unexpected round trip: %+v from %q", back, data)
+	}
+}
+
+// === Integration Tests ===
+
+func TestParseRealSettingsFile(t *testing.T) {
+	data, err := os.ReadFile("/Users/josediazgonzalez/Library/Application Support/ares/settings.bml")
+	if err != nil {
+		t.Skipf("skipping: settings.bml not found: %v", err)
+	}
+
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Verify some known values from the real file
+	if driver := doc.Root.Get("Video/Driver").String(""); driver == "" {
+		t.Error("expected Video/Driver to have a value")
+	}
+
+	if doc.Root.Get("Video/Multiplier").Int(0) == 0 {
+		t.Error("expected Video/Multiplier to have a value")
+	}
+
+	// Test boolean value
+	_ = doc.Root.Get("Boot/Fast").Bool(false)
+
+	// Test float value
+	_ = doc.Root.Get("Video/Luminance").Float(0)
+}
+
+func TestRoundTripRealSettingsFile(t *testing.T) {
+	data, err := os.ReadFile("/Users/josediazgonzalez/Library/Application Support/ares/settings.bml")
+	if err != nil {
+		t.Skipf("skipping: settings.bml not found: %v", err)
+	}
+
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Get original values
+	origDriver := doc.Root.Get("Video/Driver").String("")
+	origMultiplier := doc.Root.Get("Video/Multiplier").Int(0)
+
+	// Serialize and re-parse
+	output := Serialize(doc)
+	doc2, err := Parse(output)
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+
+	// Verify values match
+	if doc2.Root.Get("Video/Driver").String("") != origDriver {
+		t.Error("Video/Driver mismatch after round-trip")
+	}
+	if doc2.Root.Get("Video/Multiplier").Int(0) != origMultiplier {
+		t.Error("Video/Multiplier mismatch after round-trip")
+	}
+}
+
+func TestModifyAndSerialize(t *testing.T) {
+	input := `Video
+  Driver: OpenGL
+  Multiplier: 1`
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Modify values
+	doc.Root.Get("Video").Set("Driver", "Metal")
+	doc.Root.Get("Video").SetInt("Multiplier", 2)
+	doc.Root.Get("Video").SetBool("NewSetting", true)
+
+	// Serialize and re-parse
+	output := Serialize(doc)
+	doc2, err := Parse(output)
+	if err != nil {
+		t.Fatalf("re-parse error: %v", err)
+	}
+
+	if doc2.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("expected Driver to be 'Metal'")
+	}
+	if doc2.Root.Get("Video/Multiplier").Int(0) != 2 {
+		t.Error("expected Multiplier to be 2")
+	}
+	if doc2.Root.Get("Video/NewSetting").Bool(false) != true {
+		t.Error("expected NewSetting to be true")
+	}
+}
+
+// === Helper function tests ===
+
+func TestIsValidNameChar(t *testing.T) {
+	valid := []byte{'A', 'Z', 'a', 'z', '0', '9', '-', '.'}
+	for _, c := range valid {
+		if !isValidNameChar(c) {
+			t.Errorf("expected %c to be valid", c)
+		}
+	}
+
+	invalid := []byte{' ', ':', '=', '"', '\t', '\n', '@', '!'}
+	for _, c := range invalid {
+		if isValidNameChar(c) {
+			t.Errorf("expected %c to be invalid", c)
+		}
+	}
+}
+
+func TestReadDepth(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected int
+	}{
+		{"Node", 0},
+		{"  Node", 2},
+		{"\tNode", 1},
+		{"\t\tNode", 2},
+		{"    Node", 4},
+		{"\t  Node", 3},
+	}
+
+	for _, tt := range tests {
+		depth := readDepth(tt.line)
+		if depth != tt.expected {
+			t.Errorf("readDepth(%q) = %d, expected %d", tt.line, depth, tt.expected)
+		}
+	}
+}
+
+// === Additional edge case tests for 100% coverage ===
+
+func TestParseValueNoContent(t *testing.T) {
+	// Test parseValue with position at end of line
+	value, pos, err := parseValue("Node", 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "" {
+		t.Errorf("expected empty value, got %q", value)
+	}
+	if pos != 4 {
+		t.Errorf("expected pos 4, got %d", pos)
+	}
+}
+
+func TestParseValueUnknownFormat(t *testing.T) {
+	// Test parseValue with unknown format (not :, =, or ")
+	value, pos, err := parseValue("Node X", 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "" {
+		t.Errorf("expected empty value, got %q", value)
+	}
+	if pos != 4 {
+		t.Errorf("expected pos 4, got %d", pos)
+	}
+}
+
+func TestSerializeNilNode(t *testing.T) {
+	// This shouldn't panic
+	serializeNode(nil, 0, 0, nil, SerializeOptions{})
+}
+
+func TestNodeGetPathWithEmptyParts(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
+
+	// Path with empty parts (double slash)
+	node := doc.Root.Get("Video//Driver")
+	if node == nil {
+		t.Fatal("expected to find node with empty path parts")
+	}
+	if node.Value != "Metal" {
+		t.Errorf("expected 'Metal', got %q", node.Value)
+	}
+}
+
+func TestNodeSetEmptyPath(t *testing.T) {
+	doc, _ := Parse([]byte(""))
+	result := doc.Root.Set("", "value")
+	if result != doc.Root {
+		t.Error("expected root node for empty path")
+	}
+}
+
+func TestDeepEqual(t *testing.T) {
+	input := `A
+  B
+    C: value`
+
+	doc1, _ := Parse([]byte(input))
+	doc2, _ := Parse([]byte(input))
+
+	if !reflect.DeepEqual(doc1.Root.Get("A/B/C"), doc2.Root.Get("A/B/C")) {
+		t.Error("expected equal nodes")
+	}
+}
+
+func TestParseColonValueTrailingSpaces(t *testing.T) {
+	input := "Driver: Metal   "
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if doc.Root.Children[0].Value != "Metal" {
+		t.Errorf("expected 'Metal', got %q", doc.Root.Children[0].Value)
+	}
+}
+
+func TestFloat32Field(t *testing.T) {
+	input := `Value: 3.14`
+
+	type S struct {
+		Value float32 `bml:"Value"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if s.Value < 3.13 || s.Value > 3.15 {
+		t.Errorf("expected ~3.14, got %f", s.Value)
+	}
+}
+
+func TestInt8Int16Int32Fields(t *testing.T) {
+	input := `I8: 127
+I16: 32000
+I32: 2000000`
+
+	type S struct {
+		I8  int8  `bml:"I8"`
+		I16 int16 `bml:"I16"`
+		I32 int32 `bml:"I32"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if s.I8 != 127 {
+		t.Errorf("expected 127, got %d", s.I8)
+	}
+	if s.I16 != 32000 {
+		t.Errorf("expected 32000, got %d", s.I16)
+	}
+	if s.I32 != 2000000 {
+		t.Errorf("expected 2000000, got %d", s.I32)
+	}
+}
+
+func TestUint16Uint32Fields(t *testing.T) {
+	input := `U16: 65000
+U32: 4000000`
+
+	type S struct {
+		U16 uint16 `bml:"U16"`
+		U32 uint32 `bml:"U32"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+
+	if s.U16 != 65000 {
+		t.Errorf("expected 65000, got %d", s.U16)
+	}
+	if s.U32 != 4000000 {
+		t.Errorf("expected 4000000, got %d", s.U32)
+	}
+}
+
+func TestMarshalFloat32(t *testing.T) {
+	type S struct {
+		Value float32 `bml:"Value"`
+	}
+	s := S{Value: 3.14}
+	data, err := Marshal(&s)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	if !strings.Contains(string(data), "3.14") {
+		t.Errorf("expected '3.14' in output, got %q", string(data))
+	}
+}
+
+func TestMarshalIntVariants(t *testing.T) {
+	type S struct {
+		I8  int8  `bml:"I8"`
+		I16 int16 `bml:"I16"`
+		I32 int32 `bml:"I32"`
+	}
+	s := S{I8: 10, I16: 1000, I32: 100000}
+	data, err := Marshal(&s)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	var result S
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if result.I8 != 10 || result.I16 != 1000 || result.I32 != 100000 {
+		t.Error("int variant mismatch after round-trip")
+	}
+}
+
+func TestMarshalUintVariants(t *testing.T) {
+	type S struct {
+		U8  uint8  `bml:"U8"`
+		U16 uint16 `bml:"U16"`
+		U32 uint32 `bml:"U32"`
+	}
+	s := S{U8: 200, U16: 60000, U32: 4000000}
+	data, err := Marshal(&s)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+
+	var result S
+	err = Unmarshal(data, &result)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	if result.U8 != 200 || result.U16 != 60000 || result.U32 != 4000000 {
+		t.Error("uint variant mismatch after round-trip")
+	}
+}
+
+// === Additional edge case tests for 100% coverage ===
+
+func TestUnmarshalParseError(t *testing.T) {
+	// Invalid BML that causes Parse to fail
+	input := `Driver="unclosed`
+
+	type S struct {
+		Driver string `bml:"Driver"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error for invalid BML")
+	}
+}
+
+func TestRemovePathWithEmptyParts(t *testing.T) {
+	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
+
+	// Path with empty parts
+	removed := doc.Root.Remove("Video//Driver")
+	if !removed {
+		t.Error("expected Remove to handle empty path parts")
+	}
+}
+
+func TestUnmarshalNodeNil(t *testing.T) {
+	// Test unmarshalNode with nil node directly
+	type S struct {
+		Value string `bml:"Value"`
+	}
+	input := ""
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSerializeNodeWithChildrenAndMultilineValue(t *testing.T) {
+	// Node with both multiline value AND children
+	doc := &Document{Root: &Node{
+		Children: []*Node{
+			{
+				Name:  "Desc",
+				Value: "Line1\nLine2",
+				Children: []*Node{
+					{Name: "Child", Value: "value"},
+				},
+			},
+		},
+	}}
+	data := Serialize(doc)
+	// Should serialize without panic
+	if len(data) == 0 {
+		t.Error("expected non-empty output")
+	}
+}
+
+func TestUnmarshalNodeError(t *testing.T) {
+	// Test error propagation in unmarshalNode
+	input := `Nested
+  Value: abc`
+
+	type Inner struct {
+		Value int `bml:"Value"`
+	}
+	type S struct {
+		Nested Inner `bml:"Nested"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error for invalid nested int")
+	}
+}
+
+func TestMarshalStructError(t *testing.T) {
+	// Test error in nested struct marshaling
+	type Inner struct {
+		Data complex128 `bml:"Data"`
+	}
+	type S struct {
+		Nested Inner `bml:"Nested"`
+	}
+	s := S{Nested: Inner{Data: 1i}}
+	_, err := Marshal(&s)
+	if err == nil {
+		t.Fatal("expected error for unsupported type in nested struct")
+	}
+}
+
+func TestParseNodeAttributeNoValue(t *testing.T) {
+	// Attribute without a value
+	input := "Node attr1"
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.Root.Children[0].Children) != 1 {
+		t.Fatalf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
+	}
+	if doc.Root.Children[0].Children[0].Name != "attr1" {
+		t.Errorf("expected attr1, got %q", doc.Root.Children[0].Children[0].Name)
+	}
+}
+
+func TestMultilineValueWithExistingValue(t *testing.T) {
+	// Node with initial value followed by continuation
+	input := `Desc: Initial
+  : Line2`
+
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	node := doc.Root.Children[0]
+	expected := "Initial\nLine2"
+	if node.Value != expected {
+		t.Errorf("expected %q, got %q", expected, node.Value)
+	}
+}
+
+func TestUnmarshalNilPointerTyped(t *testing.T) {
+	type S struct {
+		Value string `bml:"Value"`
+	}
+	var s *S = nil
+	err := Unmarshal([]byte("Value: test"), s)
+	if err == nil {
+		t.Fatal("expected error for nil typed pointer")
+	}
+}
+
+func TestUnmarshalNodeFieldError(t *testing.T) {
+	// Test when unmarshalValue returns an error for a field
+	input := `Value: notanumber`
+
+	type S struct {
+		Value int `bml:"Value"`
+	}
+	var s S
+	err := Unmarshal([]byte(input), &s)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "Value") {
+		t.Errorf("expected error to mention field name, got: %v", err)
+	}
+}
+
+// Test internal parseNode functions by calling them via exported wrappers
+// These test defensive code paths
+
+func TestParseNodeEdgeCases(t *testing.T) {
+	// Test calling parseNode directly to trigger defensive checks
+
+	// Test "unexpected end of input"
+	p := &parser{}
+	err := p.parseNode(&Node{}, -1)
+	if err == nil {
+		t.Fatal("expected error for empty lines")
+	}
+	if !strings.Contains(err.Error(), "unexpected end") {
+		t.Errorf("expected 'unexpected end' error, got: %v", err)
+	}
+
+	// Test "invalid indentation" - node at same or lower depth than parent
+	p = &parser{lines: []line{{text: "Node"}, {text: "  Child"}}, index: 1} // Start at Child
+	err = p.parseNode(&Node{}, 5)                                           // Parent depth 5, but Child has depth 2
+	if err == nil {
+		t.Fatal("expected error for invalid indentation")
+	}
+	if !strings.Contains(err.Error(), "invalid indentation") {
+		t.Errorf("expected 'invalid indentation' error, got: %v", err)
+	}
+}
+
+func TestNormalizeLinesThoroughly(t *testing.T) {
+	// Test various line ending combinations
+	tests := []struct {
+		input    string
+		expected int // expected number of lines after normalization
+	}{
+		{"A\r\nB\r\nC", 3},        // Windows
+		{"A\rB\rC", 3},            // Old Mac
+		{"A\nB\nC", 3},            // Unix
+		{"A\n\nB", 2},             // Empty lines removed
+		{"// comment\nA", 1},      // Comment removed
+		{"  // comment\nA", 1},    // Indented comment removed
+		{"\t// comment\nA", 1},    // Tab-indented comment removed
+		{"", 0},                   // Empty
+		{"   \n\t\n  ", 0},        // Only whitespace
+	}
+
+	for _, tt := range tests {
+		lines, err := (&parser{}).normalizeLines(tt.input)
+		if err != nil {
+			t.Fatalf("normalizeLines(%q) unexpected error: %v", tt.input, err)
+		}
+		if len(lines) != tt.expected {
+			t.Errorf("normalizeLines(%q) = %d lines, expected %d", tt.input, len(lines), tt.expected)
+		}
+	}
+}
+
+func TestParseNodeAttributeEdgeCases(t *testing.T) {
+	// Test attribute parsing edge cases
+
+	// Node with trailing spaces after value (pos >= len after spaces)
+	input := "Node: value   "
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Children[0].Value != "value" {
+		t.Errorf("expected 'value', got %q", doc.Root.Children[0].Value)
+	}
+
+	// Node with invalid character after attributes (breaks at attrStart)
+	input = "Node attr1=v1 !"
+	doc, err = Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Should parse attr1 but stop at !
+	if len(doc.Root.Children[0].Children) != 1 {
+		t.Errorf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
+	}
+}
+
+func TestParseNodeChildError(t *testing.T) {
+	// Test error propagation when parsing child node fails
+	// We need a child node that causes an error
+	// The only way to cause an error in child parsing is unclosed quote
+
+	input := `Parent
+  Child="unclosed`
+
+	_, err := Parse([]byte(input))
+	if err == nil {
+		t.Fatal("expected error from child parsing")
+	}
+}
+
+func TestUnmarshalNodeNilDirectly(t *testing.T) {
+	// Test unmarshalNode when called with nil node
+	type S struct {
+		Value string `bml:"Value"`
+	}
+	var s S
+	// Call unmarshalNode directly with nil
+	err := (&decoder{}).unmarshalNode(nil, reflect.ValueOf(&s).Elem())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParseNodeAttributeTrailingSpaces(t *testing.T) {
+	// Test attribute loop ending at pos >= len(line) after spaces
+	input := "Node attr1=v1 "
+	doc, err := Parse([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.Root.Children[0].Children) != 1 {
+		t.Errorf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
+	}
+}
+
+func TestParseNodeAttributeParseValueError(t *testing.T) {
+	// Test error in parseValue during attribute parsing
+	input := `Node attr="unclosed`
+	_, err := Parse([]byte(input))
+	if err == nil {
+		t.Fatal("expected error for unclosed attribute quote")
+	}
+}
+
+// === byuuML Compatibility Tests ===
+// Tests against the official byuuML test file from https://github.com/SolraBizna/byuuML
+
+func TestParseByuuMLTestFile(t *testing.T) {
+	data, err := os.ReadFile("testdata/byuuml_test.bml")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Verify root-level nodes
+	if len(doc.Root.Children) != 4 {
+		t.Fatalf("expected 4 root nodes, got %d", len(doc.Root.Children))
+	}
+
+	// Test root-node structure
+	rootNode := doc.Root.Children[0]
+	if rootNode.Name != "root-node" {
+		t.Errorf("expected 'root-node', got %q", rootNode.Name)
+	}
+	if len(rootNode.Children) != 2 {
+		t.Fatalf("expected 2 children of root-node, got %d", len(rootNode.Children))
+	}
+
+	// Test child-node-1 with multiline value
+	childNode1 := rootNode.Children[0]
+	if childNode1.Name != "child-node-1" {
+		t.Errorf("expected 'child-node-1', got %q", childNode1.Name)
+	}
+	if childNode1.Value != "datacont1" {
+		t.Errorf("child-node-1: expected value 'datacont1', got %q", childNode1.Value)
+	}
+
+	// Test child-node-2 with empty initial value and continuation
+	childNode2 := rootNode.Children[1]
+	if childNode2.Name != "child-node-2" {
+		t.Errorf("expected 'child-node-2', got %q", childNode2.Name)
+	}
+	if childNode2.Value != "datacont2" {
+		t.Errorf("child-node-2: expected value 'datacont2', got %q", childNode2.Value)
+	}
+
+	// Test root-node-2 with value and continuation lines
+	rootNode2 := doc.Root.Children[1]
+	if rootNode2.Name != "root-node-2" {
+		t.Errorf("expected 'root-node-2', got %q", rootNode2.Name)
+	}
+	// The test file uses \r (carriage return) within the continuation line, which gets normalized to \n
+	// This creates separate continuation lines: "  continues  " and "apace"
+	// Then there's an empty continuation line (just `:`)
+	expectedValue := "Data\n  continues  \napace\n"
+	if rootNode2.Value != expectedValue {
+		t.Errorf("root-node-2: expected value %q, got %q", expectedValue, rootNode2.Value)
+	}
+
+	// Test that root-node-2 has child-node children (there are 2 with same name)
+	childNodes := 0
+	for _, child := range rootNode2.Children {
+		if child.Name == "child-node" {
+			childNodes++
+		}
+	}
+	if childNodes != 2 {
+		t.Errorf("expected 2 child-node children, got %d", childNodes)
+	}
+
+	// Test additional-child with attributes (inside second child-node)
+	// The second child-node has additional-child, another-child, yet-another-child as children
+	secondChildNode := rootNode2.Children[1]
+	if secondChildNode.Name != "child-node" {
+		t.Errorf("expected second 'child-node', got %q", secondChildNode.Name)
+	}
+
+	// Find additional-child
+	var additionalChild *Node
+	for _, child := range secondChildNode.Children {
+		if child.Name == "additional-child" {
+			additionalChild = child
+			break
+		}
+	}
+	if additionalChild == nil {
+		t.Fatal("expected to find additional-child")
+	}
+
+	// Test attributes of additional-child
+	// Should have: with-a-dataless-attribute, followed-by, and, give, up
+	if len(additionalChild.Children) != 5 {
+		t.Errorf("additional-child: expected 5 attributes, got %d", len(additionalChild.Children))
+	}
+
+	// Critical test: followed-by value must end with literal backslash (no escape)
+	// byuuML spec: "There is no provision for escaping characters"
+	var followedBy *Node
+	for _, attr := range additionalChild.Children {
+		if attr.Name == "followed-by" {
+			followedBy = attr
+			break
+		}
+	}
+	if followedBy == nil {
+		t.Fatal("expected to find followed-by attribute")
+	}
+	// The value should be "never escape\" (ending with literal backslash)
+	if followedBy.Value != `never escape\` {
+		t.Errorf("followed-by: expected 'never escape\\', got %q", followedBy.Value)
+	}
+
+	// Test another-child (should have no value due to inline comment)
+	var anotherChild *Node
+	for _, child := range secondChildNode.Children {
+		if child.Name == "another-child" {
+			anotherChild = child
+			break
+		}
+	}
+	if anotherChild == nil {
+		t.Fatal("expected to find another-child")
+	}
+	if anotherChild.Value != "" {
+		t.Errorf("another-child: expected empty value (comment), got %q", anotherChild.Value)
+	}
+
+	// Test yet-another-child (value should be "// without comment" because it's equals format)
+	var yetAnotherChild *Node
+	for _, child := range secondChildNode.Children {
+		if child.Name == "yet-another-child" {
+			yetAnotherChild = child
+			break
+		}
+	}
+	if yetAnotherChild == nil {
+		t.Fatal("expected to find yet-another-child")
+	}
+	// In equals format without quotes, value is read until space
+	// "yet-another-child=// without comment" -> value is "//"
+	if yetAnotherChild.Value != "//" {
+		t.Errorf("yet-another-child: expected '//', got %q", yetAnotherChild.Value)
+	}
+
+	// Test oh-no-more-root-node with attributes
+	ohNoMore := doc.Root.Children[2]
+	if ohNoMore.Name != "oh-no-more-root-node" {
+		t.Errorf("expected 'oh-no-more-root-node', got %q", ohNoMore.Name)
+	}
+	// Note: The test file has "c=3\td=4" (tab between c and d)
+	// The current parser doesn't treat tab as separator in unquoted equals values,
+	// so it parses as 3 attributes: a=1, b=2, c="3\td=4"
+	if len(ohNoMore.Children) != 3 {
+		t.Errorf("oh-no-more-root-node: expected 3 attributes (current parser behavior), got %d", len(ohNoMore.Children))
+	}
+
+	// Verify attribute values
+	attrs := make(map[string]string)
+	for _, attr := range ohNoMore.Children {
+		attrs[attr.Name] = attr.Value
+	}
+	if attrs["a"] != "1" || attrs["b"] != "2" {
+		t.Errorf("oh-no-more-root-node: unexpected attribute values: %v", attrs)
+	}
+	// c's value includes the tab and d=4 due to current parser behavior
+	if attrs["c"] != "3\td=4" {
+		t.Errorf("oh-no-more-root-node: expected c='3\\td=4', got %q", attrs["c"])
+	}
+
+	// Test lost-child
+	lostChild := doc.Root.Children[3]
+	if lostChild.Name != "lost-child" {
+		t.Errorf("expected 'lost-child', got %q", lostChild.Name)
+	}
+	// Note: The test file has "easily-misplaced:very true"
+	// The current parser's colon format reads to end of line for attributes,
+	// so easily-misplaced gets value "very true" (not just "very")
+	// and "true" is NOT parsed as a separate attribute
+	if len(lostChild.Children) != 1 {
+		t.Errorf("lost-child: expected 1 child (current parser behavior), got %d", len(lostChild.Children))
+	}
+
+	var easilyMisplaced *Node
+	for _, child := range lostChild.Children {
+		if child.Name == "easily-misplaced" {
+			easilyMisplaced = child
+		}
+	}
+
+	if easilyMisplaced == nil {
+		t.Fatal("expected to find easily-misplaced attribute")
+	}
+	// Current parser includes "true" in the value due to colon format reading to EOL
+	if easilyMisplaced.Value != "very true" {
+		t.Errorf("easily-misplaced: expected 'very true' (current behavior), got %q", easilyMisplaced.Value)
+	}
+}
+
+// === Reader Tests ===
+
+func TestParseReaderPlain(t *testing.T) {
+	doc, err := ParseReader(strings.NewReader("Video\n  Driver: Metal"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("expected Video/Driver to be 'Metal'")
+	}
+}
+
+func TestParseReaderGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte("Video\n  Driver: Metal")); err != nil {
+		t.Fatalf("gzip write error: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip close error: %v", err)
+	}
+
+	doc, err := ParseReader(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("expected Video/Driver to be 'Metal'")
+	}
+}
+
+func TestParseReaderShortInput(t *testing.T) {
+	doc, err := ParseReader(strings.NewReader("A"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Get("A") == nil {
+		t.Error("expected single-byte input to parse")
+	}
+
+	doc, err = ParseReader(strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.Root.Children) != 0 {
+		t.Error("expected empty document")
+	}
+}
+
+func TestParseReaderErrors(t *testing.T) {
+	// Gzip magic followed by a truncated header
+	if _, err := ParseReader(bytes.NewReader([]byte{0x1f, 0x8b, 0x08})); err == nil {
+		t.Error("expected error for corrupt gzip header")
+	}
+
+	// Valid gzip header with a corrupt body
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write([]byte("Video\n  Driver: Metal"))
+	_ = gz.Close()
+	data := buf.Bytes()
+	data[len(data)-5] ^= 0xff
+	if _, err := ParseReader(bytes.NewReader(data)); err == nil {
+		t.Error("expected error for corrupt gzip body")
+	}
+
+	// Read errors are returned
+	if _, err := ParseReader(iotest.ErrReader(errors.New("boom"))); err == nil || err.Error() != "boom" {
+		t.Errorf("expected read error, got: %v", err)
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+
+	// Parse errors are returned
+	if _, err := ParseReader(strings.NewReader(`Driver="Metal`)); err == nil {
+		t.Error("expected parse error")
 	}
-	// Empty values should leave zero values
-	if s.Int != 0 || s.Float != 0 || s.Uint != 0 {
-		t.Error("expected zero values for empty strings")
+}
+
+// writeFiles creates the named files with their contents under a temporary
+// directory and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
 	}
+	return dir
 }
 
-type TestUnsupportedType struct {
-	Data []string `bml:"Data"`
+func TestParseFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"settings.bml":      "Video\n  Driver: Metal\nInclude: audio/audio.bml\nInput\n  Include: input.bml\n",
+		"audio/audio.bml":   "Audio\n  Driver: SDL\nInclude: latency.bml\n",
+		"audio/latency.bml": "Latency: 20\n",
+		"input.bml":         "Driver: XInput\n",
+	})
+
+	doc, err := ParseFileWithOptions(filepath.Join(dir, "settings.bml"), ParseOptions{Includes: true})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want := "Video\n  Driver: Metal\nAudio\n  Driver: SDL\nLatency: 20\nInput\n  Driver: XInput\n"
+	if got := string(Serialize(doc)); got != want {
+		t.Errorf("ParseFileWithOptions: expected %q, got %q", want, got)
+	}
+
+	// Without the option, Include nodes are ordinary nodes
+	doc, err = ParseFile(filepath.Join(dir, "settings.bml"))
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if doc.Root.Get("Include").String("") != "audio/audio.bml" {
+		t.Error("ParseFile() should not resolve includes")
+	}
+
+	// With NormalizeNames the directive is matched in its normalized form
+	dir = writeFiles(t, map[string]string{
+		"settings.bml": "INCLUDE: input.bml\nInput\n  include: input.bml\n",
+		"input.bml":    "Driver: XInput\n",
+	})
+	opts := ParseOptions{Includes: true, NormalizeNames: strings.ToLower}
+	doc, err = ParseFileWithOptions(filepath.Join(dir, "settings.bml"), opts)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	want = "driver: XInput\ninput\n  driver: XInput\n"
+	if got := string(Serialize(doc)); got != want {
+		t.Errorf("ParseFileWithOptions: expected %q, got %q", want, got)
+	}
+
+	// Attributes named Include are not directives
+	doc, err = ParseWithOptions([]byte("Node Include=x.bml\n"), ParseOptions{Includes: true})
+	if err != nil || doc.Root.Get("Node/Include").Value != "x.bml" {
+		t.Errorf("unexpected ParseWithOptions result: %v, %v", doc, err)
+	}
 }
 
-func TestUnmarshalUnsupportedType(t *testing.T) {
-	input := `Data: value`
+func TestParseFileErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"a.bml":       "Include: b.bml\n",
+		"b.bml":       "Node\n  Include: a.bml\n",
+		"missing.bml": "Include: nowhere.bml\n",
+		"empty.bml":   "Include\n",
+		"bad.bml":     "Include: broken.bml\n",
+		"broken.bml":  "Node=\"unclosed\n",
+	})
+	opts := ParseOptions{Includes: true}
 
-	var settings TestUnsupportedType
-	err := Unmarshal([]byte(input), &settings)
-	if err == nil {
-		t.Fatal("expected error for unsupported type")
+	a, b := filepath.Join(dir, "a.bml"), filepath.Join(dir, "b.bml")
+	_, err := ParseFileWithOptions(a, opts)
+	if err == nil || err.Error() != "include cycle: "+a+" -> "+b+" -> "+a {
+		t.Errorf("expected cycle error, got %v", err)
 	}
-	if !strings.Contains(err.Error(), "unsupported") {
-		t.Errorf("expected 'unsupported' in error, got: %v", err)
+
+	_, err = ParseFileWithOptions(filepath.Join(dir, "missing.bml"), opts)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected a not-exist error, got %v", err)
+	}
+
+	_, err = ParseFileWithOptions(filepath.Join(dir, "empty.bml"), opts)
+	if err == nil || !strings.HasSuffix(err.Error(), "empty.bml: Include without a file path") {
+		t.Errorf("expected empty include error, got %v", err)
+	}
+
+	_, err = ParseFileWithOptions(filepath.Join(dir, "bad.bml"), opts)
+	if err == nil || !strings.Contains(err.Error(), "broken.bml: unclosed quote") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+
+	if _, err := ParseFile(filepath.Join(dir, "none.bml")); err == nil {
+		t.Error("expected error for missing file")
 	}
 }
 
-func TestMarshalBasic(t *testing.T) {
-	settings := TestSettings{
-		Video: TestVideoSettings{
-			Driver:     "Metal",
-			Multiplier: 2,
-			Luminance:  1.5,
-			ColorBleed: true,
-		},
-		Audio: TestAudioSettings{
-			Driver: "SDL",
-			Volume: 0.8,
-			Mute:   false,
-		},
+func TestWriteFile(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"settings.bml":       "Video\n  Driver: Metal\n",
+		"occupied.bml/x.bml": "Node\n",
+	})
+	path := filepath.Join(dir, "settings.bml")
+
+	doc, err := ParseFile(path)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	doc.Root.Set("Video/Driver", "OpenGL")
+	if err := WriteFile(path, doc, 0o600); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
 	}
 
-	data, err := Marshal(&settings)
+	doc, err = ReadFile(path)
 	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+		t.Fatalf("ReadFile error: %v", err)
+	}
+	if got := doc.Root.Get("Video/Driver").String(""); got != "OpenGL" {
+		t.Errorf("Video/Driver: expected %q, got %q", "OpenGL", got)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected mode 0600, got %v, %v", info, err)
 	}
 
-	// Parse it back
-	var result TestSettings
-	err = Unmarshal(data, &result)
+	// A failed rename leaves the target alone and removes the temporary file
+	if err := WriteFile(filepath.Join(dir, "occupied.bml"), doc, 0o644); err == nil {
+		t.Error("expected error when the target is a directory")
+	}
+	if err := WriteFile(filepath.Join(dir, "missing", "settings.bml"), doc, 0o644); err == nil {
+		t.Error("expected error for a missing directory")
+	}
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatal(err)
 	}
+	if len(entries) != 2 {
+		t.Errorf("expected no temporary files to remain, got %v", entries)
+	}
+}
 
-	if result.Video.Driver != "Metal" {
-		t.Errorf("expected 'Metal', got %q", result.Video.Driver)
+// === Scanner Tests ===
+
+func TestScanner(t *testing.T) {
+	input := `// header
+Video
+  Driver: Metal
+
+  // between children
+  Multiplier: 2
+// before audio
+Audio
+  Driver: SDL
+Paths
+// trailing comment
+`
+
+	s := NewScanner(strings.NewReader(input))
+
+	var names []string
+	for s.Scan() {
+		names = append(names, s.Node().Name)
+		if s.Node().Name == "Video" && s.Node().Get("Multiplier").Int(0) != 2 {
+			t.Error("expected Video to include all of its children")
+		}
 	}
-	if result.Video.Multiplier != 2 {
-		t.Errorf("expected 2, got %d", result.Video.Multiplier)
+	if err := s.Err(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"Video", "Audio", "Paths"}) {
+		t.Errorf("unexpected nodes: %v", names)
+	}
+	if s.Node() != nil {
+		t.Error("expected nil node after scanning finishes")
+	}
+	if s.Scan() {
+		t.Error("expected Scan to keep returning false at end of input")
 	}
 }
 
-func TestMarshalNonPointer(t *testing.T) {
-	settings := TestSettings{}
-	data, err := Marshal(settings) // non-pointer should work
+func TestScannerIndentedRoots(t *testing.T) {
+	s := NewScanner(strings.NewReader("  A\n    Child\n  B\n C"))
+
+	var names []string
+	for s.Scan() {
+		names = append(names, s.Node().Name)
+	}
+	if s.Err() != nil {
+		t.Fatalf("unexpected error: %v", s.Err())
+	}
+	if !reflect.DeepEqual(names, []string{"A", "B", "C"}) {
+		t.Errorf("unexpected nodes: %v", names)
+	}
+}
+
+func TestScannerMatchesParse(t *testing.T) {
+	data, err := os.ReadFile("testdata/byuuml_test.bml")
 	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+		t.Fatalf("failed to read test file: %v", err)
 	}
-	if len(data) == 0 {
-		t.Error("expected non-empty output")
+	doc, err := Parse(data)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	s := NewScanner(bytes.NewReader(data))
+	var nodes []*Node
+	for s.Scan() {
+		nodes = append(nodes, s.Node())
+	}
+	if s.Err() != nil {
+		t.Fatalf("unexpected error: %v", s.Err())
+	}
+	if !(&Node{Children: nodes}).Equal(doc.Root) {
+		t.Error("expected scanned nodes to match Parse")
 	}
 }
 
-func TestMarshalNilPointer(t *testing.T) {
-	var settings *TestSettings
-	_, err := Marshal(settings)
-	if err == nil {
-		t.Fatal("expected error for nil pointer")
+func TestScannerParseError(t *testing.T) {
+	s := NewScanner(strings.NewReader("Video\n  Driver: Metal\nAudio=\"unclosed\nPaths"))
+
+	if !s.Scan() || s.Node().Name != "Video" {
+		t.Fatal("expected Video before the error")
+	}
+	if s.Scan() {
+		t.Fatal("expected Scan to fail on the malformed node")
+	}
+	if s.Err() == nil || !strings.Contains(s.Err().Error(), "unclosed quote") {
+		t.Errorf("expected unclosed quote error, got: %v", s.Err())
+	}
+	if s.Scan() {
+		t.Error("expected Scan to stop after an error")
 	}
 }
 
-func TestMarshalNonStruct(t *testing.T) {
-	s := "string"
-	_, err := Marshal(&s)
-	if err == nil {
-		t.Fatal("expected error for non-struct")
+func TestScannerReadError(t *testing.T) {
+	s := NewScanner(iotest.ErrReader(errors.New("boom")))
+	if s.Scan() {
+		t.Fatal("expected Scan to fail")
+	}
+	if s.Err() == nil || s.Err().Error() != "boom" {
+		t.Errorf("expected read error, got: %v", s.Err())
 	}
 }
 
-func TestMarshalPointerFields(t *testing.T) {
-	driver := "Metal"
-	count := 5
-	settings := TestPointerSettings{
-		Driver: &driver,
-		Count:  &count,
+func TestScanLines(t *testing.T) {
+	tests := []struct {
+		input string
+		lines []string
+	}{
+		{"A\nB", []string{"A", "B"}},
+		{"A\r\nB\r\n", []string{"A", "B"}},
+		{"A\rB\r", []string{"A", "B"}},
+		{"A\r", []string{"A"}},
+		{"", nil},
 	}
 
-	data, err := Marshal(&settings)
-	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+	for _, tt := range tests {
+		s := bufio.NewScanner(iotest.OneByteReader(strings.NewReader(tt.input)))
+		s.Split(scanLines)
+		var lines []string
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		if !reflect.DeepEqual(lines, tt.lines) {
+			t.Errorf("scanLines(%q) = %q, expected %q", tt.input, lines, tt.lines)
+		}
 	}
+}
 
-	var result TestPointerSettings
-	err = Unmarshal(data, &result)
+// === Parse Options Tests ===
+
+func TestParseWithOptionsDefaults(t *testing.T) {
+	doc, err := ParseWithOptions([]byte("Video\n  Driver: Metal"), ParseOptions{})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
-
-	if result.Driver == nil || *result.Driver != "Metal" {
-		t.Error("expected Driver to be 'Metal'")
+	if doc.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("expected Video/Driver to be 'Metal'")
 	}
 }
 
-func TestMarshalNilPointerFields(t *testing.T) {
-	settings := TestPointerSettings{
-		Driver: nil,
-		Count:  nil,
-	}
+func TestParseMaxNodes(t *testing.T) {
+	input := []byte("Video\n  Driver: Metal\nAudio")
 
-	data, err := Marshal(&settings)
-	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+	if _, err := ParseWithOptions(input, ParseOptions{MaxNodes: 3}); err != nil {
+		t.Fatalf("unexpected error at limit: %v", err)
 	}
 
-	// Nil pointer fields should be skipped
-	if strings.Contains(string(data), "Driver") {
-		t.Error("expected nil Driver to be skipped")
+	_, err := ParseWithOptions(input, ParseOptions{MaxNodes: 2})
+	if err == nil {
+		t.Fatal("expected error when exceeding MaxNodes")
+	}
+	if !strings.Contains(err.Error(), "maximum of 2 nodes") {
+		t.Errorf("expected node limit error, got: %v", err)
 	}
 }
 
-func TestMarshalUnexportedFields(t *testing.T) {
-	settings := TestUnexportedFields{
-		Public:  "value",
-		private: "secret",
+func TestParseMaxNodesCountsAttributes(t *testing.T) {
+	_, err := ParseWithOptions([]byte("Node a=1 b=2"), ParseOptions{MaxNodes: 2})
+	if err == nil {
+		t.Fatal("expected error when attributes exceed MaxNodes")
 	}
+}
 
-	data, err := Marshal(&settings)
-	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+func TestParseMaxLineLength(t *testing.T) {
+	input := []byte("Video\n  Driver: Metal")
+
+	if _, err := ParseWithOptions(input, ParseOptions{MaxLineLength: 15}); err != nil {
+		t.Fatalf("unexpected error at limit: %v", err)
 	}
 
-	// private field should not be in output
-	if strings.Contains(string(data), "private") {
-		t.Error("expected private field to be skipped")
+	_, err := ParseWithOptions(input, ParseOptions{MaxLineLength: 14})
+	if err == nil {
+		t.Fatal("expected error when exceeding MaxLineLength")
+	}
+	if !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error to name line 2, got: %v", err)
 	}
 }
 
-func TestMarshalNoTagFields(t *testing.T) {
-	settings := TestNoTagFields{
-		Tagged:   "value",
-		Untagged: "ignored",
+func TestParseIndentStyleAny(t *testing.T) {
+	input := []byte("Video\n  Driver: Metal\n\tMultiplier: 2")
+	if _, err := ParseWithOptions(input, ParseOptions{IndentStyle: IndentAny}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
+}
 
-	data, err := Marshal(&settings)
-	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+func TestParseIndentStyleSpaces(t *testing.T) {
+	if _, err := ParseWithOptions([]byte("Video\n  Driver: Metal"), ParseOptions{IndentStyle: IndentSpaces}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if !strings.Contains(string(data), "Tagged") {
-		t.Error("expected Tagged field in output")
+	_, err := ParseWithOptions([]byte("Video\n  Driver: Metal\n \tMultiplier: 2"), ParseOptions{IndentStyle: IndentSpaces})
+	if err == nil {
+		t.Fatal("expected error for tab indentation")
 	}
-	if strings.Contains(string(data), "Untagged") {
-		t.Error("expected Untagged field to be skipped (no tag)")
+	if !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "tabs") {
+		t.Errorf("expected error naming line 3 and tabs, got: %v", err)
 	}
 }
 
-func TestMarshalUnsupportedType(t *testing.T) {
-	settings := TestUnsupportedType{
-		Data: []string{"a", "b"},
+func TestParseIndentStyleTabs(t *testing.T) {
+	if _, err := ParseWithOptions([]byte("Video\n\tDriver: Metal"), ParseOptions{IndentStyle: IndentTabs}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	_, err := Marshal(&settings)
+	_, err := ParseWithOptions([]byte("Video\n\t Driver: Metal"), ParseOptions{IndentStyle: IndentTabs})
 	if err == nil {
-		t.Fatal("expected error for unsupported type")
+		t.Fatal("expected error for space indentation")
+	}
+	if !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "spaces") {
+		t.Errorf("expected error naming line 2 and spaces, got: %v", err)
 	}
 }
 
-func TestMarshalUintFields(t *testing.T) {
-	settings := TestUintFields{
-		Count:   42,
-		Count8:  255,
-		Count64: 9999999999,
+func TestParseIndentStyleAppliesToComments(t *testing.T) {
+	_, err := ParseWithOptions([]byte("Video\n\t// comment\n  Driver: Metal"), ParseOptions{IndentStyle: IndentSpaces})
+	if err == nil {
+		t.Fatal("expected error for tab-indented comment")
 	}
+}
 
-	data, err := Marshal(&settings)
+func TestParseRawText(t *testing.T) {
+	input := `Description
+  This is a paragraph
+  written without colons.
+
+    Indented line
+  Author: me
+  // comment
+  : continued
+  Done
+
+Video
+  Driver: Metal`
+
+	opts := ParseOptions{RawText: []string{"Description"}, PreserveComments: true}
+	doc, err := ParseWithOptions([]byte(input), opts)
 	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	var result TestUintFields
-	err = Unmarshal(data, &result)
+	// Blank lines, comments, and lines that look like children are text
+	desc := doc.Root.Get("Description")
+	expected := "This is a paragraph\nwritten without colons.\n\n  Indented line\nAuthor: me\n// comment\ncontinued\nDone"
+	if desc.Value != expected {
+		t.Errorf("expected %q, got %q", expected, desc.Value)
+	}
+	if len(desc.Children) != 0 {
+		t.Errorf("expected no children, got %d", len(desc.Children))
+	}
+	if doc.Root.Get("Video/Driver").String("") != "Metal" {
+		t.Error("expected Video/Driver to be unaffected")
+	}
+
+	// Round-trip through Serialize preserves the block, with or without
+	// the option
+	for _, o := range []ParseOptions{{}, opts} {
+		doc2, err := ParseWithOptions(Serialize(doc), o)
+		if err != nil {
+			t.Fatalf("re-parse error: %v", err)
+		}
+		if doc2.Root.Get("Description").Value != expected {
+			t.Errorf("expected %q after round-trip, got %q", expected, doc2.Root.Get("Description").Value)
+		}
+	}
+
+	// With KeepRaw the block is reprinted as it was
+	doc, err = ParseWithOptions([]byte(input), ParseOptions{RawText: []string{"Description"}, KeepRaw: true})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = strings.Replace(input, "Done\n\n", "Done\n", 1)
+	if got := string(SerializeWithOptions(doc, SerializeOptions{PreferRaw: true})); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
 
-	if result.Count != 42 || result.Count8 != 255 || result.Count64 != 9999999999 {
-		t.Error("uint fields mismatch after round-trip")
+	// A listed node with only blank lines after it has no value
+	doc, err = ParseWithOptions([]byte("Description\n\n"), opts)
+	if err != nil || doc.Root.Get("Description").HasValue {
+		t.Errorf("unexpected result %v, %v", doc, err)
 	}
 }
 
-// === Integration Tests ===
+func TestParseRawTextShallowerLine(t *testing.T) {
+	input := "Notes\n    deep text\n  shallow text"
 
-func TestParseRealSettingsFile(t *testing.T) {
-	data, err := os.ReadFile("/Users/josediazgonzalez/Library/Application Support/ares/settings.bml")
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{RawText: []string{"Notes"}})
 	if err != nil {
-		t.Skipf("skipping: settings.bml not found: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Get("Notes").Value != "deep text\nshallow text" {
+		t.Errorf("unexpected value %q", doc.Root.Get("Notes").Value)
+	}
+}
+
+func TestParseRawTextRequiresNoValue(t *testing.T) {
+	input := "Notes: inline\n  Child text"
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{RawText: []string{"Notes"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	notes := doc.Root.Get("Notes")
+	if notes.Value != "inline" {
+		t.Errorf("expected 'inline', got %q", notes.Value)
+	}
+	if notes.Get("Child") == nil {
+		t.Error("expected Child to be parsed as a node when Notes has a value")
+	}
+}
+
+func TestParseRawTextDisabled(t *testing.T) {
+	doc, err := Parse([]byte("Notes\n  Some text"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Get("Notes/Some") == nil {
+		t.Error("expected text to parse as a child without RawText")
 	}
+}
 
-	doc, err := Parse(data)
+func TestParseNextLineValues(t *testing.T) {
+	input := `Name
+  Super Mario World
+Path
+  /roms // rom folder
+Tags
+  Platformer
+  SNES
+Region
+  Code: US
+Title: Set
+  Ignored
+Other
+  Child
+Last
+  // before value
+  value`
+
+	var warnings []Warning
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{
+		NextLineValues:   []string{"Name", "Path", "Tags", "Region", "Title", "Last"},
+		PreserveComments: true,
+		Warnings:         func(w Warning) { warnings = append(warnings, w) },
+	})
 	if err != nil {
-		t.Fatalf("parse error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Verify some known values from the real file
-	if driver := doc.Root.Get("Video/Driver").String(""); driver == "" {
-		t.Error("expected Video/Driver to have a value")
+	if got := doc.Root.Get("Name"); got.Value != "Super Mario World" || !got.HasValue || len(got.Children) != 0 {
+		t.Errorf("unexpected Name: %+v", got)
+	}
+	if got := doc.Root.Get("Path"); got.Value != "/roms" || got.InlineComment != "rom folder" {
+		t.Errorf("unexpected Path: %+v", got)
+	}
+	if got := doc.Root.Get("Last").Value; got != "value" {
+		t.Errorf("expected Last value %q, got %q", "value", got)
 	}
 
-	if doc.Root.Get("Video/Multiplier").Int(0) == 0 {
-		t.Error("expected Video/Multiplier to have a value")
+	// More than one deeper line, a name: line, an existing value, or an
+	// unlisted node means children
+	for path, children := range map[string]int{"Tags": 2, "Region": 1, "Title": 1, "Other": 1} {
+		node := doc.Root.Get(path)
+		if len(node.Children) != children {
+			t.Errorf("%s: expected %d children, got %+v", path, children, node)
+		}
 	}
 
-	// Test boolean value
-	_ = doc.Root.Get("Boot/Fast").Bool(false)
+	if len(warnings) != 1 || warnings[0].Line != 16 || warnings[0].Category != WarnDroppedComment {
+		t.Errorf("unexpected warnings: %+v", warnings)
+	}
 
-	// Test float value
-	_ = doc.Root.Get("Video/Luminance").Float(0)
+	// Serialize writes the standard form
+	if got := string(Serialize(&Document{Root: &Node{Children: doc.Root.Children[:1]}})); got != "Name: Super Mario World\n" {
+		t.Errorf("unexpected serialization: %q", got)
+	}
 }
 
-func TestRoundTripRealSettingsFile(t *testing.T) {
-	data, err := os.ReadFile("/Users/josediazgonzalez/Library/Application Support/ares/settings.bml")
+func TestParseNextLineValuesInlineCommentConflict(t *testing.T) {
+	var warnings []Warning
+	doc, err := ParseWithOptions([]byte("Name // first\n  value // second\nEnd\n  text"), ParseOptions{
+		NextLineValues:   []string{"Name", "End"},
+		PreserveComments: true,
+		Warnings:         func(w Warning) { warnings = append(warnings, w) },
+	})
 	if err != nil {
-		t.Skipf("skipping: settings.bml not found: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := doc.Root.Get("Name"); got.Value != "value" || got.InlineComment != "first" {
+		t.Errorf("unexpected Name: %+v", got)
+	}
+	if got := doc.Root.Get("End").Value; got != "text" {
+		t.Errorf("expected %q, got %q", "text", got)
+	}
+	if len(warnings) != 1 || warnings[0].Line != 2 {
+		t.Errorf("unexpected warnings: %+v", warnings)
 	}
 
-	doc, err := Parse(data)
-	if err != nil {
-		t.Fatalf("parse error: %v", err)
+	// A listed node followed by a sibling or the end of the input has no
+	// value to take
+	for _, input := range []string{"Name\nOther", "Name"} {
+		doc, err = ParseWithOptions([]byte(input), ParseOptions{NextLineValues: []string{"Name"}})
+		if err != nil || doc.Root.Get("Name").HasValue {
+			t.Errorf("%q: unexpected result: %+v, %v", input, doc, err)
+		}
 	}
+}
 
-	// Get original values
-	origDriver := doc.Root.Get("Video/Driver").String("")
-	origMultiplier := doc.Root.Get("Video/Multiplier").Int(0)
+func TestParseRootValue(t *testing.T) {
+	input := ": /home/user/roms\n: second line\n"
 
-	// Serialize and re-parse
-	output := Serialize(doc)
-	doc2, err := Parse(output)
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{RootValue: true})
 	if err != nil {
-		t.Fatalf("re-parse error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if doc.Root.Value != "/home/user/roms\nsecond line" || !doc.Root.HasValue || len(doc.Root.Children) != 0 {
+		t.Errorf("unexpected root: %+v", doc.Root)
+	}
+	opts := SerializeOptions{FinalNewline: true, RootValue: true}
+	if got := string(SerializeWithOptions(doc, opts)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
 
-	// Verify values match
-	if doc2.Root.Get("Video/Driver").String("") != origDriver {
-		t.Error("Video/Driver mismatch after round-trip")
+	// Serialize leaves the value out unless asked to write it
+	if got := string(Serialize(doc)); got != "" {
+		t.Errorf("expected %q, got %q", "", got)
 	}
-	if doc2.Root.Get("Video/Multiplier").Int(0) != origMultiplier {
-		t.Error("Video/Multiplier mismatch after round-trip")
+
+	// A root value may precede nodes, and an empty one round-trips
+	doc = &Document{Root: &Node{HasValue: true, Children: []*Node{{Name: "Video", Value: "Metal"}}}}
+	expected := ": \nVideo: Metal\n"
+	if got := string(SerializeWithOptions(doc, opts)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := string(Serialize(doc)); got != "Video: Metal\n" {
+		t.Errorf("expected %q, got %q", "Video: Metal\n", got)
+	}
+	doc2, err := ParseWithOptions([]byte(expected), ParseOptions{RootValue: true})
+	if err != nil || !doc2.Root.HasValue || doc2.Root.Get("Video").Value != "Metal" {
+		t.Errorf("unexpected round-trip: %+v, %v", doc2, err)
+	}
+
+	// Without the option a headless value is an error, and a bare line is a
+	// node name
+	_, err = Parse([]byte(input))
+	if err == nil || !strings.Contains(err.Error(), "value without a node name") {
+		t.Errorf("expected value without a node name error, got %v", err)
+	}
+	doc, err = ParseWithOptions([]byte("Metal"), ParseOptions{RootValue: true})
+	if err != nil || doc.Root.Get("Metal") == nil || doc.Root.HasValue {
+		t.Errorf("expected Metal to be a node name, got %+v, %v", doc, err)
 	}
 }
 
-func TestModifyAndSerialize(t *testing.T) {
-	input := `Video
-  Driver: OpenGL
-  Multiplier: 1`
+func TestParseEscapedNames(t *testing.T) {
+	input := `Port\:1: Gamepad
+Key\=Value\: a\:b=1 c=2
+  Drive\:: C
+`
 
-	doc, err := Parse([]byte(input))
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{EscapedNames: true})
 	if err != nil {
-		t.Fatalf("parse error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := doc.Root.Children[0]; got.Name != "Port:1" || got.Value != "Gamepad" {
+		t.Errorf("unexpected first node: %+v", got)
+	}
+	node := doc.Root.Children[1]
+	if node.Name != "Key=Value:" || len(node.Children) != 3 {
+		t.Fatalf("unexpected second node: %+v", node)
+	}
+	if attr := node.Children[0]; attr.Name != "a:b" || attr.Value != "1" || !attr.IsAttr {
+		t.Errorf("unexpected attribute: %+v", attr)
+	}
+	if child := node.Children[2]; child.Name != "Drive:" || child.Value != "C" {
+		t.Errorf("unexpected child: %+v", child)
 	}
 
-	// Modify values
-	doc.Root.Get("Video").Set("Driver", "Metal")
-	doc.Root.Get("Video").SetInt("Multiplier", 2)
-	doc.Root.Get("Video").SetBool("NewSetting", true)
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
+	}
 
-	// Serialize and re-parse
-	output := Serialize(doc)
-	doc2, err := Parse(output)
+	// Without the option a backslash ends the name
+	doc, err = Parse([]byte(`Port\:1: Gamepad`))
 	if err != nil {
-		t.Fatalf("re-parse error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := doc.Root.Children[0]; len(doc.Root.Children) != 1 || got.Name != "Port" || got.Value != "" {
+		t.Errorf("expected name to end at the backslash, got %+v", doc.Root.Children)
 	}
+}
 
-	if doc2.Root.Get("Video/Driver").String("") != "Metal" {
-		t.Error("expected Driver to be 'Metal'")
+func TestParseFlow(t *testing.T) {
+	input := "Resolution { Width=640 Height=480 }\n" +
+		"Video driver=Metal { Shader=crt { Path=\"a b.slang\" Scale=2 } Sync } // compact\n" +
+		"  Multiplier: 2\n"
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{Flow: true, PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if doc2.Root.Get("Video/Multiplier").Int(0) != 2 {
-		t.Error("expected Multiplier to be 2")
+	res := doc.Root.Get("Resolution")
+	if len(res.Children) != 2 || res.Get("Width").Int(0) != 640 || res.Get("Height").Int(0) != 480 {
+		t.Fatalf("unexpected Resolution: %s", SerializeNode(res))
 	}
-	if doc2.Root.Get("Video/NewSetting").Bool(false) != true {
-		t.Error("expected NewSetting to be true")
+	if res.Children[0].IsAttr {
+		t.Error("expected braced children to be blocks")
+	}
+	video := doc.Root.Get("Video")
+	if got := video.Attr("driver").String(""); got != "Metal" {
+		t.Errorf("expected the driver attribute, got %q", got)
+	}
+	if got := video.Get("Shader").String(""); got != "crt" {
+		t.Errorf("expected Shader value crt, got %q", got)
+	}
+	if got := video.Get("Shader/Path").String(""); got != "a b.slang" {
+		t.Errorf("expected nested Path, got %q", got)
+	}
+	if sync := video.Get("Sync"); sync == nil || sync.HasValue {
+		t.Errorf("expected Sync without a value, got %+v", sync)
+	}
+	if got := video.Get("Multiplier").Int(0); got != 2 {
+		t.Errorf("expected a block child after the braces, got %d", got)
+	}
+	if video.InlineComment != "compact" {
+		t.Errorf("expected the inline comment after the braces, got %q", video.InlineComment)
 	}
-}
-
-// === Helper function tests ===
 
-func TestIsValidNameChar(t *testing.T) {
-	valid := []byte{'A', 'Z', 'a', 'z', '0', '9', '-', '.'}
-	for _, c := range valid {
-		if !isValidNameChar(c) {
-			t.Errorf("expected %c to be valid", c)
-		}
+	// Without the option a brace ends the line's attributes
+	doc, _ = Parse([]byte("Resolution { Width=640 }"))
+	if got := len(doc.Root.Get("Resolution").Children); got != 0 {
+		t.Errorf("expected no children without Flow, got %d", got)
 	}
 
-	invalid := []byte{' ', ':', '=', '"', '\t', '\n', '@', '!'}
-	for _, c := range invalid {
-		if isValidNameChar(c) {
-			t.Errorf("expected %c to be invalid", c)
+	for _, input := range []string{
+		"Resolution { Width=640",
+		"Resolution { Video { Width=640 }",
+		"Resolution { Width=640 // }",
+		"Resolution { : }",
+		"Resolution { Width=\"640 }",
+		"Resolution { Video { Width=\"640 } }",
+	} {
+		if _, err := ParseWithOptions([]byte(input), ParseOptions{Flow: true}); err == nil {
+			t.Errorf("%q: expected an error", input)
 		}
 	}
+	if _, err := ParseWithOptions([]byte("A { B C }"), ParseOptions{Flow: true, MaxNodes: 2}); err == nil {
+		t.Error("expected braced children to count toward MaxNodes")
+	}
 }
 
-func TestReadDepth(t *testing.T) {
+func TestParseSiblingContinuation(t *testing.T) {
+	input := `Desc: Line1
+: Line2
+:Line3
+Game
+  Notes
+  : First
+  // dropped
+  : Second
+  Title: One
+    : Nested
+Empty`
+
+	var warnings []Warning
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{
+		SiblingContinuation: true,
+		PreserveComments:    true,
+		Warnings:            func(w Warning) { warnings = append(warnings, w) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	tests := []struct {
-		line     string
-		expected int
+		path, value string
 	}{
-		{"Node", 0},
-		{"  Node", 2},
-		{"\tNode", 1},
-		{"\t\tNode", 2},
-		{"    Node", 4},
-		{"\t  Node", 3},
+		{"Desc", "Line1\nLine2\nLine3"},
+		{"Game/Notes", "First\nSecond"},
+		{"Game/Title", "One\nNested"},
+		{"Empty", ""},
 	}
-
 	for _, tt := range tests {
-		depth := readDepth(tt.line)
-		if depth != tt.expected {
-			t.Errorf("readDepth(%q) = %d, expected %d", tt.line, depth, tt.expected)
+		if got := doc.Root.Get(tt.path); got == nil || got.Value != tt.value {
+			t.Errorf("Get(%q): expected value %q, got %v", tt.path, tt.value, got)
 		}
 	}
-}
-
-// === Additional edge case tests for 100% coverage ===
+	if len(warnings) != 1 || warnings[0].Line != 8 {
+		t.Errorf("expected a warning for the comment inside the value, got %v", warnings)
+	}
 
-func TestParseValueNoContent(t *testing.T) {
-	// Test parseValue with position at end of line
-	value, pos, err := parseValue("Node", 4)
+	// With no node before it, a ":" line continues the parent
+	doc, err = ParseWithOptions([]byte("Game\n  : Value\n  Title: One"), ParseOptions{SiblingContinuation: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if value != "" {
-		t.Errorf("expected empty value, got %q", value)
+	if got := doc.Root.Get("Game").Value; got != "Value" {
+		t.Errorf("expected the parent's value, got %q", got)
 	}
-	if pos != 4 {
-		t.Errorf("expected pos 4, got %d", pos)
+	_, err = ParseWithOptions([]byte(": Value\nDesc: Line1"), ParseOptions{SiblingContinuation: true})
+	if err == nil || err.Error() != "value without a node name at line: : Value" {
+		t.Errorf("expected an error for a leading top-level value, got %v", err)
+	}
+
+	// Without the option a same-depth ":" line is not a continuation
+	if _, err := Parse([]byte("Desc: Line1\n: Line2")); err == nil {
+		t.Error("expected an error without SiblingContinuation")
 	}
 }
 
-func TestParseValueUnknownFormat(t *testing.T) {
-	// Test parseValue with unknown format (not :, =, or ")
-	value, pos, err := parseValue("Node X", 4)
+func TestParseAnchors(t *testing.T) {
+	input := `&Base Paths
+  Path: /games
+  Path: /roms
+Console
+  *Base // shared
+  Name: SNES
+Handheld
+  *Base
+    Path: /saves
+&Speed Rate: 60
+Timing
+  *Speed`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{Anchors: true, PreserveComments: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if value != "" {
-		t.Errorf("expected empty value, got %q", value)
+	if got := doc.Root.Get("Console/Paths").GetAll("Path"); len(got) != 2 || got[1].Value != "/roms" {
+		t.Errorf("expected the copied paths, got %v", got)
 	}
-	if pos != 4 {
-		t.Errorf("expected pos 4, got %d", pos)
+	if got := doc.Root.Get("Console/Paths").InlineComment; got != "shared" {
+		t.Errorf("expected the reference's comment on the copy, got %q", got)
+	}
+	if got := doc.Root.Get("Handheld/Paths").GetAll("Path"); len(got) != 3 || got[2].Value != "/saves" {
+		t.Errorf("expected a child added beneath the reference, got %v", got)
+	}
+	if got := len(doc.Root.Get("Paths").Children); got != 2 {
+		t.Errorf("expected the anchored node to be unchanged, got %d children", got)
+	}
+	if got := doc.Root.Get("Timing/Rate").Int(0); got != 60 {
+		t.Errorf("expected the copied value, got %d", got)
 	}
-}
 
-func TestSerializeNilNode(t *testing.T) {
-	// This shouldn't panic
-	serializeNode(nil, 0, nil)
-}
+	// Serialize writes the copies in full
+	expected := "Paths\n  Path: /games\n  Path: /roms\nConsole\n  Paths // shared\n    Path: /games\n    Path: /roms\n  Name: SNES\n"
+	doc, _ = ParseWithOptions([]byte("&Base Paths\n  Path: /games\n  Path: /roms\nConsole\n  *Base // shared\n  Name: SNES"), ParseOptions{Anchors: true, PreserveComments: true})
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
 
-func TestNodeGetPathWithEmptyParts(t *testing.T) {
-	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
+	tests := []struct {
+		input, want string
+	}{
+		{"*Base", `line 1: undefined anchor "Base"`},
+		{"&Base Paths\n  *Base", `line 2: anchor "Base" is referenced within its own node`},
+		{"&Base Paths\n*Base extra", "unexpected text after reference at line: *Base extra"},
+		{"* Base", "invalid anchor name at line: * Base"},
+		{"& Paths", "invalid anchor name at line: & Paths"},
+		{"&A Paths\n  Path\n*A", "document exceeds maximum of 3 nodes"},
+	}
+	for _, tt := range tests {
+		_, err := ParseWithOptions([]byte(tt.input), ParseOptions{Anchors: true, MaxNodes: 3})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%q: expected error %q, got %v", tt.input, tt.want, err)
+		}
+	}
 
-	// Path with empty parts (double slash)
-	node := doc.Root.Get("Video//Driver")
-	if node == nil {
-		t.Fatal("expected to find node with empty path parts")
+	// Each anchor references the previous one twice, doubling the copies
+	var laughs strings.Builder
+	laughs.WriteString("&L0 Laugh: ha\n")
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&laughs, "&L%d Laughs\n  *L%d\n  *L%d\n", i, i-1, i-1)
 	}
-	if node.Value != "Metal" {
-		t.Errorf("expected 'Metal', got %q", node.Value)
+	laughs.WriteString("*L40\n")
+	_, err = ParseWithOptions([]byte(laughs.String()), ParseOptions{Anchors: true})
+	if want := "anchor references copy more than 1000000 nodes"; err == nil || err.Error() != want {
+		t.Errorf("expected error %q, got %v", want, err)
 	}
-}
 
-func TestNodeSetEmptyPath(t *testing.T) {
-	doc, _ := Parse([]byte(""))
-	result := doc.Root.Set("", "value")
-	if result != doc.Root {
-		t.Error("expected root node for empty path")
+	// Without the option "&" and "*" are not names
+	if _, err := Parse([]byte("*Base")); err == nil {
+		t.Error("expected an error for a reference without Anchors")
 	}
 }
 
-func TestDeepEqual(t *testing.T) {
-	input := `A
-  B
-    C: value`
+func TestSerializeFlow(t *testing.T) {
+	input := "Resolution { Width=640 Height=480 }\n" +
+		"Video driver=Metal { Shader=crt { Path=\"a b.slang\" } Sync Blank=\"\" }\n" +
+		"Audio\n" +
+		"  // Output device\n" +
+		"  Driver: SDL\n" +
+		"Notes: text\n"
 
-	doc1, _ := Parse([]byte(input))
-	doc2, _ := Parse([]byte(input))
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{Flow: true, PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := DefaultSerializeOptions()
+	opts.Flow = true
+	if got := string(SerializeWithOptions(doc, opts)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
+	}
 
-	if !reflect.DeepEqual(doc1.Root.Get("A/B/C"), doc2.Root.Get("A/B/C")) {
-		t.Error("expected equal nodes")
+	// Without the option the children are written as blocks
+	expected := "Resolution\n  Width: 640\n  Height: 480\n"
+	doc, _ = ParseWithOptions([]byte("Resolution { Width=640 Height=480 }"), ParseOptions{Flow: true})
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
 }
 
-func TestParseColonValueTrailingSpaces(t *testing.T) {
-	input := "Driver: Metal   "
-
-	doc, err := Parse([]byte(input))
+func TestParseKeepRaw(t *testing.T) {
+	input := "Video   mode=full  // main\n" +
+		"\tDriver:Metal\n" +
+		"\tNotes: a\n" +
+		"\t  :  b\n" +
+		"\tScript: <<END\n" +
+		"  run\n" +
+		"  END\n" +
+		"Audio\n" +
+		"  Volume: 1\n" +
+		"  Volume += 2\n"
+
+	opts := ParseOptions{KeepRaw: true, PreserveComments: true, Heredoc: true, AppendOperator: true}
+	doc, err := ParseWithOptions([]byte(input), opts)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-
-	if doc.Root.Children[0].Value != "Metal" {
-		t.Errorf("expected 'Metal', got %q", doc.Root.Children[0].Value)
+	video := doc.Root.Get("Video")
+	if video.Raw != "Video   mode=full  // main" || video.RawLines != nil {
+		t.Errorf("unexpected raw text for Video: %q %q", video.Raw, video.RawLines)
+	}
+	notes := video.Get("Notes")
+	if notes.Raw != "\tNotes: a" || !reflect.DeepEqual(notes.RawLines, []string{"\t  :  b"}) {
+		t.Errorf("unexpected raw text for Notes: %q %q", notes.Raw, notes.RawLines)
+	}
+	if got := video.Get("Script").RawLines; !reflect.DeepEqual(got, []string{"  run", "  END"}) {
+		t.Errorf("unexpected raw heredoc lines: %q", got)
+	}
+	if got := doc.Root.Get("Audio/Volume").RawLines; !reflect.DeepEqual(got, []string{"  Volume += 2"}) {
+		t.Errorf("unexpected raw append lines: %q", got)
+	}
+
+	// Unchanged nodes are written verbatim
+	sopts := DefaultSerializeOptions()
+	sopts.PreferRaw = true
+	if got := string(SerializeWithOptions(doc, sopts)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
+	}
+
+	// A changed node is reformatted, and one moved to another depth too
+	video.Set("Driver", "OpenGL")
+	video.Attr("mode").Value = "window"
+	moved := doc.Root.Get("Audio")
+	doc.Root.Children = []*Node{video, {Name: "Sound", Children: []*Node{moved}}}
+	expected := "Video mode=window // main\n" +
+		"  Driver: OpenGL\n" +
+		"\tNotes: a\n" +
+		"\t  :  b\n" +
+		"\tScript: <<END\n" +
+		"  run\n" +
+		"  END\n" +
+		"Sound\n" +
+		"  Audio\n" +
+		"    Volume\n" +
+		"      : 1\n" +
+		"      : 2\n"
+	if got := string(SerializeWithOptions(doc, sopts)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// Children added beneath an unchanged node follow its raw line
+	doc, _ = ParseWithOptions([]byte("Game  id=1 { Title=One }\n"), ParseOptions{KeepRaw: true, Flow: true})
+	doc.Root.Get("Game").Set("Region", "NTSC")
+	if got := string(SerializeWithOptions(doc, sopts)); got != "Game  id=1 { Title=One }\n  Region: NTSC\n" {
+		t.Errorf("unexpected output with an added child: %q", got)
+	}
+	doc.Root.Get("Game").Get("Title").Value = "Two"
+	if got := string(SerializeWithOptions(doc, sopts)); got != "Game id=1\n  Title: Two\n  Region: NTSC\n" {
+		t.Errorf("unexpected output with a changed braced child: %q", got)
+	}
+
+	// An append line apart from its sibling reformats the sibling in place
+	input = "Volume: 1\nMute: off\nVolume += 2\nDriver: a\n  Path: /x\nDriver += b\n"
+	doc, _ = ParseWithOptions([]byte(input), opts)
+	expected = "Volume\n  : 1\n  : 2\nMute: off\nDriver\n  : a\n  : b\n  Path: /x\n"
+	if got := string(SerializeWithOptions(doc, sopts)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+
+	// Copies made by anchors have no source text
+	doc, _ = ParseWithOptions([]byte("&A Base: 1\n  Child: 2\nCopy\n  *A"), ParseOptions{KeepRaw: true, Anchors: true})
+	if got := doc.Root.Get("Copy/Base"); got.Raw != "" || got.Get("Child").Raw != "" {
+		t.Errorf("expected no raw text on a copy, got %q", got.Raw)
 	}
 }
 
-func TestFloat32Field(t *testing.T) {
-	input := `Value: 3.14`
+func TestParseNormalizeNames(t *testing.T) {
+	input := "Video MODE=Full\n  Driver: Metal\n  DRIVER: OpenGL\nAUDIO { Volume=1 }"
 
-	type S struct {
-		Value float32 `bml:"Value"`
-	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
+	var warnings []Warning
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{
+		NormalizeNames: strings.ToLower,
+		Flow:           true,
+		Warnings:       func(w Warning) { warnings = append(warnings, w) },
+	})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "video mode=Full\n  driver: Metal\n  driver: OpenGL\naudio\n  volume: 1\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if got := doc.Root.Get("video/mode").String(""); got != "Full" {
+		t.Errorf("expected values to keep their case, got %q", got)
+	}
+	if len(warnings) != 1 || warnings[0].Category != WarnDuplicateName {
+		t.Errorf("expected a duplicate warning for the normalized names, got %v", warnings)
+	}
+}
+
+func TestParserReuse(t *testing.T) {
+	ps := NewParser(ParseOptions{Anchors: true, PreserveComments: true})
+	inputs := []string{
+		"// Video\nVideo\n  Driver: Metal\n  Multiplier: 2\n&A Paths\n  Path: /roms\nCopy\n  *A",
+		"Audio: SDL",
+		"Bad=\"unclosed",
+		"*A",
+		"Video\n  Driver: OpenGL\n  Shader\n    Path: crt.slang\nAudio\n  Latency: 20",
+	}
+
+	var docs []*Document
+	for _, input := range inputs {
+		want, wantErr := ParseWithOptions([]byte(input), ParseOptions{Anchors: true, PreserveComments: true})
+		doc, err := ps.Parse([]byte(input))
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("%q: expected error %v, got %v", input, wantErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if got, expected := string(Serialize(doc)), string(Serialize(want)); got != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, got)
+		}
+		docs = append(docs, doc)
 	}
 
-	if s.Value < 3.13 || s.Value > 3.15 {
-		t.Errorf("expected ~3.14, got %f", s.Value)
+	// Earlier documents are not affected by later parses
+	if got := docs[0].Root.Get("Copy/Paths/Path").String(""); got != "/roms" {
+		t.Errorf("expected the first document to be intact, got %q", got)
 	}
 }
 
-func TestInt8Int16Int32Fields(t *testing.T) {
-	input := `I8: 127
-I16: 32000
-I32: 2000000`
+func TestLooksLikeChild(t *testing.T) {
+	tests := []struct {
+		rest     string
+		expected bool
+	}{
+		{"Name: value", true},
+		{"Name=value", true},
+		{"Name", false},
+		{"Some text", false},
+		{"(text)", false},
+		{"", false},
+	}
 
-	type S struct {
-		I8  int8  `bml:"I8"`
-		I16 int16 `bml:"I16"`
-		I32 int32 `bml:"I32"`
+	for _, tt := range tests {
+		if got := looksLikeChild(tt.rest); got != tt.expected {
+			t.Errorf("looksLikeChild(%q) = %v, expected %v", tt.rest, got, tt.expected)
+		}
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
+}
+
+func TestParseQuotedAttributeNames(t *testing.T) {
+	input := `Node "my attr"=v1 " Padded Name ": v2`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{QuotedAttributeNames: true})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if s.I8 != 127 {
-		t.Errorf("expected 127, got %d", s.I8)
+	attrs := doc.Root.Children[0].Children
+	if len(attrs) != 2 {
+		t.Fatalf("expected 2 attributes, got %d", len(attrs))
 	}
-	if s.I16 != 32000 {
-		t.Errorf("expected 32000, got %d", s.I16)
+	if attrs[0].Name != "my attr" || attrs[0].Value != "v1" {
+		t.Errorf("unexpected first attribute: %+v", attrs[0])
 	}
-	if s.I32 != 2000000 {
-		t.Errorf("expected 2000000, got %d", s.I32)
+	if attrs[1].Name != "Padded Name" || attrs[1].Value != "v2" {
+		t.Errorf("unexpected second attribute: %+v", attrs[1])
 	}
 }
 
-func TestUint16Uint32Fields(t *testing.T) {
-	input := `U16: 65000
-U32: 4000000`
+func TestParseQuotedAttributeNamesWithoutValue(t *testing.T) {
+	doc, err := ParseWithOptions([]byte(`Node "flag" other=1`), ParseOptions{QuotedAttributeNames: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	attrs := doc.Root.Children[0].Children
+	if len(attrs) != 2 || attrs[0].Name != "flag" || attrs[0].Value != "" || attrs[1].Name != "other" {
+		t.Errorf("unexpected attributes: %+v", attrs)
+	}
+}
 
-	type S struct {
-		U16 uint16 `bml:"U16"`
-		U32 uint32 `bml:"U32"`
+func TestParseQuotedAttributeNamesErrors(t *testing.T) {
+	_, err := ParseWithOptions([]byte(`Node "unclosed=v`), ParseOptions{QuotedAttributeNames: true})
+	if err == nil || !strings.Contains(err.Error(), "unclosed quote") {
+		t.Errorf("expected unclosed quote error, got: %v", err)
+	}
+
+	_, err = ParseWithOptions([]byte(`Node "  "=v`), ParseOptions{QuotedAttributeNames: true})
+	if err == nil || !strings.Contains(err.Error(), "empty attribute name") {
+		t.Errorf("expected empty name error, got: %v", err)
+	}
+}
+
+func TestParseQuotedAttributeNamesDisabled(t *testing.T) {
+	doc, err := Parse([]byte(`Node "my attr"=v1`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.Root.Children[0].Children) != 0 {
+		t.Errorf("expected quoted name to be ignored by default, got %+v", doc.Root.Children[0].Children)
+	}
+}
+
+func TestParseAppendOperator(t *testing.T) {
+	input := `Description: First line
+Description += Second line
+Description+=Third line // comment
+Video
+  Notes += ignored`
+
+	_, err := ParseWithOptions([]byte(input), ParseOptions{AppendOperator: true})
+	if err == nil || !strings.Contains(err.Error(), `cannot append to "Notes"`) {
+		t.Fatalf("expected missing sibling error, got: %v", err)
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
+
+	input = `Description: First line
+Description += Second line
+Description+=Third line // comment
+Video
+  Notes
+  Notes +=  indented
+    : continued
+    Child: value`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{AppendOperator: true})
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if s.U16 != 65000 {
-		t.Errorf("expected 65000, got %d", s.U16)
+	if len(doc.Root.Children) != 2 {
+		t.Fatalf("expected 2 root nodes, got %d", len(doc.Root.Children))
 	}
-	if s.U32 != 4000000 {
-		t.Errorf("expected 4000000, got %d", s.U32)
+	expected := "First line\nSecond line\nThird line"
+	if got := doc.Root.Get("Description").Value; got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
-}
 
-func TestMarshalFloat32(t *testing.T) {
-	type S struct {
-		Value float32 `bml:"Value"`
+	notes := doc.Root.Get("Video/Notes")
+	if notes.Value != " indented\ncontinued" {
+		t.Errorf("unexpected Notes value: %q", notes.Value)
 	}
-	s := S{Value: 3.14}
-	data, err := Marshal(&s)
-	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+	if notes.Get("Child").String("") != "value" {
+		t.Error("expected lines under the += line to belong to the sibling")
 	}
-	if !strings.Contains(string(data), "3.14") {
-		t.Errorf("expected '3.14' in output, got %q", string(data))
+	if len(doc.Root.Get("Video").Children) != 1 {
+		t.Errorf("expected a single Notes node, got %d children", len(doc.Root.Get("Video").Children))
 	}
 }
 
-func TestMarshalIntVariants(t *testing.T) {
-	type S struct {
-		I8  int8  `bml:"I8"`
-		I16 int16 `bml:"I16"`
-		I32 int32 `bml:"I32"`
-	}
-	s := S{I8: 10, I16: 1000, I32: 100000}
-	data, err := Marshal(&s)
+func TestParseAppendOperatorDisabled(t *testing.T) {
+	doc, err := Parse([]byte("Description: First\nDescription += Second"))
 	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(doc.Root.Children) != 2 {
+		t.Errorf("expected += line to be a separate node by default, got %d nodes", len(doc.Root.Children))
 	}
+}
 
-	var result S
-	err = Unmarshal(data, &result)
-	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+func TestParseStrictIndent(t *testing.T) {
+	valid := []string{
+		"A\n  B\n    C\n  D\nE\n",
+		"A\n\tB\n\t\tC\n\tD\n",
+		"A\n\tB\n\t  C\n\tD\n",
 	}
-	if result.I8 != 10 || result.I16 != 1000 || result.I32 != 100000 {
-		t.Error("int variant mismatch after round-trip")
+	for _, input := range valid {
+		if _, err := ParseWithOptions([]byte(input), ParseOptions{StrictIndent: true}); err != nil {
+			t.Errorf("ParseWithOptions(%q) error: %v", input, err)
+		}
 	}
-}
 
-func TestMarshalUintVariants(t *testing.T) {
-	type S struct {
-		U8  uint8  `bml:"U8"`
-		U16 uint16 `bml:"U16"`
-		U32 uint32 `bml:"U32"`
+	tests := []struct {
+		input string
+		want  string
+	}{
+		// A tab child under a two-space parent would become its sibling
+		{"A\n  B\n\tC\n", `line 3: indentation "\t" is ambiguous after line 2 indentation "  "`},
+		// Deeper but not an extension of the parent's indentation
+		{"A\n \tB\n\t  C\n", `line 3: indentation "\t  " is ambiguous under line 2 indentation " \t"`},
+		// Dedent to a depth that matches no enclosing line
+		{"A\n  B\n     C\n D\n", "line 4: indentation depth 1 does not match any enclosing level (valid depths: 0, 2, 5)"},
+		{"A\n  B\n      C\n    D\n", "line 4: indentation depth 4 does not match any enclosing level (valid depths: 0, 2, 6)"},
 	}
-	s := S{U8: 200, U16: 60000, U32: 4000000}
-	data, err := Marshal(&s)
+	for _, tt := range tests {
+		_, err := ParseWithOptions([]byte(tt.input), ParseOptions{StrictIndent: true})
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("ParseWithOptions(%q) error: expected %q, got %v", tt.input, tt.want, err)
+		}
+	}
+
+	// Lenient parsing is unchanged
+	doc, err := Parse([]byte("A\n  B\n\tC\n"))
 	if err != nil {
-		t.Fatalf("marshal error: %v", err)
+		t.Fatalf("parse error: %v", err)
+	}
+	if len(doc.Root.Get("A").Children) != 2 {
+		t.Errorf("lenient parse children: expected 2, got %d", len(doc.Root.Get("A").Children))
 	}
 
-	var result S
-	err = Unmarshal(data, &result)
+	// A bad dedent becomes a child of the nearest shallower line
+	doc, err = Parse([]byte("A\n  B\n     C\n D\n"))
 	if err != nil {
-		t.Fatalf("unmarshal error: %v", err)
+		t.Fatalf("parse error: %v", err)
 	}
-	if result.U8 != 200 || result.U16 != 60000 || result.U32 != 4000000 {
-		t.Error("uint variant mismatch after round-trip")
+	if len(doc.Root.Get("A").Children) != 2 {
+		t.Errorf("lenient dedent children: expected 2, got %d", len(doc.Root.Get("A").Children))
 	}
 }
 
-// === Additional edge case tests for 100% coverage ===
+func TestParseHeredoc(t *testing.T) {
+	input := "Tool\n  Script: <<END\n#!/bin/sh\n\n  echo \"hi\" // not a comment\n: not a continuation\n  END\n  Name: build\nNext: <<EOF // note\nEOF\n"
 
-func TestUnmarshalParseError(t *testing.T) {
-	// Invalid BML that causes Parse to fail
-	input := `Driver="unclosed`
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{Heredoc: true, PreserveComments: true})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
 
-	type S struct {
-		Driver string `bml:"Driver"`
+	script := doc.Root.Get("Tool/Script")
+	want := "#!/bin/sh\n\n  echo \"hi\" // not a comment\n: not a continuation"
+	if script.Value != want || script.Heredoc != "END" {
+		t.Errorf("expected Script %q, got %q (delimiter %q)", want, script.Value, script.Heredoc)
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error for invalid BML")
+	if doc.Root.Get("Tool/Name").String("") != "build" {
+		t.Error("node after heredoc not parsed")
 	}
-}
-
-func TestRemovePathWithEmptyParts(t *testing.T) {
-	doc, _ := Parse([]byte("Video\n  Driver: Metal"))
-
-	// Path with empty parts
-	removed := doc.Root.Remove("Video//Driver")
-	if !removed {
-		t.Error("expected Remove to handle empty path parts")
+	next := doc.Root.Get("Next")
+	if next.Value != "" || next.Heredoc != "EOF" || next.InlineComment != "note" {
+		t.Errorf("unexpected Next: %+v", next)
 	}
-}
 
-func TestUnmarshalNodeNil(t *testing.T) {
-	// Test unmarshalNode with nil node directly
-	type S struct {
-		Value string `bml:"Value"`
+	output := Serialize(doc)
+	if string(output) != input {
+		t.Errorf("Serialize: expected %q, got %q", input, output)
 	}
-	input := ""
-	var s S
-	err := Unmarshal([]byte(input), &s)
+
+	// Without the option the marker is an ordinary value
+	doc, err = Parse([]byte("Script: <<END\n"))
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatalf("parse error: %v", err)
+	}
+	if doc.Root.Get("Script").Value != "<<END" {
+		t.Errorf("Script: expected %q, got %q", "<<END", doc.Root.Get("Script").Value)
 	}
-}
 
-func TestSerializeNodeWithChildrenAndMultilineValue(t *testing.T) {
-	// Node with both multiline value AND children
-	doc := &Document{Root: &Node{
-		Children: []*Node{
-			{
-				Name:  "Desc",
-				Value: "Line1\nLine2",
-				Children: []*Node{
-					{Name: "Child", Value: "value"},
-				},
-			},
-		},
-	}}
-	data := Serialize(doc)
-	// Should serialize without panic
-	if len(data) == 0 {
-		t.Error("expected non-empty output")
+	// Values that are not heredoc markers
+	for _, input := range []string{"Script: <<\n", "Script: << END\n", "Script: <<A B\n", "Script <<END\n", "Script\n"} {
+		doc, err := ParseWithOptions([]byte(input), ParseOptions{Heredoc: true})
+		if err != nil {
+			t.Errorf("ParseWithOptions(%q) error: %v", input, err)
+			continue
+		}
+		if doc.Root.Children[0].Heredoc != "" {
+			t.Errorf("ParseWithOptions(%q) treated as heredoc", input)
+		}
+	}
+
+	_, err = ParseWithOptions([]byte("A\nScript: <<END\necho\n"), ParseOptions{Heredoc: true})
+	if err == nil || err.Error() != `line 2: unterminated heredoc "END"` {
+		t.Errorf("expected unterminated heredoc error, got %v", err)
 	}
 }
 
-func TestUnmarshalNodeError(t *testing.T) {
-	// Test error propagation in unmarshalNode
-	input := `Nested
-  Value: abc`
+func TestSerializeHeredocConflict(t *testing.T) {
+	doc := &Document{Root: &Node{Children: []*Node{
+		{Name: "Script", Value: "a\nEND\nb", Heredoc: "END"},
+	}}}
 
-	type Inner struct {
-		Value int `bml:"Value"`
+	want := "Script\n  : a\n  : END\n  : b\n"
+	if got := string(Serialize(doc)); got != want {
+		t.Errorf("Serialize: expected %q, got %q", want, got)
 	}
-	type S struct {
-		Nested Inner `bml:"Nested"`
+}
+
+func TestHeredocRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		"Script: <<END\n\nEND\n",
+		"Script: <<END\nEND\n",
+		"Script: <<END\n\n\nEND\n",
+	} {
+		doc, err := ParseWithOptions([]byte(input), ParseOptions{Heredoc: true})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := string(Serialize(doc)); got != input {
+			t.Errorf("expected %q, got %q", input, got)
+		}
 	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error for invalid nested int")
+
+	// Plain values that look like a heredoc marker are not written as one
+	for _, value := range []string{"<<END", `<<A"B`} {
+		doc := &Document{Root: &Node{Children: []*Node{{Name: "Script", Value: value}}}}
+		output := Serialize(doc)
+		reparsed, err := ParseWithOptions(output, ParseOptions{Heredoc: true})
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", output, err)
+		}
+		script := reparsed.Root.Get("Script")
+		if script.Value != value || script.Heredoc != "" {
+			t.Errorf("expected plain value %q, got %q (heredoc %q)", value, script.Value, script.Heredoc)
+		}
 	}
 }
 
-func TestMarshalStructError(t *testing.T) {
-	// Test error in nested struct marshaling
-	type Inner struct {
-		Data []string `bml:"Data"`
+func TestParseWarnings(t *testing.T) {
+	input := "A\n  B: 1\n  B: 2\n \tC\n  D x=1 x=2\nE\n  // lost\n  : text\nRaw\n  // lost too\n  text\nL: a\n// appended\nL += b\n// trailing\n"
+
+	var warnings []Warning
+	_, err := ParseWithOptions([]byte(input), ParseOptions{
+		PreserveComments: true,
+		AppendOperator:   true,
+		RawText:          []string{"Raw"},
+		Warnings:         func(w Warning) { warnings = append(warnings, w) },
+	})
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
 	}
-	type S struct {
-		Nested Inner `bml:"Nested"`
+
+	want := []Warning{
+		{4, WarnMixedIndent, "indentation mixes tabs and spaces"},
+		{3, WarnDuplicateName, `duplicate node "B"`},
+		{5, WarnDuplicateName, `duplicate node "x"`},
+		{8, WarnDroppedComment, "comment inside a multiline value discarded"},
+		{14, WarnDroppedComment, "comment before append line discarded"},
 	}
-	s := S{Nested: Inner{Data: []string{"a"}}}
-	_, err := Marshal(&s)
-	if err == nil {
-		t.Fatal("expected error for unsupported type in nested struct")
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings: expected %+v, got %+v", want, warnings)
 	}
-}
 
-func TestParseNodeAttributeNoValue(t *testing.T) {
-	// Attribute without a value
-	input := "Node attr1"
-	doc, err := Parse([]byte(input))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	// Parse without a callback is unaffected
+	if _, err := Parse([]byte(input)); err != nil {
+		t.Errorf("parse error: %v", err)
 	}
-	if len(doc.Root.Children[0].Children) != 1 {
-		t.Fatalf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
+}
+
+// encodeUTF16 encodes s as UTF-16 in the given byte order, optionally
+// preceded by a byte order mark.
+func encodeUTF16(s string, order binary.ByteOrder, bom bool) []byte {
+	units := utf16.Encode([]rune(s))
+	if bom {
+		units = append([]uint16{0xfeff}, units...)
 	}
-	if doc.Root.Children[0].Children[0].Name != "attr1" {
-		t.Errorf("expected attr1, got %q", doc.Root.Children[0].Children[0].Name)
+	data := make([]byte, 2*len(units))
+	for i, u := range units {
+		order.PutUint16(data[2*i:], u)
 	}
+	return data
 }
 
-func TestMultilineValueWithExistingValue(t *testing.T) {
-	// Node with initial value followed by continuation
-	input := `Desc: Initial
-  : Line2`
+func TestParseUTF16(t *testing.T) {
+	input := "Video\r\n  Driver: Métal 🎮\r\n  Scale=2\r\n"
+	opts := ParseOptions{DetectUTF16: true}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, bom := range []bool{true, false} {
+			doc, err := ParseWithOptions(encodeUTF16(input, order, bom), opts)
+			if err != nil {
+				t.Fatalf("%v bom=%v: ParseWithOptions error: %v", order, bom, err)
+			}
+			if got := doc.Root.Get("Video/Driver").String(""); got != "Métal 🎮" {
+				t.Errorf("unexpected %v bom=%v: Driver: %q", order, bom, got)
+			}
+			if got := doc.Root.Get("Video/Scale").Int(0); got != 2 {
+				t.Errorf("unexpected %v bom=%v: Scale: %d", order, bom, got)
+			}
+		}
+	}
 
-	doc, err := Parse([]byte(input))
+	// A truncated final code unit is a replacement character
+	data := append(encodeUTF16("A: x", binary.LittleEndian, true), 'y')
+	doc, err := ParseWithOptions(data, opts)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-
-	node := doc.Root.Children[0]
-	expected := "Initial\nLine2"
-	if node.Value != expected {
-		t.Errorf("expected %q, got %q", expected, node.Value)
+	if got := doc.Root.Get("A").Value; got != "x\uFFFD" {
+		t.Errorf("expected %q, got %q", "x\uFFFD", got)
 	}
-}
 
-func TestUnmarshalNilPointerTyped(t *testing.T) {
-	type S struct {
-		Value string `bml:"Value"`
+	// UTF-8 input is unaffected by the option, including odd-length input
+	for _, utf8Input := range []string{input, "A: 1\n", "AB: 1\n", "A", ""} {
+		doc, err := ParseWithOptions([]byte(utf8Input), opts)
+		if err != nil {
+			t.Fatalf("ParseWithOptions(%q) error: %v", utf8Input, err)
+		}
+		want, _ := Parse([]byte(utf8Input))
+		if !doc.Equal(want) {
+			t.Errorf("ParseWithOptions(%q) differs from Parse", utf8Input)
+		}
 	}
-	var s *S = nil
-	err := Unmarshal([]byte("Value: test"), s)
-	if err == nil {
-		t.Fatal("expected error for nil typed pointer")
+
+	// Without the option, UTF-16 input is not decoded
+	if _, err := Parse(encodeUTF16(input, binary.LittleEndian, false)); err == nil {
+		t.Error("expected error parsing undecoded UTF-16")
 	}
 }
 
-func TestUnmarshalNodeFieldError(t *testing.T) {
-	// Test when unmarshalValue returns an error for a field
-	input := `Value: notanumber`
+func TestParseWithStats(t *testing.T) {
+	input := "// header\nVideo // inline\n  Driver: Metal\n\n  Filter mode=linear\n    Level: 2\n   \nAudio\n"
 
-	type S struct {
-		Value int `bml:"Value"`
-	}
-	var s S
-	err := Unmarshal([]byte(input), &s)
-	if err == nil {
-		t.Fatal("expected error")
+	doc, stats, err := ParseWithStats([]byte(input))
+	if err != nil {
+		t.Fatalf("ParseWithStats error: %v", err)
 	}
-	if !strings.Contains(err.Error(), "Value") {
-		t.Errorf("expected error to mention field name, got: %v", err)
+	if doc.Root.Get("Video/Filter/Level").Int(0) != 2 {
+		t.Error("document not parsed")
 	}
-}
 
-// Test internal parseNode functions by calling them via exported wrappers
-// These test defensive code paths
+	want := Stats{Nodes: 6, MaxDepth: 3, Lines: 8, BlankLines: 2, Comments: 2, DroppedComments: 2}
+	if stats != want {
+		t.Errorf("stats: expected %+v, got %+v", want, stats)
+	}
 
-func TestParseNodeEdgeCases(t *testing.T) {
-	// Test calling parseNode directly to trigger defensive checks
+	// Attributes count one level below their node
+	_, stats, _ = ParseWithStats([]byte("A b=1\n"))
+	if stats.MaxDepth != 2 || stats.Nodes != 2 {
+		t.Errorf("unexpected attribute stats: %+v", stats)
+	}
 
-	// Test "unexpected end of input"
-	lines := []string{}
-	index := 0
-	_, err := parseNode(lines, &index, -1)
-	if err == nil {
-		t.Fatal("expected error for empty lines")
+	_, stats, _ = ParseWithStats(nil)
+	if stats != (Stats{}) {
+		t.Errorf("unexpected empty stats: %+v", stats)
 	}
-	if !strings.Contains(err.Error(), "unexpected end") {
-		t.Errorf("expected 'unexpected end' error, got: %v", err)
+
+	if _, _, err := ParseWithStats([]byte("!")); err == nil {
+		t.Error("expected error for invalid input")
 	}
+}
 
-	// Test "invalid indentation" - node at same or lower depth than parent
-	lines = []string{"Node", "  Child"}
-	index = 1 // Start at Child
-	_, err = parseNode(lines, &index, 5) // Parent depth 5, but Child has depth 2
-	if err == nil {
-		t.Fatal("expected error for invalid indentation")
+func TestParseStatsPreservedComments(t *testing.T) {
+	input := "A: 1 // kept\n// lost\n  : more\nA += 2 // lost\n// kept\nB\n// kept\n"
+
+	_, stats, err := ParseWithOptionsStats([]byte(input), ParseOptions{PreserveComments: true, AppendOperator: true})
+	if err != nil {
+		t.Fatalf("ParseWithOptionsStats error: %v", err)
 	}
-	if !strings.Contains(err.Error(), "invalid indentation") {
-		t.Errorf("expected 'invalid indentation' error, got: %v", err)
+
+	if stats.Comments != 5 || stats.DroppedComments != 2 {
+		t.Errorf("stats: expected 5 comments with 2 dropped, got %+v", stats)
 	}
 }
 
-func TestNormalizeLinesThoroughly(t *testing.T) {
-	// Test various line ending combinations
+func TestParseBlockComments(t *testing.T) {
+	input := `/* Settings
+   for the emulator */
+Video /* inline */ mode=full
+  Driver: Metal /* trailing */
+  Title: "a /* not a comment */ b"
+  Path: /roms // see /* nothing
+  /*
+  Shader: crt
+  */
+  Sync: true`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{BlockComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	tests := []struct {
-		input    string
-		expected int // expected number of lines after normalization
+		path, value string
 	}{
-		{"A\r\nB\r\nC", 3},        // Windows
-		{"A\rB\rC", 3},            // Old Mac
-		{"A\nB\nC", 3},            // Unix
-		{"A\n\nB", 2},             // Empty lines removed
-		{"// comment\nA", 1},      // Comment removed
-		{"  // comment\nA", 1},    // Indented comment removed
-		{"\t// comment\nA", 1},    // Tab-indented comment removed
-		{"", 0},                   // Empty
-		{"   \n\t\n  ", 0},        // Only whitespace
+		{"Video/mode", "full"},
+		{"Video/Driver", "Metal"},
+		{"Video/Title", `"a /* not a comment */ b"`},
+		{"Video/Path", "/roms"},
+		{"Video/Sync", "true"},
 	}
-
 	for _, tt := range tests {
-		lines := normalizeLines(tt.input)
-		if len(lines) != tt.expected {
-			t.Errorf("normalizeLines(%q) = %d lines, expected %d", tt.input, len(lines), tt.expected)
+		if got := doc.Root.Get(tt.path); got == nil || got.Value != tt.value {
+			t.Errorf("Get(%q): expected value %q, got %v", tt.path, tt.value, got)
+		}
+	}
+	if doc.Root.Get("Video/Shader") != nil {
+		t.Error("expected the commented-out node to be skipped")
+	}
+
+	// Comment-only lines are preserved; those sharing a line are discarded
+	var warnings []Warning
+	doc, err = ParseWithOptions([]byte(input), ParseOptions{
+		BlockComments:    true,
+		PreserveComments: true,
+		Warnings:         func(w Warning) { warnings = append(warnings, w) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	video := doc.Root.Get("Video")
+	if want := []string{"Settings", "for the emulator"}; !reflect.DeepEqual(video.LeadingComments, want) {
+		t.Errorf("LeadingComments: expected %q, got %q", want, video.LeadingComments)
+	}
+	if want := []string{"Shader: crt"}; !reflect.DeepEqual(video.Get("Sync").LeadingComments, want) {
+		t.Errorf("LeadingComments: expected %q, got %q", want, video.Get("Sync").LeadingComments)
+	}
+	if len(warnings) != 2 || warnings[0].Line != 3 || warnings[1].Line != 4 {
+		t.Errorf("expected warnings for lines 3 and 4, got %v", warnings)
+	}
+
+	for _, tt := range []struct {
+		input, want string
+	}{
+		{"/* outer /* inner */ */", "line 1: nested block comment"},
+		{"Video\n  /* open\n  Driver: Metal", "line 2: unterminated block comment"},
+	} {
+		if _, err := ParseWithOptions([]byte(tt.input), ParseOptions{BlockComments: true}); err == nil || err.Error() != tt.want {
+			t.Errorf("%q: expected error %q, got %v", tt.input, tt.want, err)
 		}
 	}
+
+	// Without the option "/*" is not special
+	if _, err := Parse([]byte("/* comment */")); err == nil {
+		t.Error("expected an error for a block comment without BlockComments")
+	}
 }
 
-func TestParseNodeAttributeEdgeCases(t *testing.T) {
-	// Test attribute parsing edge cases
+// === Comment Preservation Tests ===
 
-	// Node with trailing spaces after value (pos >= len after spaces)
-	input := "Node: value   "
-	doc, err := Parse([]byte(input))
+func TestParsePreserveComments(t *testing.T) {
+	input := `// Video settings
+// second line
+Video
+  //
+  Driver: Metal // the renderer
+  Multiplier: 2
+Flag //no value`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if doc.Root.Children[0].Value != "value" {
-		t.Errorf("expected 'value', got %q", doc.Root.Children[0].Value)
+
+	video := doc.Root.Get("Video")
+	if !reflect.DeepEqual(video.LeadingComments, []string{"Video settings", "second line"}) {
+		t.Errorf("unexpected leading comments: %q", video.LeadingComments)
 	}
 
-	// Node with invalid character after attributes (breaks at attrStart)
-	input = "Node attr1=v1 !"
-	doc, err = Parse([]byte(input))
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+	driver := doc.Root.Get("Video/Driver")
+	if !reflect.DeepEqual(driver.LeadingComments, []string{""}) {
+		t.Errorf("unexpected leading comments: %q", driver.LeadingComments)
 	}
-	// Should parse attr1 but stop at !
-	if len(doc.Root.Children[0].Children) != 1 {
-		t.Errorf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
+	if driver.Value != "Metal" || driver.InlineComment != "the renderer" {
+		t.Errorf("unexpected driver: %+v", driver)
 	}
-}
-
-func TestParseNodeChildError(t *testing.T) {
-	// Test error propagation when parsing child node fails
-	// We need a child node that causes an error
-	// The only way to cause an error in child parsing is unclosed quote
-
-	input := `Parent
-  Child="unclosed`
 
-	_, err := Parse([]byte(input))
-	if err == nil {
-		t.Fatal("expected error from child parsing")
+	if doc.Root.Get("Video/Multiplier").LeadingComments != nil {
+		t.Error("expected no comments on Multiplier")
+	}
+	if doc.Root.Get("Flag").InlineComment != "no value" {
+		t.Errorf("unexpected inline comment: %q", doc.Root.Get("Flag").InlineComment)
 	}
 }
 
-func TestUnmarshalNodeNilDirectly(t *testing.T) {
-	// Test unmarshalNode when called with nil node
-	type S struct {
-		Value string `bml:"Value"`
-	}
-	var s S
-	// Call unmarshalNode directly with nil
-	err := unmarshalNode(nil, reflect.ValueOf(&s).Elem())
+func TestParseCommentsDiscardedByDefault(t *testing.T) {
+	doc, err := Parse([]byte("// header\nDriver: Metal // inline"))
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
+	driver := doc.Root.Get("Driver")
+	if driver.LeadingComments != nil || driver.InlineComment != "" {
+		t.Errorf("expected comments to be discarded, got %+v", driver)
+	}
 }
 
-func TestParseNodeAttributeTrailingSpaces(t *testing.T) {
-	// Test attribute loop ending at pos >= len(line) after spaces
-	input := "Node attr1=v1 "
-	doc, err := Parse([]byte(input))
+func TestSerializeComments(t *testing.T) {
+	input := `// Video settings
+Video
+  //
+  Driver: Metal // the renderer
+  Description // multiline
+    : Line 1
+    : Line 2
+`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
-	if len(doc.Root.Children[0].Children) != 1 {
-		t.Errorf("expected 1 attribute, got %d", len(doc.Root.Children[0].Children))
-	}
-}
-
-func TestParseNodeAttributeParseValueError(t *testing.T) {
-	// Test error in parseValue during attribute parsing
-	input := `Node attr="unclosed`
-	_, err := Parse([]byte(input))
-	if err == nil {
-		t.Fatal("expected error for unclosed attribute quote")
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
 }
 
-// === byuuML Compatibility Tests ===
-// Tests against the official byuuML test file from https://github.com/SolraBizna/byuuML
+func TestSetPreservesComments(t *testing.T) {
+	input := "// Renderer\nDriver: Metal // keep me\n"
 
-func TestParseByuuMLTestFile(t *testing.T) {
-	data, err := os.ReadFile("testdata/byuuml_test.bml")
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
 	if err != nil {
-		t.Fatalf("failed to read test file: %v", err)
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	doc, err := Parse(data)
-	if err != nil {
-		t.Fatalf("parse error: %v", err)
-	}
+	doc.Root.Set("Driver", "OpenGL")
 
-	// Verify root-level nodes
-	if len(doc.Root.Children) != 4 {
-		t.Fatalf("expected 4 root nodes, got %d", len(doc.Root.Children))
+	expected := "// Renderer\nDriver: OpenGL // keep me\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
+}
 
-	// Test root-node structure
-	rootNode := doc.Root.Children[0]
-	if rootNode.Name != "root-node" {
-		t.Errorf("expected 'root-node', got %q", rootNode.Name)
-	}
-	if len(rootNode.Children) != 2 {
-		t.Fatalf("expected 2 children of root-node, got %d", len(rootNode.Children))
-	}
+func TestSerializeCommentSpacing(t *testing.T) {
+	input := "//banner\n\n//Renderer\nVideo //tight\n  Driver: Metal //  wide\n  Shader: crt //\tnote\n    //closing\n//footer\n"
 
-	// Test child-node-1 with multiline value
-	childNode1 := rootNode.Children[0]
-	if childNode1.Name != "child-node-1" {
-		t.Errorf("expected 'child-node-1', got %q", childNode1.Name)
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	if childNode1.Value != "datacont1" {
-		t.Errorf("child-node-1: expected value 'datacont1', got %q", childNode1.Value)
+	if got := doc.Root.Get("Video").InlineComment; got != "tight" {
+		t.Errorf("expected %q, got %q", "tight", got)
 	}
-
-	// Test child-node-2 with empty initial value and continuation
-	childNode2 := rootNode.Children[1]
-	if childNode2.Name != "child-node-2" {
-		t.Errorf("expected 'child-node-2', got %q", childNode2.Name)
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
-	if childNode2.Value != "datacont2" {
-		t.Errorf("child-node-2: expected value 'datacont2', got %q", childNode2.Value)
+	if got := string(Serialize(&Document{Root: doc.Root.Clone()})); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
 
-	// Test root-node-2 with value and continuation lines
-	rootNode2 := doc.Root.Children[1]
-	if rootNode2.Name != "root-node-2" {
-		t.Errorf("expected 'root-node-2', got %q", rootNode2.Name)
-	}
-	// The test file uses \r (carriage return) within the continuation line, which gets normalized to \n
-	// This creates separate continuation lines: "  continues  " and "apace"
-	// Then there's an empty continuation line (just `:`)
-	expectedValue := "Data\n  continues  \napace\n"
-	if rootNode2.Value != expectedValue {
-		t.Errorf("root-node-2: expected value %q, got %q", expectedValue, rootNode2.Value)
+	// Changed comments are written in the usual form
+	doc.Root.Get("Video").InlineComment = "loose"
+	doc.Root.Get("Video/Driver").ClearComments()
+	expected := "//banner\n\n//Renderer\nVideo // loose\n  Driver: Metal\n  Shader: crt //\tnote\n    //closing\n//footer\n"
+	if got := string(Serialize(doc)); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
 	}
+}
 
-	// Test that root-node-2 has child-node children (there are 2 with same name)
-	childNodes := 0
-	for _, child := range rootNode2.Children {
-		if child.Name == "child-node" {
-			childNodes++
-		}
-	}
-	if childNodes != 2 {
-		t.Errorf("expected 2 child-node children, got %d", childNodes)
+func TestClearComments(t *testing.T) {
+	doc, err := ParseWithOptions([]byte("// Renderer\nDriver: Metal // note"), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Test additional-child with attributes (inside second child-node)
-	// The second child-node has additional-child, another-child, yet-another-child as children
-	secondChildNode := rootNode2.Children[1]
-	if secondChildNode.Name != "child-node" {
-		t.Errorf("expected second 'child-node', got %q", secondChildNode.Name)
+	driver := doc.Root.Get("Driver")
+	driver.ClearComments()
+	if got := string(Serialize(doc)); got != "Driver: Metal\n" {
+		t.Errorf("expected comments to be cleared, got %q", got)
 	}
 
-	// Find additional-child
-	var additionalChild *Node
-	for _, child := range secondChildNode.Children {
-		if child.Name == "additional-child" {
-			additionalChild = child
-			break
-		}
+	var nilNode *Node
+	nilNode.ClearComments() // must not panic
+}
+
+func TestDocumentComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		document []string
+		first    []string
+	}{
+		{"comments only", "// banner\n  // indented\n", []string{"banner", "indented"}, nil},
+		{"comments and blank lines only", "// one\n\n// two\n\n", []string{"one", "two"}, nil},
+		{"banner", "// banner\n// line two\n\n// Video settings\nVideo\n  Driver: Metal\n", []string{"banner", "line two"}, []string{"Video settings"}},
+		{"no blank line", "// Video settings\nVideo\n", nil, []string{"Video settings"}},
 	}
-	if additionalChild == nil {
-		t.Fatal("expected to find additional-child")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := ParseWithOptions([]byte(tt.input), ParseOptions{PreserveComments: true})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(doc.Root.LeadingComments, tt.document) {
+				t.Errorf("expected document comments %q, got %q", tt.document, doc.Root.LeadingComments)
+			}
+			if len(doc.Root.Children) > 0 && !reflect.DeepEqual(doc.Root.Children[0].LeadingComments, tt.first) {
+				t.Errorf("expected first node comments %q, got %q", tt.first, doc.Root.Children[0].LeadingComments)
+			}
+
+			doc2, err := ParseWithOptions(Serialize(doc), ParseOptions{PreserveComments: true})
+			if err != nil {
+				t.Fatalf("re-parse error: %v", err)
+			}
+			if !reflect.DeepEqual(doc2.Root.LeadingComments, doc.Root.LeadingComments) || !doc2.Equal(doc) {
+				t.Errorf("round-trip changed the document: %q", Serialize(doc))
+			}
+		})
+	}
+
+	doc := &Document{Root: &Node{LeadingComments: []string{"banner"}, Children: []*Node{{Name: "Video"}}}}
+	if got := string(Serialize(doc)); got != "// banner\n\nVideo\n" {
+		t.Errorf("unexpected serialization: %q", got)
 	}
+}
 
-	// Test attributes of additional-child
-	// Should have: with-a-dataless-attribute, followed-by, and, give, up
-	if len(additionalChild.Children) != 5 {
-		t.Errorf("additional-child: expected 5 attributes, got %d", len(additionalChild.Children))
+func TestTrailingComments(t *testing.T) {
+	input := `Video
+  Driver: Metal
+  Shader
+    Path: crt
+    // end of shader
+  // end of video
+Audio
+  Driver: SDL
+  // end of audio
+`
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Critical test: followed-by value must end with literal backslash (no escape)
-	// byuuML spec: "There is no provision for escaping characters"
-	var followedBy *Node
-	for _, attr := range additionalChild.Children {
-		if attr.Name == "followed-by" {
-			followedBy = attr
-			break
+	tests := map[string][]string{
+		"Video":        {"end of video"},
+		"Video/Shader": {"end of shader"},
+		"Audio":        {"end of audio"},
+		"Video/Driver": nil,
+	}
+	for path, want := range tests {
+		if got := doc.Root.Get(path).TrailingComments; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected trailing comments %q, got %q", path, want, got)
 		}
 	}
-	if followedBy == nil {
-		t.Fatal("expected to find followed-by attribute")
+	if got := doc.Root.Get("Audio").LeadingComments; got != nil {
+		t.Errorf("expected no leading comments on Audio, got %q", got)
 	}
-	// The value should be "never escape\" (ending with literal backslash)
-	if followedBy.Value != `never escape\` {
-		t.Errorf("followed-by: expected 'never escape\\', got %q", followedBy.Value)
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
 
-	// Test another-child (should have no value due to inline comment)
-	var anotherChild *Node
-	for _, child := range secondChildNode.Children {
-		if child.Name == "another-child" {
-			anotherChild = child
-			break
-		}
+	// Clone copies trailing comments and Prune keeps a node holding only them
+	clone := doc.Clone()
+	clone.Root.Get("Video/Shader").TrailingComments[0] = "changed"
+	clone.Root.Get("Video/Shader").Remove("Path")
+	clone.Root.Prune()
+	if doc.Root.Get("Video/Shader").TrailingComments[0] != "end of shader" {
+		t.Error("expected clone to copy trailing comments")
 	}
-	if anotherChild == nil {
-		t.Fatal("expected to find another-child")
+	if clone.Root.Get("Video/Shader") == nil {
+		t.Error("expected Prune to keep a node with trailing comments")
 	}
-	if anotherChild.Value != "" {
-		t.Errorf("another-child: expected empty value (comment), got %q", anotherChild.Value)
+
+	// A trailing comment on an attribute keeps it from being written inline
+	attr := &Node{Name: "Node", Children: []*Node{{Name: "a", Value: "1", IsAttr: true, TrailingComments: []string{"note"}}}}
+	if got := string(Serialize(&Document{Root: &Node{Children: []*Node{attr}}})); got != "Node\n  a: 1\n    // note\n" {
+		t.Errorf("unexpected attribute serialization: %q", got)
 	}
 
-	// Test yet-another-child (value should be "// without comment" because it's equals format)
-	var yetAnotherChild *Node
-	for _, child := range secondChildNode.Children {
-		if child.Name == "yet-another-child" {
-			yetAnotherChild = child
-			break
-		}
+	doc.Root.Get("Video").ClearComments()
+	if doc.Root.Get("Video").TrailingComments != nil {
+		t.Error("expected ClearComments to remove trailing comments")
 	}
-	if yetAnotherChild == nil {
-		t.Fatal("expected to find yet-another-child")
+
+	// Indented comments with no node to close belong to the footer
+	var warnings []Warning
+	doc, stats, err := ParseWithOptionsStats([]byte(": value\n  // orphan\n"), ParseOptions{
+		PreserveComments: true,
+		RootValue:        true,
+		Warnings:         func(w Warning) { warnings = append(warnings, w) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	// In equals format without quotes, value is read until space
-	// "yet-another-child=// without comment" -> value is "//"
-	if yetAnotherChild.Value != "//" {
-		t.Errorf("yet-another-child: expected '//', got %q", yetAnotherChild.Value)
+	if stats.DroppedComments != 0 || len(warnings) != 0 || !reflect.DeepEqual(doc.Root.TrailingComments, []string{"orphan"}) {
+		t.Errorf("unexpected stats %+v, warnings %+v, and footer %q", stats, warnings, doc.Root.TrailingComments)
 	}
+}
 
-	// Test oh-no-more-root-node with attributes
-	ohNoMore := doc.Root.Children[2]
-	if ohNoMore.Name != "oh-no-more-root-node" {
-		t.Errorf("expected 'oh-no-more-root-node', got %q", ohNoMore.Name)
+func TestFooterComments(t *testing.T) {
+	input := "// header\n\nVideo\n  Driver: Metal\n  // end of video\n// footer\n// more\n// end of file\n"
+
+	doc, err := ParseWithOptions([]byte(input), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	// Note: The test file has "c=3\td=4" (tab between c and d)
-	// The current parser doesn't treat tab as separator in unquoted equals values,
-	// so it parses as 3 attributes: a=1, b=2, c="3\td=4"
-	if len(ohNoMore.Children) != 3 {
-		t.Errorf("oh-no-more-root-node: expected 3 attributes (current parser behavior), got %d", len(ohNoMore.Children))
+	if got := doc.Root.Get("Video").TrailingComments; !reflect.DeepEqual(got, []string{"end of video"}) {
+		t.Errorf("expected the indented comment to close Video, got %q", got)
+	}
+	want := []string{"footer", "more", "end of file"}
+	if !reflect.DeepEqual(doc.Root.TrailingComments, want) {
+		t.Errorf("expected footer %q, got %q", want, doc.Root.TrailingComments)
 	}
 
-	// Verify attribute values
-	attrs := make(map[string]string)
-	for _, attr := range ohNoMore.Children {
-		attrs[attr.Name] = attr.Value
+	if got := string(Serialize(doc)); got != input {
+		t.Errorf("expected %q, got %q", input, got)
 	}
-	if attrs["a"] != "1" || attrs["b"] != "2" {
-		t.Errorf("oh-no-more-root-node: unexpected attribute values: %v", attrs)
+
+	// Indented comments after the start of the footer stay in it
+	doc, err = ParseWithOptions([]byte("A\n// footer\n    // deeper\n"), ParseOptions{PreserveComments: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-	// c's value includes the tab and d=4 due to current parser behavior
-	if attrs["c"] != "3\td=4" {
-		t.Errorf("oh-no-more-root-node: expected c='3\\td=4', got %q", attrs["c"])
+	if !reflect.DeepEqual(doc.Root.TrailingComments, []string{"footer", "deeper"}) {
+		t.Errorf("unexpected footer %q", doc.Root.TrailingComments)
 	}
+}
 
-	// Test lost-child
-	lostChild := doc.Root.Children[3]
-	if lostChild.Name != "lost-child" {
-		t.Errorf("expected 'lost-child', got %q", lostChild.Name)
-	}
-	// Note: The test file has "easily-misplaced:very true"
-	// The current parser's colon format reads to end of line for attributes,
-	// so easily-misplaced gets value "very true" (not just "very")
-	// and "true" is NOT parsed as a separate attribute
-	if len(lostChild.Children) != 1 {
-		t.Errorf("lost-child: expected 1 child (current parser behavior), got %d", len(lostChild.Children))
+// === Benchmarks ===
+
+// benchmarkInput builds a document resembling a game library: n entries,
+// each with a handful of attributes and children.
+func benchmarkInput(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "// Entry %d\n", i)
+		fmt.Fprintf(&buf, "Game id=%d region=NTSC\n", i)
+		fmt.Fprintf(&buf, "  Title: Game number %d\n", i)
+		buf.WriteString("  Board: SHVC-1A3M-30\n")
+		buf.WriteString("    Memory type=ROM size=0x100000\n")
+		buf.WriteString("  Notes\n    : first line\n    : second line\n\n")
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkParse measures parsing a 1000-entry document. Scanning the input
+// by index in normalizeLines, instead of normalizing line endings and
+// splitting it into a slice of lines, cut the memory allocated per parse
+// from 4.36 MB to 2.25 MB. The number of allocations did not fall in any
+// meaningful way (18,042 to 18,020), as nearly all of them build the nodes.
+func BenchmarkParse(b *testing.B) {
+	data := benchmarkInput(1000)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(data); err != nil {
+			b.Fatal(err)
+		}
 	}
+}
 
-	var easilyMisplaced *Node
-	for _, child := range lostChild.Children {
-		if child.Name == "easily-misplaced" {
-			easilyMisplaced = child
+// BenchmarkParser measures parsing a small document many times with a
+// reused Parser, for comparison with BenchmarkParseSmall. Reusing its
+// buffers of input lines and multiline value lines allocates 12.2 kB per
+// parse against 18.4 kB for Parse, while the number of allocations barely
+// changes (92 against 95), as nearly all of them build the document.
+func BenchmarkParser(b *testing.B) {
+	data := benchmarkInput(5)
+	ps := NewParser(ParseOptions{})
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ps.Parse(data); err != nil {
+			b.Fatal(err)
 		}
 	}
+}
 
-	if easilyMisplaced == nil {
-		t.Fatal("expected to find easily-misplaced attribute")
+// BenchmarkParseSmall measures parsing the document of BenchmarkParser
+// with Parse.
+func BenchmarkParseSmall(b *testing.B) {
+	data := benchmarkInput(5)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(data); err != nil {
+			b.Fatal(err)
+		}
 	}
-	// Current parser includes "true" in the value due to colon format reading to EOL
-	if easilyMisplaced.Value != "very true" {
-		t.Errorf("easily-misplaced: expected 'very true' (current behavior), got %q", easilyMisplaced.Value)
+}
+
+// BenchmarkParseLongMultiline measures parsing a value of 10000
+// continuation lines. Joining the lines once instead of concatenating each
+// line onto the value cut the time per parse from 1.05 s to
+// 3.0 ms and the memory allocated from 3.96 GB to 3.27 MB.
+func BenchmarkParseLongMultiline(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString("Text\n")
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&buf, "  : line %d of a long embedded text blob\n", i)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Parse(data); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
+
+// === Fuzz Tests ===
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		"",
+		"Video",
+		"Driver: Metal",
+		"Driver=Metal",
+		`Driver="Metal GPU"`,
+		"Video\n  Driver: Metal\n  Multiplier: 2\nAudio\n  Driver: SDL",
+		"// This is a comment\nVideo\n  // Another comment\n  Driver: Metal",
+		"Driver: Metal // This is a comment",
+		"Video\r\n  Driver: Metal\r\n",
+		"Video\r  Driver: Metal\r",
+		"Video\n\tDriver: Metal",
+		`Driver="Metal`,
+		"  : value",
+		"Description\n  : Line 1\n  : Line 2",
+		"Node attr1=value1 attr2: value2",
+		"Node attr1=v1 !",
+		"Node=",
+		"Node:",
+		" \n:",
+		"\t \t:",
+		"Node //",
+		"Node a=\"",
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+	if data, err := os.ReadFile("testdata/byuuml_test.bml"); err == nil {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		doc, err := Parse(data)
+		if err != nil {
+			return
+		}
+		if doc == nil || doc.Root == nil {
+			t.Fatal("expected a document when Parse returns no error")
+		}
+		if _, err := Parse(Serialize(doc)); err != nil {
+			t.Fatalf("serialized output failed to re-parse: %v", err)
+		}
+	})
+}